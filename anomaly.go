@@ -0,0 +1,243 @@
+package sessions
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Reason explains why Start() rejected an existing session.
+type Reason string
+
+// Reasons for rejecting a session.
+const (
+	ReasonNone           Reason = ""               // The session was not rejected.
+	ReasonExpired        Reason = "expired"        // The session was not accessed for longer than SessionExpiry (or RememberMeExpiry).
+	ReasonMaxLifetime    Reason = "maxlifetime"    // The session was started longer than SessionMaxLifetime ago.
+	ReasonRemoteIP       Reason = "remoteip"       // The remote IP address changed more than AcceptRemoteIP (or AcceptRemoteIPv4Prefix/AcceptRemoteIPv6Prefix) allows.
+	ReasonUserAgent      Reason = "useragent"      // The user agent changed (see AcceptChangingUserAgent).
+	ReasonLanguage       Reason = "language"       // The Accept-Language header changed (see AcceptChangingLanguage).
+	ReasonTLSFingerprint Reason = "tlsfingerprint" // The TLS fingerprint changed (see TLSFingerprint).
+	ReasonDeadline       Reason = "deadline"       // The time set with Session.SetExpiryAt() has passed.
+)
+
+// requestInfo contains the information about a request which is needed to
+// evaluate a session. It is computed once per request.
+type requestInfo struct {
+	now             time.Time // The time of the request.
+	remoteAddr      string    // The remote address (IP:port).
+	agentHash       uint64    // The hash of the normalized user agent string. 0 if there is none.
+	legacyAgentHash uint64    // The hash of the user agent string before normalization, if it differs from agentHash. 0 otherwise.
+	languageHash    uint64    // The hash of the Accept-Language header. 0 if there is none.
+	fingerprint     string    // The TLS fingerprint. Empty if there is none.
+}
+
+// anomalyConfig contains the configuration which determines whether a session
+// is still valid.
+type anomalyConfig struct {
+	sessionExpiry           time.Duration
+	maxLifetime             time.Duration
+	rememberMeExpiry        time.Duration
+	acceptRemoteIP          int
+	ipv4Prefix              int
+	ipv6Prefix              int
+	acceptIPFamilyChange    bool
+	remoteHistorySize       int
+	acceptChangingUserAgent bool
+	acceptChangingLanguage  bool
+	acceptMissingLanguage   bool
+	checkTLSFingerprint     bool
+}
+
+// currentAnomalyConfig returns the anomalyConfig given by the package
+// variables.
+func currentAnomalyConfig() anomalyConfig {
+	return anomalyConfig{
+		sessionExpiry:           SessionExpiry,
+		maxLifetime:             SessionMaxLifetime,
+		rememberMeExpiry:        RememberMeExpiry,
+		acceptRemoteIP:          AcceptRemoteIP,
+		ipv4Prefix:              AcceptRemoteIPv4Prefix,
+		ipv6Prefix:              AcceptRemoteIPv6Prefix,
+		acceptIPFamilyChange:    AcceptRemoteIPFamilyChange,
+		remoteHistorySize:       RemoteHistorySize,
+		acceptChangingUserAgent: AcceptChangingUserAgent,
+		acceptChangingLanguage:  AcceptChangingLanguage,
+		acceptMissingLanguage:   AcceptMissingLanguage,
+		checkTLSFingerprint:     TLSFingerprint != nil,
+	}
+}
+
+// ipPrefixes returns the number of leading bits of IPv4 and IPv6 addresses
+// which must not change between requests. An IPv4 prefix of 0 is derived from
+// acceptRemoteIP. A prefix of 0 means that addresses of this family are not
+// checked.
+func (cfg anomalyConfig) ipPrefixes() (ipv4, ipv6 int) {
+	ipv4 = cfg.ipv4Prefix
+	if ipv4 == 0 && cfg.acceptRemoteIP > 1 && cfg.acceptRemoteIP <= 4 {
+		ipv4 = (cfg.acceptRemoteIP - 1) * 8
+	}
+	return ipv4, cfg.ipv6Prefix
+}
+
+// checksRemoteIP returns whether changes of the remote IP address may cause a
+// session to be rejected.
+func (cfg anomalyConfig) checksRemoteIP() bool {
+	ipv4, ipv6 := cfg.ipPrefixes()
+	return ipv4 > 0 || ipv6 > 0
+}
+
+// evaluateSession decides whether an existing session may be used for the given
+// request. If not, the reason is returned. The session is compared to the
+// request as it was when it was last accessed. The remote IP address and the
+// user agent may also match one of the earlier values in the session's history
+// (see RemoteHistorySize). This function has no side effects. The caller must
+// hold at least a read lock on the session.
+func evaluateSession(s *Session, req requestInfo, cfg anomalyConfig) (bool, Reason) {
+	// Is it stale?
+	if req.now.Sub(s.lastAccess) >= sessionIdleTimeout(s.rememberMe, cfg.sessionExpiry, cfg.rememberMeExpiry) {
+		return false, ReasonExpired
+	}
+	if started := s.startTime(); !started.IsZero() && req.now.Sub(started) >= cfg.maxLifetime {
+		return false, ReasonMaxLifetime
+	}
+	if !s.expiresAt.IsZero() && !req.now.Before(s.expiresAt) {
+		return false, ReasonDeadline
+	}
+
+	// Limit the history to the configured size.
+	ipHistory, userAgentHistory := s.ipHistory, s.userAgentHistory
+	if size := cfg.remoteHistorySize - 1; size <= 0 {
+		ipHistory, userAgentHistory = nil, nil
+	} else {
+		if len(ipHistory) > size {
+			ipHistory = ipHistory[:size]
+		}
+		if len(userAgentHistory) > size {
+			userAgentHistory = userAgentHistory[:size]
+		}
+	}
+
+	// Has the remote IP changed too much?
+	if ipv4Prefix, ipv6Prefix := cfg.ipPrefixes(); ipv4Prefix > 0 || ipv6Prefix > 0 {
+		currentIP := parseRemoteIP(req.remoteAddr)
+		similar := similarIP(s.lastIP, currentIP, ipv4Prefix, ipv6Prefix, cfg.acceptIPFamilyChange)
+		for index := 0; !similar && index < len(ipHistory); index++ {
+			similar = similarIP(ipHistory[index], currentIP, ipv4Prefix, ipv6Prefix, cfg.acceptIPFamilyChange)
+		}
+		if !similar {
+			return false, ReasonRemoteIP
+		}
+	}
+
+	// Has the remote user agent changed? Sessions stored before
+	// NormalizeUserAgent was applied hold the hash of the full user agent
+	// string. We accept it once (Start() then stores the normalized hash).
+	if !cfg.acceptChangingUserAgent && s.lastUserAgentHash != 0 && s.lastUserAgentHash != req.agentHash &&
+		(req.legacyAgentHash == 0 || s.lastUserAgentHash != req.legacyAgentHash) {
+		known := false
+		for _, hash := range userAgentHistory {
+			if hash == req.agentHash || req.legacyAgentHash != 0 && hash == req.legacyAgentHash {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false, ReasonUserAgent
+		}
+	}
+
+	// Has the Accept-Language header changed?
+	if !cfg.acceptChangingLanguage && s.lastLanguageHash != 0 {
+		if req.languageHash == 0 && !cfg.acceptMissingLanguage ||
+			req.languageHash != 0 && s.lastLanguageHash != req.languageHash {
+			return false, ReasonLanguage
+		}
+	}
+
+	// Has the TLS fingerprint changed?
+	if cfg.checkTLSFingerprint && s.tlsFingerprint != "" && s.tlsFingerprint != req.fingerprint {
+		return false, ReasonTLSFingerprint
+	}
+
+	return true, ReasonNone
+}
+
+// parseRemoteIP returns the IP address of the given remote address (IP:port
+// or a plain IP address). IPv4-mapped IPv6 addresses are turned into IPv4
+// addresses. The zero address is returned if the address cannot be parsed.
+func parseRemoteIP(remoteAddr string) netip.Addr {
+	ip, err := netip.ParseAddr(remoteHost(remoteAddr))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap().WithZone("")
+}
+
+// similarIP returns whether the previous remote address (IP:port) and the
+// current IP address share the same first "ipv4Prefix" (for IPv4 addresses) or
+// "ipv6Prefix" (for IPv6 addresses) bits. A prefix of 0 disables the check for
+// that address family. Addresses which cannot be parsed are always similar.
+// Addresses of different families (e.g. a dual-stack client switching from
+// IPv4 to IPv6) are only similar if "acceptFamilyChange" is true.
+func similarIP(previousAddr string, currentIP netip.Addr, ipv4Prefix, ipv6Prefix int, acceptFamilyChange bool) bool {
+	previousIP := parseRemoteIP(previousAddr)
+	if !previousIP.IsValid() || !currentIP.IsValid() {
+		return true
+	}
+	if previousIP.Is4() != currentIP.Is4() {
+		return acceptFamilyChange
+	}
+	bits := ipv6Prefix
+	if currentIP.Is4() {
+		bits = ipv4Prefix
+	}
+	if bits <= 0 {
+		return true
+	}
+	if bits > currentIP.BitLen() {
+		bits = currentIP.BitLen()
+	}
+	previousPrefix, _ := previousIP.Prefix(bits)
+	currentPrefix, _ := currentIP.Prefix(bits)
+	return previousPrefix == currentPrefix
+}
+
+// recordRemote adds the session's last remote address and user agent hash to
+// its history if they differ from the given ones, which are about to replace
+// them. The history is limited to RemoteHistorySize-1 entries each. The
+// session must be locked when this function is called.
+func (s *Session) recordRemote(remoteAddr string, agentHash uint64) {
+	size := RemoteHistorySize - 1
+	if size <= 0 {
+		s.ipHistory, s.userAgentHistory = nil, nil
+		return
+	}
+
+	// Remote IP addresses. We compare only the hosts, not the ports.
+	if s.lastIP != "" && remoteHost(s.lastIP) != remoteHost(remoteAddr) {
+		history := []string{s.lastIP}
+		for _, ip := range s.ipHistory {
+			if len(history) >= size {
+				break
+			}
+			if host := remoteHost(ip); host != remoteHost(s.lastIP) && host != remoteHost(remoteAddr) {
+				history = append(history, ip)
+			}
+		}
+		s.ipHistory = history
+	}
+
+	// User agents.
+	if s.lastUserAgentHash != 0 && s.lastUserAgentHash != agentHash {
+		history := []uint64{s.lastUserAgentHash}
+		for _, hash := range s.userAgentHistory {
+			if len(history) >= size {
+				break
+			}
+			if hash != s.lastUserAgentHash && hash != agentHash {
+				history = append(history, hash)
+			}
+		}
+		s.userAgentHistory = history
+	}
+}
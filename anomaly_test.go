@@ -0,0 +1,192 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test the anomaly decision for remote IP changes.
+func TestEvaluateSessionRemoteIP(t *testing.T) {
+	now := time.Now()
+	session := &Session{lastAccess: now, lastIP: "192.168.178.1:80"}
+	for _, test := range []struct {
+		remoteAddr string
+		accept     int
+		valid      bool
+	}{
+		{"192.168.178.1:8080", 4, true},
+		{"192.168.178.2:80", 1, true},
+		{"192.168.178.2:80", 4, true},
+		{"192.168.177.1:80", 4, false},
+		{"192.168.177.1:80", 3, true},
+		{"192.167.178.1:80", 3, false},
+		{"192.167.178.1:80", 2, true},
+		{"191.168.178.1:80", 2, false},
+		{"191.168.178.1:80", 1, true},
+		{"10.0.0.1:80", 5, true}, // Out of range, not checked.
+		{"[::1]:80", 4, false},   // Switched to IPv6.
+		{"[::1]:80", 1, true},    // Not checked.
+	} {
+		valid, reason := evaluateSession(session, requestInfo{now: now, remoteAddr: test.remoteAddr}, anomalyConfig{
+			sessionExpiry:           time.Hour,
+			acceptRemoteIP:          test.accept,
+			acceptChangingUserAgent: true,
+			acceptChangingLanguage:  true,
+		})
+		if valid != test.valid {
+			t.Errorf("IP %s with AcceptRemoteIP %d: expected %t, got %t (%s)", test.remoteAddr, test.accept, test.valid, valid, reason)
+		}
+		if !valid && reason != ReasonRemoteIP {
+			t.Errorf("IP %s: unexpected reason %q", test.remoteAddr, reason)
+		}
+	}
+}
+
+// Test the anomaly decision for remote IP changes with prefix lengths.
+func TestEvaluateSessionIPPrefixes(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		lastIP, remoteAddr     string
+		ipv4Prefix, ipv6Prefix int
+		acceptFamilyChange     bool
+		valid                  bool
+	}{
+		{"192.168.178.1:80", "192.168.178.200:80", 24, 0, false, true},
+		{"192.168.178.1:80", "192.168.179.1:80", 24, 0, false, false},
+		{"192.168.178.1:80", "192.168.179.1:80", 22, 0, false, true},
+		{"192.168.178.1:80", "[::ffff:192.168.178.2]:80", 24, 0, false, true}, // IPv4-mapped.
+		{"192.168.178.1:80", "[::ffff:192.168.1.2]:80", 24, 0, false, false},
+		{"[2001:db8:1:2::1]:80", "[2001:db8:1:2:abcd::7]:80", 0, 64, false, true},
+		{"[2001:db8:1:2::1]:80", "[2001:db8:1:3::1]:80", 0, 64, false, false},
+		{"[2001:db8:1:2::1]:80", "[2001:db8:1:3::1]:80", 0, 48, false, true},
+		{"[2001:db8:1:2::1]:80", "[2001:db9:1:2::1]:80", 0, 48, false, false},
+		{"[2001:db8:1:2::1]:80", "[2001:db9:1:2::1]:80", 24, 0, false, true},       // IPv6 not checked.
+		{"[2001:db8:1:2::1]:80", "[2001:db8:1:2::1%eth0]:80", 0, 128, false, true}, // Zones are ignored.
+		{"192.168.178.1:80", "[2001:db8::1]:80", 24, 48, false, false},             // Switched to IPv6.
+		{"[2001:db8::1]:80", "192.168.178.1:80", 24, 48, false, false},             // Switched to IPv4.
+		{"[2001:db8::1]:80", "192.168.178.1:80", 0, 48, false, false},              // Switched to unchecked IPv4.
+		{"192.168.178.1:80", "[2001:db8::1]:80", 24, 48, true, true},               // Dual-stack accepted.
+		{"192.168.178.1:80", "unknown", 24, 48, false, true},
+	} {
+		session := &Session{lastAccess: now, lastIP: test.lastIP}
+		valid, reason := evaluateSession(session, requestInfo{now: now, remoteAddr: test.remoteAddr}, anomalyConfig{
+			sessionExpiry:           time.Hour,
+			ipv4Prefix:              test.ipv4Prefix,
+			ipv6Prefix:              test.ipv6Prefix,
+			acceptIPFamilyChange:    test.acceptFamilyChange,
+			acceptChangingUserAgent: true,
+			acceptChangingLanguage:  true,
+		})
+		if valid != test.valid {
+			t.Errorf("IP %s after %s with prefixes %d/%d: expected %t, got %t (%s)", test.remoteAddr, test.lastIP, test.ipv4Prefix, test.ipv6Prefix, test.valid, valid, reason)
+		}
+	}
+}
+
+// Test the anomaly decision for all other checks.
+func TestEvaluateSession(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		name    string
+		session *Session
+		request requestInfo
+		config  anomalyConfig
+		reason  Reason
+	}{
+		{"valid", &Session{lastAccess: now}, requestInfo{}, anomalyConfig{sessionExpiry: time.Hour}, ReasonNone},
+		{"expired", &Session{lastAccess: now.Add(-time.Hour)}, requestInfo{}, anomalyConfig{sessionExpiry: time.Hour}, ReasonExpired},
+		{"before deadline", &Session{lastAccess: now, expiresAt: now.Add(time.Second)}, requestInfo{}, anomalyConfig{sessionExpiry: time.Hour}, ReasonNone},
+		{"deadline", &Session{lastAccess: now, expiresAt: now}, requestInfo{}, anomalyConfig{sessionExpiry: time.Hour}, ReasonDeadline},
+		{"same agent", &Session{lastAccess: now, lastUserAgentHash: 1}, requestInfo{agentHash: 1}, anomalyConfig{sessionExpiry: time.Hour}, ReasonNone},
+		{"changed agent", &Session{lastAccess: now, lastUserAgentHash: 1}, requestInfo{agentHash: 2}, anomalyConfig{sessionExpiry: time.Hour}, ReasonUserAgent},
+		{"missing agent", &Session{lastAccess: now, lastUserAgentHash: 1}, requestInfo{}, anomalyConfig{sessionExpiry: time.Hour}, ReasonUserAgent},
+		{"new agent", &Session{lastAccess: now}, requestInfo{agentHash: 2}, anomalyConfig{sessionExpiry: time.Hour}, ReasonNone},
+		{"accepted agent", &Session{lastAccess: now, lastUserAgentHash: 1}, requestInfo{agentHash: 2}, anomalyConfig{sessionExpiry: time.Hour, acceptChangingUserAgent: true}, ReasonNone},
+		{"changed language", &Session{lastAccess: now, lastLanguageHash: 1}, requestInfo{languageHash: 2}, anomalyConfig{sessionExpiry: time.Hour, acceptChangingUserAgent: true}, ReasonLanguage},
+		{"missing language", &Session{lastAccess: now, lastLanguageHash: 1}, requestInfo{}, anomalyConfig{sessionExpiry: time.Hour, acceptChangingUserAgent: true}, ReasonLanguage},
+		{"accepted missing language", &Session{lastAccess: now, lastLanguageHash: 1}, requestInfo{}, anomalyConfig{sessionExpiry: time.Hour, acceptChangingUserAgent: true, acceptMissingLanguage: true}, ReasonNone},
+		{"accepted language", &Session{lastAccess: now, lastLanguageHash: 1}, requestInfo{languageHash: 2}, anomalyConfig{sessionExpiry: time.Hour, acceptChangingUserAgent: true, acceptChangingLanguage: true}, ReasonNone},
+		{"changed fingerprint", &Session{lastAccess: now, tlsFingerprint: "a"}, requestInfo{fingerprint: "b"}, anomalyConfig{sessionExpiry: time.Hour, acceptChangingUserAgent: true, checkTLSFingerprint: true}, ReasonTLSFingerprint},
+		{"unchecked fingerprint", &Session{lastAccess: now, tlsFingerprint: "a"}, requestInfo{fingerprint: "b"}, anomalyConfig{sessionExpiry: time.Hour, acceptChangingUserAgent: true}, ReasonNone},
+	} {
+		test.request.now = now
+		valid, reason := evaluateSession(test.session, test.request, test.config)
+		if reason != test.reason || valid != (test.reason == ReasonNone) {
+			t.Errorf("%s: expected %q, got %t/%q", test.name, test.reason, valid, reason)
+		}
+	}
+}
+
+// Test the history of remote IP addresses and user agents.
+func TestRemoteHistory(t *testing.T) {
+	defer reset()
+	AcceptRemoteIP = 4
+	RemoteHistorySize = 3
+
+	// Record alternating addresses.
+	session := &Session{lastIP: "10.0.0.1:80", lastUserAgentHash: 1}
+	session.recordRemote("10.0.0.1:8080", 1) // Same host, not recorded.
+	session.recordRemote("10.0.1.1:80", 2)
+	session.lastIP, session.lastUserAgentHash = "10.0.1.1:80", 2
+	session.recordRemote("10.0.2.1:80", 3)
+	session.lastIP, session.lastUserAgentHash = "10.0.2.1:80", 3
+	session.recordRemote("10.0.0.1:80", 1) // Moves the first address out of the history.
+	session.lastIP, session.lastUserAgentHash = "10.0.0.1:80", 1
+	if len(session.ipHistory) != 2 || session.ipHistory[0] != "10.0.2.1:80" || session.ipHistory[1] != "10.0.1.1:80" {
+		t.Errorf("Unexpected IP history: %v", session.ipHistory)
+	}
+	if len(session.userAgentHistory) != 2 || session.userAgentHistory[0] != 3 || session.userAgentHistory[1] != 2 {
+		t.Errorf("Unexpected user agent history: %v", session.userAgentHistory)
+	}
+
+	// Evaluate requests.
+	now := time.Now()
+	session.lastAccess = now
+	for _, test := range []struct {
+		remoteAddr string
+		agentHash  uint64
+		size       int
+		valid      bool
+	}{
+		{"10.0.0.1:80", 1, 1, true},
+		{"10.0.1.1:80", 2, 1, false},
+		{"10.0.1.1:80", 2, 3, true},
+		{"10.0.2.1:80", 3, 2, true},
+		{"10.0.1.1:80", 3, 2, false},
+		{"10.0.3.1:80", 1, 3, false},
+		{"10.0.0.1:80", 4, 3, false},
+	} {
+		valid, reason := evaluateSession(session, requestInfo{now: now, remoteAddr: test.remoteAddr, agentHash: test.agentHash}, anomalyConfig{
+			sessionExpiry:          time.Hour,
+			acceptRemoteIP:         4,
+			remoteHistorySize:      test.size,
+			acceptChangingLanguage: true,
+		})
+		if valid != test.valid {
+			t.Errorf("IP %s, user agent %d, history size %d: expected %t, got %t (%s)", test.remoteAddr, test.agentHash, test.size, test.valid, valid, reason)
+		}
+	}
+
+	// Clients which alternate between known addresses keep their session.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:80"
+	started, err := Start(httptest.NewRecorder(), req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started.ipHistory = []string{"10.0.1.1:80"} // From an earlier request.
+	for _, remoteAddr := range []string{"10.0.1.1:80", "10.0.0.1:80", "10.0.1.1:80"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: started.id})
+		session, err := Start(httptest.NewRecorder(), req, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session != started {
+			t.Fatalf("Session was lost when switching to %s", remoteAddr)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package sessions
+
+import "strings"
+
+// anonKeyPrefix is prepended to the keys of anonymous session values (see
+// SetAnon()). It contains NUL characters so it cannot collide with the keys
+// chosen by applications.
+const anonKeyPrefix = "\x00anon\x00"
+
+// SetAnon stores a value in the session's anonymous namespace. Anonymous
+// values are state which belongs to the visitor rather than to a user
+// account, e.g. a shopping cart, a referral code, or an A/B test cohort. Unlike
+// values stored with Set(), they are kept when a user logs in while
+// ClearDataOnLogIn is enabled. Use GetAnon() to retrieve them.
+//
+// Anonymous values cross the boundary between an unauthenticated and an
+// authenticated session. Anything stored here before the login may have been
+// planted by an attacker (e.g. with a session fixation attack) and becomes
+// visible to the logged-in user. Only store values in this namespace which are
+// harmless in this situation and validate them before use. Never store values
+// here which grant privileges.
+//
+// Anonymous values do not interfere with values stored with Set() under the
+// same key. Otherwise, this function behaves exactly like Set().
+func (s *Session) SetAnon(key string, value interface{}) error {
+	return s.Set(anonKeyPrefix+key, value)
+}
+
+// GetAnon returns a value stored with SetAnon(). If the key does not exist,
+// "def" is returned.
+func (s *Session) GetAnon(key string, def interface{}) interface{} {
+	return s.Get(anonKeyPrefix+key, def)
+}
+
+// DeleteAnon removes a value stored with SetAnon(). It behaves exactly like
+// Delete().
+func (s *Session) DeleteAnon(key string) error {
+	return s.Delete(anonKeyPrefix + key)
+}
+
+// clearData removes all values from the session data except anonymous values
+// (see SetAnon()). The keys of the removed values are returned. The session
+// data must have been loaded and the session must be locked while this
+// function is called.
+func (s *Session) clearData() ([]string, error) {
+	data, err := s.openData()
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for key := range data {
+		if !strings.HasPrefix(key, anonKeyPrefix) {
+			delete(data, key)
+			removed = append(removed, key)
+		}
+	}
+	return removed, s.closeData(data)
+}
@@ -0,0 +1,63 @@
+package sessions
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Test anonymous values which survive a login.
+func TestAnonValues(t *testing.T) {
+	defer reset()
+	session := &Session{data: make(map[string]interface{})}
+	if err := session.Set("cart", "private"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.SetAnon("cart", "items"); err != nil {
+		t.Fatal(err)
+	}
+	if value := session.Get("cart", nil); value != "private" {
+		t.Errorf("Anonymous value overwrote regular value: %v", value)
+	}
+	if value := session.GetAnon("cart", nil); value != "items" {
+		t.Errorf("Unexpected anonymous value: %v", value)
+	}
+
+	// Log in without clearing.
+	if err := session.LogIn(&TestUser{ID: "userid"}, false, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if session.Get("cart", nil) != "private" || session.GetAnon("cart", nil) != "items" {
+		t.Error("Session data was changed by login")
+	}
+
+	// Log in with clearing.
+	ClearDataOnLogIn = true
+	events, unsubscribe := session.Subscribe()
+	defer unsubscribe()
+	if err := session.LogIn(&TestUser{ID: "otherid"}, false, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if value := session.Get("cart", nil); value != nil {
+		t.Errorf("Regular value survived login: %v", value)
+	}
+	if value := session.GetAnon("cart", nil); value != "items" {
+		t.Errorf("Anonymous value did not survive login: %v", value)
+	}
+	var deleted bool
+	for len(events) > 0 {
+		if event := <-events; event.Type == SessionEventDelete && event.Key == "cart" {
+			deleted = true
+		}
+	}
+	if !deleted {
+		t.Error("No delete event for cleared value")
+	}
+
+	// Delete anonymous values.
+	if err := session.DeleteAnon("cart"); err != nil {
+		t.Fatal(err)
+	}
+	if value := session.GetAnon("cart", nil); value != nil {
+		t.Errorf("Anonymous value was not deleted: %v", value)
+	}
+}
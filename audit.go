@@ -0,0 +1,98 @@
+package sessions
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Types of audit events (see AuditLogger).
+const (
+	AuditSessionCreated   = "session_created"   // A new session was created by Start().
+	AuditSessionDestroyed = "session_destroyed" // A session was destroyed.
+	AuditLogIn            = "login"             // A user was logged in (or their pending authentication was completed).
+	AuditLogInPending     = "login_pending"     // A user was logged in but their authentication is still pending.
+	AuditLogOut           = "logout"            // A user was logged out of a session.
+	AuditIDChanged        = "id_changed"        // A session's ID was replaced by a new ID.
+	AuditSessionRejected  = "session_rejected"  // Start() rejected an existing session (see AuditRecord.Reason).
+	AuditUnknownSessionID = "unknown_session"   // Start() received a session ID for which no session exists.
+)
+
+// AuditRecord is a single entry of the audit log which is written to
+// AuditLogger in JSON format.
+type AuditRecord struct {
+	// The time of the event.
+	Time time.Time `json:"time"`
+
+	// The type of the event, one of the Audit constants.
+	Event string `json:"event"`
+
+	// The ID of the affected session. Masked if AuditMaskSessionIDs is true.
+	SessionID string `json:"session,omitempty"`
+
+	// For AuditIDChanged events, the session's ID before it was replaced. Masked
+	// if AuditMaskSessionIDs is true.
+	PreviousSessionID string `json:"previous_session,omitempty"`
+
+	// The ID of the session's user. Omitted if no user is attached to the
+	// session.
+	UserID interface{} `json:"user,omitempty"`
+
+	// The IP address of the client. For events which are not triggered by a
+	// request, this is the IP address of the last request of the session.
+	RemoteIP string `json:"ip,omitempty"`
+
+	// For AuditSessionRejected events, the reason why the session was rejected.
+	Reason Reason `json:"reason,omitempty"`
+
+	// For AuditSessionRejected events, the TLS fingerprint of the request (see
+	// TLSFingerprint).
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// auditMutex serializes writes to AuditLogger.
+var auditMutex sync.Mutex
+
+// writeAudit writes the given record as one line of JSON to AuditLogger. The
+// record's time is set and its session IDs are masked if requested. Nothing
+// happens if AuditLogger is nil.
+func writeAudit(record AuditRecord) {
+	if AuditLogger == nil {
+		return
+	}
+	record.Time = time.Now()
+	if AuditMaskSessionIDs {
+		record.SessionID = MaskSessionID(record.SessionID)
+		record.PreviousSessionID = MaskSessionID(record.PreviousSessionID)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return // Only the user ID can cause this. There's no one to tell.
+	}
+	line = append(line, '\n')
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	AuditLogger.Write(line)
+}
+
+// audit writes an audit record for this session (see writeAudit()). The
+// session's ID, the ID of its user, and the IP address of its last request are
+// added to the record unless they were already provided. The session must not
+// be locked when this function is called.
+func (s *Session) audit(record AuditRecord) {
+	if AuditLogger == nil {
+		return
+	}
+	s.RLock()
+	if record.SessionID == "" {
+		record.SessionID = s.id
+	}
+	if record.UserID == nil {
+		record.UserID, _ = s.userID()
+	}
+	if record.RemoteIP == "" {
+		record.RemoteIP = remoteHost(s.lastIP)
+	}
+	s.RUnlock()
+	writeAudit(record)
+}
@@ -0,0 +1,101 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test the audit log.
+func TestAuditLogger(t *testing.T) {
+	defer reset()
+	var log bytes.Buffer
+	AuditLogger = &log
+	AcceptRemoteIP = 4
+
+	// Create a session, log in and out, and destroy it.
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := Start(httptest.NewRecorder(), req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.LogIn(&TestUser{ID: "userid"}, false, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.LogOut(); err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if err := session.Destroy(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unknown session ID.
+	if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A session from a different network.
+	session, err = Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the records.
+	expected := []AuditRecord{
+		{Event: AuditSessionCreated},
+		{Event: AuditIDChanged, UserID: "userid"},
+		{Event: AuditLogIn, UserID: "userid"},
+		{Event: AuditLogOut, UserID: "userid"},
+		{Event: AuditSessionDestroyed},
+		{Event: AuditUnknownSessionID},
+		{Event: AuditSessionCreated},
+		{Event: AuditSessionRejected, Reason: ReasonRemoteIP, RemoteIP: "10.0.0.1"},
+		{Event: AuditSessionDestroyed},
+	}
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d audit records, got %d: %s", len(expected), len(lines), log.String())
+	}
+	for index, line := range lines {
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		exp := expected[index]
+		if record.Event != exp.Event || record.UserID != exp.UserID || record.Reason != exp.Reason ||
+			exp.RemoteIP != "" && record.RemoteIP != exp.RemoteIP {
+			t.Errorf("Unexpected audit record %d: %s", index, line)
+		}
+		if record.Time.IsZero() || record.SessionID == "" || exp.Event == AuditIDChanged && record.PreviousSessionID == "" {
+			t.Errorf("Audit record %d is incomplete: %s", index, line)
+		}
+	}
+}
+
+// Test masked session IDs in the audit log.
+func TestAuditMaskSessionIDs(t *testing.T) {
+	defer reset()
+	var log bytes.Buffer
+	AuditLogger = &log
+	AuditMaskSessionIDs = true
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(log.String(), session.id) {
+		t.Errorf("Audit log contains the session ID: %s", log.String())
+	}
+	if !strings.Contains(log.String(), MaskSessionID(session.id)) {
+		t.Errorf("Audit log does not contain the masked session ID: %s", log.String())
+	}
+}
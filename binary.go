@@ -0,0 +1,482 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Type identifiers for values in the compact binary session format.
+const (
+	binaryNil byte = iota
+	binaryBool
+	binaryInt
+	binaryInt64
+	binaryUint64
+	binaryFloat64
+	binaryString
+	binaryBytes
+	binaryTime
+)
+
+// MarshalBinary serializes a session into a compact binary format. It
+// implements the encoding.BinaryMarshaler interface. Compared to GobEncode(),
+// the result does not contain any type information and is therefore
+// considerably smaller, especially for sessions with little data. This makes it
+// suitable for high-volume key-value stores.
+//
+// The fields are written in a fixed order, timestamps and integers are encoded
+// as varints, and strings are length-prefixed. Only the following types are
+// supported for the user ID and for values stored in the session: nil, bool,
+// int, int64, uint64, float64, string, []byte, and time.Time. An error is
+// returned for any other type.
+//
+// If CompressSessions is true, large sessions are compressed.
+func (s *Session) MarshalBinary() ([]byte, error) {
+	s = s.snapshot() // See GobEncode().
+
+	var buffer bytes.Buffer
+
+	// Add a version number first.
+	buffer.WriteByte(13)
+
+	// Fixed fields.
+	writeBinaryTime(&buffer, s.created)
+	writeBinaryTime(&buffer, s.lastAccess)
+	writeBinaryString(&buffer, s.lastIP)
+	writeBinaryUvarint(&buffer, s.lastUserAgentHash)
+	writeBinaryString(&buffer, s.referenceID)
+	writeBinaryBool(&buffer, s.authPending)
+	writeBinaryString(&buffer, s.authPendingReason)
+	writeBinaryString(&buffer, s.tag)
+	writeBinaryString(&buffer, s.tlsFingerprint)
+
+	// User ID.
+	userID, loggedIn := s.userID()
+	writeBinaryBool(&buffer, loggedIn)
+	if loggedIn {
+		if err := writeBinaryValue(&buffer, userID); err != nil {
+			return nil, fmt.Errorf("Unable to encode user ID: %s", err)
+		}
+	}
+
+	// Custom data.
+	writeBinaryUvarint(&buffer, uint64(len(s.data)))
+	for key, value := range s.data {
+		writeBinaryString(&buffer, key)
+		if err := writeBinaryValue(&buffer, value); err != nil {
+			return nil, fmt.Errorf("Unable to encode session value for key %s: %s", key, err)
+		}
+	}
+
+	// Fields added in later versions.
+	writeBinaryVarint(&buffer, int64(s.uses))
+	writeBinaryUvarint(&buffer, s.lastLanguageHash)
+	writeBinaryBytes(&buffer, s.sealed)
+	writeBinaryUvarint(&buffer, uint64(len(s.ipHistory)))
+	for _, ip := range s.ipHistory {
+		writeBinaryString(&buffer, ip)
+	}
+	writeBinaryUvarint(&buffer, uint64(len(s.userAgentHistory)))
+	for _, hash := range s.userAgentHistory {
+		writeBinaryUvarint(&buffer, hash)
+	}
+	writeBinaryBytes(&buffer, s.computeUserMAC(s.id))
+	writeBinaryTime(&buffer, s.expiresAt)
+	writeBinaryVarint(&buffer, int64(s.assuranceLevel))
+	writeBinaryString(&buffer, s.lastInstance)
+	writeBinaryString(&buffer, s.location.Country)
+	writeBinaryString(&buffer, s.location.City)
+	writeBinaryUvarint(&buffer, math.Float64bits(s.location.Latitude))
+	writeBinaryUvarint(&buffer, math.Float64bits(s.location.Longitude))
+	writeBinaryTime(&buffer, s.started)
+	writeBinaryBool(&buffer, s.rememberMe)
+	writeBinaryTime(&buffer, s.authTime)
+
+	return compressSession(buffer.Bytes())
+}
+
+// UnmarshalBinary unserializes a session from the compact binary format
+// generated by MarshalBinary(). It implements the encoding.BinaryUnmarshaler
+// interface. If a user ID was stored with the session, LoadUser() of the
+// persistence layer is called to retrieve the user. Compressed sessions (see
+// CompressSessions) are decompressed first.
+func (s *Session) UnmarshalBinary(data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := decompressSession(data)
+	if err != nil {
+		return err
+	}
+	reader := bytes.NewReader(data)
+
+	// Get version.
+	version, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("Unable to decode session version: %s", err)
+	}
+	if version < 1 || version > 13 {
+		return fmt.Errorf("Invalid version: %d", version)
+	}
+
+	// Fixed fields.
+	if s.created, err = readBinaryTime(reader); err != nil {
+		return fmt.Errorf("Unable to decode session creation time: %s", err)
+	}
+	if s.lastAccess, err = readBinaryTime(reader); err != nil {
+		return fmt.Errorf("Unable to decode session last access time: %s", err)
+	}
+	if s.lastIP, err = readBinaryString(reader); err != nil {
+		return fmt.Errorf("Unable to decode session remote IP: %s", err)
+	}
+	if s.lastUserAgentHash, err = binary.ReadUvarint(reader); err != nil {
+		return fmt.Errorf("Unable to decode hash of session remote user agent: %s", err)
+	}
+	if s.referenceID, err = readBinaryString(reader); err != nil {
+		return fmt.Errorf("Unable to decode session reference ID: %s", err)
+	}
+	if s.authPending, err = readBinaryBool(reader); err != nil {
+		return fmt.Errorf("Unable to decode pending authentication state: %s", err)
+	}
+	if s.authPendingReason, err = readBinaryString(reader); err != nil {
+		return fmt.Errorf("Unable to decode pending authentication reason: %s", err)
+	}
+	if s.tag, err = readBinaryString(reader); err != nil {
+		return fmt.Errorf("Unable to decode session tag: %s", err)
+	}
+	if s.tlsFingerprint, err = readBinaryString(reader); err != nil {
+		return fmt.Errorf("Unable to decode session TLS fingerprint: %s", err)
+	}
+
+	// User.
+	loggedIn, err := readBinaryBool(reader)
+	if err != nil {
+		return fmt.Errorf("Unable to decode log-in state: %s", err)
+	}
+	if loggedIn {
+		userID, err := readBinaryValue(reader)
+		if err != nil {
+			return fmt.Errorf("Unable to decode user ID: %s", err)
+		}
+		if LazyUserLoading {
+			s.pendingUserID = userID
+		} else if s.user, err = loadSessionUser(userID); err != nil {
+			return fmt.Errorf("Failed to load user: %s", err)
+		}
+	}
+
+	// Custom data.
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return fmt.Errorf("Unable to decode session data size: %s", err)
+	}
+	if count > uint64(reader.Len()) {
+		return fmt.Errorf("Invalid session data size: %d", count)
+	}
+	s.data = make(map[string]interface{}, count)
+	for ; count > 0; count-- {
+		key, err := readBinaryString(reader)
+		if err != nil {
+			return fmt.Errorf("Unable to decode session data key: %s", err)
+		}
+		if s.data[key], err = readBinaryValue(reader); err != nil {
+			return fmt.Errorf("Unable to decode session value for key %s: %s", key, err)
+		}
+	}
+
+	// Fields added in later versions.
+	if version >= 2 {
+		uses, err := binary.ReadVarint(reader)
+		if err != nil {
+			return fmt.Errorf("Unable to decode session ID uses: %s", err)
+		}
+		s.uses = int(uses)
+	}
+	if version >= 3 {
+		if s.lastLanguageHash, err = binary.ReadUvarint(reader); err != nil {
+			return fmt.Errorf("Unable to decode hash of session remote language: %s", err)
+		}
+	}
+	if version >= 4 {
+		if s.sealed, err = readBinaryBytes(reader); err != nil {
+			return fmt.Errorf("Unable to decode sealed session data: %s", err)
+		}
+		if len(s.sealed) == 0 {
+			s.sealed = nil
+		}
+	}
+	if version >= 5 {
+		count, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return fmt.Errorf("Unable to decode session remote IP history size: %s", err)
+		}
+		if count > uint64(reader.Len()) {
+			return fmt.Errorf("Invalid session remote IP history size: %d", count)
+		}
+		s.ipHistory = nil
+		for ; count > 0; count-- {
+			ip, err := readBinaryString(reader)
+			if err != nil {
+				return fmt.Errorf("Unable to decode session remote IP history: %s", err)
+			}
+			s.ipHistory = append(s.ipHistory, ip)
+		}
+		if count, err = binary.ReadUvarint(reader); err != nil {
+			return fmt.Errorf("Unable to decode session remote user agent history size: %s", err)
+		}
+		if count > uint64(reader.Len()) {
+			return fmt.Errorf("Invalid session remote user agent history size: %d", count)
+		}
+		s.userAgentHistory = nil
+		for ; count > 0; count-- {
+			hash, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return fmt.Errorf("Unable to decode session remote user agent history: %s", err)
+			}
+			s.userAgentHistory = append(s.userAgentHistory, hash)
+		}
+	}
+	if version >= 6 {
+		if s.userMAC, err = readBinaryBytes(reader); err != nil {
+			return fmt.Errorf("Unable to decode session user MAC: %s", err)
+		}
+		if len(s.userMAC) == 0 {
+			s.userMAC = nil
+		}
+	}
+	if version >= 7 {
+		if s.expiresAt, err = readBinaryTime(reader); err != nil {
+			return fmt.Errorf("Unable to decode session expiry time: %s", err)
+		}
+		if s.expiresAt.IsZero() {
+			s.expiresAt = time.Time{}
+		}
+	}
+	if version >= 8 {
+		level, err := binary.ReadVarint(reader)
+		if err != nil {
+			return fmt.Errorf("Unable to decode session assurance level: %s", err)
+		}
+		s.assuranceLevel = int(level)
+	}
+	if version >= 9 {
+		if s.lastInstance, err = readBinaryString(reader); err != nil {
+			return fmt.Errorf("Unable to decode session instance ID: %s", err)
+		}
+	}
+	if version >= 10 {
+		if s.location.Country, err = readBinaryString(reader); err != nil {
+			return fmt.Errorf("Unable to decode session location: %s", err)
+		}
+		if s.location.City, err = readBinaryString(reader); err != nil {
+			return fmt.Errorf("Unable to decode session location: %s", err)
+		}
+		latitude, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return fmt.Errorf("Unable to decode session location: %s", err)
+		}
+		longitude, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return fmt.Errorf("Unable to decode session location: %s", err)
+		}
+		s.location.Latitude, s.location.Longitude = math.Float64frombits(latitude), math.Float64frombits(longitude)
+	}
+	if version >= 11 {
+		if s.started, err = readBinaryTime(reader); err != nil {
+			return fmt.Errorf("Unable to decode session start time: %s", err)
+		}
+	}
+	if version >= 12 {
+		if s.rememberMe, err = readBinaryBool(reader); err != nil {
+			return fmt.Errorf("Unable to decode session remember-me flag: %s", err)
+		}
+	}
+	if version >= 13 {
+		if s.authTime, err = readBinaryTime(reader); err != nil {
+			return fmt.Errorf("Unable to decode session authentication time: %s", err)
+		}
+		if s.authTime.IsZero() {
+			s.authTime = time.Time{}
+		}
+	}
+
+	return nil
+}
+
+// writeBinaryVarint writes a signed varint to the buffer.
+func writeBinaryVarint(buffer *bytes.Buffer, value int64) {
+	var b [binary.MaxVarintLen64]byte
+	buffer.Write(b[:binary.PutVarint(b[:], value)])
+}
+
+// writeBinaryUvarint writes an unsigned varint to the buffer.
+func writeBinaryUvarint(buffer *bytes.Buffer, value uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buffer.Write(b[:binary.PutUvarint(b[:], value)])
+}
+
+// writeBinaryBool writes a boolean as a single byte to the buffer.
+func writeBinaryBool(buffer *bytes.Buffer, value bool) {
+	if value {
+		buffer.WriteByte(1)
+	} else {
+		buffer.WriteByte(0)
+	}
+}
+
+// writeBinaryBytes writes a length-prefixed byte slice to the buffer.
+func writeBinaryBytes(buffer *bytes.Buffer, value []byte) {
+	writeBinaryUvarint(buffer, uint64(len(value)))
+	buffer.Write(value)
+}
+
+// writeBinaryString writes a length-prefixed string to the buffer.
+func writeBinaryString(buffer *bytes.Buffer, value string) {
+	writeBinaryUvarint(buffer, uint64(len(value)))
+	buffer.WriteString(value)
+}
+
+// writeBinaryTime writes a timestamp as two varints (seconds and nanoseconds)
+// to the buffer. The time zone is not preserved.
+func writeBinaryTime(buffer *bytes.Buffer, value time.Time) {
+	writeBinaryVarint(buffer, value.Unix())
+	writeBinaryUvarint(buffer, uint64(value.Nanosecond()))
+}
+
+// writeBinaryValue writes a type identifier followed by the value to the
+// buffer. An error is returned if the value's type is not supported.
+func writeBinaryValue(buffer *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteByte(binaryNil)
+	case bool:
+		buffer.WriteByte(binaryBool)
+		writeBinaryBool(buffer, v)
+	case int:
+		buffer.WriteByte(binaryInt)
+		writeBinaryVarint(buffer, int64(v))
+	case int64:
+		buffer.WriteByte(binaryInt64)
+		writeBinaryVarint(buffer, v)
+	case uint64:
+		buffer.WriteByte(binaryUint64)
+		writeBinaryUvarint(buffer, v)
+	case float64:
+		buffer.WriteByte(binaryFloat64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		buffer.Write(b[:])
+	case string:
+		buffer.WriteByte(binaryString)
+		writeBinaryString(buffer, v)
+	case []byte:
+		buffer.WriteByte(binaryBytes)
+		writeBinaryBytes(buffer, v)
+	case time.Time:
+		buffer.WriteByte(binaryTime)
+		b, err := v.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		writeBinaryUvarint(buffer, uint64(len(b)))
+		buffer.Write(b)
+	default:
+		return fmt.Errorf("Unsupported type %T", value)
+	}
+	return nil
+}
+
+// readBinaryBool reads a boolean byte from the reader.
+func readBinaryBool(reader *bytes.Reader) (bool, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return false, err
+	}
+	return b != 0, nil
+}
+
+// readBinaryBytes reads a length-prefixed byte slice from the reader.
+func readBinaryBytes(reader *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(reader.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readBinaryString reads a length-prefixed string from the reader.
+func readBinaryString(reader *bytes.Reader) (string, error) {
+	b, err := readBinaryBytes(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readBinaryTime reads a timestamp written by writeBinaryTime() from the
+// reader.
+func readBinaryTime(reader *bytes.Reader) (time.Time, error) {
+	seconds, err := binary.ReadVarint(reader)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanoseconds, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, int64(nanoseconds)), nil
+}
+
+// readBinaryValue reads a value written by writeBinaryValue() from the reader.
+func readBinaryValue(reader *bytes.Reader) (interface{}, error) {
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case binaryNil:
+		return nil, nil
+	case binaryBool:
+		return readBinaryBool(reader)
+	case binaryInt:
+		v, err := binary.ReadVarint(reader)
+		return int(v), err
+	case binaryInt64:
+		return binary.ReadVarint(reader)
+	case binaryUint64:
+		return binary.ReadUvarint(reader)
+	case binaryFloat64:
+		var b [8]byte
+		if _, err := io.ReadFull(reader, b[:]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+	case binaryString:
+		return readBinaryString(reader)
+	case binaryBytes:
+		return readBinaryBytes(reader)
+	case binaryTime:
+		b, err := readBinaryBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		var t time.Time
+		if err := t.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, errors.New("Unknown value type")
+}
@@ -0,0 +1,162 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+// binaryTestSession returns a session used to test the binary format.
+func binaryTestSession() *Session {
+	date, _ := time.Parse("2006-01-02", "2017-06-27")
+	return &Session{
+		user:              &TestUser{ID: "12345"},
+		referenceID:       "ABCD",
+		created:           date,
+		lastAccess:        date.Add(time.Minute),
+		lastIP:            "192.168.178.1:80",
+		lastUserAgentHash: 2838198717544347415,
+		ipHistory:         []string{"10.0.0.1:1234", "10.0.0.2:1234"},
+		userAgentHistory:  []uint64{1, 2},
+		expiresAt:         date.Add(time.Hour),
+		assuranceLevel:    2,
+		lastInstance:      "node-1",
+		location:          Location{Country: "DE", City: "Berlin", Latitude: 52.52, Longitude: 13.405},
+		started:           date.Add(-time.Hour),
+		rememberMe:        true,
+		authTime:          date.Add(-time.Minute),
+		tag:               "tenant",
+		data: map[string]interface{}{
+			"field": "value",
+			"42":    13,
+			"true":  false,
+			"nil":   nil,
+			"pi":    3.14159,
+			"bytes": []byte{1, 2, 3},
+		},
+	}
+}
+
+// Test the compact binary format for sessions.
+func TestSessionBinary(t *testing.T) {
+	defer reset()
+	session := binaryTestSession()
+	Persistence = ExtendablePersistenceLayer{
+		LoadUserFunc: func(id interface{}) (User, error) {
+			return session.user, nil
+		},
+	}
+
+	// Serialize.
+	b, err := session.MarshalBinary()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(session); err != nil {
+		t.Error(err)
+		return
+	}
+	t.Logf("Binary size: %d, gob size: %d", len(b), buffer.Len())
+	session.data["date"] = session.created // Not supported by gob without registration.
+	if b, err = session.MarshalBinary(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Deserialize.
+	var recoveredSession Session
+	if err := recoveredSession.UnmarshalBinary(b); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Compare sessions.
+	if !recoveredSession.created.Equal(session.created) {
+		t.Errorf("Recovered session has different creation time (%s) than expected (%s)", recoveredSession.created, session.created)
+	}
+	if !recoveredSession.lastAccess.Equal(session.lastAccess) {
+		t.Errorf("Recovered session has different last access time (%s) than expected (%s)", recoveredSession.lastAccess, session.lastAccess)
+	}
+	if recoveredSession.referenceID != session.referenceID {
+		t.Errorf("Recovered session has different reference ID (%s) than expected (%s)", recoveredSession.referenceID, session.referenceID)
+	}
+	if recoveredSession.lastIP != session.lastIP {
+		t.Errorf("Recovered session has different IP (%s) than expected (%s)", recoveredSession.lastIP, session.lastIP)
+	}
+	if recoveredSession.lastUserAgentHash != session.lastUserAgentHash {
+		t.Errorf("Recovered session has different user agent hash (%d) than expected (%d)", recoveredSession.lastUserAgentHash, session.lastUserAgentHash)
+	}
+	if recoveredSession.tag != session.tag {
+		t.Errorf("Recovered session has different tag (%s) than expected (%s)", recoveredSession.tag, session.tag)
+	}
+	if recoveredSession.User() != session.User() {
+		t.Errorf("Recovered session has different user (%v) than expected (%v)", recoveredSession.user, session.user)
+	}
+	if len(recoveredSession.data) != len(session.data) {
+		t.Errorf("Recovered session data has different size (%d) than expected (%d)", len(recoveredSession.data), len(session.data))
+	}
+	for field, value := range session.data {
+		recoveredValue, ok := recoveredSession.data[field]
+		if !ok {
+			t.Errorf("Field %s not in recovered session data", field)
+			continue
+		}
+		switch v := value.(type) {
+		case []byte:
+			if !bytes.Equal(v, recoveredValue.([]byte)) {
+				t.Errorf("Value %v for field %s not as expected (%v)", recoveredValue, field, value)
+			}
+		case time.Time:
+			if !v.Equal(recoveredValue.(time.Time)) {
+				t.Errorf("Value %v for field %s not as expected (%v)", recoveredValue, field, value)
+			}
+		default:
+			if recoveredValue != value {
+				t.Errorf("Value %v for field %s not as expected (%v)", recoveredValue, field, value)
+			}
+		}
+	}
+
+	// Unsupported types.
+	session.data["struct"] = struct{}{}
+	if _, err := session.MarshalBinary(); err == nil {
+		t.Error("Unsupported type was accepted")
+	}
+}
+
+// Benchmark the compact binary format.
+func BenchmarkSessionBinary(b *testing.B) {
+	session := binaryTestSession()
+	session.user = nil
+	for i := 0; i < b.N; i++ {
+		data, err := session.MarshalBinary()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var recovered Session
+		if err := recovered.UnmarshalBinary(data); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(len(data)), "bytes/session")
+	}
+}
+
+// Benchmark the gob format for comparison with the binary format.
+func BenchmarkSessionGob(b *testing.B) {
+	session := binaryTestSession()
+	session.user = nil
+	for i := 0; i < b.N; i++ {
+		var buffer bytes.Buffer
+		if err := gob.NewEncoder(&buffer).Encode(session); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(buffer.Len()), "bytes/session")
+		var recovered Session
+		if err := gob.NewDecoder(&buffer).Decode(&recovered); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,17 +1,46 @@
 package sessions
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// cacheShards is the number of shards of the sessions cache. Each shard has
+// its own lock so requests for different sessions rarely have to wait for
+// each other.
+const cacheShards = 16
+
+// cacheShard is one part of the sessions cache. It holds the sessions whose
+// IDs are mapped to it (see cache.shard()).
+type cacheShard struct {
+	sync.Mutex
+	sessions  map[string]*Session
+	deletions uint64 // Incremented whenever sessions are removed from this shard (see cache.Get()).
+}
+
 // cache implements a simple LRU write-though cache for user sessions. It
 // is used implicitly by all sessions functions.
 //
+// The cache is split into shards, each with its own lock. The maximum cache
+// size (MaxSessionCacheSize) and the cache expiry (SessionCacheExpiry) apply to
+// the cache as a whole. When the cache is full, the least recently accessed
+// session of all shards is dropped. Because sessions may be added concurrently,
+// the cache may briefly exceed its maximum size. Inactive sessions are looked
+// for at most once per SessionCacheExpiry (but at least once per minute) so
+// that the shards are not scanned with every access.
+//
 // Member functions should not be called while sessions are locked.
 type cache struct {
-	sync.Mutex
-	sessions map[string]*Session
+	shards     []*cacheShard
+	size       int64      // The number of cached sessions. Accessed atomically.
+	lastSweep  int64      // The time of the last check for inactive sessions, in Unix nanoseconds. Accessed atomically.
+	compaction sync.Mutex // Serializes compactions.
 }
 
 // sessions is the global sessions cache.
@@ -19,8 +48,41 @@ var sessions *cache
 
 // initCache initializes the global sessions cache.
 func initCache() {
-	sessions = &cache{
-		sessions: make(map[string]*Session),
+	sessions = newCache(cacheShards)
+}
+
+// newCache returns a new, empty cache with the given number of shards.
+func newCache(shards int) *cache {
+	c := &cache{shards: make([]*cacheShard, shards), lastSweep: time.Now().UnixNano()}
+	for index := range c.shards {
+		c.shards[index] = &cacheShard{sessions: make(map[string]*Session)}
+	}
+	return c
+}
+
+// shard returns the cache shard for the given session ID. The shard is
+// determined by a 32-bit FNV-1a hash of the ID.
+func (c *cache) shard(id string) *cacheShard {
+	hash := uint32(2166136261)
+	for index := 0; index < len(id); index++ {
+		hash ^= uint32(id[index])
+		hash *= 16777619
+	}
+	return c.shards[hash%uint32(len(c.shards))]
+}
+
+// lockAll locks all shards of the cache, e.g. to iterate over all cached
+// sessions.
+func (c *cache) lockAll() {
+	for _, shard := range c.shards {
+		shard.Lock()
+	}
+}
+
+// unlockAll unlocks all shards of the cache locked with lockAll().
+func (c *cache) unlockAll() {
+	for _, shard := range c.shards {
+		shard.Unlock()
 	}
 }
 
@@ -28,147 +90,549 @@ func initCache() {
 // cached, the persistence layer is asked to load and return the session. If no
 // such session exists, a nil session may be returned. This function does not
 // update the session's last access date.
+//
+// The shard is not locked while the session is loaded so that a slow
+// persistence layer does not hold up requests for other sessions.
 func (c *cache) Get(id string) (*Session, error) {
-	c.Lock()
-	defer c.Unlock()
+	shard := c.shard(id)
+	shard.Lock()
 
 	// Do we have a cached session?
-	session, ok := c.sessions[id]
-	if !ok {
-		// Not cached. Query the persistence layer for a session.
-		var err error
-		session, err = Persistence.LoadSession(id)
-		if err != nil {
-			return nil, err
+	if session, ok := shard.sessions[id]; ok {
+		session.RLock()
+		stale := cacheEntryStale(session)
+		session.RUnlock()
+		if !stale || writeBehind.pending(id) {
+			shard.Unlock()
+			countMetric(MetricCacheHits)
+			return session, nil
 		}
 
-		if session != nil {
-			// Save it in the cache.
-			if MaxSessionCacheSize != 0 {
-				c.compact(1)
-				c.sessions[id] = session
-			}
+		// The cached copy is too old. Read it again.
+		delete(shard.sessions, id)
+		shard.deletions++
+		c.resize(-1)
+	}
+	deletions := shard.deletions
+	shard.Unlock()
 
-			// Store ID.
-			session.Lock()
-			session.id = id
-			session.Unlock()
-		}
+	// Not cached. Query the persistence layer for a session.
+	countMetric(MetricCacheMisses)
+	start := time.Now()
+	session, err := Persistence.LoadSession(id)
+	observeDuration(MetricPersistenceLoad, start)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	// Store ID. Don't serve another session's user.
+	session.Lock()
+	session.id = id
+	session.cachedAt = time.Now()
+	valid := session.verifyUserMAC(id)
+	session.Unlock()
+	if !valid {
+		return nil, ErrUserMismatch
+	}
+	if MaxSessionCacheSize == 0 {
+		return session, nil
 	}
 
+	// Save it in the cache, possibly without its data. If the session was
+	// cached or deleted in the meantime, that takes precedence.
+	shard.Lock()
+	if cached, ok := shard.sessions[id]; ok {
+		shard.Unlock()
+		return cached, nil
+	}
+	if shard.deletions != deletions {
+		shard.Unlock()
+		return session, nil
+	}
+	session.Lock()
+	if LazyDataLoading && session.referenceID == "" {
+		session.data = nil
+		session.dataPending = true
+	}
+	session.Unlock()
+	shard.sessions[id] = session
+	c.resize(1)
+	shard.Unlock()
+
+	// Make room for the new session.
+	c.maybeCompact(id)
+
 	return session, nil
 }
 
+// cacheEntryStale returns whether the given cached session is older than
+// SessionCacheMaxAge and must be read from the persistence layer again. The
+// session must be locked (at least for reading) while this function is called.
+func cacheEntryStale(session *Session) bool {
+	return SessionCacheMaxAge > 0 && !CacheIsAuthoritative && time.Since(session.cachedAt) >= SessionCacheMaxAge
+}
+
+// cached returns the session with the given ID if it is in the cache or nil if
+// it is not. Unlike Get(), the persistence layer is not consulted.
+func (c *cache) cached(id string) *Session {
+	shard := c.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
+	return shard.sessions[id]
+}
+
 // Set inserts or updates a session in the cache. Since this is a write-through
 // cache, the persistence layer is also triggered to save the session.
 func (c *cache) Set(session *Session) error {
-	c.Lock()
-	defer c.Unlock()
 	session.Lock()
 	session.lastAccess = time.Now()
+	if session.cachedAt.IsZero() {
+		session.cachedAt = session.lastAccess
+	}
 	id := session.id
 	session.Unlock()
 
-	// Try to compact the cache.
-	var requiredSpace int
-	if _, ok := c.sessions[id]; !ok {
-		requiredSpace = 1
-	}
-	c.compact(requiredSpace)
-
 	// Save in cache.
+	shard := c.shard(id)
+	shard.Lock()
 	if MaxSessionCacheSize != 0 {
-		c.sessions[id] = session
+		if _, ok := shard.sessions[id]; !ok {
+			c.resize(1)
+		}
+		shard.sessions[id] = session
 	}
 
 	// Write through to database.
-	if err := Persistence.SaveSession(id, session); err != nil {
-		return err
-	}
+	err := saveSession(id, session)
+	shard.Unlock()
 
-	return nil
+	// Try to compact the cache.
+	c.maybeCompact(id)
+
+	return err
 }
 
 // Delete deletes a session. A logged-in user will be logged out.
 func (c *cache) Delete(id string) error {
-	c.Lock()
-	defer c.Unlock()
+	shard := c.shard(id)
+	shard.Lock()
+	defer shard.Unlock()
 
 	// Remove from cache.
-	delete(c.sessions, id)
+	if _, ok := shard.sessions[id]; ok {
+		delete(shard.sessions, id)
+		c.resize(-1)
+	}
+	shard.deletions++
+	writeBehind.remove(id)
 
 	// Remove from database.
+	defer observeDuration(MetricPersistenceDelete, time.Now())
 	return Persistence.DeleteSession(id)
 }
 
-// compact drops sessions from the cache to make space for the given number
-// of sessions. It also drops sessions that have been in the cache longer than
-// SessionCacheExpiry. The number of dropped sessions are returned. Dropped
-// sessions are updated in the persistence layer to update the last access time.
+// resize changes the number of sessions held in the cache by "delta" and
+// reports the new number to MetricsSink, if set.
+func (c *cache) resize(delta int64) {
+	size := atomic.AddInt64(&c.size, delta)
+	if MetricsSink != nil {
+		MetricsSink.SetGauge(MetricCachedSessions, float64(size))
+	}
+}
+
+// maybeCompact calls compact() if the cache holds more than MaxSessionCacheSize
+// sessions or if it is time to look for inactive sessions again (see
+// SessionCacheExpiry). Otherwise, it returns immediately without locking
+// anything.
+//
+// This function must not be called while a shard of the cache is locked.
+func (c *cache) maybeCompact(keep string) {
+	if MaxSessionCacheSize >= 0 && !CacheIsAuthoritative && atomic.LoadInt64(&c.size) > int64(MaxSessionCacheSize) {
+		c.compact(keep)
+		return
+	}
+	interval := SessionCacheExpiry
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	lastSweep := atomic.LoadInt64(&c.lastSweep)
+	now := time.Now().UnixNano()
+	if now-lastSweep < int64(interval) || !atomic.CompareAndSwapInt64(&c.lastSweep, lastSweep, now) {
+		return // Not due yet or another goroutine is doing it.
+	}
+	c.compact(keep)
+}
+
+// compact drops sessions from the cache until it holds no more than
+// MaxSessionCacheSize sessions, starting with the least recently accessed
+// sessions. It also drops sessions that have been in the cache longer than
+// SessionCacheExpiry. The session with the ID "keep", which was usually just
+// added, is never dropped. The number of dropped sessions are returned.
+// Dropped sessions are updated in the persistence layer to update the last
+// access time. Sessions waiting in the write-behind queue (see WriteBehind) are
+// kept until they were saved, even if the cache grows beyond
+// MaxSessionCacheSize.
+//
+// If CacheIsAuthoritative is true, only sessions which have expired (see
+// Session.Expired()) are dropped.
 //
-// This function does not synchronize concurrent access to the cache.
-func (c *cache) compact(requiredSpace int) (int, error) {
+// This function must not be called while a shard of the cache is locked.
+func (c *cache) compact(keep string) (int, error) {
+	c.compaction.Lock()
+	defer c.compaction.Unlock()
+	atomic.StoreInt64(&c.lastSweep, time.Now().UnixNano())
+
 	// Check for old sessions.
-	for id, session := range c.sessions {
-		session.RLock()
-		age := time.Since(session.lastAccess)
-		session.RUnlock()
-		if age > SessionCacheExpiry {
-			if err := Persistence.SaveSession(id, session); err != nil {
-				return 0, err
+	var dropped int
+	for _, shard := range c.shards {
+		shard.Lock()
+		for id, session := range shard.sessions {
+			if id == keep {
+				continue
+			}
+			var drop bool
+			if CacheIsAuthoritative {
+				drop = session.Expired()
+			} else {
+				session.RLock()
+				drop = time.Since(session.lastAccess) > SessionCacheExpiry
+				session.RUnlock()
+			}
+			if drop {
+				if err := saveSession(id, session); err != nil {
+					shard.Unlock()
+					return dropped, err
+				}
+				if writeBehind.pending(id) {
+					continue // Keep it until it was saved.
+				}
+				delete(shard.sessions, id)
+				shard.deletions++
+				c.resize(-1)
+				dropped++
+				countMetric(MetricCacheEvictions)
+				logDebug("Session evicted from cache", "session", MaskSessionID(id), "reason", "expired")
 			}
-			delete(c.sessions, id)
 		}
+		shard.Unlock()
 	}
 
 	// Cache may still grow.
-	if MaxSessionCacheSize < 0 || len(c.sessions)+requiredSpace <= MaxSessionCacheSize {
-		return 0, nil
+	if MaxSessionCacheSize < 0 || CacheIsAuthoritative {
+		return dropped, nil
 	}
 
 	// Drop the oldest sessions.
-	var dropped int
-	if requiredSpace > MaxSessionCacheSize {
-		requiredSpace = MaxSessionCacheSize // We can't request more than is allowed.
-	}
-	for len(c.sessions)+requiredSpace > MaxSessionCacheSize {
-		// Find oldest sessions and delete them.
+	for atomic.LoadInt64(&c.size) > int64(MaxSessionCacheSize) {
+		// Find the oldest session.
 		var (
 			oldestAccessTime time.Time
 			oldestSessionID  string
+			oldestShard      *cacheShard
 		)
-		for id, session := range c.sessions {
-			session.RLock()
-			before := session.lastAccess.Before(oldestAccessTime)
-			session.RUnlock()
-			if oldestSessionID == "" || before {
-				oldestSessionID = id
-				oldestAccessTime = session.lastAccess
+		for _, shard := range c.shards {
+			shard.Lock()
+			for id, session := range shard.sessions {
+				if id == keep || writeBehind.pending(id) {
+					continue
+				}
+				session.RLock()
+				lastAccess := session.lastAccess
+				session.RUnlock()
+				if oldestShard == nil || lastAccess.Before(oldestAccessTime) {
+					oldestSessionID = id
+					oldestAccessTime = lastAccess
+					oldestShard = shard
+				}
 			}
+			shard.Unlock()
+		}
+		if oldestShard == nil {
+			break // Only the session to keep is left.
 		}
-		if err := Persistence.SaveSession(oldestSessionID, c.sessions[oldestSessionID]); err != nil {
-			return 0, err
+
+		// Delete it. It may have been deleted by someone else in the meantime.
+		oldestShard.Lock()
+		if session, ok := oldestShard.sessions[oldestSessionID]; ok {
+			if err := saveSession(oldestSessionID, session); err != nil {
+				oldestShard.Unlock()
+				return dropped, err
+			}
+			if !writeBehind.pending(oldestSessionID) {
+				delete(oldestShard.sessions, oldestSessionID)
+				oldestShard.deletions++
+				c.resize(-1)
+				dropped++
+				countMetric(MetricCacheEvictions)
+				logDebug("Session evicted from cache", "session", MaskSessionID(oldestSessionID), "reason", "size")
+			}
 		}
-		delete(c.sessions, oldestSessionID)
-		dropped++
+		oldestShard.Unlock()
 	}
 
 	return dropped, nil
 }
 
+// referenceDeletions holds the timers which delete reference sessions at the
+// end of their grace period (see Session.RegenerateID()), keyed by the IDs of
+// the reference sessions.
+var (
+	referenceDeletions      = make(map[string]*time.Timer)
+	referenceDeletionsMutex sync.Mutex
+)
+
+// scheduleReferenceDeletion deletes the reference session with the given ID
+// after SessionIDGracePeriod.
+func scheduleReferenceDeletion(id string) {
+	referenceDeletionsMutex.Lock()
+	defer referenceDeletionsMutex.Unlock()
+	if timer, ok := referenceDeletions[id]; ok {
+		timer.Stop()
+	}
+	referenceDeletions[id] = time.AfterFunc(SessionIDGracePeriod, func() {
+		referenceDeletionsMutex.Lock()
+		delete(referenceDeletions, id)
+		referenceDeletionsMutex.Unlock()
+		if err := sessions.Delete(id); err != nil {
+			logError("Could not delete reference session", "session", MaskSessionID(id), "error", err)
+		}
+	})
+}
+
+// cancelReferenceDeletions stops the timers which were started by
+// scheduleReferenceDeletion() without deleting the reference sessions. They
+// expire like any other session.
+func cancelReferenceDeletions() {
+	referenceDeletionsMutex.Lock()
+	defer referenceDeletionsMutex.Unlock()
+	for _, timer := range referenceDeletions {
+		timer.Stop()
+	}
+	referenceDeletions = make(map[string]*time.Timer)
+}
+
+// deleteReferenceSessions deletes all reference sessions whose deletion was
+// scheduled with scheduleReferenceDeletion() but has not happened yet. Their
+// timers are stopped. If a session cannot be deleted, the remaining sessions
+// are still processed.
+func deleteReferenceSessions() error {
+	referenceDeletionsMutex.Lock()
+	ids := make([]string, 0, len(referenceDeletions))
+	for id, timer := range referenceDeletions {
+		timer.Stop()
+		ids = append(ids, id)
+	}
+	referenceDeletions = make(map[string]*time.Timer)
+	referenceDeletionsMutex.Unlock()
+
+	var errs []error
+	for _, id := range ids {
+		if err := sessions.Delete(id); err != nil {
+			errs = append(errs, fmt.Errorf("Could not delete reference session %s: %w", MaskSessionID(id), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // PurgeSessions removes all sessions from the local cache. The current cache
 // content is also saved via the persistence layer, to update the session last
 // access times.
+//
+// Reference sessions (see Session.RegenerateID()) whose grace period has not
+// ended yet are deleted from the persistence layer instead. They would
+// otherwise remain in the data store after a restart because their deletion is
+// scheduled in memory. Browsers which still send the old session ID lose their
+// session.
 func PurgeSessions() {
-	sessions.Lock()
-	defer sessions.Unlock()
+	deleteReferenceSessions()
+	// Errors are not that bad. These sessions expire anyway.
+
+	sessions.lockAll()
+	defer sessions.unlockAll()
 
 	// Update all sessions in the database.
-	for id, session := range sessions.sessions {
-		Persistence.SaveSession(id, session)
-		// We only do this to update the last access time. Errors are not that
-		// bad.
+	for _, shard := range sessions.shards {
+		for id, session := range shard.sessions {
+			session.RLock()
+			reference := session.referenceID != ""
+			session.RUnlock()
+			if reference {
+				Persistence.DeleteSession(id)
+				continue
+			}
+			if session.loadData() != nil {
+				continue // Without data, we would overwrite the stored data.
+			}
+			Persistence.SaveSession(id, session)
+			// We only do this to update the last access time. Errors are not that
+			// bad.
+		}
+		shard.sessions = make(map[string]*Session)
+		shard.deletions++
+	}
+	atomic.StoreInt64(&sessions.size, 0)
+	sessions.resize(0)
+}
+
+// CachedSessionIDs returns the IDs of all sessions which are currently held in
+// the local cache, in no particular order. This includes the IDs of reference
+// sessions (see Session.RegenerateID()). It is a cheap way to inspect the
+// cache, e.g. for debugging or for administrative views, because no session is
+// locked or loaded.
+//
+// Note that the result reflects only the local cache, not the sessions stored
+// in the persistence layer. The cache shards are visited one after another so
+// sessions which are added or removed concurrently may or may not be included.
+func CachedSessionIDs() []string {
+	ids := make([]string, 0, atomic.LoadInt64(&sessions.size))
+	for _, shard := range sessions.shards {
+		shard.Lock()
+		for id := range shard.sessions {
+			ids = append(ids, id)
+		}
+		shard.Unlock()
+	}
+	return ids
+}
+
+// ExportCache writes all sessions of the local cache to the given writer,
+// using gob encoding. Together with ImportCache(), this allows you to hand
+// the cache over to a new process, e.g. during a restart, without losing
+// sessions that are not persisted and without the latency of a cold cache.
+//
+// The cache is locked while the sessions are exported.
+func ExportCache(w io.Writer) error {
+	sessions.lockAll()
+	defer sessions.unlockAll()
+
+	encoder := gob.NewEncoder(w)
+	if err := encoder.Encode(int(atomic.LoadInt64(&sessions.size))); err != nil {
+		return fmt.Errorf("Unable to encode cache size: %s", err)
+	}
+	for _, shard := range sessions.shards {
+		for id, session := range shard.sessions {
+			if err := session.loadData(); err != nil {
+				return err
+			}
+			if err := encoder.Encode(id); err != nil {
+				return fmt.Errorf("Unable to encode session ID: %s", err)
+			}
+			if err := encoder.Encode(session); err != nil {
+				return fmt.Errorf("Unable to encode session: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ImportCache reads sessions written by ExportCache() from the given reader and
+// adds them to the local cache. The cache must be empty when this function is
+// called. If there are more sessions than MaxSessionCacheSize allows, the
+// remaining sessions are discarded. (They are not saved to the persistence
+// layer.)
+//
+// The sessions are only added if the entire stream could be decoded. If an
+// error is returned, the cache remains empty.
+//
+// Users attached to the sessions are loaded with Persistence.LoadUser().
+func ImportCache(r io.Reader) error {
+	sessions.lockAll()
+	defer sessions.unlockAll()
+
+	if atomic.LoadInt64(&sessions.size) > 0 {
+		return errors.New("Cannot import into a non-empty cache")
+	}
+
+	decoder := gob.NewDecoder(r)
+	var count int
+	if err := decoder.Decode(&count); err != nil {
+		return fmt.Errorf("Unable to decode cache size: %s", err)
+	}
+	var imported []*Session
+	for ; count > 0; count-- {
+		var id string
+		if err := decoder.Decode(&id); err != nil {
+			return fmt.Errorf("Unable to decode session ID: %s", err)
+		}
+		session := &Session{}
+		if err := decoder.Decode(session); err != nil {
+			return fmt.Errorf("Unable to decode session %s: %s", MaskSessionID(id), err)
+		}
+		if MaxSessionCacheSize >= 0 && len(imported) >= MaxSessionCacheSize {
+			continue // Decode the rest anyway to validate the stream.
+		}
+		session.id = id
+		session.cachedAt = time.Now() // Not exported. Count SessionCacheMaxAge from now.
+		imported = append(imported, session)
+	}
+
+	// The stream is valid. Add the sessions to the cache.
+	for _, session := range imported {
+		sessions.shard(session.id).sessions[session.id] = session
+		sessions.resize(1)
 	}
 
-	sessions.sessions = make(map[string]*Session, MaxSessionCacheSize)
+	return nil
+}
+
+// Export serializes this session, including its ID, into a self-contained
+// byte slice which can be restored with ImportSession(). Unlike GobEncode(),
+// which is used to hand sessions to the persistence layer, the result contains
+// the session ID. Use this to transfer single sessions, e.g. to migrate a
+// user's session to another environment or to reproduce a reported problem.
+//
+// The result gives full access to the session. Treat it like a password.
+func (s *Session) Export() ([]byte, error) {
+	if err := s.loadData(); err != nil {
+		return nil, err
+	}
+	s.RLock()
+	id := s.id
+	s.RUnlock()
+
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(id); err != nil {
+		return nil, fmt.Errorf("Unable to encode session ID: %s", err)
+	}
+	if err := encoder.Encode(s); err != nil {
+		return nil, fmt.Errorf("Unable to encode session: %s", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// ImportSession restores a session serialized with Session.Export(). A user
+// attached to the session is loaded with Persistence.LoadUser().
+//
+// The session is not added to the local cache or to the persistence layer.
+// Call RegisterSession() for that.
+func ImportSession(data []byte) (*Session, error) {
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	var id string
+	if err := decoder.Decode(&id); err != nil {
+		return nil, fmt.Errorf("Unable to decode session ID: %s", err)
+	}
+	session := &Session{}
+	if err := decoder.Decode(session); err != nil {
+		return nil, fmt.Errorf("Unable to decode session %s: %s", MaskSessionID(id), err)
+	}
+	session.id = id
+	return session, nil
+}
+
+// RegisterSession adds a session, e.g. one returned by ImportSession(), to the
+// local cache and saves it via the persistence layer. Any existing session with
+// the same ID is replaced. From then on, requests which present the session's
+// ID receive this session.
+func RegisterSession(session *Session) error {
+	session.RLock()
+	id := session.id
+	session.RUnlock()
+	if !ValidSessionIDFormat(id) {
+		return errors.New("Session ID has an invalid format")
+	}
+	sessionIDMutexes.Lock(id)
+	defer sessionIDMutexes.Unlock(id)
+	return sessions.Set(session)
 }
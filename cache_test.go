@@ -1,19 +1,59 @@
 package sessions
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// cachedSessions returns a copy of the contents of the sessions cache.
+func cachedSessions() map[string]*Session {
+	sessions.lockAll()
+	defer sessions.unlockAll()
+	cached := make(map[string]*Session)
+	for _, shard := range sessions.shards {
+		for id, session := range shard.sessions {
+			cached[id] = session
+		}
+	}
+	return cached
+}
+
+// clearCache removes all sessions from the sessions cache without saving them.
+// Scheduled deletions of reference sessions are cancelled.
+func clearCache() {
+	sessions.lockAll()
+	defer sessions.unlockAll()
+	for _, shard := range sessions.shards {
+		shard.sessions = make(map[string]*Session)
+	}
+	atomic.StoreInt64(&sessions.size, 0)
+	cancelReferenceDeletions()
+	forgetTerminated()
+
+	writeBehind.Lock()
+	defer writeBehind.Unlock()
+	writeBehind.sessions = make(map[string]*Session)
+}
+
 // Test basic cache functionality.
 func TestCache(t *testing.T) {
+	defer reset()
+
 	// A session ID set.
 	set := map[string]struct{}{"s3": {}, "s4": {}}
 
 	// Some reference counts.
 	var loaded, saved, deleted int
 	tab := func(step int) {
-		t.Logf("%d: Loaded = %d, saved = %d, deleted = %d, cache size = %d, set = %s", step, loaded, saved, deleted, len(sessions.sessions), set)
+		t.Logf("%d: Loaded = %d, saved = %d, deleted = %d, cache size = %d, set = %s", step, loaded, saved, deleted, len(cachedSessions()), set)
 	}
 
 	// A test persistence layer.
@@ -117,8 +157,8 @@ func TestCache(t *testing.T) {
 	if deleted != 2 {
 		t.Errorf("Deleted = %d, expected %d", deleted, 4)
 	}
-	if len(sessions.sessions) != 0 {
-		t.Errorf("Cache size = %d, expected %d", len(sessions.sessions), 0)
+	if len(cachedSessions()) != 0 {
+		t.Errorf("Cache size = %d, expected %d", len(cachedSessions()), 0)
 	}
 	if len(set) != 4 {
 		t.Errorf("Set size = %d, expected %d", len(set), 4)
@@ -129,3 +169,659 @@ func TestCache(t *testing.T) {
 		}
 	}
 }
+
+// Test a cache which does not drop sessions unless they have expired.
+func TestCacheAuthoritative(t *testing.T) {
+	defer reset()
+	CacheIsAuthoritative = true
+	MaxSessionCacheSize = 2
+	SessionCacheExpiry = time.Millisecond
+	SessionIDGracePeriod = time.Millisecond
+	if err := sessions.Set(&Session{id: "ref", referenceID: "s1"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for _, id := range []string{"s1", "s2", "s3"} {
+		if err := sessions.Set(&Session{id: id, created: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := cachedSessions()
+	if len(cached) != 3 {
+		t.Errorf("Cache size = %d, expected 3", len(cached))
+	}
+	if _, ok := cached["ref"]; ok {
+		t.Error("Expired reference session was not dropped")
+	}
+
+	// Nothing is dropped after the cache expiry either.
+	time.Sleep(5 * time.Millisecond)
+	if err := sessions.Set(&Session{id: "s4", created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if len(cachedSessions()) != 4 {
+		t.Errorf("Cache size = %d, expected 4", len(cachedSessions()))
+	}
+}
+
+// Test listing the IDs of cached sessions.
+func TestCachedSessionIDs(t *testing.T) {
+	defer reset()
+	if ids := CachedSessionIDs(); len(ids) != 0 {
+		t.Errorf("Empty cache returned IDs %v", ids)
+	}
+	for _, id := range []string{"s1", "s2", "s3"} {
+		if err := sessions.Set(&Session{id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := CachedSessionIDs()
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "s1,s2,s3" {
+		t.Errorf("Unexpected session IDs %v", ids)
+	}
+}
+
+// Test reading cached sessions again after SessionCacheMaxAge.
+func TestCacheMaxAge(t *testing.T) {
+	defer reset()
+	var loads int
+	value := "first"
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			loads++
+			return &Session{data: map[string]interface{}{"value": value}}, nil
+		},
+	}
+	SessionCacheMaxAge = 20 * time.Millisecond
+
+	// Fresh sessions come from the cache.
+	session, err := sessions.Get("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value = "second" // Changed on another node.
+	if session, err = sessions.Get("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 1 || session.Get("value", nil) != "first" {
+		t.Errorf("Fresh session was loaded again (%d loads, value %v)", loads, session.Get("value", nil))
+	}
+
+	// Old sessions are loaded again.
+	time.Sleep(25 * time.Millisecond)
+	if session, err = sessions.Get("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 2 || session.Get("value", nil) != "second" {
+		t.Errorf("Old session was not loaded again (%d loads, value %v)", loads, session.Get("value", nil))
+	}
+	if len(cachedSessions()) != 1 {
+		t.Errorf("Cache size = %d, expected 1", len(cachedSessions()))
+	}
+
+	// Sessions deleted on another node disappear.
+	Persistence = ExtendablePersistenceLayer{}
+	time.Sleep(25 * time.Millisecond)
+	if session, err = sessions.Get("s1"); err != nil || session != nil {
+		t.Errorf("Deleted session was returned (error %v)", err)
+	}
+
+	// Authoritative caches are never read again.
+	CacheIsAuthoritative = true
+	if err := sessions.Set(&Session{id: "s2"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if session, err = sessions.Get("s2"); err != nil || session == nil {
+		t.Errorf("Authoritative session was dropped (error %v)", err)
+	}
+}
+
+// Test that purging the cache deletes reference sessions.
+func TestCachePurgeReferenceSessions(t *testing.T) {
+	defer reset()
+	store := make(map[string]bool)
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			store[id] = true
+			return nil
+		},
+		DeleteSessionFunc: func(id string) error {
+			delete(store, id)
+			return nil
+		},
+	}
+	session := &Session{id: "old", data: make(map[string]interface{})}
+	if err := sessions.Set(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RegenerateID(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reference session whose deletion was not scheduled by this process.
+	if err := sessions.Set(&Session{id: "older", referenceID: "old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	PurgeSessions()
+	if len(store) != 1 || !store[session.id] {
+		t.Errorf("Unexpected sessions in store: %v", store)
+	}
+	if len(referenceDeletions) != 0 {
+		t.Error("Reference session deletion is still scheduled")
+	}
+}
+
+// Test exporting and importing the cache.
+func TestCacheExportImport(t *testing.T) {
+	defer reset()
+	for _, id := range []string{"s1", "s2", "s3"} {
+		if err := sessions.Set(&Session{id: id, lastAccess: time.Now(), data: map[string]interface{}{"id": id}}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	var buffer bytes.Buffer
+	if err := ExportCache(&buffer); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ImportCache(bytes.NewReader(buffer.Bytes())); err == nil {
+		t.Error("Import into non-empty cache succeeded")
+	}
+	clearCache()
+	MaxSessionCacheSize = 2
+	truncated := buffer.Bytes()[:buffer.Len()-10]
+	if err := ImportCache(bytes.NewReader(truncated)); err == nil {
+		t.Error("Import of truncated stream succeeded")
+	}
+	if len(cachedSessions()) != 0 {
+		t.Errorf("Truncated stream left %d sessions in the cache", len(cachedSessions()))
+	}
+	if err := ImportCache(&buffer); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(cachedSessions()) != 2 {
+		t.Errorf("Cache size = %d, expected 2", len(cachedSessions()))
+	}
+	for id, session := range cachedSessions() {
+		if session.id != id || session.Get("id", nil) != id {
+			t.Errorf("Imported session %s has unexpected content", id)
+		}
+	}
+}
+
+// Test that imported sessions are not considered stale immediately.
+func TestCacheImportMaxAge(t *testing.T) {
+	defer reset()
+	var loads int
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			loads++
+			return nil, nil
+		},
+	}
+	SessionCacheMaxAge = time.Hour
+	if err := sessions.Set(&Session{id: "s1", lastAccess: time.Now(), data: map[string]interface{}{"id": "s1"}}); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := ExportCache(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	clearCache()
+	if err := ImportCache(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	session, err := sessions.Get("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session == nil || session.Get("id", nil) != "s1" || loads != 0 {
+		t.Errorf("Imported session was not served from the cache (%d loads)", loads)
+	}
+}
+
+// Test retrying failed saves in the background.
+func TestCacheWriteBehind(t *testing.T) {
+	defer reset()
+	var (
+		mutex    sync.Mutex
+		failures = 1
+		saved    int
+	)
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if failures > 0 {
+				failures--
+				return errors.New("Data store unavailable")
+			}
+			saved++
+			return nil
+		},
+	}
+	session := &Session{id: "s1", lastAccess: time.Now()}
+	if err := sessions.Set(session); err == nil {
+		t.Error("Error was not returned without write-behind")
+	}
+	failures = 1
+	WriteBehind = true
+	if err := sessions.Set(session); err != nil {
+		t.Error(err)
+		return
+	}
+	if PendingWrites() != 1 {
+		t.Errorf("Pending writes = %d, expected 1", PendingWrites())
+	}
+	time.Sleep(3 * writeBehindMinBackoff)
+	if PendingWrites() != 0 {
+		t.Errorf("Pending writes = %d, expected 0", PendingWrites())
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if saved != 1 {
+		t.Errorf("Saved = %d, expected 1", saved)
+	}
+}
+
+// Test that Close() stops retrying failed saves and cancels pending timers.
+func TestCacheWriteBehindClose(t *testing.T) {
+	defer reset()
+	defer clearCache()
+	var (
+		mutex    sync.Mutex
+		attempts int
+	)
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			attempts++
+			return errors.New("Data store unavailable")
+		},
+	}
+	WriteBehind = true
+	if err := sessions.Set(&Session{id: "s1", lastAccess: time.Now()}); err != nil {
+		t.Error(err)
+		return
+	}
+	scheduleReferenceDeletion("s2")
+	markTerminated("s3")
+	Close()
+
+	time.Sleep(3 * writeBehindMinBackoff)
+	mutex.Lock()
+	if attempts != 1 {
+		t.Errorf("Saves were retried after Close(): %d attempts", attempts)
+	}
+	mutex.Unlock()
+	if PendingWrites() != 1 {
+		t.Errorf("Pending writes = %d, expected 1", PendingWrites())
+	}
+	referenceDeletionsMutex.Lock()
+	if len(referenceDeletions) != 0 {
+		t.Error("Reference deletions are still scheduled after Close()")
+	}
+	referenceDeletionsMutex.Unlock()
+	if terminated("s3") {
+		t.Error("Terminated session ID is still remembered after Close()")
+	}
+
+	// Queueing another session restarts the retries.
+	if err := sessions.Set(&Session{id: "s4", lastAccess: time.Now()}); err != nil {
+		t.Error(err)
+		return
+	}
+	retried := waitFor(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return attempts > 2
+	})
+	if !retried {
+		t.Error("Saves were not retried after restart")
+	}
+	writeBehind.close()
+}
+
+// Test that a session queued for write-behind under its old ID does not
+// overwrite the reference session after its ID was replaced.
+func TestCacheWriteBehindRegenerateID(t *testing.T) {
+	defer reset()
+	var (
+		mutex     sync.Mutex
+		available bool
+		reference = make(map[string]bool) // Whether a reference session was saved last, by ID.
+	)
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !available {
+				return errors.New("Data store unavailable")
+			}
+			reference[id] = session.referenceID != ""
+			return nil
+		},
+	}
+	WriteBehind = true
+	session := &Session{id: sessionID, created: time.Now(), lastAccess: time.Now(), data: make(map[string]interface{})}
+	if err := sessions.Set(session); err != nil {
+		t.Fatal(err)
+	}
+	if PendingWrites() != 1 {
+		t.Fatalf("Pending writes = %d, expected 1", PendingWrites())
+	}
+
+	// The data store recovers before the queued session is retried.
+	mutex.Lock()
+	available = true
+	mutex.Unlock()
+	if err := session.RegenerateID(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return PendingWrites() == 0 }) {
+		t.Fatalf("Pending writes = %d, expected 0", PendingWrites())
+	}
+	time.Sleep(2 * writeBehindMinBackoff)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reference[sessionID] {
+		t.Error("Reference session under the old ID was overwritten")
+	}
+	if reference[session.id] {
+		t.Error("Session under the new ID is a reference session")
+	}
+}
+
+// Test that sessions queued for write-behind are not evicted from the cache.
+func TestCacheWriteBehindEviction(t *testing.T) {
+	defer reset()
+	var (
+		mutex     sync.Mutex
+		available bool
+	)
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !available {
+				return errors.New("Data store unavailable")
+			}
+			return nil
+		},
+	}
+	WriteBehind = true
+	MaxSessionCacheSize = 1
+	SessionCacheExpiry = time.Minute
+
+	// Expired and oldest sessions.
+	if err := sessions.Set(&Session{id: "s1", lastAccess: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Set(&Session{id: "s2", lastAccess: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Set(&Session{id: "s3", lastAccess: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"s1", "s2", "s3"} {
+		if sessions.cached(id) == nil {
+			t.Errorf("Queued session %s was evicted", id)
+		}
+	}
+
+	// Once they are saved, they may be evicted.
+	mutex.Lock()
+	available = true
+	mutex.Unlock()
+	if !waitFor(func() bool { return PendingWrites() == 0 }) {
+		t.Fatalf("Pending writes = %d, expected 0", PendingWrites())
+	}
+	if dropped, err := sessions.compact("s3"); err != nil || dropped != 2 {
+		t.Errorf("Dropped %d sessions (%v), expected 2", dropped, err)
+	}
+}
+
+// Test exporting and importing single sessions.
+func TestSessionExportImport(t *testing.T) {
+	defer reset()
+	var saved []string
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			saved = append(saved, id)
+			return nil
+		},
+		LoadUserFunc: func(id interface{}) (User, error) {
+			return &TestUser{ID: id.(string)}, nil
+		},
+	}
+	session := &Session{
+		id:         sessionID,
+		user:       &TestUser{ID: "12345"},
+		created:    time.Now(),
+		lastAccess: time.Now(),
+		data:       map[string]interface{}{"cart": "full"},
+	}
+	data, err := session.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportSession(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.id != sessionID || !imported.Equal(session) {
+		t.Error("Imported session differs from exported session")
+	}
+	if len(saved) != 0 || sessions.cached(sessionID) != nil {
+		t.Error("Imported session was registered")
+	}
+	if _, err := ImportSession(data[:len(data)/2]); err == nil {
+		t.Error("Truncated session was imported")
+	}
+
+	// Register it.
+	if err := RegisterSession(imported); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0] != sessionID || sessions.cached(sessionID) != imported {
+		t.Errorf("Session was not registered (saved %v)", saved)
+	}
+	imported.id = "short"
+	if err := RegisterSession(imported); err == nil {
+		t.Error("Session with invalid ID was registered")
+	}
+}
+
+// Test caching sessions without their data.
+func TestCacheLazyDataLoading(t *testing.T) {
+	defer reset()
+	LazyDataLoading = true
+	var dataLoaded int
+	var saved map[string]interface{}
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			return &Session{lastAccess: time.Now(), data: map[string]interface{}{"key": "value"}}, nil
+		},
+		LoadSessionDataFunc: func(id string) (map[string]interface{}, error) {
+			dataLoaded++
+			return map[string]interface{}{"key": "value"}, nil
+		},
+		SaveSessionFunc: func(id string, session *Session) error {
+			saved = session.data
+			return nil
+		},
+	}
+
+	// The cached session has no data.
+	session, err := sessions.Get(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.data != nil || dataLoaded != 0 {
+		t.Error("Cached session contains data")
+	}
+
+	// Saving the session must not lose the data.
+	if err := session.SetTag("tag"); err != nil {
+		t.Fatal(err)
+	}
+	if saved["key"] != "value" || dataLoaded != 1 {
+		t.Errorf("Data was not loaded before saving: %v", saved)
+	}
+
+	// The data is only loaded once.
+	if value := session.Get("key", nil); value != "value" || dataLoaded != 1 {
+		t.Errorf("Unexpected value %v after %d loads", value, dataLoaded)
+	}
+
+	// Errors while loading the data.
+	session, _ = sessions.Get("other")
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionDataFunc: func(id string) (map[string]interface{}, error) {
+			return nil, errors.New("Data store unavailable")
+		},
+	}
+	if err := session.Set("key", "value"); err == nil {
+		t.Error("Session data error was not returned")
+	}
+	if value := session.Get("key", "default"); value != "default" {
+		t.Errorf("Expected default value, got %v", value)
+	}
+}
+
+// sameShardIDs returns two different session IDs which are mapped to the same
+// cache shard.
+func sameShardIDs() (string, string) {
+	first := "slow"
+	for index := 0; ; index++ {
+		other := fmt.Sprintf("other%d", index)
+		if sessions.shard(other) == sessions.shard(first) {
+			return first, other
+		}
+	}
+}
+
+// Test that loading a session does not block other sessions of the same shard
+// and that a session deleted while it was loaded is not cached.
+func TestCacheLoadUnlocked(t *testing.T) {
+	defer reset()
+	clearCache()
+	defer clearCache()
+	slow, other := sameShardIDs()
+	loading, release := make(chan struct{}), make(chan struct{})
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			if id == slow {
+				close(loading)
+				<-release
+			}
+			return &Session{lastAccess: time.Now()}, nil
+		},
+	}
+	loaded := make(chan *Session)
+	go func() {
+		session, err := sessions.Get(slow)
+		if err != nil {
+			t.Error(err)
+		}
+		loaded <- session
+	}()
+	<-loading
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := sessions.Get(other); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Slow load blocked another session of the same shard")
+	}
+
+	// Delete the session while it is being loaded.
+	if err := sessions.Delete(slow); err != nil {
+		t.Error(err)
+	}
+	close(release)
+	if session := <-loaded; session == nil {
+		t.Error("Loaded session was not returned")
+	}
+	if sessions.cached(slow) != nil {
+		t.Error("Session deleted while loading was cached")
+	}
+}
+
+// Test that inactive sessions are dropped even if the cache is not full.
+func TestCacheSweep(t *testing.T) {
+	defer reset()
+	clearCache()
+	defer clearCache()
+	SessionCacheExpiry = 10 * time.Millisecond
+	if err := sessions.Set(&Session{id: "s1", lastAccess: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := sessions.Set(&Session{id: "s2", lastAccess: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if sessions.cached("s1") != nil {
+		t.Error("Inactive session was not dropped")
+	}
+	if sessions.cached("s2") == nil {
+		t.Error("Active session was dropped")
+	}
+}
+
+// Benchmark concurrent cache access with a single lock and with sharding. The
+// "mixed" workload updates every eighth session it looks up.
+func BenchmarkCacheParallel(b *testing.B) {
+	defer reset()
+	defer initCache()
+	ids := make([]string, 1024)
+	for index := range ids {
+		ids[index], _ = generateSessionID()
+	}
+	for _, shards := range []int{1, cacheShards} {
+		for _, mixed := range []bool{false, true} {
+			workload := "lookups"
+			if mixed {
+				workload = "mixed"
+			}
+			b.Run(fmt.Sprintf("shards=%d/%s", shards, workload), func(b *testing.B) {
+				sessions = newCache(shards)
+				for _, id := range ids {
+					if err := sessions.Set(&Session{id: id}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				var next uint32
+				b.RunParallel(func(pb *testing.PB) {
+					index := int(atomic.AddUint32(&next, 97))
+					for pb.Next() {
+						index++
+						session, err := sessions.Get(ids[index%len(ids)])
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						if mixed && index%8 == 0 {
+							if err := sessions.Set(session); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidClaims is returned by VerifySignedClaims() if a token is
+// malformed, if its signature does not match, or if it is too old.
+var ErrInvalidClaims = errors.New("Invalid signed claims")
+
+// Claims returns a description of the identity of the session's user which may
+// be forwarded to other services, e.g. by an edge service to the services
+// behind it. The returned map contains the following keys:
+//
+//   - "sub": The ID of the user (see User.GetID()).
+//   - "aal": The authentication assurance level (see SetAssuranceLevel()).
+//   - "auth_time": The time the user's authentication was completed (see
+//     LogIn() and CompleteAuth()), in seconds since the Unix epoch. Omitted if
+//     it is not known, e.g. while authentication is pending.
+//   - "iat": The time the claims were issued, in seconds since the Unix epoch.
+//   - "pending": True if the user's authentication has not been completed yet
+//     (see LogInPending()). Omitted otherwise.
+//
+// An error is returned if no user is logged into this session. The user is not
+// loaded (see LazyUserLoading). Use SignedClaims() to transmit the claims such
+// that other services can verify them.
+func (s *Session) Claims() (map[string]interface{}, error) {
+	s.RLock()
+	defer s.RUnlock()
+	userID, ok := s.userID()
+	if !ok {
+		return nil, errors.New("No user is logged into this session")
+	}
+	claims := map[string]interface{}{
+		"sub": userID,
+		"aal": s.assuranceLevel,
+		"iat": time.Now().Unix(),
+	}
+	if !s.authTime.IsZero() {
+		claims["auth_time"] = s.authTime.Unix()
+	}
+	if s.authPending {
+		claims["pending"] = true
+	}
+	return claims, nil
+}
+
+// SignedClaims returns the session's claims (see Claims()) as a compact token
+// which is signed with the given key using HMAC-SHA256. The token consists of
+// the Base64-encoded (URL-safe, unpadded) JSON claims and the Base64-encoded
+// signature, separated by a dot. It is suitable for HTTP headers. Services
+// which share the key can check it with VerifySignedClaims().
+//
+// The claims are signed, not encrypted. Anyone who receives the token can read
+// them. The key should be at least 32 bytes long and must be kept secret. It
+// should also be different from the keys used elsewhere in this package.
+func (s *Session) SignedClaims(key []byte) (string, error) {
+	if len(key) == 0 {
+		return "", errors.New("No claims key provided")
+	}
+	claims, err := s.Claims()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("Unable to encode claims: %s", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signClaims(key, encoded)), nil
+}
+
+// VerifySignedClaims checks a token generated by Session.SignedClaims() with
+// the given key and returns its claims. If "maxAge" is positive, tokens which
+// were issued longer ago than that are rejected. ErrInvalidClaims is returned
+// if the token cannot be verified.
+//
+// Note that the claims are decoded from JSON. Numbers, including numeric user
+// IDs, are therefore float64 values.
+func VerifySignedClaims(token string, key []byte, maxAge time.Duration) (map[string]interface{}, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || len(key) == 0 {
+		return nil, ErrInvalidClaims
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, signClaims(key, encoded)) {
+		return nil, ErrInvalidClaims
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidClaims
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidClaims
+	}
+	issued, ok := claims["iat"].(float64)
+	if !ok {
+		return nil, ErrInvalidClaims
+	}
+	if maxAge > 0 && time.Since(time.Unix(int64(issued), 0)) > maxAge {
+		return nil, ErrInvalidClaims
+	}
+	return claims, nil
+}
+
+// signClaims returns the HMAC-SHA256 of the encoded claims.
+func signClaims(key []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,84 @@
+package sessions
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test claims of the session user.
+func TestSessionClaims(t *testing.T) {
+	defer reset()
+	session := &Session{id: sessionID, data: make(map[string]interface{})}
+	if _, err := session.Claims(); err == nil {
+		t.Error("Claims were returned without a user")
+	}
+	session.user = &TestUser{ID: "12345"}
+	session.assuranceLevel = 2
+	claims, err := session.Claims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "12345" || claims["aal"] != 2 || claims["auth_time"] != nil || claims["pending"] != nil {
+		t.Errorf("Unexpected claims %v", claims)
+	}
+	session.authTime = time.Unix(1500000000, 0)
+	if claims, _ = session.Claims(); claims["auth_time"] != int64(1500000000) {
+		t.Errorf("Unexpected authentication time in claims %v", claims)
+	}
+	session.authPending = true
+	if claims, _ = session.Claims(); claims["pending"] != true {
+		t.Errorf("Pending authentication is missing in claims %v", claims)
+	}
+}
+
+// Test signing and verifying claims.
+func TestSignedClaims(t *testing.T) {
+	defer reset()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	session := &Session{id: sessionID, user: &TestUser{ID: "12345"}, assuranceLevel: 1, data: make(map[string]interface{})}
+	token, err := session.SignedClaims(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := VerifySignedClaims(token, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "12345" || claims["aal"] != 1.0 {
+		t.Errorf("Unexpected claims %v", claims)
+	}
+
+	// Rejected tokens.
+	encoded, signature, _ := strings.Cut(token, ".")
+	for name, tampered := range map[string]string{
+		"wrong key":     "",
+		"modified":      encoded + "x." + signature,
+		"no signature":  encoded,
+		"bad signature": encoded + ".!!!",
+	} {
+		verifyKey := key
+		if tampered == "" {
+			tampered, verifyKey = token, []byte("another key")
+		}
+		if _, err := VerifySignedClaims(tampered, verifyKey, 0); !errors.Is(err, ErrInvalidClaims) {
+			t.Errorf("Token with %s was not rejected: %v", name, err)
+		}
+	}
+
+	// Expired tokens.
+	old := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"12345","aal":1,"iat":%d}`, time.Now().Add(-time.Hour).Unix())))
+	old += "." + base64.RawURLEncoding.EncodeToString(signClaims(key, old))
+	if _, err := VerifySignedClaims(old, key, time.Minute); !errors.Is(err, ErrInvalidClaims) {
+		t.Errorf("Expired token was not rejected: %v", err)
+	}
+	if _, err := VerifySignedClaims(old, key, 0); err != nil {
+		t.Errorf("Token without age limit was rejected: %s", err)
+	}
+	if _, err := session.SignedClaims(nil); err == nil {
+		t.Error("Claims were signed without a key")
+	}
+}
@@ -0,0 +1,62 @@
+package sessions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// gzipWriters holds gzip writers for reuse because they are expensive to
+// allocate.
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		writer, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return writer
+	},
+}
+
+// compressSession gzip-compresses a serialized session if CompressSessions is
+// true and if the session is at least CompressSessionsThreshold bytes long.
+// The serialized session is returned unchanged if compression is disabled or
+// if it would not make the session smaller.
+func compressSession(serialized []byte) ([]byte, error) {
+	if !CompressSessions || len(serialized) < CompressSessionsThreshold {
+		return serialized, nil
+	}
+	var buffer bytes.Buffer
+	writer := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(writer)
+	writer.Reset(&buffer)
+	if _, err := writer.Write(serialized); err != nil {
+		return nil, fmt.Errorf("Unable to compress session: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("Unable to compress session: %s", err)
+	}
+	if buffer.Len() >= len(serialized) {
+		return serialized, nil
+	}
+	return buffer.Bytes(), nil
+}
+
+// decompressSession reverses compressSession(). Compressed sessions are
+// recognized by the gzip header. Neither the gob nor the binary format can
+// start with it because their first byte is a small length or version number.
+// Other data is returned unchanged, regardless of CompressSessions, so sessions
+// remain readable when compression is turned on or off.
+func decompressSession(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress session: %s", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress session: %s", err)
+	}
+	return decompressed, nil
+}
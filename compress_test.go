@@ -0,0 +1,93 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+)
+
+// compressTestSession returns a session with a lot of data.
+func compressTestSession() *Session {
+	session := binaryTestSession()
+	session.user = nil
+	session.data["text"] = strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100)
+	return session
+}
+
+// Test compressing serialized sessions.
+func TestCompressSessions(t *testing.T) {
+	defer reset()
+	session := compressTestSession()
+	uncompressedGob, err := session.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressedBinary, err := session.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CompressSessions = true
+	compressedGob, err := session.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedBinary, err := session.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressedGob) >= len(uncompressedGob) || len(compressedBinary) >= len(uncompressedBinary) {
+		t.Errorf("Sessions were not compressed: gob %d -> %d bytes, binary %d -> %d bytes",
+			len(uncompressedGob), len(compressedGob), len(uncompressedBinary), len(compressedBinary))
+	}
+
+	// Compressed sessions can be decoded even without CompressSessions.
+	CompressSessions = false
+	var fromGob, fromBinary Session
+	if err := fromGob.GobDecode(compressedGob); err != nil {
+		t.Fatal(err)
+	}
+	if err := fromBinary.UnmarshalBinary(compressedBinary); err != nil {
+		t.Fatal(err)
+	}
+	if !session.Equal(&fromGob) || !session.Equal(&fromBinary) {
+		t.Error("Decompressed sessions differ from the original session")
+	}
+
+	// Small sessions are not compressed.
+	CompressSessions = true
+	small := &Session{data: map[string]interface{}{"a": 1}}
+	serialized, err := small.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serialized) >= CompressSessionsThreshold || serialized[0] == 0x1f {
+		t.Errorf("Small session was compressed: %v", serialized)
+	}
+}
+
+// Benchmark the encoding and decoding of a large session with and without
+// compression. The resulting session sizes are reported.
+func BenchmarkCompressSessions(b *testing.B) {
+	defer reset()
+	session := compressTestSession()
+	for _, compress := range []bool{false, true} {
+		name := "uncompressed"
+		if compress {
+			name = "compressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			CompressSessions = compress
+			for i := 0; i < b.N; i++ {
+				data, err := session.MarshalBinary()
+				if err != nil {
+					b.Fatal(err)
+				}
+				var recovered Session
+				if err := recovered.UnmarshalBinary(data); err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(len(data)), "bytes/session")
+			}
+		})
+	}
+}
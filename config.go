@@ -1,8 +1,12 @@
 package sessions
 
 import (
+	"fmt"
+	"io"
 	"math"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -15,6 +19,28 @@ var (
 	// has not been accessed will be destroyed, hence logging a user out.
 	SessionExpiry time.Duration = math.MaxInt64
 
+	// SessionMaxLifetime is the maximum time which may pass after a session was
+	// started before it will be destroyed, regardless of its activity. While
+	// SessionExpiry is an idle timeout which ends sessions that are no longer
+	// used, this is an absolute timeout which limits the time an attacker can
+	// use a hijacked session (as recommended by the OWASP Session Management
+	// Cheat Sheet). Users must then log in again. Unlike SessionIDExpiry, this
+	// duration is not reset when the session ID changes. The default is
+	// "forever". For sessions stored by older versions of this package, the
+	// creation time of the current session ID is used as their start time.
+	SessionMaxLifetime time.Duration = math.MaxInt64
+
+	// RememberMeExpiry, if positive, is the idle timeout of sessions which are
+	// remembered, replacing SessionExpiry for them (see
+	// Session.SetRememberMe()). It is typically much longer than SessionExpiry,
+	// e.g. 30 days compared to 30 minutes. When this is set, sessions which are
+	// not remembered receive browser session cookies (without "Expires" and
+	// "Max-Age" attributes) so they end when the browser is closed while
+	// remembered sessions keep the cookie lifetime of NewSessionCookie. The
+	// default of 0 disables this distinction. SessionMaxLifetime applies to
+	// both kinds of sessions.
+	RememberMeExpiry time.Duration = 0
+
 	// SessionIDExpiry is the maximum duration a session ID can be used before it
 	// is changed to a new session ID. This helps prevent session hijacking. It
 	// may be set to 0, leading to a session ID change with every request.
@@ -26,13 +52,77 @@ var (
 	// conditions when multiple requests are issued at nearly the same time.
 	SessionIDExpiry = time.Hour
 
+	// SessionIDExpiryJitter spreads session ID changes over time. If many
+	// sessions are created at the same time (e.g. after a deployment), their
+	// session IDs would otherwise all be replaced at the same time later,
+	// causing a burst of load on the persistence layer. If this value is
+	// positive, each session ID will be replaced up to this duration before
+	// SessionIDExpiry. The exact amount is derived from the session ID so it
+	// remains the same for each session ID. A value of 0 (the default) disables
+	// the jitter.
+	SessionIDExpiryJitter time.Duration
+
 	// SessionIDGracePeriod is the duration for a replaced (old) session ID to
 	// remain active so multiple concurrent requests from the browser don't
 	// accidentally lead to session loss. While the default of five minutes may
 	// appear long, in a mobile context or other slow networks, it is a reasonable
 	// time.
+	//
+	// During the grace period, the old session ID is kept as a reference
+	// session in the persistence layer. Its deletion is scheduled in memory, so
+	// reference sessions of a process which is stopped remain in the data store
+	// until they are requested again or until they are purged by a cron job
+	// (see Session.Expired()). Long grace periods therefore mean more reference
+	// sessions in the data store. They also keep stolen old session IDs usable
+	// for longer. Regardless of the process, a reference session is never
+	// resolved after its grace period has ended. This value must be shorter
+	// than SessionIDExpiry (if positive) and SessionExpiry. A few minutes are
+	// sufficient for all practical purposes.
 	SessionIDGracePeriod = 5 * time.Minute
 
+	// TerminatedSessionExpiry, if positive, is the duration for which the IDs
+	// of sessions ended with Session.Destroy() (or DestroySessionsByTag()) are
+	// remembered. If a browser presents such an ID, Start() deletes the cookie
+	// and returns ErrSessionTerminated instead of treating the ID as unknown
+	// (and possibly creating a new session). This allows you to tell users that
+	// they were logged out, e.g. in another browser tab, rather than silently
+	// serving them an anonymous session. Respond to the request accordingly,
+	// e.g. with a redirect to the login page or with a status code which your
+	// client code recognizes. The browser's next request will not carry the
+	// old cookie anymore.
+	//
+	// Note that Session.LogOut() keeps the session and its ID. Use
+	// Session.Destroy() to end the session in all tabs. Terminated session IDs
+	// are only remembered by the process which destroyed the session, not by
+	// the persistence layer, so keep this duration short, e.g. a few minutes.
+	// The default of 0 disables this feature.
+	TerminatedSessionExpiry time.Duration = 0
+
+	// NearExpiryWindow, if positive, is the duration before a session's idle
+	// timeout (see SessionExpiry) within which Start() calls
+	// OnSessionNearExpiry. That is, a session which is accessed when less than
+	// this duration of its idle time remains is reported to the hook before the
+	// access resets its idle timeout. The hook is called at most once per idle
+	// period. It must be shorter than SessionExpiry. The default of 0 disables
+	// the hook.
+	NearExpiryWindow time.Duration = 0
+
+	// OnSessionNearExpiry, if set, is called by Start() for sessions which are
+	// accessed within NearExpiryWindow of their idle timeout. Server-rendered
+	// applications may use this to remember that the user was about to be
+	// logged out, e.g. to inject a keep-alive prompt into the next page. See
+	// also Session.RemainingIdleTime() for client-side timers. The hook is
+	// called before Start() returns and while neither the session nor its ID
+	// are locked so it may call the session's methods.
+	OnSessionNearExpiry func(session *Session)
+
+	// SessionIDMaxUses is the maximum number of requests which may access a
+	// session under the same session ID before it is changed to a new session
+	// ID. This may be used instead of or in addition to SessionIDExpiry if the
+	// number of requests is a better indicator of the risk of session hijacking
+	// than the time passed. A value of 0 (the default) disables this check.
+	SessionIDMaxUses = 0
+
 	// AcceptRemoteIP determines how much change of an IPv4 remote IP address is
 	// accepted before destroying a session. If set to 4, the last (4th) byte of
 	// the client's IP address may change but if the 3rd byte changes compared to
@@ -44,11 +134,74 @@ var (
 	// required to log in again. Session hijacking becomes much more difficult
 	// that way.
 	//
-	// IPv6 address or ports, while stored, are currently disregarded.
+	// This setting only applies to IPv4 addresses. Use AcceptRemoteIPv4Prefix
+	// for finer control and AcceptRemoteIPv6Prefix for IPv6 addresses. Ports
+	// are disregarded.
 	//
-	// Note that this does not work if your server runs behind a proxy.
+	// If your server runs behind a reverse proxy, request.RemoteAddr is the
+	// proxy's address. Configure TrustedProxies so the client's address is
+	// taken from the proxy's headers instead (see RemoteIPFromRequest).
 	AcceptRemoteIP = 1
 
+	// AcceptRemoteIPv4Prefix, if positive, is the number of leading bits of a
+	// client's IPv4 address which must not change between requests. For
+	// example, a value of 24 accepts changes within a /24 network. It replaces
+	// AcceptRemoteIP (where a value of 4 corresponds to a prefix of 24 bits).
+	// Values between 1 and 32 are allowed. The default of 0 falls back to
+	// AcceptRemoteIP.
+	AcceptRemoteIPv4Prefix = 0
+
+	// AcceptRemoteIPv6Prefix, if positive, is the number of leading bits of a
+	// client's IPv6 address which must not change between requests. Because
+	// IPv6 clients often change their interface identifier (the last 64 bits,
+	// see RFC 8981) and sometimes their subnet, a value of 48 or 56 is
+	// typically a good choice. Values between 1 and 128 are allowed. The
+	// default of 0 accepts any changes of IPv6 addresses.
+	AcceptRemoteIPv6Prefix = 0
+
+	// AcceptRemoteIPFamilyChange determines whether a client may switch
+	// between IPv4 and IPv6 addresses while the remote IP address is checked
+	// (see AcceptRemoteIP, AcceptRemoteIPv4Prefix, and AcceptRemoteIPv6Prefix).
+	// Addresses of different families cannot be compared. By default, such a
+	// switch is therefore treated like a change of the IP address and the
+	// session is rejected, unless the new address was used by the session
+	// before (see RemoteHistorySize). Otherwise, an attacker could bypass the
+	// check simply by using the other address family.
+	//
+	// Set this to true if your users are behind dual-stack networks which
+	// switch address families frequently. Note that this weakens the
+	// protection against session hijacking.
+	AcceptRemoteIPFamilyChange = false
+
+	// RemoteIPFromRequest determines the IP address of the client which sent a
+	// request. Start() uses it for the IP address checks (see AcceptRemoteIP)
+	// and stores it with the session. If it is nil or returns nil,
+	// request.RemoteAddr is used. The default, ForwardedRemoteIP(), evaluates
+	// the "X-Forwarded-For" and "X-Real-IP" headers of requests sent by
+	// TrustedProxies. Replace it if your proxy uses a different mechanism.
+	RemoteIPFromRequest func(request *http.Request) net.IP = ForwardedRemoteIP
+
+	// TrustedProxies lists the IP addresses (e.g. "10.0.0.1") and networks in
+	// CIDR notation (e.g. "10.0.0.0/8") of the reverse proxies whose
+	// "X-Forwarded-For" and "X-Real-IP" headers are trusted by
+	// ForwardedRemoteIP(). If empty (the default), these headers are ignored
+	// because any client could forge them. Only list proxies which overwrite or
+	// append to these headers.
+	TrustedProxies []string
+
+	// RemoteHistorySize is the number of recent remote IP addresses and user
+	// agents which are remembered for each session. A request passes the checks
+	// of AcceptRemoteIP and AcceptChangingUserAgent if its IP address or user
+	// agent matches any of them, not just the most recent one. This reduces
+	// spurious logouts of clients which alternate between addresses, e.g.
+	// dual-stack clients or clients behind carrier-grade NAT. The history is
+	// stored with the session.
+	//
+	// Larger values weaken the protection against session hijacking somewhat
+	// because an attacker's request may match any of the remembered values. The
+	// default of 1 compares only the most recent IP address and user agent.
+	RemoteHistorySize = 1
+
 	// AcceptChangingUserAgent determines if the remote browser's user agent is
 	// checked for consistency. We assume that the user agent for the current
 	// session will always remain the same. If it changes, the session is
@@ -58,16 +211,190 @@ var (
 	// user agent string changes.
 	AcceptChangingUserAgent = false
 
+	// NormalizeUserAgent is applied to the user agent string before it is
+	// hashed for the comparison described in AcceptChangingUserAgent. Browsers
+	// update themselves frequently, changing the version numbers in their user
+	// agent strings. The default implementation therefore reduces all version
+	// numbers to their major version (e.g. "Chrome/118.0.5993.70" becomes
+	// "Chrome/118"). This way, sessions survive minor browser updates but not a
+	// change to a different browser or a major version upgrade.
+	//
+	// Sessions whose stored hash was computed from the full user agent string
+	// (e.g. before this function was introduced or while it was nil) are
+	// accepted if the full user agent string is unchanged. Their hash is then
+	// replaced with the hash of the normalized string.
+	//
+	// Set this to nil to compare the full user agent string.
+	NormalizeUserAgent func(userAgent string) string = normalizeUserAgent
+
+	// HashUserAgent computes the hash of the (normalized) user agent string
+	// which is stored with a session for the comparison described in
+	// AcceptChangingUserAgent. The default, FNVUserAgentHash(), is a fast 64-bit
+	// FNV-1a hash. Because it is not a cryptographic hash, a different user
+	// agent string with the same hash can be constructed. Set this to
+	// SHA256UserAgentHash to make this impractical, at a small cost of CPU time
+	// per request. You may also provide your own function, e.g. a keyed hash.
+	// The result is always stored as a 64-bit value.
+	//
+	// Changing this function changes the hashes of all user agents. Existing
+	// sessions then appear to come from a different user agent and, unless
+	// AcceptChangingUserAgent is true, they will be destroyed when they are
+	// requested next. Only change it when you can afford to log out your users
+	// or set AcceptChangingUserAgent to true during the transition (at least
+	// for SessionExpiry).
+	HashUserAgent func(userAgent string) uint64 = FNVUserAgentHash
+
+	// AcceptChangingLanguage determines if the remote browser's Accept-Language
+	// header is checked for consistency. This header is usually stable for a
+	// device. If this value is set to "false" and the header changes compared to
+	// the last request, the session is destroyed. Note that users may change
+	// their language settings legitimately, leading to a logout.
+	//
+	// The default is "true", i.e. the header is not checked.
+	AcceptChangingLanguage = true
+
+	// AcceptMissingLanguage determines whether a session remains valid if a
+	// request does not contain an Accept-Language header even though previous
+	// requests did. This is only relevant if AcceptChangingLanguage is "false".
+	AcceptMissingLanguage = true
+
+	// TLSFingerprint, if set, returns a fingerprint of the TLS connection of the
+	// given request, e.g. a JA3 hash or a string derived from the cipher suite
+	// and TLS version in request.TLS. The fingerprint is recorded when a session
+	// is created. If it changes in subsequent requests, the session is
+	// destroyed. Sessions without a recorded fingerprint are not checked.
+	//
+	// The Go standard library exposes only limited information about the TLS
+	// handshake. This function therefore allows you to plug in richer
+	// fingerprints, e.g. computed by a TLS-terminating proxy. If nil (the
+	// default), TLS fingerprints are not recorded or checked.
+	TLSFingerprint func(request *http.Request) string
+
+	// Locator, if set, determines the approximate location of clients from
+	// their IP addresses. The location is recorded when a session is created and
+	// whenever the client's IP address changes. It is stored with the session
+	// and can be retrieved with Session.Location(), e.g. to show users where
+	// they are logged in. Trusted devices also record their location (see
+	// TrustedDevice). The location has no influence on the validity of a
+	// session.
+	//
+	// This package does not include a geolocation database. Implement the
+	// GeoLocator interface to connect one. If nil (the default), locations are
+	// not determined.
+	Locator GeoLocator
+
+	// OnUnknownSessionID, if set, is called by Start() when the browser sent a
+	// correctly formatted session ID for which no session exists. Repeated
+	// calls for the same client may indicate that someone is trying to guess
+	// session IDs. You may use this function to feed an intrusion detection
+	// system or a rate limiter. It is called after the session ID was unlocked
+	// and it is not called for malformed session IDs.
+	OnUnknownSessionID func(id string, request *http.Request)
+
+	// Log, if set, receives diagnostic messages about problems which this
+	// package cannot report to the caller, e.g. errors which occur in
+	// background goroutines such as the deletion of reference sessions or the
+	// retries of WriteBehind. It also receives warnings about sessions rejected
+	// because of anomalies (see EventHooks.OnAnomalyDetected) and debug
+	// messages about sessions evicted from the cache. Assign a *slog.Logger or
+	// any other Logger implementation. If nil (the default), nothing is logged.
+	Log Logger
+
+	// MetricsSink, if set, receives metrics about the sessions handled by this
+	// package: the number of created sessions, cache hits, misses, and
+	// evictions, the number of cached sessions, sessions rejected because of
+	// anomalies, and the latency of the persistence layer (see the Metric
+	// constants). Use the "prometheus" subpackage to expose them to a
+	// Prometheus server or implement the Metrics interface for other systems.
+	// If nil (the default), no metrics are collected. See also Stats().
+	MetricsSink Metrics
+
+	// Events contains hooks which are called when sessions are created,
+	// destroyed, or rejected because of anomalies, when their IDs change, and
+	// when users log in or out (see EventHooks). Use them, for example, to
+	// collect metrics or to feed a monitoring system. For a ready-made audit
+	// trail, see AuditLogger.
+	Events EventHooks
+
+	// AuditLogger, if set, receives an audit trail of security-relevant events
+	// as JSON lines, one AuditRecord per line: the creation and destruction of
+	// sessions, logins and logouts, session ID changes, sessions rejected by
+	// Start() (e.g. because the remote IP address changed), and unknown session
+	// IDs. Each record contains the time, the session ID, the user ID, and the
+	// client's IP address where available. Writes are serialized so the writer
+	// need not be thread-safe. Write errors are ignored.
+	//
+	// Note that for the user ID to be included, it must be serializable to
+	// JSON. If nil (the default), no audit records are written.
+	AuditLogger io.Writer
+
+	// AuditMaskSessionIDs determines whether session IDs are masked in the
+	// records written to AuditLogger. If true, each session ID is replaced by
+	// the result of MaskSessionID() from which it cannot be recovered. Records
+	// concerning the same session can still be correlated. Use this if your
+	// audit log is accessible to more people than your session store.
+	AuditMaskSessionIDs = false
+
+	// SessionIDMaskPrefix determines how MaskSessionID() redacts session IDs.
+	// If 0 (the default), a session ID is replaced by a 16-character hex hash.
+	// If positive, this is the number of leading characters of the session ID
+	// which are kept, followed by "...". Such prefixes are easier to match
+	// against cookies when debugging but every revealed character makes the
+	// rest of the ID easier to guess. Keep this value small, e.g. 6. It must be
+	// less than 12, half the length of a session ID.
+	SessionIDMaskPrefix = 0
+
+	// RedirectCookieOnce determines how often the session cookie is changed when
+	// a browser requests a session with an old session ID (i.e. during the
+	// SessionIDGracePeriod after a session ID change). If false (the default),
+	// every such request results in a "Set-Cookie" header with the new session
+	// ID. If true, this header is only sent in the response to the first such
+	// request, reducing cookie churn. However, if that response does not reach
+	// the browser (e.g. because the request was aborted), the browser will not
+	// receive the new session ID and the session will be lost after the grace
+	// period.
+	//
+	// The information whether the cookie was already redirected is kept only in
+	// the local cache. Without a cache (MaxSessionCacheSize is 0), the cookie is
+	// always redirected.
+	RedirectCookieOnce = false
+
+	// SkipCreateFor, if not nil, is called by Start() before a new session is
+	// created. If it returns true, no session is created and no cookie is set,
+	// as if Start() had been called with "createIfNew" set to false. Existing
+	// sessions are not affected. This may be used to keep crawlers and other
+	// bots from filling the data store with sessions which are never used
+	// again, for example:
+	//
+	//     SkipCreateFor = func(request *http.Request) bool {
+	//       return ParseUserAgent(request.UserAgent()).Bot
+	//     }
+	SkipCreateFor func(request *http.Request) bool
+
 	// SessionCookie is the name of the session cookie that will contain the
 	// session ID.
 	SessionCookie = "id"
 
+	// SessionCookieAliases are former names of the session cookie. They allow
+	// you to rename the session cookie (SessionCookie) without logging out all
+	// users. If the browser does not send a cookie named SessionCookie, Start()
+	// tries these names in order. If a cookie is found under one of them, its
+	// session ID is moved to a cookie named SessionCookie and the cookie with the
+	// old name is deleted. Once all browsers have visited your site (or their
+	// sessions have expired), the alias may be removed.
+	//
+	// The cookies with the old names are assumed to have the same path and
+	// domain as the current session cookie (see SessionCookieFor()). Otherwise,
+	// browsers will not delete them.
+	SessionCookieAliases []string
+
 	// NewSessionCookie is used to create new session cookies or to renew them.
 	// The "Name" and "Value" fields need not be set. It is recommended that you
 	// overwrite the default implementation with your specific defaults,
-	// especially the "Domain", "Path", and "Secure" fields. Be sure to set
-	// "Secure" to true when using TLS (HTTPS). For more information on cookies,
-	// refer to:
+	// especially the "Domain", "Path", "Secure", and "SameSite" fields. Be sure
+	// to set "Secure" to true when using TLS (HTTPS). StrictCookieDefaults()
+	// provides a starting point for production use. For more information on
+	// cookies, refer to:
 	//
 	//     - https://tools.ietf.org/html/rfc6265
 	//     - https://en.wikipedia.org/wiki/HTTP_cookie#Cookie_attributes
@@ -78,24 +405,471 @@ var (
 			HttpOnly: true,
 
 			// Uncomment and edit the following fields for production use:
-			//Domain: "www.example.com",
-			//Path:   "/",
-			//Secure: true,
+			//Domain:   "www.example.com",
+			//Path:     "/",
+			//Secure:   true,
+			//SameSite: http.SameSiteLaxMode,
 		}
 	}
 
+	// CookieSameSite, if not 0, is the "SameSite" attribute of all session
+	// cookies, including the cookies which replace the session ID (see
+	// Session.RegenerateID()) or delete the session cookie (see
+	// Session.Destroy()). It overrides the attribute set by NewSessionCookie or
+	// NewSessionCookieForRequest. http.SameSiteLaxMode is a good choice for
+	// most websites. http.SameSiteStrictMode also withholds the cookie when
+	// users follow links from other websites, i.e. they will appear to be
+	// logged out. Browsers only accept http.SameSiteNoneMode for "Secure"
+	// cookies. If PartitionedCookies is true, this setting is ignored. The
+	// default of 0 leaves the attribute to the cookie functions.
+	CookieSameSite http.SameSite = 0
+
+	// DeletedCookieValue is the value of the cookie which is sent to the
+	// browser to delete the session cookie, e.g. when a session is destroyed.
+	// Browsers discard the cookie anyway because it has already expired but
+	// some proxies or web application firewalls log or react to specific
+	// values. An empty value is allowed. The deleting cookie's other attributes
+	// (e.g. "Path", "Domain", "Secure", and "SameSite") are taken from
+	// SessionCookieFor() so they match those of the original cookie. Otherwise,
+	// browsers would not delete it.
+	DeletedCookieValue = "deleted"
+
+	// ScopedCSRFTokenExpiry is the time after which a CSRF token issued by
+	// Session.CSRFTokenFor() expires.
+	ScopedCSRFTokenExpiry = time.Hour
+
+	// MaxScopedCSRFTokens is the maximum number of scoped CSRF tokens (see
+	// Session.CSRFTokenFor()) stored in a session. It limits the growth of
+	// sessions whose users open many different forms. When the limit is
+	// reached, the token which expires first is removed.
+	MaxScopedCSRFTokens = 32
+
+	// UserIntegrityKey is an optional secret key which protects against
+	// persistence layers returning the wrong session for a session ID, e.g.
+	// because of a bug or a misconfigured cache in front of the data store. If
+	// set, each serialized session carries an HMAC (keyed with this value)
+	// over its session ID and the ID of its user. When a session is loaded
+	// from the persistence layer, the HMAC is checked against the requested
+	// session ID. On a mismatch, the session is not used and an error wrapping
+	// ErrUserMismatch is returned, e.g. by Start(), instead of serving one
+	// user's session to another user.
+	//
+	// Sessions without a user and sessions which were saved before the key was
+	// set are not checked. Changing the key causes the check of all existing
+	// sessions with users to fail. The key should be at least 32 bytes long.
+	UserIntegrityKey []byte
+
+	// TrustedDeviceCookie is the name of the cookie which contains the token of
+	// a trusted device (see IssueTrustedDevice()). The cookie's other attributes
+	// are taken from SessionCookieFor().
+	TrustedDeviceCookie = "trusteddevice"
+
+	// TrustedDeviceExpiry is the duration for which a device remains trusted
+	// after IssueTrustedDevice() was called. After that, users will have to
+	// go through the full authentication again (e.g. two-factor authentication)
+	// on that device.
+	TrustedDeviceExpiry = 30 * 24 * time.Hour
+
+	// AutoRegisterGobTypes causes the types of all values stored in sessions
+	// with Session.Set() or Session.Swap() to be registered with encoding/gob
+	// (see also RegisterCommonTypes(), which is called, too). This avoids "type
+	// not registered" errors when sessions are serialized with GobEncode(). The
+	// default is false.
+	//
+	// Note that gob registrations are global to the process and cannot be
+	// undone. And types are only registered when a value is stored. If sessions
+	// are decoded in a different process (e.g. after a restart or on another
+	// machine) before a value of the same type was stored there, decoding still
+	// fails. Therefore, your own types should still be registered with
+	// gob.Register() when your program starts.
+	AutoRegisterGobTypes = false
+
+	// SealKey is the key used to encrypt the data of sealed sessions (see
+	// Session.Seal()) with AES-GCM. It must be 16, 24, or 32 bytes long,
+	// selecting AES-128, AES-192, or AES-256. If it is nil, sessions cannot be
+	// sealed and the data of sealed sessions cannot be accessed. An error is
+	// returned in that case (ErrNoSealKey). If the key changes, the data of
+	// sessions sealed with the previous key is lost unless that key is added
+	// to PreviousSealKeys.
+	SealKey []byte
+
+	// PreviousSealKeys contains keys which were previously used as SealKey. The
+	// data of sealed sessions is decrypted with these keys if it cannot be
+	// decrypted with SealKey. New data is always encrypted with SealKey. This
+	// allows you to rotate the seal key without losing session data. See
+	// ReEncryptSessions() for details.
+	PreviousSealKeys [][]byte
+
+	// NewSessionCookieForRequest, if not nil, is used instead of
+	// NewSessionCookie to create session cookies. It receives the request which
+	// the cookie will be sent back to. This allows you to choose the cookie's
+	// "Path" and "Domain" per area of your website, e.g. to scope sessions of an
+	// admin panel to "Path=/admin" and all other sessions to "Path=/".
+	//
+	// The function must always return the same "Path" and "Domain" for requests
+	// of the same area. Browsers only delete a cookie if the deleting cookie
+	// has the same name, path, and domain as the original one. (Browsers don't
+	// send these attributes back with the cookie so they cannot be taken from
+	// the request.) Otherwise, expired sessions and logged-out users would keep
+	// their cookies. Note also that the cookies of different areas have the same
+	// name (SessionCookie). If their paths overlap (e.g. "/" and "/admin"), the
+	// browser sends both cookies to the nested area, the most specific one
+	// first.
+	NewSessionCookieForRequest func(request *http.Request) *http.Cookie
+
+	// PartitionedCookies allows sessions to be used in cross-site iframes, e.g.
+	// in embeddable widgets. If true, session cookies (and trusted device
+	// cookies) are always sent with the attributes "SameSite=None" and
+	// "Secure", plus the "Partitioned" attribute. The latter causes browsers
+	// which support CHIPS ("Cookies Having Independent Partitioned State") to
+	// store the cookie separately for each top-level site the widget is
+	// embedded in. Browsers which block third-party cookies will still accept
+	// partitioned cookies.
+	//
+	// Note that "Secure" cookies require TLS (HTTPS), except on localhost.
+	PartitionedCookies = false
+
 	// MaxSessionCacheSize is the maximum size of the local sessions cache. If
 	// this value is 0, nothing is cached. If this value is negative, the cache
 	// may expand indefinitely. When the maximum size is reached, sessions with
 	// the oldest access time are discarded. They are also removed from the cache
 	// when their age exceeds SessionCacheExpiry. (This is checked whenever the
-	// cache is accessed.)
+	// cache is full, otherwise at most once per SessionCacheExpiry or once per
+	// minute, whichever is shorter.)
 	//
 	// Set this value to 0 if you want to rely on a different cache library. Then
 	// connect it via the persistence layer.
+	//
+	// Caution: Without a persistence layer (the default), the cache holds the
+	// only copy of each session. Sessions which are dropped from the cache are
+	// then lost, i.e. their users are logged out and their data is gone. Either
+	// configure a persistence layer or set CacheIsAuthoritative to true.
 	MaxSessionCacheSize = 1024 * 1024
 
 	// SessionCacheExpiry is the maximum duration an inactive session will remain
 	// in the local cache.
 	SessionCacheExpiry = time.Hour
+
+	// SessionCacheMaxAge, if positive, is the maximum time a session is served
+	// from the local cache before it is read from the persistence layer again.
+	// Unlike SessionCacheExpiry, which only evicts inactive sessions when the
+	// cache is compacted, this applies to every access: once a cached session is
+	// older than SessionCacheMaxAge, the next request for it (e.g. via Start())
+	// loads it again via Persistence.LoadSession().
+	//
+	// This is useful if your application runs on multiple nodes behind a load
+	// balancer without sticky sessions. Each node then has its own cache and a
+	// change made on one node only becomes visible on another node once that
+	// node reads the session again. SessionCacheMaxAge puts an upper bound on
+	// this delay. Shorter values mean more consistency but also more load on
+	// the persistence layer. A value of a few seconds is a reasonable start.
+	//
+	// Sessions which are waiting to be saved (see WriteBehind) are not read
+	// again. This value is ignored if CacheIsAuthoritative is true. The default
+	// of 0 means that cached sessions are used until they are dropped from the
+	// cache.
+	SessionCacheMaxAge time.Duration = 0
+
+	// InstanceID, if not empty, identifies this process, e.g. by its host name
+	// or its container ID. It is recorded in every session which this process
+	// creates or accesses and can be retrieved with Session.LastInstance(). This
+	// is for debugging only and has no influence on the validity of sessions.
+	// It helps find out whether requests for a session are handled by different
+	// nodes, e.g. behind a load balancer without sticky sessions. If empty (the
+	// default), nothing is recorded.
+	InstanceID string
+
+	// CacheIsAuthoritative treats the local cache as the only store of
+	// sessions. This is useful during development or in small applications
+	// which do not configure a persistence layer. If true, sessions are never
+	// dropped from the cache because of MaxSessionCacheSize or
+	// SessionCacheExpiry. They remain in the cache until they are destroyed or
+	// until they have expired (see Session.Expired()). The cache may therefore
+	// grow indefinitely. Note that PurgeSessions() still empties the cache.
+	// Use ExportCache() and ImportCache() to keep sessions across restarts.
+	//
+	// MaxSessionCacheSize must not be 0 if this is true.
+	CacheIsAuthoritative = false
+
+	// LazyDataLoading reduces the memory used by the local session cache. If
+	// true, sessions loaded from the persistence layer are cached without their
+	// custom data (the values stored with Session.Set()). The data is loaded
+	// from the persistence layer (see SessionDataLoader) the first time it is
+	// accessed, e.g. by Session.Get() or Session.Set(). This is useful if
+	// sessions carry a lot of data but most requests only need the session's
+	// user.
+	//
+	// The price is an additional read from the data store for each session
+	// whose data is accessed after it was loaded into the cache. Note that
+	// saving a session also requires its data, e.g. when a user logs in or
+	// when the session's ID is changed, or when the session is dropped from the
+	// cache. In the worst case, every session is therefore read twice. New
+	// sessions and sessions which are not cached (MaxSessionCacheSize is 0)
+	// always keep their data.
+	LazyDataLoading = false
+
+	// CompressSessions determines whether serialized sessions are compressed
+	// before they are handed to the persistence layer. If true, the results of
+	// Session.GobEncode() and Session.MarshalBinary() are gzip-compressed if
+	// they are at least CompressSessionsThreshold bytes long. This reduces the
+	// storage and bandwidth needed for sessions which carry a lot of data, at
+	// the cost of CPU time. Small sessions are not compressed because they
+	// would only get bigger.
+	//
+	// Compressed sessions are recognized automatically when they are decoded,
+	// regardless of this setting. It may therefore be changed at any time.
+	CompressSessions = false
+
+	// CompressSessionsThreshold is the minimum size in bytes of a serialized
+	// session to be compressed (see CompressSessions).
+	CompressSessionsThreshold = 1024
+
+	// ClearDataOnLogIn determines whether all data stored in a session is
+	// removed when a user logs into it (see Session.LogIn()). Data stored
+	// before authentication may have been planted by an attacker, e.g. in a
+	// session fixation attack, and should not be trusted afterwards. Values
+	// which are meant to survive the login (e.g. a shopping cart) must be
+	// stored with Session.SetAnon() instead of Session.Set(). The default is
+	// false, i.e. all data is kept.
+	ClearDataOnLogIn = false
+
+	// MaxSessionKeys is the maximum number of keys a session may hold. If a
+	// new key would exceed this limit, Session.Set() and Session.Swap() return
+	// ErrTooManyKeys and the session remains unchanged. Existing keys may
+	// always be overwritten. This protects the persistence layer and the
+	// serializer from sessions which are stuffed with large numbers of keys.
+	// Keys used internally, e.g. for CSRF tokens or anonymous values (see
+	// Session.SetAnon()), are counted, too. A value of 0 (the default) means
+	// that there is no limit.
+	MaxSessionKeys = 0
+
+	// LazyUserLoading defers loading the user of a session. If false (the
+	// default), Persistence.LoadUser() is called as soon as a session with a
+	// user is decoded, e.g. when it is loaded from the persistence layer. If
+	// true, only the user ID is kept and Persistence.LoadUser() is called the
+	// first time the user is needed, e.g. by Session.User(). The result is
+	// kept with the session. This avoids queries to the user store for requests
+	// which only need the session data or for sessions which are loaded in
+	// bulk. Functions which only need the user ID (e.g. IsUserLoggedIn()) do
+	// not load the user.
+	//
+	// Note that with lazy loading, errors returned by Persistence.LoadUser()
+	// do not prevent a session from being loaded. Instead, Session.User()
+	// returns nil in that case.
+	LazyUserLoading = false
+
+	// OnLoadUserError, if not nil, is called when Persistence.LoadUser() fails
+	// to load the user of a session, e.g. because the user store is
+	// temporarily unavailable. It receives the user ID and the error and
+	// returns the result to be used instead:
+	//
+	//   - Return the error (or another error) to fail the loading of the
+	//     session. This is what happens if OnLoadUserError is nil.
+	//   - Return a nil user and a nil error to load the session without a user.
+	//     The session then behaves as if the user had logged out. If it is
+	//     saved afterwards, the user ID is lost, too.
+	//   - Return a user, e.g. after retrying Persistence.LoadUser().
+	//
+	// With LazyUserLoading, this function is called when the user is first
+	// needed rather than when the session is loaded.
+	OnLoadUserError func(id interface{}, err error) (User, error)
+
+	// BackgroundMutexPurge determines whether a background goroutine regularly
+	// removes stale session ID locks from memory. If false, stale locks are only
+	// removed when their number grows too large. You may want to disable this in
+	// short-lived processes. Because the goroutine is started when the package
+	// is initialized, a change of this value only takes effect after a call to
+	// Close().
+	BackgroundMutexPurge = true
+
+	// MeasureLockWaits determines whether statistics are collected about the
+	// locks which this package holds on session IDs, e.g. while a session is
+	// loaded in Start() or while its ID is changed. If true, the time spent
+	// waiting for these locks and the number of goroutines waiting for the same
+	// session ID are recorded and made available via Stats(). This helps you
+	// find out if lock contention is a source of latency in your application.
+	// Because it adds some overhead to each lock, it is disabled by default.
+	MeasureLockWaits = false
+
+	// WriteBehind determines what happens when the persistence layer fails to
+	// save a session. If false (the default), the error is returned to the
+	// caller. If true, the session is kept in the local cache and queued for a
+	// later retry, with increasing delays between attempts, until it is saved
+	// successfully. No error is returned to the caller in this case. This keeps
+	// users logged in when the data store is temporarily unavailable.
+	//
+	// Note that this weakens the durability of session changes: Queued changes
+	// are lost if the program exits before the data store recovers. Other
+	// machines will not see queued changes either. Use PendingWrites() to find
+	// out how many sessions are waiting to be saved.
+	WriteBehind = false
+
+	// WriteBehindQueueSize is the maximum number of sessions which are queued
+	// for a retry when WriteBehind is true. If the queue is full, errors from
+	// the persistence layer are returned to the caller again.
+	WriteBehindQueueSize = 1024
+
+	// UseBuiltInPasswordLists determines whether password checks (see
+	// ReasonablePassword() and PasswordPolicy.Check()) use the built-in English
+	// dictionary and the built-in list of common compromised passwords. Set it
+	// to false if these lists don't fit your users, e.g. for non-English
+	// deployments, and register your own lists with AddPasswordDictionary() and
+	// AddCompromisedPasswords().
+	UseBuiltInPasswordLists = true
+
+	// CompromisedPasswords, if set, is consulted by ReasonablePassword() and
+	// PasswordPolicy.Check() (if CheckBreached is true) in addition to the
+	// embedded list of the 100,000 most common compromised passwords. Use
+	// HIBPChecker for the "Have I Been Pwned" database with hundreds of
+	// millions of passwords. Note that this may cause a network request for
+	// every password checked. If the checker fails, the password is not
+	// considered compromised and the error is logged (see Log).
+	// AnalyzePassword() only consults it if AnalyzeCompromisedPasswords is
+	// true.
+	CompromisedPasswords CompromisedPasswordChecker
+
+	// AnalyzeCompromisedPasswords determines whether AnalyzePassword() consults
+	// CompromisedPasswords. AnalyzePassword() is typically used for strength
+	// meters which analyze the password with every keystroke, so this is
+	// disabled by default to avoid sending a request to an external service for
+	// every partial password. The built-in and registered lists of compromised
+	// passwords are checked either way.
+	AnalyzeCompromisedPasswords = false
+
+	// PasswordHashParameters are the parameters used by HashPassword(). The
+	// defaults follow the second recommendation of RFC 9106 (64 MiB of memory,
+	// 3 iterations, 4 lanes). Each hash then takes a noticeable amount of time
+	// and memory, which is the point of it. If your servers cannot afford this,
+	// lower the memory first (but not below 19 MiB with 2 iterations, following
+	// the OWASP Password Storage Cheat Sheet). Changing the parameters does not
+	// invalidate existing hashes but PasswordNeedsRehash() will report them.
+	// Hashes with more than 2 GiB of memory, 64 iterations, or 64 lanes are
+	// rejected by VerifyPassword().
+	PasswordHashParameters = Argon2Parameters{
+		Iterations:  3,
+		Memory:      64 * 1024,
+		Parallelism: 4,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
 )
+
+// ValidateConfig checks the package configuration variables for values which
+// are invalid or which contradict each other, e.g. a SessionIDGracePeriod
+// which is not shorter than the SessionIDExpiry. Such misconfigurations lead to
+// symptoms which are hard to diagnose (for example, users who are logged out
+// seemingly at random). It is recommended that you call this function after
+// configuring the package and that you abort the program if it returns an
+// error.
+//
+// All problems found are described in the returned error. If the configuration
+// is consistent, nil is returned.
+func ValidateConfig() error {
+	var problems []string
+	if Persistence == nil {
+		problems = append(problems, "Persistence must not be nil")
+	}
+	if SessionExpiry < 0 {
+		problems = append(problems, "SessionExpiry must not be negative")
+	}
+	if p := PasswordHashParameters; p.Iterations < 1 || p.Parallelism < 1 || p.Memory < 8*uint32(p.Parallelism) || p.SaltLength < 8 || p.KeyLength < 16 {
+		problems = append(problems, "PasswordHashParameters require at least 1 iteration and lane, 8 KiB of memory per lane, 8 bytes of salt, and 16 bytes of key")
+	}
+	if p := PasswordHashParameters; p.Iterations > maxArgon2Iterations || p.Parallelism > maxArgon2Parallelism || p.Memory > maxArgon2Memory {
+		problems = append(problems, fmt.Sprintf("PasswordHashParameters must not exceed %d iterations, %d lanes, and %d KiB of memory", maxArgon2Iterations, maxArgon2Parallelism, maxArgon2Memory))
+	}
+	if SessionMaxLifetime < 0 {
+		problems = append(problems, "SessionMaxLifetime must not be negative")
+	}
+	if RememberMeExpiry < 0 {
+		problems = append(problems, "RememberMeExpiry must not be negative")
+	}
+	if SessionIDExpiry < 0 {
+		problems = append(problems, "SessionIDExpiry must not be negative")
+	}
+	if SessionIDExpiryJitter < 0 || SessionIDExpiryJitter > SessionIDExpiry {
+		problems = append(problems, fmt.Sprintf("SessionIDExpiryJitter (%s) must be between 0 and SessionIDExpiry (%s)", SessionIDExpiryJitter, SessionIDExpiry))
+	}
+	if TerminatedSessionExpiry < 0 {
+		problems = append(problems, "TerminatedSessionExpiry must not be negative")
+	}
+	if NearExpiryWindow < 0 || NearExpiryWindow > 0 && NearExpiryWindow >= SessionExpiry {
+		problems = append(problems, fmt.Sprintf("NearExpiryWindow (%s) must be between 0 and SessionExpiry (%s)", NearExpiryWindow, SessionExpiry))
+	}
+	if SessionIDMaxUses < 0 {
+		problems = append(problems, "SessionIDMaxUses must not be negative")
+	}
+	if SessionIDGracePeriod < 0 {
+		problems = append(problems, "SessionIDGracePeriod must not be negative")
+	}
+	if SessionIDExpiry > 0 && SessionIDGracePeriod >= SessionIDExpiry {
+		problems = append(problems, fmt.Sprintf("SessionIDGracePeriod (%s) must be shorter than SessionIDExpiry (%s)", SessionIDGracePeriod, SessionIDExpiry))
+	}
+	if SessionIDGracePeriod >= SessionExpiry {
+		problems = append(problems, fmt.Sprintf("SessionIDGracePeriod (%s) must be shorter than SessionExpiry (%s)", SessionIDGracePeriod, SessionExpiry))
+	}
+	if SessionExpiry < SessionIDExpiry {
+		problems = append(problems, fmt.Sprintf("SessionExpiry (%s) must not be shorter than SessionIDExpiry (%s)", SessionExpiry, SessionIDExpiry))
+	}
+	if AcceptRemoteIP < 1 || AcceptRemoteIP > 4 {
+		problems = append(problems, fmt.Sprintf("AcceptRemoteIP (%d) must be between 1 and 4", AcceptRemoteIP))
+	}
+	if SessionCookie == "" {
+		problems = append(problems, "SessionCookie must not be empty")
+	}
+	if AcceptRemoteIPv4Prefix < 0 || AcceptRemoteIPv4Prefix > 32 {
+		problems = append(problems, fmt.Sprintf("AcceptRemoteIPv4Prefix (%d) must be between 0 and 32", AcceptRemoteIPv4Prefix))
+	}
+	if AcceptRemoteIPv6Prefix < 0 || AcceptRemoteIPv6Prefix > 128 {
+		problems = append(problems, fmt.Sprintf("AcceptRemoteIPv6Prefix (%d) must be between 0 and 128", AcceptRemoteIPv6Prefix))
+	}
+	for _, proxy := range TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				problems = append(problems, fmt.Sprintf("TrustedProxies contains an invalid address or network: %q", proxy))
+			}
+		}
+	}
+	for _, alias := range SessionCookieAliases {
+		if alias == "" || alias == SessionCookie {
+			problems = append(problems, "SessionCookieAliases must not contain empty names or SessionCookie")
+			break
+		}
+	}
+	if NewSessionCookie == nil {
+		problems = append(problems, "NewSessionCookie must not be nil")
+	}
+	if TrustedDeviceCookie == "" || TrustedDeviceCookie == SessionCookie {
+		problems = append(problems, "TrustedDeviceCookie must not be empty and must differ from SessionCookie")
+	}
+	if TrustedDeviceExpiry <= 0 {
+		problems = append(problems, "TrustedDeviceExpiry must be positive")
+	}
+	if SealKey != nil && len(SealKey) != 16 && len(SealKey) != 24 && len(SealKey) != 32 {
+		problems = append(problems, fmt.Sprintf("SealKey must be 16, 24, or 32 bytes long, not %d", len(SealKey)))
+	}
+	for _, key := range PreviousSealKeys {
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			problems = append(problems, fmt.Sprintf("PreviousSealKeys must be 16, 24, or 32 bytes long, not %d", len(key)))
+		}
+	}
+	if UserIntegrityKey != nil && len(UserIntegrityKey) < 16 {
+		problems = append(problems, fmt.Sprintf("UserIntegrityKey must be at least 16 bytes long, not %d", len(UserIntegrityKey)))
+	}
+	if SessionCacheExpiry < 0 {
+		problems = append(problems, "SessionCacheExpiry must not be negative")
+	}
+	if SessionIDMaskPrefix < 0 || SessionIDMaskPrefix >= 12 {
+		problems = append(problems, fmt.Sprintf("SessionIDMaskPrefix must be between 0 and 11, not %d", SessionIDMaskPrefix))
+	}
+	if SessionCacheMaxAge < 0 {
+		problems = append(problems, "SessionCacheMaxAge must not be negative")
+	}
+	if CacheIsAuthoritative && MaxSessionCacheSize == 0 {
+		problems = append(problems, "MaxSessionCacheSize must not be 0 if CacheIsAuthoritative is true")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid sessions configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
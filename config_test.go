@@ -0,0 +1,45 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test validation of the package configuration.
+func TestValidateConfig(t *testing.T) {
+	defer reset()
+	if err := ValidateConfig(); err != nil {
+		t.Errorf("Default configuration is invalid: %s", err)
+	}
+	SessionIDExpiry = time.Minute
+	SessionIDGracePeriod = time.Hour
+	SessionExpiry = time.Second
+	CacheIsAuthoritative = true
+	MaxSessionCacheSize = 0
+	SessionCacheMaxAge = -time.Second
+	NearExpiryWindow = time.Minute
+	SessionCookieAliases = []string{SessionCookie}
+	TrustedProxies = []string{"10.0.0.0/33"}
+	AcceptRemoteIPv6Prefix = 129
+	SessionMaxLifetime = -time.Second
+	RememberMeExpiry = -time.Second
+	PasswordHashParameters.SaltLength = 4
+	err := ValidateConfig()
+	if err == nil {
+		t.Error("Invalid configuration was not detected")
+		return
+	}
+	for _, name := range []string{"SessionIDGracePeriod", "SessionExpiry", "CacheIsAuthoritative", "SessionCacheMaxAge", "NearExpiryWindow", "SessionCookieAliases", "TrustedProxies", "AcceptRemoteIPv6Prefix", "SessionMaxLifetime", "RememberMeExpiry", "PasswordHashParameters"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Error does not mention %s: %s", name, err)
+		}
+	}
+
+	// Hashing parameters which VerifyPassword() would reject.
+	reset()
+	PasswordHashParameters.Iterations = maxArgon2Iterations + 1
+	if err := ValidateConfig(); err == nil || !strings.Contains(err.Error(), "must not exceed") {
+		t.Errorf("Excessive PasswordHashParameters were not detected: %v", err)
+	}
+}
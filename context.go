@@ -0,0 +1,143 @@
+package sessions
+
+import (
+	"context"
+	"net/http"
+)
+
+// contextKey is the type of keys used to store values in a context.
+type contextKey int
+
+// Keys for values stored in a context.
+const (
+	sessionContextKey contextKey = iota // The key for the current session.
+)
+
+// NewContext returns a copy of the given context which carries the given
+// session. Use FromContext() to retrieve it again.
+func NewContext(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey, session)
+}
+
+// FromContext returns the session stored in the given context with
+// NewContext(). The second return value is false if there is none.
+func FromContext(ctx context.Context) (*Session, bool) {
+	session, _ := ctx.Value(sessionContextKey).(*Session)
+	return session, session != nil
+}
+
+// UserFromContext returns the user of the session stored in the given context
+// (see NewContext()). The second return value is false if there is no session
+// in the context or if no user is logged into the session. Users whose
+// authentication is still pending (see Session.LogInPending()) are not
+// returned.
+func UserFromContext(ctx context.Context) (User, bool) {
+	session, ok := FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	user := session.EffectiveUser()
+	if user == nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// Middleware returns an HTTP handler which starts the session for each request
+// (see Start()) and adds it to the request's context (see NewContext()) before
+// calling the "next" handler. Handlers further down the chain can then
+// retrieve the session with FromContext() instead of calling Start()
+// themselves. If "createIfNew" is false, requests without a session are passed
+// on without a session in their context. If the context already contains a
+// session, Start() is not called again. If Start() fails, the handler responds
+// with a "500 Internal Server Error" status.
+//
+// Start() may set the session cookie in the response header. If the "next"
+// handler panics before it has written the response header, the handler
+// responds with a "500 Internal Server Error" status which still carries the
+// session cookie, so a new or replaced session ID is not lost. The panic is
+// then passed on.
+func Middleware(next http.Handler, createIfNew bool) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if _, ok := FromContext(request.Context()); !ok {
+			session, err := Start(response, request, createIfNew)
+			if err != nil {
+				http.Error(response, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if session != nil {
+				request = request.WithContext(NewContext(request.Context(), session))
+			}
+		}
+
+		writer := &headerTrackingWriter{ResponseWriter: response}
+		defer func() {
+			if err := recover(); err != nil {
+				if !writer.wroteHeader && err != http.ErrAbortHandler {
+					http.Error(response, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					http.NewResponseController(response).Flush()
+				}
+				panic(err)
+			}
+		}()
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// headerTrackingWriter is a response writer which records whether the response
+// header was written.
+type headerTrackingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *headerTrackingWriter) WriteHeader(statusCode int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements http.ResponseWriter.
+func (w *headerTrackingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher.
+func (w *headerTrackingWriter) Flush() {
+	w.wroteHeader = true
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the original response writer so http.ResponseController can
+// access its optional features, e.g. flushing.
+func (w *headerTrackingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// RequireUser returns an HTTP handler which calls the "next" handler only if a
+// user is logged into the current session and their authentication is not
+// pending. Otherwise, it responds with a "401 Unauthorized" status.
+//
+// The current session is taken from the request's context (see NewContext()).
+// If the context does not contain a session, Start() is called and the
+// resulting session is added to the context passed on to the "next" handler.
+func RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if _, ok := FromContext(request.Context()); !ok {
+			session, err := Start(response, request, false)
+			if err != nil {
+				http.Error(response, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if session != nil {
+				request = request.WithContext(NewContext(request.Context(), session))
+			}
+		}
+		if _, ok := UserFromContext(request.Context()); !ok {
+			http.Error(response, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
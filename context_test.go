@@ -0,0 +1,112 @@
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test retrieving sessions and users from a context.
+func TestContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("Empty context returned a session")
+	}
+	if _, ok := UserFromContext(context.Background()); ok {
+		t.Error("Empty context returned a user")
+	}
+	if _, ok := FromContext(NewContext(context.Background(), nil)); ok {
+		t.Error("Context with a nil session returned a session")
+	}
+	session := &Session{}
+	ctx := NewContext(context.Background(), session)
+	if s, ok := FromContext(ctx); !ok || s != session {
+		t.Error("Context did not return the session")
+	}
+	if _, ok := UserFromContext(ctx); ok {
+		t.Error("Context returned a user for an anonymous session")
+	}
+	user := &TestUser{ID: "userid"}
+	session.user = user
+	if u, ok := UserFromContext(ctx); !ok || u != User(user) {
+		t.Error("Context did not return the user")
+	}
+	session.authPending = true
+	if _, ok := UserFromContext(ctx); ok {
+		t.Error("Context returned a user whose authentication is pending")
+	}
+}
+
+// Test the middleware which starts sessions.
+func TestMiddleware(t *testing.T) {
+	defer reset()
+	var session *Session
+	handler := Middleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		session, _ = FromContext(request.Context())
+		if request.URL.Path == "/panic" {
+			panic("handler failed")
+		}
+	}), true)
+
+	// A new session is created and handed to the next handler.
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+	if session == nil {
+		t.Fatal("No session in context")
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != session.id {
+		t.Errorf("Session cookie was not set: %v", cookies)
+	}
+
+	// Existing sessions in the context are kept.
+	existing := &Session{id: sessionID}
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(NewContext(req.Context(), existing))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if session != existing {
+		t.Error("Session in context was replaced")
+	}
+
+	// Panics still deliver the session cookie.
+	res = httptest.NewRecorder()
+	func() {
+		defer func() {
+			if err := recover(); err != "handler failed" {
+				t.Errorf("Unexpected panic value %v", err)
+			}
+		}()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/panic", nil))
+	}()
+	if res.Code != http.StatusInternalServerError || !res.Flushed {
+		t.Errorf("Unexpected response to panic (status %d)", res.Code)
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != session.id {
+		t.Errorf("Session cookie was not set after panic: %v", cookies)
+	}
+}
+
+// Test the middleware which requires a logged-in user.
+func TestRequireUser(t *testing.T) {
+	defer reset()
+	var called bool
+	handler := RequireUser(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		called = true
+	}))
+
+	// No session.
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("", "/", nil))
+	if called || res.Code != http.StatusUnauthorized {
+		t.Errorf("Request without session was not rejected (status %d)", res.Code)
+	}
+
+	// Session with user.
+	session := &Session{user: &TestUser{ID: "userid"}}
+	req := httptest.NewRequest("", "/", nil)
+	req = req.WithContext(NewContext(req.Context(), session))
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if !called || res.Code != http.StatusOK {
+		t.Errorf("Request with logged-in user was rejected (status %d)", res.Code)
+	}
+}
@@ -0,0 +1,222 @@
+package sessions
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SessionCookieFor returns the session cookie, without its value, which is used
+// in the response to the given request. It is created by
+// NewSessionCookieForRequest() or, if that function is nil or the request is
+// nil, by NewSessionCookie(). Its name is always SessionCookie. This may be
+// used to find out which path and domain the session cookie has in different
+// areas of a website.
+func SessionCookieFor(request *http.Request) *http.Cookie {
+	var cookie *http.Cookie
+	if NewSessionCookieForRequest != nil && request != nil {
+		cookie = NewSessionCookieForRequest(request)
+	} else {
+		cookie = NewSessionCookie()
+	}
+	cookie.Name = SessionCookie
+	if CookieSameSite != 0 {
+		cookie.SameSite = CookieSameSite
+	}
+	if PartitionedCookies {
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+	return cookie
+}
+
+// StrictCookieDefaults returns a session cookie with production-ready
+// attributes: it is only sent over HTTPS ("Secure"), it is not accessible to
+// JavaScript ("HttpOnly"), it is withheld from cross-site subrequests and
+// form posts ("SameSite=Lax"), and it is valid for the entire website
+// ("Path=/"). Like the default NewSessionCookie, it has a lifetime of 10 years.
+// Use it as follows:
+//
+//	sessions.NewSessionCookie = sessions.StrictCookieDefaults
+//
+// Or modify its fields further:
+//
+//	sessions.NewSessionCookie = func() *http.Cookie {
+//		cookie := sessions.StrictCookieDefaults()
+//		cookie.Domain = "www.example.com"
+//		return cookie
+//	}
+func StrictCookieDefaults() *http.Cookie {
+	return &http.Cookie{
+		Path:     "/",
+		Expires:  time.Now().Add(10 * 365 * 24 * time.Hour),
+		MaxAge:   10 * 365 * 24 * 60 * 60,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// requestSessionCookie returns the session cookie sent with the given request.
+// If the browser did not send a cookie named SessionCookie, the names in
+// SessionCookieAliases are tried in order. The second return value indicates
+// whether the cookie was found under one of these aliases. If the request
+// carries no session cookie, nil is returned.
+func requestSessionCookie(request *http.Request) (*http.Cookie, bool) {
+	if cookie, err := request.Cookie(SessionCookie); err == nil {
+		return cookie, false
+	}
+	for _, alias := range SessionCookieAliases {
+		if alias == SessionCookie {
+			continue
+		}
+		if cookie, err := request.Cookie(alias); err == nil {
+			return cookie, true
+		}
+	}
+	return nil, false
+}
+
+// migrateCookie moves the session ID of a cookie which was found under one of
+// the SessionCookieAliases to a cookie named SessionCookie. The cookie with
+// the old name is deleted from the browser. If the session ID changes later in
+// the same response, the newer cookie replaces the one set here.
+func migrateCookie(response http.ResponseWriter, request *http.Request, alias *http.Cookie) {
+	cookie := SessionCookieFor(request)
+	cookie.Value = alias.Value
+	setCookie(response, cookie)
+	deleteCookieNamed(response, request, alias.Name)
+}
+
+// setCookie adds a "Set-Cookie" header with the given cookie to the response.
+// If PartitionedCookies is true, the "Partitioned" attribute is added, which
+// is not supported by all versions of http.Cookie.
+func setCookie(response http.ResponseWriter, cookie *http.Cookie) {
+	if !PartitionedCookies {
+		http.SetCookie(response, cookie)
+		return
+	}
+	if value := cookie.String(); value != "" {
+		response.Header().Add("Set-Cookie", value+"; Partitioned")
+	}
+}
+
+// ExplainCookie checks the session cookie generated by SessionCookieFor() (with
+// the name SessionCookie) against the given request and explains why a browser
+// might reject the cookie or not send it back. This is a diagnostic function
+// intended to help debug sessions which do not "stick". It checks, for
+// example, the rules for the "__Host-" and "__Secure-" cookie name prefixes,
+// whether a "Secure" cookie is set over a plain HTTP connection, and whether
+// the cookie's domain and path match the request.
+//
+// The returned string contains one problem per line. It is empty if no
+// problems were found. An error is returned if the cookie cannot be checked
+// at all.
+func ExplainCookie(request *http.Request) (string, error) {
+	if request == nil {
+		return "", errors.New("No request provided")
+	}
+	if NewSessionCookie == nil && NewSessionCookieForRequest == nil {
+		return "", errors.New("NewSessionCookie is nil")
+	}
+	var cookie *http.Cookie
+	if NewSessionCookieForRequest != nil {
+		cookie = NewSessionCookieForRequest(request)
+	} else {
+		cookie = NewSessionCookie()
+	}
+	if cookie == nil {
+		return "", errors.New("No session cookie was returned")
+	}
+	cookie.Name = SessionCookie
+	if CookieSameSite != 0 {
+		cookie.SameSite = CookieSameSite
+	}
+	if PartitionedCookies {
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+
+	var problems []string
+	problem := func(text string) {
+		problems = append(problems, text)
+	}
+
+	// The cookie name.
+	if cookie.Name == "" || strings.ContainsAny(cookie.Name, "()<>@,;:\\\"/[]?={} \t") {
+		problem("The cookie name (SessionCookie) is empty or contains invalid characters")
+	}
+	if strings.HasPrefix(cookie.Name, "__Host-") {
+		if !cookie.Secure {
+			problem(`The "__Host-" prefix requires the Secure attribute, but it is not set`)
+		}
+		if cookie.Domain != "" {
+			problem(`The "__Host-" prefix requires that no Domain is set, but Domain is "` + cookie.Domain + `"`)
+		}
+		if cookie.Path != "/" {
+			problem(`The "__Host-" prefix requires the Path "/", but Path is "` + cookie.Path + `"`)
+		}
+	} else if strings.HasPrefix(cookie.Name, "__Secure-") && !cookie.Secure {
+		problem(`The "__Secure-" prefix requires the Secure attribute, but it is not set`)
+	}
+
+	// Secure cookies.
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if cookie.Secure && request.TLS == nil && host != "localhost" && host != "127.0.0.1" && host != "::1" {
+		problem("The cookie is Secure but the request was made over plain HTTP (browsers will ignore it unless a TLS-terminating proxy is used)")
+	}
+	if cookie.SameSite == http.SameSiteNoneMode && !cookie.Secure {
+		problem("SameSite=None requires the Secure attribute, but it is not set")
+	}
+
+	// Domain.
+	if cookie.Domain != "" && host != "" {
+		domain := strings.ToLower(strings.TrimPrefix(cookie.Domain, "."))
+		lowerHost := strings.ToLower(host)
+		if lowerHost != domain && !strings.HasSuffix(lowerHost, "."+domain) {
+			problem(`The cookie Domain "` + cookie.Domain + `" does not match the request host "` + host + `"`)
+		}
+	}
+
+	// Path.
+	if cookie.Path != "" && request.URL != nil {
+		path := request.URL.Path
+		if path == "" {
+			path = "/"
+		}
+		if !pathMatch(path, cookie.Path) {
+			problem(`The cookie Path "` + cookie.Path + `" does not include the request path "` + path + `", the cookie will not be sent with this request`)
+		}
+	}
+
+	// Expiry.
+	if cookie.MaxAge < 0 || !cookie.Expires.IsZero() && cookie.Expires.Before(time.Now()) && cookie.MaxAge == 0 {
+		problem("The cookie has already expired")
+	}
+
+	// Recommendations.
+	if !cookie.HttpOnly {
+		problem("The cookie is not HttpOnly, it may be accessed by JavaScript (recommended: set HttpOnly)")
+	}
+
+	return strings.Join(problems, "\n"), nil
+}
+
+// pathMatch returns whether a browser sends a cookie with the given path along
+// with a request for the given request path (see RFC 6265, section 5.1.4). For
+// example, the cookie path "/app" matches "/app" and "/app/users" but not
+// "/application".
+func pathMatch(requestPath, cookiePath string) bool {
+	if requestPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || requestPath[len(cookiePath)] == '/'
+}
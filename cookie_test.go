@@ -0,0 +1,273 @@
+package sessions
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the cookie diagnostics.
+func TestExplainCookie(t *testing.T) {
+	defer reset()
+
+	// Default cookie over HTTP.
+	req := httptest.NewRequest("GET", "http://www.example.com/app", nil)
+	explanation, err := ExplainCookie(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if explanation != "" {
+		t.Errorf("Unexpected problems found: %s", explanation)
+	}
+
+	// A broken "__Host-" cookie.
+	SessionCookie = "__Host-id"
+	NewSessionCookie = func() *http.Cookie {
+		return &http.Cookie{
+			Domain:   "example.org",
+			Path:     "/admin",
+			Secure:   true,
+			HttpOnly: true,
+		}
+	}
+	explanation, err = ExplainCookie(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, expected := range []string{"no Domain", `Path "/"`, "plain HTTP", "does not match the request host", "does not include the request path"} {
+		if !strings.Contains(explanation, expected) {
+			t.Errorf("Explanation does not contain %q: %s", expected, explanation)
+		}
+	}
+
+	// A correct "__Host-" cookie.
+	NewSessionCookie = func() *http.Cookie {
+		return &http.Cookie{
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+		}
+	}
+	req.TLS = &tls.ConnectionState{}
+	explanation, err = ExplainCookie(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if explanation != "" {
+		t.Errorf("Unexpected problems found: %s", explanation)
+	}
+}
+
+// Test matching request paths against cookie paths.
+func TestCookiePathMatch(t *testing.T) {
+	for _, test := range []struct {
+		requestPath, cookiePath string
+		match                   bool
+	}{
+		{"/", "/", true},
+		{"/app", "/", true},
+		{"/app", "/app", true},
+		{"/app/", "/app", true},
+		{"/app/users", "/app", true},
+		{"/app/users", "/app/", true},
+		{"/application", "/app", false},
+		{"/app", "/app/", false},
+		{"/", "/app", false},
+	} {
+		if match := pathMatch(test.requestPath, test.cookiePath); match != test.match {
+			t.Errorf("Path %q with cookie path %q: expected %t, got %t", test.requestPath, test.cookiePath, test.match, match)
+		}
+	}
+}
+
+// Test session cookies whose attributes depend on the request.
+func TestSessionCookieForRequest(t *testing.T) {
+	defer reset()
+	NewSessionCookieForRequest = func(request *http.Request) *http.Cookie {
+		path := "/"
+		if strings.HasPrefix(request.URL.Path, "/admin") {
+			path = "/admin"
+		}
+		return &http.Cookie{Path: path, HttpOnly: true}
+	}
+	if cookie := SessionCookieFor(httptest.NewRequest("GET", "/admin/users", nil)); cookie.Path != "/admin" || cookie.Name != SessionCookie {
+		t.Errorf("Unexpected admin cookie: %s", cookie)
+	}
+	if cookie := SessionCookieFor(httptest.NewRequest("GET", "/blog", nil)); cookie.Path != "/" {
+		t.Errorf("Unexpected cookie path: %s", cookie.Path)
+	}
+
+	// New sessions, ID changes, and deleted sessions use the same path.
+	req := httptest.NewRequest("GET", "/admin", nil)
+	res := httptest.NewRecorder()
+	session, err := Start(res, req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Path != "/admin" {
+		t.Errorf("Unexpected new session cookie: %v", cookies)
+	}
+	res = httptest.NewRecorder()
+	if err := session.RegenerateID(res); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Path != "/admin" {
+		t.Errorf("Unexpected regenerated session cookie: %v", cookies)
+	}
+	req = httptest.NewRequest("GET", "/admin", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	res = httptest.NewRecorder()
+	if err := session.Destroy(res, req); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Path != "/admin" || cookies[0].MaxAge >= 0 {
+		t.Errorf("Unexpected deleted session cookie: %v", cookies)
+	}
+}
+
+// Test partitioned cookies for cross-site iframes.
+func TestPartitionedCookies(t *testing.T) {
+	defer reset()
+	PartitionedCookies = true
+	req := httptest.NewRequest("GET", "https://widget.example.com/", nil)
+	res := httptest.NewRecorder()
+	if _, err := Start(res, req, true); err != nil {
+		t.Fatal(err)
+	}
+	header := res.Header().Get("Set-Cookie")
+	for _, attribute := range []string{"SameSite=None", "Secure", "Partitioned"} {
+		if !strings.Contains(header, "; "+attribute) {
+			t.Errorf("Cookie is missing the %s attribute: %s", attribute, header)
+		}
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != SessionCookie {
+		t.Errorf("Cookie cannot be parsed: %s", header)
+	}
+}
+
+// Test the cookie which deletes the session cookie.
+func TestDeleteCookie(t *testing.T) {
+	defer reset()
+	NewSessionCookie = func() *http.Cookie {
+		return &http.Cookie{
+			Domain:   "example.com",
+			Path:     "/app",
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		}
+	}
+	for _, value := range []string{"deleted", ""} {
+		DeletedCookieValue = value
+		req := httptest.NewRequest("GET", "/app", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: "malformed"})
+		res := httptest.NewRecorder()
+		if _, err := Start(res, req, false); err != nil {
+			t.Fatal(err)
+		}
+		cookies := res.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Expected one cookie, got %d", len(cookies))
+		}
+		cookie := cookies[0]
+		if cookie.Name != SessionCookie || cookie.Value != value || cookie.MaxAge >= 0 {
+			t.Errorf("Session cookie was not deleted: %s", cookie)
+		}
+		if cookie.Domain != "example.com" || cookie.Path != "/app" || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+			t.Errorf("Deleting cookie does not match the session cookie: %s", cookie)
+		}
+	}
+}
+
+// Test renaming the session cookie.
+func TestSessionCookieAliases(t *testing.T) {
+	defer reset()
+	SessionCookieAliases = []string{"oldid"}
+	sessions.Set(&Session{id: sessionID, created: time.Now(), lastAccess: time.Now(), data: make(map[string]interface{})})
+
+	// The old cookie is replaced.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "oldid", Value: sessionID})
+	res := httptest.NewRecorder()
+	session, err := Start(res, req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session == nil || session.id != sessionID {
+		t.Fatal("Session was not found via the old cookie name")
+	}
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range res.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	if cookie := cookies[SessionCookie]; cookie == nil || cookie.Value != sessionID || cookie.MaxAge < 0 {
+		t.Errorf("New session cookie was not set: %v", cookie)
+	}
+	if cookie := cookies["oldid"]; cookie == nil || cookie.MaxAge >= 0 {
+		t.Errorf("Old session cookie was not deleted: %v", cookie)
+	}
+
+	// The new name has precedence.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "oldid", Value: "unknown"})
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+	res = httptest.NewRecorder()
+	if session, err = Start(res, req, false); err != nil {
+		t.Fatal(err)
+	}
+	if session == nil || session.id != sessionID || len(res.Result().Cookies()) != 0 {
+		t.Error("Old session cookie was used despite a new one")
+	}
+}
+
+// Test the SameSite attribute of session cookies.
+func TestCookieSameSite(t *testing.T) {
+	defer reset()
+	NewSessionCookie = StrictCookieDefaults
+	if cookie := StrictCookieDefaults(); !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" || cookie.MaxAge <= 0 {
+		t.Errorf("Unexpected default cookie: %s", cookie)
+	}
+	CookieSameSite = http.SameSiteStrictMode
+	check := func(action string, res *httptest.ResponseRecorder) {
+		t.Helper()
+		cookies := res.Result().Cookies()
+		if len(cookies) == 0 {
+			t.Fatalf("%s: No cookie was set", action)
+		}
+		for _, cookie := range cookies {
+			if cookie.SameSite != http.SameSiteStrictMode || !cookie.Secure {
+				t.Errorf("%s: Unexpected cookie attributes: %s", action, cookie)
+			}
+		}
+	}
+
+	// New session.
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	session, err := Start(res, req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("Start", res)
+
+	// Regenerated ID.
+	res = httptest.NewRecorder()
+	if err := session.RegenerateID(res); err != nil {
+		t.Fatal(err)
+	}
+	check("RegenerateID", res)
+
+	// Destroyed session.
+	res = httptest.NewRecorder()
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if err := session.Destroy(res, req); err != nil {
+		t.Fatal(err)
+	}
+	check("Destroy", res)
+}
@@ -0,0 +1,326 @@
+package sessions
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csrfTokenKey is the key under which a session's CSRF token is stored in the
+// session data. Like anonKeyPrefix, it cannot collide with application keys.
+// Scoped tokens (see CSRFTokenFor()) are stored under this key plus ":" plus
+// their scope.
+const csrfTokenKey = "\x00csrf"
+
+// Default names used by CSRFMiddleware() if CSRFOptions leaves them empty.
+const (
+	DefaultCSRFHeader = "X-CSRF-Token" // The request header which carries the CSRF token.
+	DefaultCSRFField  = "csrf_token"   // The form field which carries the CSRF token.
+)
+
+// CSRFToken returns the token which protects this session against cross-site
+// request forgery (CSRF). A new random token is generated and stored in the
+// session if it doesn't have one yet. Include the token in your forms (e.g.
+// in a hidden field) or in the headers of your JavaScript requests and verify
+// it with CSRFMiddleware() or VerifyCSRFToken().
+//
+// The token is replaced when a user logs into the session (see LogIn()).
+//
+// Note that since the sessions cache is write-through, generating a token will
+// also result in a call to SaveSession() of the persistence layer.
+func (s *Session) CSRFToken() (string, error) {
+	if err := s.loadData(); err != nil {
+		return "", err
+	}
+	s.Lock()
+	data, err := s.openData()
+	if err != nil {
+		s.Unlock()
+		return "", err
+	}
+	if token, ok := data[csrfTokenKey].(string); ok {
+		s.Unlock()
+		return token, nil
+	}
+	token, err := RandomID(32)
+	if err != nil {
+		s.Unlock()
+		return "", fmt.Errorf("Could not generate CSRF token: %s", err)
+	}
+	data[csrfTokenKey] = token
+	if err := s.closeData(data); err != nil {
+		s.Unlock()
+		return "", err
+	}
+	s.Unlock()
+	return token, s.save()
+}
+
+// VerifyCSRFToken returns whether the given token matches this session's CSRF
+// token (see CSRFToken()). The comparison takes constant time. If the session
+// has no token yet, false is returned.
+func (s *Session) VerifyCSRFToken(token string) bool {
+	if token == "" || s.loadData() != nil {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	data, err := s.openData()
+	if err != nil {
+		return false
+	}
+	expected, ok := data[csrfTokenKey].(string)
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// CSRFTokenFor returns a CSRF token which is bound to the given scope, e.g.
+// the name of a form. Unlike the session-wide token returned by CSRFToken(),
+// each scope has its own token with its own expiry (ScopedCSRFTokenExpiry).
+// This helps when users have several forms open at the same time, e.g. in
+// different browser tabs: Issuing or expiring the token of one form does not
+// invalidate the tokens of the others. Use VerifyCSRFFor() to check tokens.
+//
+// The token of a scope is generated when it is first requested or when it has
+// expired. Each scoped token is stored in the session data, so the session
+// grows with every scope. Expired tokens are removed when a new token is
+// issued. If there are still MaxScopedCSRFTokens tokens, the token which
+// expires first is removed, too. All scoped tokens are removed when a user
+// logs into the session (see LogIn()).
+//
+// Note that since the sessions cache is write-through, generating a token will
+// also result in a call to SaveSession() of the persistence layer.
+func (s *Session) CSRFTokenFor(scope string) (string, error) {
+	if err := s.loadData(); err != nil {
+		return "", err
+	}
+	s.Lock()
+	data, err := s.openData()
+	if err != nil {
+		s.Unlock()
+		return "", err
+	}
+	key := csrfTokenKey + ":" + scope
+	now := time.Now()
+	if token, expires, ok := parseScopedCSRFToken(data[key]); ok && now.Before(expires) {
+		s.Unlock()
+		return token, nil
+	}
+
+	// Make room for the new token.
+	var (
+		count        int
+		firstKey     string
+		firstExpires time.Time
+	)
+	for k, value := range data {
+		if !strings.HasPrefix(k, csrfTokenKey+":") {
+			continue
+		}
+		_, expires, ok := parseScopedCSRFToken(value)
+		if !ok || !now.Before(expires) || k == key {
+			delete(data, k)
+			continue
+		}
+		count++
+		if firstKey == "" || expires.Before(firstExpires) {
+			firstKey, firstExpires = k, expires
+		}
+	}
+	if count >= MaxScopedCSRFTokens && firstKey != "" {
+		delete(data, firstKey)
+	}
+
+	// Issue the new token.
+	token, err := RandomID(32)
+	if err != nil {
+		s.Unlock()
+		return "", fmt.Errorf("Could not generate CSRF token: %s", err)
+	}
+	expires := strconv.FormatInt(now.Add(ScopedCSRFTokenExpiry).UnixNano(), 36)
+	data[key] = expires + ":" + token
+	if err := s.closeData(data); err != nil {
+		s.Unlock()
+		return "", err
+	}
+	s.Unlock()
+	return token, s.save()
+}
+
+// VerifyCSRFFor returns whether the given token matches the token of the given
+// scope (see CSRFTokenFor()) and whether that token has not expired yet. The
+// comparison takes constant time.
+func (s *Session) VerifyCSRFFor(scope, token string) bool {
+	if token == "" || s.loadData() != nil {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	data, err := s.openData()
+	if err != nil {
+		return false
+	}
+	expected, expires, ok := parseScopedCSRFToken(data[csrfTokenKey+":"+scope])
+	return ok && time.Now().Before(expires) && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// parseScopedCSRFToken splits a scoped CSRF token as stored in the session data
+// into the token and its expiry. The last return value is false if the value
+// is not a scoped CSRF token.
+func parseScopedCSRFToken(value interface{}) (string, time.Time, bool) {
+	stored, ok := value.(string)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	expires, token, ok := strings.Cut(stored, ":")
+	if !ok {
+		return "", time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(expires, 36, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return token, time.Unix(0, nanos), true
+}
+
+// removeCSRFToken removes this session's CSRF token and all scoped tokens so
+// that new ones are generated with the next call to CSRFToken() or
+// CSRFTokenFor(). The session data must have been loaded and the session must
+// be locked while this function is called.
+func (s *Session) removeCSRFToken() error {
+	data, err := s.openData()
+	if err != nil {
+		return err
+	}
+	var removed bool
+	for key := range data {
+		if key == csrfTokenKey || strings.HasPrefix(key, csrfTokenKey+":") {
+			delete(data, key)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.closeData(data)
+}
+
+// CSRFOptions configures the middleware returned by CSRFMiddleware().
+type CSRFOptions struct {
+	// The name of the request header which carries the CSRF token. Defaults to
+	// DefaultCSRFHeader.
+	Header string
+
+	// The name of the form field which carries the CSRF token if the request
+	// header is missing. Defaults to DefaultCSRFField.
+	Field string
+
+	// Requests whose URL path equals one of these paths are not checked. A path
+	// ending in "/" exempts all paths starting with it.
+	ExemptPaths []string
+
+	// If not empty, responses to requests with safe methods (GET, HEAD,
+	// OPTIONS, TRACE) receive a cookie with this name which contains the CSRF
+	// token. It is readable by JavaScript so scripts can copy it into the
+	// request header. The cookie's other attributes are taken from
+	// SessionCookieFor().
+	Cookie string
+
+	// The handler called when a request is rejected. If nil, a "403 Forbidden"
+	// status is returned.
+	Failure http.Handler
+}
+
+// CSRFMiddleware returns a function which wraps HTTP handlers with protection
+// against cross-site request forgery (CSRF). Requests with unsafe methods
+// (POST, PUT, PATCH, DELETE, and any other methods not considered safe by RFC
+// 9110) must carry the session's CSRF token (see Session.CSRFToken()) in the
+// request header or form field named in the options. Requests without a
+// session, without a token, or with a wrong token are rejected.
+//
+// The current session is taken from the request's context (see NewContext()).
+// If the context does not contain a session, Start() is called, creating a new
+// session for requests with safe methods, and the resulting session is added
+// to the context passed on to the wrapped handler.
+func CSRFMiddleware(options CSRFOptions) func(http.Handler) http.Handler {
+	if options.Header == "" {
+		options.Header = DefaultCSRFHeader
+	}
+	if options.Field == "" {
+		options.Field = DefaultCSRFField
+	}
+	failure := options.Failure
+	if failure == nil {
+		failure = http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			http.Error(response, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			// Exempt paths.
+			for _, path := range options.ExemptPaths {
+				if request.URL.Path == path || strings.HasSuffix(path, "/") && strings.HasPrefix(request.URL.Path, path) {
+					next.ServeHTTP(response, request)
+					return
+				}
+			}
+
+			// Get the session.
+			safe := csrfSafeMethod(request.Method)
+			session, ok := FromContext(request.Context())
+			if !ok {
+				var err error
+				session, err = Start(response, request, safe)
+				if err != nil {
+					http.Error(response, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				if session != nil {
+					request = request.WithContext(NewContext(request.Context(), session))
+				}
+			}
+
+			// Safe methods only need the token cookie.
+			if safe {
+				if options.Cookie != "" && session != nil {
+					token, err := session.CSRFToken()
+					if err != nil {
+						http.Error(response, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+						return
+					}
+					cookie := SessionCookieFor(request)
+					cookie.Name = options.Cookie
+					cookie.Value = token
+					cookie.HttpOnly = false
+					setCookie(response, cookie)
+				}
+				next.ServeHTTP(response, request)
+				return
+			}
+
+			// Check the token.
+			token := request.Header.Get(options.Header)
+			if token == "" {
+				token = request.PostFormValue(options.Field)
+			}
+			if session == nil || !session.VerifyCSRFToken(token) {
+				failure.ServeHTTP(response, request)
+				return
+			}
+			next.ServeHTTP(response, request)
+		})
+	}
+}
+
+// csrfSafeMethod returns whether the given HTTP method is safe, i.e. whether it
+// does not need CSRF protection.
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the CSRF middleware.
+func TestCSRFMiddleware(t *testing.T) {
+	defer reset()
+	var called int
+	handler := CSRFMiddleware(CSRFOptions{
+		Cookie:      "csrf",
+		ExemptPaths: []string{"/webhooks/"},
+	})(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		called++
+	}))
+	serve := func(request *http.Request) int {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, request)
+		return res.Code
+	}
+
+	// A GET request creates a session and a token cookie.
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+	if called != 1 || res.Code != http.StatusOK {
+		t.Fatalf("GET request was rejected (status %d)", res.Code)
+	}
+	var token, id string
+	for _, cookie := range res.Result().Cookies() {
+		switch cookie.Name {
+		case "csrf":
+			token = cookie.Value
+			if cookie.HttpOnly {
+				t.Error("Token cookie is not readable by JavaScript")
+			}
+		case SessionCookie:
+			id = cookie.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("No token cookie was set")
+	}
+	session := cachedSessions()[id]
+	if session == nil {
+		t.Fatal("No session was created")
+	}
+	withSession := func(request *http.Request) *http.Request {
+		return request.WithContext(NewContext(request.Context(), session))
+	}
+
+	// Missing and wrong tokens.
+	if code := serve(httptest.NewRequest("POST", "/", nil)); code != http.StatusForbidden {
+		t.Errorf("POST request without session was not rejected (status %d)", code)
+	}
+	if code := serve(withSession(httptest.NewRequest("POST", "/", nil))); code != http.StatusForbidden {
+		t.Errorf("POST request without token was not rejected (status %d)", code)
+	}
+	req := withSession(httptest.NewRequest("DELETE", "/", nil))
+	req.Header.Set(DefaultCSRFHeader, token+"x")
+	if code := serve(req); code != http.StatusForbidden {
+		t.Errorf("DELETE request with wrong token was not rejected (status %d)", code)
+	}
+	if called != 1 {
+		t.Errorf("Handler was called for rejected requests")
+	}
+
+	// Correct tokens in the header and in a form.
+	req = withSession(httptest.NewRequest("PUT", "/", nil))
+	req.Header.Set(DefaultCSRFHeader, token)
+	if code := serve(req); code != http.StatusOK {
+		t.Errorf("PUT request with token in header was rejected (status %d)", code)
+	}
+	req = withSession(httptest.NewRequest("POST", "/", strings.NewReader(url.Values{DefaultCSRFField: {token}}.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if code := serve(req); code != http.StatusOK {
+		t.Errorf("POST request with token in form was rejected (status %d)", code)
+	}
+
+	// Exempt paths.
+	if code := serve(httptest.NewRequest("POST", "/webhooks/payment", nil)); code != http.StatusOK {
+		t.Errorf("POST request to exempt path was rejected (status %d)", code)
+	}
+
+	// Logging in rotates the token.
+	if err := session.LogIn(&TestUser{ID: "userid"}, false, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if session.VerifyCSRFToken(token) {
+		t.Error("Token was not rotated on login")
+	}
+	newToken, err := session.CSRFToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newToken == token {
+		t.Error("Same token was generated after login")
+	}
+	req = withSession(httptest.NewRequest("PATCH", "/", nil))
+	req.Header.Set(DefaultCSRFHeader, newToken)
+	if code := serve(req); code != http.StatusOK {
+		t.Errorf("PATCH request with new token was rejected (status %d)", code)
+	}
+}
+
+// Test CSRF tokens bound to scopes.
+func TestCSRFScopedTokens(t *testing.T) {
+	defer reset()
+	MaxScopedCSRFTokens = 2
+	session := &Session{id: sessionID, data: make(map[string]interface{})}
+	profile, err := session.CSRFTokenFor("profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := session.CSRFTokenFor("profile"); token != profile {
+		t.Error("Token of scope changed")
+	}
+	password, err := session.CSRFTokenFor("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password == profile {
+		t.Error("Different scopes have the same token")
+	}
+	if !session.VerifyCSRFFor("profile", profile) || !session.VerifyCSRFFor("password", password) {
+		t.Error("Valid scoped tokens were rejected")
+	}
+	if session.VerifyCSRFFor("password", profile) || session.VerifyCSRFFor("email", profile) || session.VerifyCSRFToken(profile) {
+		t.Error("Scoped token was accepted for a different scope")
+	}
+
+	// The cap removes the token which expires first.
+	if _, err := session.CSRFTokenFor("email"); err != nil {
+		t.Fatal(err)
+	}
+	if session.VerifyCSRFFor("profile", profile) || !session.VerifyCSRFFor("password", password) {
+		t.Error("Wrong token was removed when the cap was reached")
+	}
+
+	// Expiry.
+	ScopedCSRFTokenExpiry = time.Millisecond
+	expiring, err := session.CSRFTokenFor("search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if session.VerifyCSRFFor("search", expiring) {
+		t.Error("Expired token was accepted")
+	}
+	if token, _ := session.CSRFTokenFor("search"); token == expiring {
+		t.Error("Expired token was not replaced")
+	}
+
+	// Logging in removes all scoped tokens.
+	if err := session.LogIn(&TestUser{ID: "userid"}, false, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if session.VerifyCSRFFor("password", password) {
+		t.Error("Scoped token survived login")
+	}
+}
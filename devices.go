@@ -0,0 +1,181 @@
+package sessions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// ErrNoTrustedDeviceStore is returned by IssueTrustedDevice() if the
+// persistence layer does not implement TrustedDeviceStore or cannot store
+// trusted devices (e.g. ExtendablePersistenceLayer without
+// SaveTrustedDeviceFunc).
+var ErrNoTrustedDeviceStore = errors.New("Persistence layer does not store trusted devices")
+
+// TrustedDevice is a browser which a user has marked as trusted, e.g. by
+// checking a "trust this device" box when logging in with two-factor
+// authentication. Subsequent logins from a trusted device may then skip the
+// second factor until the device expires or is revoked.
+//
+// A trusted device is independent of sessions. It is identified by a random
+// token which is stored in a long-lived browser cookie (see
+// TrustedDeviceCookie). Only the hash of that token is handed to the
+// persistence layer so a leaked data store does not reveal valid tokens.
+type TrustedDevice struct {
+	// ID is the hex-encoded SHA-256 hash of the device token. It uniquely
+	// identifies the device and may be used to revoke it.
+	ID string
+
+	// UserID is the ID of the user who trusts this device.
+	UserID interface{}
+
+	// Created is the time the device was marked as trusted.
+	Created time.Time
+
+	// Expires is the time after which the device is not trusted anymore.
+	Expires time.Time
+
+	// UserAgent is the "User-Agent" header sent by the browser when the device
+	// was marked as trusted. It may be used to describe the device to the user,
+	// e.g. with ParseUserAgent().
+	UserAgent string
+
+	// Location is the location of the browser when the device was marked as
+	// trusted (see Locator). It is the zero location if it is unknown.
+	Location Location
+}
+
+// Expired returns whether this device's trust has expired.
+func (d *TrustedDevice) Expired() bool {
+	return !time.Now().Before(d.Expires)
+}
+
+// trustedDeviceID returns the ID of the trusted device with the given token.
+func trustedDeviceID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// IssueTrustedDevice marks the browser which sent the request as a trusted
+// device of the user with the given ID. A new device token is generated and
+// sent to the browser in a cookie named TrustedDeviceCookie. The device expires
+// after TrustedDeviceExpiry. The ID of the new device is returned. It may be
+// used with RevokeTrustedDevice().
+//
+// Use IsTrustedDevice() during subsequent logins to check whether the browser
+// is still trusted. The persistence layer must implement TrustedDeviceStore,
+// otherwise ErrNoTrustedDeviceStore is returned. No cookie is set if the device
+// could not be saved.
+func IssueTrustedDevice(response http.ResponseWriter, request *http.Request, userID interface{}) (string, error) {
+	if userID == nil {
+		return "", errors.New("No user ID provided")
+	}
+	store, ok := Persistence.(TrustedDeviceStore)
+	if !ok {
+		return "", ErrNoTrustedDeviceStore
+	}
+
+	// Generate a new token.
+	token, err := RandomID(32)
+	if err != nil {
+		return "", fmt.Errorf("Could not generate device token: %s", err)
+	}
+
+	// Save the device.
+	now := time.Now()
+	device := &TrustedDevice{
+		ID:        trustedDeviceID(token),
+		UserID:    userID,
+		Created:   now,
+		Expires:   now.Add(TrustedDeviceExpiry),
+		UserAgent: request.UserAgent(),
+		Location:  locate(remoteAddress(request)),
+	}
+	if err := store.SaveTrustedDevice(device); err != nil {
+		return "", fmt.Errorf("Could not save trusted device: %w", err)
+	}
+
+	// Set the cookie.
+	cookie := SessionCookieFor(request)
+	cookie.Name = TrustedDeviceCookie
+	cookie.Value = token
+	cookie.Expires = device.Expires
+	cookie.MaxAge = int(TrustedDeviceExpiry / time.Second)
+	setCookie(response, cookie)
+
+	return device.ID, nil
+}
+
+// IsTrustedDevice returns whether the browser which sent the request was
+// marked as a trusted device of the user with the given ID (see
+// IssueTrustedDevice()) and whether that trust has not expired or been revoked
+// yet. Expired devices are deleted from the persistence layer. User IDs are
+// compared with reflect.DeepEqual().
+func IsTrustedDevice(request *http.Request, userID interface{}) (bool, error) {
+	store, ok := Persistence.(TrustedDeviceStore)
+	if !ok {
+		return false, nil // No store, no trusted devices.
+	}
+	cookie, err := request.Cookie(TrustedDeviceCookie)
+	if err != nil || cookie.Value == "" {
+		return false, nil // No cookie, no trusted device.
+	}
+
+	// Load the device.
+	id := trustedDeviceID(cookie.Value)
+	device, err := store.LoadTrustedDevice(id)
+	if err != nil {
+		return false, fmt.Errorf("Could not load trusted device: %s", err)
+	}
+	if device == nil {
+		return false, nil
+	}
+
+	// Check it.
+	if device.Expired() {
+		if err := store.DeleteTrustedDevice(id); err != nil {
+			return false, fmt.Errorf("Could not delete expired trusted device: %s", err)
+		}
+		return false, nil
+	}
+	return userID != nil && reflect.DeepEqual(device.UserID, userID), nil
+}
+
+// RevokeTrustedDevice revokes the trust of the device with the given ID. It is
+// not an error if the device does not exist. The device's cookie is not
+// deleted but it will not be accepted anymore.
+func RevokeTrustedDevice(id string) error {
+	store, ok := Persistence.(TrustedDeviceStore)
+	if !ok {
+		return nil
+	}
+	if err := store.DeleteTrustedDevice(id); err != nil {
+		return fmt.Errorf("Could not delete trusted device: %s", err)
+	}
+	return nil
+}
+
+// TrustedDevices returns the devices which are trusted by the user with the
+// given ID, e.g. to list them in a "devices" section of the user's account
+// settings. Expired devices are not returned.
+func TrustedDevices(userID interface{}) ([]*TrustedDevice, error) {
+	store, ok := Persistence.(TrustedDeviceStore)
+	if !ok {
+		return nil, nil
+	}
+	devices, err := store.UserTrustedDevices(userID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve trusted devices: %s", err)
+	}
+	var trusted []*TrustedDevice
+	for _, device := range devices {
+		if device != nil && !device.Expired() {
+			trusted = append(trusted, device)
+		}
+	}
+	return trusted, nil
+}
@@ -0,0 +1,144 @@
+package sessions
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test issuing, checking, listing, and revoking trusted devices.
+func TestTrustedDevices(t *testing.T) {
+	defer reset()
+	devices := make(map[string]*TrustedDevice)
+	Persistence = ExtendablePersistenceLayer{
+		LoadTrustedDeviceFunc: func(id string) (*TrustedDevice, error) {
+			return devices[id], nil
+		},
+		SaveTrustedDeviceFunc: func(device *TrustedDevice) error {
+			devices[device.ID] = device
+			return nil
+		},
+		DeleteTrustedDeviceFunc: func(id string) error {
+			delete(devices, id)
+			return nil
+		},
+		UserTrustedDevicesFunc: func(userID interface{}) ([]*TrustedDevice, error) {
+			var list []*TrustedDevice
+			for _, device := range devices {
+				if device.UserID == userID {
+					list = append(list, device)
+				}
+			}
+			return list, nil
+		},
+	}
+
+	// Issue a device.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "Test Browser")
+	res := httptest.NewRecorder()
+	id, err := IssueTrustedDevice(res, req, "userid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != TrustedDeviceCookie {
+		t.Fatalf("Trusted device cookie not set: %v", cookies)
+	}
+	if id != trustedDeviceID(cookies[0].Value) {
+		t.Error("Device ID is not the hash of the token")
+	}
+	if _, ok := devices[cookies[0].Value]; ok {
+		t.Error("Device token was stored in plain text")
+	}
+
+	// Check it.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	if ok, err := IsTrustedDevice(req, "userid"); err != nil || !ok {
+		t.Errorf("Device not trusted (error %v)", err)
+	}
+	if ok, _ := IsTrustedDevice(req, "otheruser"); ok {
+		t.Error("Device trusted for the wrong user")
+	}
+	if ok, _ := IsTrustedDevice(httptest.NewRequest("GET", "/", nil), "userid"); ok {
+		t.Error("Request without cookie was trusted")
+	}
+
+	// List it.
+	list, err := TrustedDevices("userid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != id || list[0].UserAgent != "Test Browser" {
+		t.Errorf("Unexpected trusted devices: %v", list)
+	}
+
+	// Revoke it.
+	if err := RevokeTrustedDevice(id); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := IsTrustedDevice(req, "userid"); ok {
+		t.Error("Revoked device is still trusted")
+	}
+
+	// Expired devices.
+	res = httptest.NewRecorder()
+	id, err = IssueTrustedDevice(res, req, "userid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices[id].Expires = time.Now().Add(-time.Second)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(res.Result().Cookies()[0])
+	if list, _ := TrustedDevices("userid"); len(list) != 0 {
+		t.Error("Expired device was listed")
+	}
+	if ok, _ := IsTrustedDevice(req, "userid"); ok {
+		t.Error("Expired device is still trusted")
+	}
+	if _, ok := devices[id]; ok {
+		t.Error("Expired device was not deleted")
+	}
+}
+
+// Test trusted devices of users whose IDs are not comparable with ==.
+func TestTrustedDevicesSliceID(t *testing.T) {
+	defer reset()
+	devices := make(map[string]*TrustedDevice)
+	Persistence = ExtendablePersistenceLayer{
+		LoadTrustedDeviceFunc: func(id string) (*TrustedDevice, error) {
+			return devices[id], nil
+		},
+		SaveTrustedDeviceFunc: func(device *TrustedDevice) error {
+			devices[device.ID] = device
+			return nil
+		},
+	}
+	res := httptest.NewRecorder()
+	if _, err := IssueTrustedDevice(res, httptest.NewRequest("GET", "/", nil), []string{"tenant", "userid"}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(res.Result().Cookies()[0])
+	if ok, err := IsTrustedDevice(req, []string{"tenant", "userid"}); err != nil || !ok {
+		t.Errorf("Device not trusted (error %v)", err)
+	}
+	if ok, _ := IsTrustedDevice(req, []string{"tenant", "otheruser"}); ok {
+		t.Error("Device trusted for the wrong user")
+	}
+}
+
+// Test that the default persistence layer does not pretend to store trusted
+// devices.
+func TestTrustedDevicesDefaultPersistence(t *testing.T) {
+	defer reset()
+	res := httptest.NewRecorder()
+	if _, err := IssueTrustedDevice(res, httptest.NewRequest("GET", "/", nil), "userid"); !errors.Is(err, ErrNoTrustedDeviceStore) {
+		t.Errorf("Expected ErrNoTrustedDeviceStore, got %v", err)
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Trusted device cookie was set: %v", cookies)
+	}
+}
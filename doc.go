@@ -14,6 +14,7 @@ In addition, the package provides the following functionality:
   - Log in/out functions for users
   - Various identifier generation functions
   - Password strength checks (based on NIST recommendations)
+  - Password hashing with Argon2id
 
 While simple to use, the package offers a number of extensively documented
 configuration variables. It also does not assume specific backend technologies.
@@ -22,7 +23,9 @@ PersistenceLayer interface (or parts of it).
 
 This package is currently not written to be run on multiple machines in a
 distributed fashion without a load balancer that implements sticky sessions.
-This may change in the future.
+This may change in the future. If sticky sessions are not an option, set
+SessionCacheMaxAge to limit how long a node may serve an outdated copy of a
+session which was changed on another node.
 
 Basic Example
 
@@ -45,11 +48,22 @@ current session, simply call Start():
 By providing "true" instead of "false" to the Start() function, you can force
 the creation of a session, even if there previously was none.
 
+Alternatively, wrap your handlers with Middleware(), which calls Start() for
+you and stores the session in the request's context. Handlers then retrieve
+it with FromContext():
+
+  http.Handle("/", sessions.Middleware(http.HandlerFunc(MyHandler), true))
+
+  func MyHandler(response http.ResponseWriter, request *http.Request) {
+  	session, _ := sessions.FromContext(request.Context())
+  	// ...
+  }
+
 Once you have a session, you can identify a user across multiple HTTP requests.
 You may add values to the session, attach a user to it, cause its session ID
 to change, or destroy it again. For more extensive user-centered functions
-(for example, signing up, logging in and out, changing passwords etc.), see the
-subdirectory "users".
+(for example, signing up, verifying email addresses, logging in and out,
+resetting passwords, deleting accounts), see the subpackage "users".
 
 Configuration
 
@@ -79,6 +93,13 @@ your application:
   - SessionExpiry: The maximum time which may pass before a session that has not
     been accessed will be destroyed. The default is "forever", meaning unused
     sessions will not time out.
+  - SessionMaxLifetime: The maximum time which may pass after a session was
+    started before it will be destroyed, even if it is still in use. The
+    default is "forever".
+  - RememberMeExpiry: The maximum time which may pass before a session that
+    has not been accessed will be destroyed if the user chose to be
+    remembered (see Session.SetRememberMe()). If set, all other sessions use
+    cookies which are deleted when the browser is closed.
   - SessionIDExpiry: The maximum duration a session ID can be used before it is
     changed to a new session ID. Session ID renewals reduce the risk of session
     hijacking attacks.
@@ -87,10 +108,15 @@ your application:
     a slow network. This variable specifies how long a previous session ID
     remains active when a new session ID is already in place.
 
+Call ValidateConfig() after changing these values. It will return an error if
+they contradict each other, e.g. if the grace period is not shorter than the
+session ID expiry.
+
 To further reduce the risk of session hijacking attacks, this package checks
 client IP addresses as well as user agent strings and destroys sessions if
-changes in these properties were detected. Refer to the AcceptRemoteIP and
-AcceptChangingUserAgent variables for more information.
+changes in these properties were detected. Refer to the AcceptRemoteIP,
+AcceptRemoteIPv6Prefix, and AcceptChangingUserAgent variables for more
+information.
 
 The Session Cache and the Persistence Layer
 
@@ -106,10 +132,13 @@ of functions which allow the storage and retrieval of objects from a permanent
 data store. For example, you may use an SQL database or a key-value store.
 
 See the documentation of PersistenceLayer for details on the functions to be
-implemented. If you need to implement only some of the functions, you may use
-ExtendablePersistenceLayer instead of creating your own class. The package
-default is to do nothing. That is, sessions are not persisted and therefore
+implemented. Some features need additional functions which are declared in
+small optional interfaces, e.g. TagIndexer. If you need to implement only some
+of the functions, you may use ExtendablePersistenceLayer instead of creating
+your own class. The package default is to do nothing. That is, sessions are not persisted and therefore
 will get lost when purged from the local cache or when the application exits.
+To retry failed operations of a network-backed data store, wrap your
+persistence layer with NewRetryingPersistence().
 
 Session objects implement gob.GobEncoder/gob.GobDecoder and
 json.Marshaler/json.Unmarshaler. While encoding to JSON allows you to easily
@@ -117,12 +146,22 @@ inspect session attributes in your database, GOB serialization is preferred as
 it will restore session objects precisely. (For example, the JSON package always
 unmarshals numbers into floats even if they were originally integers.)
 
+Sessions also implement encoding.BinaryMarshaler/encoding.BinaryUnmarshaler.
+This compact binary format is considerably smaller than GOB but supports only a
+limited set of value types (see Session.MarshalBinary() for details).
+
 It is recommended that you purge your data store from expired sessions from time
 to time, e.g. by using a cron job, because users may abandon your website which
 will leave old sessions in your store.
 
 It is recommended to call PurgeSessions() before exiting the program. This will
-cause session last access times to be updated.
+cause session last access times to be updated. It also deletes reference
+sessions whose grace period has not ended yet because they would otherwise
+remain in your store after a restart.
+
+If you don't use a persistence layer, you may hand the local cache over to a
+new process with ExportCache() and ImportCache(). Single sessions may be
+transferred with Session.Export(), ImportSession(), and RegisterSession().
 
 Utility Functions
 
@@ -134,7 +173,19 @@ user IDs.
 
 The RandomID() function generates random Base-62 strings of any length.
 
+For tests, SetDeterministicSource() makes session IDs, RandomID(), and all
+tokens generated by this package reproducible. Never use it in production.
+
+The ParseUserAgent() function extracts browser, operating system, and device
+type information from user agent strings.
+
 The ReasonablePassword() function checks the strength of a password based on the
-recommendations of NIST SP 800-63B.
+recommendations of NIST SP 800-63B. Passwords which pass the check may be stored
+as hashes generated by HashPassword() and checked with VerifyPassword().
+PasswordNeedsRehash() detects hashes which should be upgraded, e.g. after
+PasswordHashParameters were increased, and PasswordReused() checks a new
+password against the hashes of previous passwords. For password strength meters,
+AnalyzePassword() estimates a password's entropy, points out predictable
+patterns such as keyboard walks or dates, and makes suggestions.
 */
 package sessions
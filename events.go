@@ -0,0 +1,48 @@
+package sessions
+
+// EventHooks contains functions which are called when sessions reach important
+// points in their life cycle (see Events). Any of them may be nil. They are
+// called synchronously, after the corresponding change was made, and while the
+// session is not locked. They may therefore read from the session (e.g. with
+// User() or Tag()) but they should not change it. Time-consuming work should be
+// handed off to other goroutines.
+//
+// Unlike AuditLogger, these hooks receive the session itself rather than a
+// serialized record. They are not called for reference sessions.
+type EventHooks struct {
+	// OnCreated is called by Start() after a new session was created.
+	OnCreated func(session *Session)
+
+	// OnRegeneratedID is called after the session's ID was replaced by a new
+	// one (see Session.RegenerateID()). This includes the ID changes caused by
+	// SessionIDExpiry, SessionIDMaxUses, and by logging users in.
+	OnRegeneratedID func(session *Session)
+
+	// OnDestroyed is called after a session was destroyed, e.g. by
+	// Session.Destroy(), DestroySessionsByTag(), or because Start() rejected
+	// it. The session is never nil.
+	OnDestroyed func(session *Session)
+
+	// OnAnomalyDetected is called by Start() when it rejects a session because
+	// of a suspicious change of the client's properties, e.g. its IP address or
+	// its user agent (see Reason). Sessions which simply expired are not
+	// reported here. OnDestroyed is called for the session afterwards.
+	OnAnomalyDetected func(session *Session, reason Reason)
+
+	// OnLogin is called after a user was logged into a session with
+	// Session.LogIn() or Session.LogInPending(), or after their pending
+	// authentication was completed with Session.CompleteAuth(). Use
+	// Session.IsAuthPending() to distinguish these cases.
+	OnLogin func(session *Session)
+
+	// OnLogout is called after the user with the given ID was logged out of the
+	// session, either with Session.LogOut() or with LogOut().
+	OnLogout func(session *Session, userID interface{})
+}
+
+// anomalyReason returns whether the given reason for rejecting a session
+// indicates an anomaly (see EventHooks.OnAnomalyDetected) rather than a
+// regular expiry.
+func anomalyReason(reason Reason) bool {
+	return reason != ReasonNone && reason != ReasonExpired && reason != ReasonDeadline
+}
@@ -0,0 +1,82 @@
+package sessions
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Test the event hooks.
+func TestEvents(t *testing.T) {
+	defer reset()
+	AcceptRemoteIP = 4
+	var events []string
+	Events = EventHooks{
+		OnCreated: func(session *Session) {
+			events = append(events, "created")
+		},
+		OnRegeneratedID: func(session *Session) {
+			if err := session.Set("regenerated", true); err != nil { // Must not deadlock.
+				t.Error(err)
+			}
+			events = append(events, "regenerated")
+		},
+		OnDestroyed: func(session *Session) {
+			events = append(events, "destroyed")
+		},
+		OnAnomalyDetected: func(session *Session, reason Reason) {
+			events = append(events, fmt.Sprintf("anomaly:%s", reason))
+		},
+		OnLogin: func(session *Session) {
+			events = append(events, fmt.Sprintf("login:%v", session.User().GetID()))
+		},
+		OnLogout: func(session *Session, userID interface{}) {
+			events = append(events, fmt.Sprintf("logout:%v", userID))
+		},
+	}
+
+	// Create a session, log in and out, and destroy it.
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := Start(httptest.NewRecorder(), req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.LogIn(&TestUser{ID: "userid"}, false, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.LogOut(); err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if err := session.Destroy(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// A session from a different network.
+	session, err = Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"created",
+		"regenerated",
+		"login:userid",
+		"logout:userid",
+		"destroyed",
+		"created",
+		"anomaly:remoteip",
+		"destroyed",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Unexpected events %v, expected %v", events, expected)
+	}
+}
@@ -0,0 +1,50 @@
+package sessions
+
+// Location is the approximate geographical location of a client, as
+// determined by Locator. Fields which are unknown are empty or zero.
+type Location struct {
+	// The ISO 3166-1 alpha-2 code of the country, e.g. "DE".
+	Country string
+
+	// The name of the city, e.g. "Berlin".
+	City string
+
+	// The coordinates, in degrees.
+	Latitude, Longitude float64
+}
+
+// IsZero returns whether the location is unknown.
+func (l Location) IsZero() bool {
+	return l == Location{}
+}
+
+// GeoLocator determines the location of IP addresses (see Locator). Use it to
+// connect a geolocation database, e.g. MaxMind GeoLite2, to this package.
+type GeoLocator interface {
+	// Locate returns the location of the given IP address (without a port).
+	// It must be safe for concurrent use. It is called while a request is
+	// processed so it should return quickly.
+	Locate(ip string) (Location, error)
+}
+
+// locate returns the location of the given remote address (IP:port) as
+// determined by Locator. The zero location is returned if Locator is nil or if
+// it fails.
+func locate(remoteAddr string) Location {
+	if Locator == nil {
+		return Location{}
+	}
+	location, err := Locator.Locate(remoteHost(remoteAddr))
+	if err != nil {
+		return Location{}
+	}
+	return location
+}
+
+// Location returns the approximate location of the client which last accessed
+// this session (see Locator). The zero location is returned if it is unknown.
+func (s *Session) Location() Location {
+	s.RLock()
+	defer s.RUnlock()
+	return s.location
+}
@@ -0,0 +1,67 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testLocator locates IP addresses from a fixed table.
+type testLocator map[string]Location
+
+// Locate implements GeoLocator.
+func (l testLocator) Locate(ip string) (Location, error) {
+	location, ok := l[ip]
+	if !ok {
+		return Location{}, errors.New("Unknown IP address")
+	}
+	return location, nil
+}
+
+// Test recording session locations.
+func TestSessionLocation(t *testing.T) {
+	defer reset()
+	berlin := Location{Country: "DE", City: "Berlin", Latitude: 52.52, Longitude: 13.405}
+	paris := Location{Country: "FR", City: "Paris", Latitude: 48.857, Longitude: 2.352}
+
+	// Without a locator, nothing is recorded.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	session, err := Start(httptest.NewRecorder(), req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.Location().IsZero() {
+		t.Errorf("Unexpected location %+v", session.Location())
+	}
+
+	// New sessions are located.
+	Locator = testLocator{"192.0.2.1": berlin, "198.51.100.1": paris}
+	if session, err = Start(httptest.NewRecorder(), req, true); err != nil {
+		t.Fatal(err)
+	}
+	if session.Location() != berlin {
+		t.Errorf("Unexpected location %+v after creation", session.Location())
+	}
+
+	// A changed IP address leads to a new location.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if session, err = Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if session.Location() != paris {
+		t.Errorf("Unexpected location %+v after IP change", session.Location())
+	}
+
+	// Unknown addresses result in an unknown location.
+	req.RemoteAddr = "203.0.113.1:1234"
+	if session, err = Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if !session.Location().IsZero() {
+		t.Errorf("Unexpected location %+v for unknown IP address", session.Location())
+	}
+}
@@ -0,0 +1,61 @@
+package sessions
+
+import (
+	"encoding/gob"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// commonTypesOnce ensures that the common types are only registered once.
+	commonTypesOnce sync.Once
+
+	// gobTypes contains the types (reflect.Type) of session values which were
+	// already registered with encoding/gob (see AutoRegisterGobTypes).
+	gobTypes sync.Map
+)
+
+// RegisterCommonTypes registers types with encoding/gob which are frequently
+// stored in sessions but which are not registered by encoding/gob itself, for
+// example time.Time or map[string]interface{}. Values stored in sessions are
+// interface values and encoding/gob can only encode and decode interface values
+// whose types were registered. Otherwise, saving a session (e.g. when it is
+// dropped from the cache) fails with a "type not registered" error.
+//
+// Registration is global to the process and cannot be undone. Types which were
+// already registered under a different name are skipped. It is safe to call
+// this function multiple times.
+func RegisterCommonTypes() {
+	commonTypesOnce.Do(func() {
+		for _, value := range []interface{}{
+			time.Time{},
+			time.Duration(0),
+			[]interface{}{},
+			map[string]interface{}{},
+			map[string]string{},
+			map[string]int{},
+			map[string]bool{},
+			map[string][]string{},
+			[]map[string]interface{}{},
+		} {
+			registerGobType(value)
+		}
+	})
+}
+
+// registerGobType registers the type of the given value with encoding/gob if it
+// has not been registered by this package before. Conflicting registrations
+// (which cause encoding/gob to panic) are ignored.
+func registerGobType(value interface{}) {
+	if value == nil {
+		return
+	}
+	if _, loaded := gobTypes.LoadOrStore(reflect.TypeOf(value), struct{}{}); loaded {
+		return
+	}
+	defer func() {
+		recover() // The type was registered under a different name.
+	}()
+	gob.Register(value)
+}
@@ -0,0 +1,51 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+// gobTestValue is a custom type stored in sessions.
+type gobTestValue struct {
+	Name    string
+	Created time.Time
+}
+
+// Test the automatic registration of gob types.
+func TestAutoRegisterGobTypes(t *testing.T) {
+	defer reset()
+	AutoRegisterGobTypes = true
+	session := &Session{data: make(map[string]interface{})}
+	value := gobTestValue{Name: "test", Created: time.Now().Round(0)}
+	if err := session.Set("custom", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Set("time", value.Created); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Set("map", map[string]interface{}{"list": []interface{}{1, "two"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Serialize and unserialize the session.
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(session); err != nil {
+		t.Fatal(err)
+	}
+	var recovered Session
+	if err := gob.NewDecoder(&buffer).Decode(&recovered); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := recovered.Get("custom", nil).(gobTestValue); !ok || v.Name != value.Name || !v.Created.Equal(value.Created) {
+		t.Errorf("Unexpected custom value %v", recovered.Get("custom", nil))
+	}
+	if !recovered.Equal(session) {
+		t.Error("Recovered session differs from the original session")
+	}
+
+	// Registering twice does not panic.
+	RegisterCommonTypes()
+	registerGobType(value)
+}
@@ -0,0 +1,112 @@
+package sessions
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CompromisedPasswordChecker checks passwords against an external list of
+// compromised passwords, i.e. passwords which were exposed in data breaches.
+// See CompromisedPasswords.
+type CompromisedPasswordChecker interface {
+	// Compromised returns whether the given password is known to be
+	// compromised. An error is returned if this cannot be determined.
+	Compromised(password string) (bool, error)
+}
+
+// DefaultHIBPURL is the address of the "Have I Been Pwned" range API used by
+// HIBPChecker if no other URL is given.
+const DefaultHIBPURL = "https://api.pwnedpasswords.com/range/"
+
+// HIBPChecker implements CompromisedPasswordChecker with the "Have I Been
+// Pwned" Pwned Passwords range API. The password never leaves your server:
+// only the first 5 characters of its SHA-1 hash are sent to the API, which
+// responds with the suffixes of all compromised hashes starting with these
+// characters (k-anonymity). Responses are padded to make them
+// indistinguishable. The zero value is ready to use:
+//
+//	sessions.CompromisedPasswords = &sessions.HIBPChecker{}
+//
+// See https://haveibeenpwned.com/API/v3#PwnedPasswords for details.
+type HIBPChecker struct {
+	// The HTTP client used for requests to the API. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// The maximum duration of a request to the API. If 0, a default of 5
+	// seconds is used.
+	Timeout time.Duration
+
+	// The URL of the range API, to which the hash prefix is appended. If empty,
+	// DefaultHIBPURL is used. This may point to a mirror of the API.
+	URL string
+
+	// The minimum number of times a password must have been seen in data
+	// breaches to be considered compromised. If 0, a password is compromised if
+	// it was seen at all.
+	MinCount int
+}
+
+// Compromised returns whether the given password was found in the "Have I Been
+// Pwned" database.
+func (h *HIBPChecker) Compromised(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	url := h.URL
+	if url == "" {
+		url = DefaultHIBPURL
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url+prefix, nil)
+	if err != nil {
+		return false, fmt.Errorf("Could not create request: %s", err)
+	}
+	request.Header.Set("Add-Padding", "true")
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return false, fmt.Errorf("Could not query compromised passwords: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Could not query compromised passwords: %s", response.Status)
+	}
+
+	// Each line contains a hash suffix and its count, e.g.
+	// "0018A45C4D1DEF81644B54AB7F969B88D65:10". Padding entries have a count
+	// of 0.
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineSuffix, countText, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(countText)
+		if err != nil {
+			return false, fmt.Errorf("Invalid count in response: %q", line)
+		}
+		return count > 0 && count >= h.MinCount, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("Could not read response: %s", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,82 @@
+package sessions
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test checking passwords against the "Have I Been Pwned" range API.
+func TestHIBPChecker(t *testing.T) {
+	defer reset()
+
+	// SHA-1 of "P@ssw0rd" is 21BD12DC183F740EE76F27B78EB39C8AD972A757.
+	var (
+		requests      []string
+		requestsMutex sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestsMutex.Lock()
+		requests = append(requests, request.URL.Path)
+		requestsMutex.Unlock()
+		if request.Header.Get("Add-Padding") != "true" {
+			t.Error("Padding was not requested")
+		}
+		switch request.URL.Path {
+		case "/21BD1":
+			fmt.Fprint(response, "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n2DC183F740EE76F27B78EB39C8AD972A757:52579\r\nFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:0\r\n")
+		case "/5BAA6":
+			time.Sleep(100 * time.Millisecond)
+		case "/fail/7B5A7":
+			http.Error(response, "Unavailable", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(response, "2DC183F740EE76F27B78EB39C8AD972A757:0\r\n")
+		}
+	}))
+	defer server.Close()
+	checker := &HIBPChecker{URL: server.URL + "/", Timeout: 50 * time.Millisecond}
+
+	if compromised, err := checker.Compromised("P@ssw0rd"); err != nil || !compromised {
+		t.Errorf("Compromised password was not detected (error %v)", err)
+	}
+	requestsMutex.Lock()
+	if len(requests) != 1 || requests[0] != "/21BD1" {
+		t.Errorf("Unexpected requests %v", requests)
+	}
+	requestsMutex.Unlock()
+	if compromised, err := checker.Compromised("hflIhf.lKK$982ß"); err != nil || compromised {
+		t.Errorf("Unknown password was reported (error %v)", err)
+	}
+	checker.MinCount = 100000
+	if compromised, err := checker.Compromised("P@ssw0rd"); err != nil || compromised {
+		t.Errorf("Password below the minimum count was reported (error %v)", err)
+	}
+
+	// Timeouts. (SHA-1 of "password" starts with 5BAA6.)
+	if _, err := checker.Compromised("password"); err == nil || !strings.Contains(err.Error(), "Could not query") {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+
+	// Integration with password checks.
+	checker.MinCount = 0
+	CompromisedPasswords = checker
+	if result := ReasonablePassword("P@ssw0rd", nil); result != PasswordWasCompromised {
+		t.Errorf("Expected PasswordWasCompromised, got %d", result)
+	}
+	logger := &testLogger{}
+	Log = logger
+	if result := ReasonablePassword("password", nil); result != PasswordWasCompromised {
+		t.Errorf("Embedded list was not checked: %d", result)
+	}
+	CompromisedPasswords = &HIBPChecker{URL: server.URL + "/fail/"}
+	if problems := (PasswordPolicy{CheckBreached: true}).Check("hflIhf.lKK$982ß", nil); len(problems) != 0 {
+		t.Errorf("Failed check rejected password: %v", problems)
+	}
+	if !logger.contains("WARN: Could not check for compromised password") {
+		t.Errorf("Failed check was not logged: %v", logger.messages)
+	}
+}
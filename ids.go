@@ -1,8 +1,9 @@
 package sessions
 
 import (
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
@@ -18,6 +19,8 @@ var (
 	lastMutex   sync.Mutex // The mutex which syncs access to the timestamp and counter.
 	lastTime    uint64     // The timestamp of the last CCUID.
 	lastCounter uint64     // The counter of the last CCUID.
+	atTime      uint64     // The timestamp of the last CUID generated by CUIDAt().
+	atCounter   uint64     // The counter of the last CUID generated by CUIDAt().
 )
 
 // Initialize variables needed for the CUID.
@@ -54,20 +57,40 @@ func initCUID() {
 func CUID() string {
 	lastMutex.Lock()
 	defer lastMutex.Unlock()
+	return cuid(time.Now(), &lastTime, &lastCounter)
+}
 
+// CUIDAt is like CUID() but uses the given time for the timestamp field instead
+// of the current time. This is useful when backfilling historical records whose
+// identifiers should be sortable by their original creation time.
+//
+// As with CUID(), a counter is increased with every consecutive call for the
+// same timestamp (in milliseconds) to avoid collisions. This counter is
+// separate from the one used by CUID(). It is reset when the timestamp changes
+// so you should generate the identifiers of records with the same timestamp
+// consecutively, e.g. by processing records in chronological order.
+func CUIDAt(t time.Time) string {
+	lastMutex.Lock()
+	defer lastMutex.Unlock()
+	return cuid(t, &atTime, &atCounter)
+}
+
+// cuid generates a CUID for the given time. The variables which hold the
+// timestamp and the counter of the previous call are updated. This function
+// does not synchronize access to these variables.
+func cuid(now time.Time, lastTime, lastCounter *uint64) string {
 	// Initialize the bits with the timestamp.
-	now := time.Now()
 	timestamp := uint64(now.Unix())*1000 - referenceDate + uint64(now.Nanosecond())/1000000
 	timestamp &= (1 << 40) - 1
 
 	// Counter.
-	if timestamp == lastTime {
-		lastCounter++
+	if timestamp == *lastTime {
+		*lastCounter++
 	} else {
-		lastCounter = 0
+		*lastCounter = 0
 	}
-	lastTime = timestamp
-	counter := uint64(lastCounter & 0xff)
+	*lastTime = timestamp
+	counter := uint64(*lastCounter & 0xff)
 
 	// MAC address.
 	var macHash uint16
@@ -75,7 +98,7 @@ func CUID() string {
 		macHash = (macHash << 5) - macHash // *= 31 (a prime).
 		macHash += uint16(b)
 	}
-	spill := lastCounter >> 8
+	spill := *lastCounter >> 8
 	if spill != 0 {
 		macHash += uint16(spill & 0xffff)
 	}
@@ -104,19 +127,18 @@ func RandomID(length int) (string, error) {
 	chars := "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 	var b [1]byte
 	for length > 0 {
-		n, err := rand.Reader.Read(b[:])
-		if err != nil {
+		if err := readRandom(b[:]); err != nil {
 			return "", err
 		}
-		if n < 1 {
-			return "", errors.New("Unable to generate random number")
-		}
 		length--
 		id[length] = chars[int(b[0])%len(chars)]
 	}
 	return string(id), nil
 }
 
+// sessionIDBytes is the number of random bytes in a session ID.
+const sessionIDBytes = 16
+
 // generateSessionID generates a random 128-bit, Base64-encoded session ID.
 // Collision probability is close to zero. The resulting string is 24 characters
 // long.
@@ -124,9 +146,73 @@ func generateSessionID() (string, error) {
 	// For more on collisions:
 	// https://en.wikipedia.org/wiki/Birthday_problem
 	// http://www.wolframalpha.com/input/?i=1-e%5E(-1000000000*(1000000000-1)%2F(2*2%5E128))
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
+	b := make([]byte, sessionIDBytes)
+	if err := readRandom(b); err != nil {
 		return "", fmt.Errorf("Could not generate session ID: %s", err)
 	}
 	return base64.StdEncoding.EncodeToString(b), nil
 }
+
+// newSessionID returns an ID for a new session. It is generated by the
+// persistence layer (see SessionIDGenerator) or, if the persistence layer does
+// not provide one, by generateSessionID().
+func newSessionID() (string, error) {
+	generator, ok := Persistence.(SessionIDGenerator)
+	if !ok {
+		return generateSessionID()
+	}
+	id, err := generator.NewSessionID()
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return generateSessionID()
+	}
+	if !ValidSessionIDFormat(id) {
+		return "", errors.New("Persistence layer generated a session ID with an invalid format")
+	}
+	return id, nil
+}
+
+// MaskSessionID redacts a session ID so it can be written to logs without
+// leaking a credential which could be used to hijack the session. Depending on
+// SessionIDMaskPrefix, the ID is either replaced by a hash of it (the default)
+// or shortened to its first characters followed by "...". Masking the same ID
+// always gives the same result so log entries concerning the same session can
+// still be correlated. An empty ID remains empty.
+//
+// The package uses this function for session IDs in its own error messages
+// and, if AuditMaskSessionIDs is true, in audit records.
+func MaskSessionID(id string) string {
+	if id == "" {
+		return ""
+	}
+	if SessionIDMaskPrefix > 0 {
+		if len(id) <= SessionIDMaskPrefix {
+			return "..."
+		}
+		return id[:SessionIDMaskPrefix] + "..."
+	}
+	hash := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(hash[:8])
+}
+
+// ValidSessionIDFormat checks whether the given string has the format of a
+// session ID as generated by this package, i.e. if it consists of 24 Base64
+// characters. Both the standard and the URL-safe Base64 alphabets are
+// accepted. No session store is consulted so this is cheap enough to reject
+// malformed session cookies early, e.g. in a middleware or a gateway. Start()
+// performs the same check. Note that a valid format does not mean that a
+// session with this ID exists.
+func ValidSessionIDFormat(id string) bool {
+	if len(id) != base64.StdEncoding.EncodedLen(sessionIDBytes) {
+		return false
+	}
+	for _, ch := range id {
+		if !(ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '+' || ch == '/' || ch == '-' || ch == '_' || ch == '=') {
+			return false
+		}
+	}
+	return true
+}
@@ -1,8 +1,11 @@
 package sessions
 
 import (
+	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Test generation of CUIDs and collisions.
@@ -36,3 +39,98 @@ func TestRandomID(t *testing.T) {
 	}
 	t.Logf("Generated ID: %s", id)
 }
+
+// Test generation of CUIDs for a given time.
+func TestCUIDAt(t *testing.T) {
+	date, _ := time.Parse("2006-01-02", "2018-03-15")
+	set := make(map[string]struct{})
+	count := 1024
+	for i := 0; i < count; i++ {
+		set[CUIDAt(date)] = struct{}{}
+	}
+	if len(set) != count {
+		t.Errorf("Found %d CUID collisions", count-len(set))
+	}
+	earlier, later := CUIDAt(date), CUIDAt(date.Add(time.Hour))
+	if earlier >= later {
+		t.Errorf("CUIDs are not sorted by time: %s >= %s", earlier, later)
+	}
+}
+
+// Test the validation of session ID formats.
+func TestValidSessionIDFormat(t *testing.T) {
+	id, err := generateSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidSessionIDFormat(id) {
+		t.Errorf("Generated session ID was rejected: %s", id)
+	}
+	for _, id := range []string{"", "short", id + "A", "AAAAAAAAAAAAAAAAAAAAAA$=", "AAAAAAAAAAAAAAAAAAAAAA ="} {
+		if ValidSessionIDFormat(id) {
+			t.Errorf("Invalid session ID was accepted: %q", id)
+		}
+	}
+	if !ValidSessionIDFormat("Ab-_AAAAAAAAAAAAAAAAAA==") {
+		t.Error("URL-safe session ID was rejected")
+	}
+}
+
+// Test masking session IDs.
+func TestMaskSessionID(t *testing.T) {
+	defer reset()
+	if MaskSessionID("") != "" {
+		t.Error("Empty session ID was not kept")
+	}
+	masked := MaskSessionID(sessionID)
+	if len(masked) != 16 || strings.Contains(sessionID, masked[:4]) || MaskSessionID(sessionID) != masked {
+		t.Errorf("Unexpected hash mask %q", masked)
+	}
+	if MaskSessionID(sessionID+"x") == masked {
+		t.Error("Different session IDs have the same mask")
+	}
+	SessionIDMaskPrefix = 6
+	if masked := MaskSessionID(sessionID); masked != "012345..." {
+		t.Errorf("Unexpected prefix mask %q", masked)
+	}
+	if masked := MaskSessionID("abc"); masked != "..." {
+		t.Errorf("Short session ID was revealed: %q", masked)
+	}
+}
+
+// Test session IDs generated by the persistence layer.
+func TestNewSessionID(t *testing.T) {
+	defer reset()
+	id, err := newSessionID()
+	if err != nil || !ValidSessionIDFormat(id) {
+		t.Errorf("Invalid default session ID %q: %v", id, err)
+	}
+
+	// Store-generated IDs.
+	next := "AAAAAAAAAAAAAAAAAAAAAA01"
+	Persistence = ExtendablePersistenceLayer{
+		NewSessionIDFunc: func() (string, error) {
+			return next, nil
+		},
+	}
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.id != next {
+		t.Errorf("Session has ID %q, expected %q", session.id, next)
+	}
+	next = "AAAAAAAAAAAAAAAAAAAAAA02"
+	if err := session.RegenerateID(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if session.id != next {
+		t.Errorf("Regenerated session has ID %q, expected %q", session.id, next)
+	}
+
+	// Invalid IDs are rejected.
+	next = "short"
+	if _, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true); err == nil {
+		t.Error("Invalid session ID was accepted")
+	}
+}
@@ -0,0 +1,55 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrUserMismatch is returned when a session loaded from the persistence layer
+// does not belong to the requested session ID (see UserIntegrityKey).
+var ErrUserMismatch = errors.New("Session user does not match session ID")
+
+// computeUserMAC returns an HMAC over the given session ID and the ID of the
+// session's user, keyed with UserIntegrityKey. It returns nil if no key is
+// configured or if no user is logged into the session. The session must be
+// locked (at least for reading) while this function is called.
+func (s *Session) computeUserMAC(id string) []byte {
+	userID, ok := s.userID()
+	if UserIntegrityKey == nil || !ok {
+		return nil
+	}
+	mac := hmac.New(sha256.New, UserIntegrityKey)
+	mac.Write([]byte(id))
+	mac.Write([]byte{0})
+	mac.Write([]byte(canonicalUserID(userID)))
+	return mac.Sum(nil)
+}
+
+// verifyUserMAC checks if the user MAC read from the persistence layer matches
+// the given session ID and the session's user. Sessions without a user and
+// sessions which were saved without a MAC are accepted. All sessions are
+// accepted if UserIntegrityKey is nil. The session must be locked (at least
+// for reading) while this function is called.
+func (s *Session) verifyUserMAC(id string) bool {
+	if UserIntegrityKey == nil || s.userMAC == nil {
+		return true
+	}
+	expected := s.computeUserMAC(id)
+	return expected != nil && hmac.Equal(expected, s.userMAC)
+}
+
+// canonicalUserID returns a string representation of a user ID which does not
+// change when the ID goes through serialization. In particular, numeric IDs
+// are decoded from JSON as float64 values.
+func canonicalUserID(userID interface{}) string {
+	switch id := userID.(type) {
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(id), 'f', -1, 32)
+	}
+	return fmt.Sprint(userID)
+}
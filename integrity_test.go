@@ -0,0 +1,99 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test the detection of sessions which were returned for the wrong ID.
+func TestUserIntegrity(t *testing.T) {
+	defer reset()
+	UserIntegrityKey = []byte("0123456789abcdef0123456789abcdef")
+	store := make(map[string][]byte)
+	id1, _ := generateSessionID()
+	id2, _ := generateSessionID()
+	var swapped bool // Simulates a faulty store.
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			if swapped {
+				id = map[string]string{id1: id2, id2: id1}[id]
+			}
+			serialized, ok := store[id]
+			if !ok {
+				return nil, nil
+			}
+			var session Session
+			return &session, session.GobDecode(serialized)
+		},
+		SaveSessionFunc: func(id string, session *Session) error {
+			serialized, err := session.GobEncode()
+			store[id] = serialized
+			return err
+		},
+		LoadUserFunc: func(id interface{}) (User, error) {
+			return &TestUser{ID: id.(string)}, nil
+		},
+	}
+	for id, userID := range map[string]string{id1: "alice", id2: "bob", "s3": ""} {
+		session := &Session{id: id, data: make(map[string]interface{})}
+		if userID != "" {
+			session.user = &TestUser{ID: userID}
+		}
+		if err := sessions.Set(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Correct sessions are accepted.
+	clearCache()
+	session, err := sessions.Get(id1)
+	if err != nil || session == nil || session.User().GetID() != "alice" {
+		t.Fatalf("Correct session was not loaded: %v", err)
+	}
+
+	// Swapped sessions are rejected.
+	clearCache()
+	swapped = true
+	if _, err := sessions.Get(id2); err != ErrUserMismatch {
+		t.Errorf("Expected ErrUserMismatch, got %v", err)
+	}
+	if len(cachedSessions()) != 0 {
+		t.Error("Rejected session was cached")
+	}
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(&http.Cookie{Name: SessionCookie, Value: id1})
+	if _, err := Start(httptest.NewRecorder(), request, true); !errors.Is(err, ErrUserMismatch) {
+		t.Error("Start() accepted a session of another user")
+	}
+
+	// Without a key, nothing is checked.
+	UserIntegrityKey = nil
+	if _, err := sessions.Get(id2); err != nil {
+		t.Errorf("Session was rejected without a key: %s", err)
+	}
+}
+
+// Test user MACs with numeric user IDs which change their type in JSON.
+func TestUserIntegrityJSON(t *testing.T) {
+	defer reset()
+	UserIntegrityKey = []byte("0123456789abcdef0123456789abcdef")
+	LazyUserLoading = true
+	session := &Session{id: "s1", pendingUserID: 1234500, data: make(map[string]interface{})}
+	serialized, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Session
+	if err := json.Unmarshal(serialized, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.verifyUserMAC("s1") {
+		t.Error("User MAC does not match after JSON round trip")
+	}
+	if decoded.verifyUserMAC("s2") {
+		t.Error("User MAC matches a different session ID")
+	}
+}
@@ -0,0 +1,43 @@
+package sessions
+
+// SetLocal attaches a value to this session which exists only in the memory of
+// the current process. Unlike values stored with Set(), local values are never
+// serialized, never handed to the persistence layer, and never announced to
+// subscribers (see Subscribe()). This makes them suitable for objects which
+// are derived from the session or from the request, e.g. a parsed locale or a
+// resolved tenant object, and which must not end up in the data store. Use
+// GetLocal() to retrieve them.
+//
+// Local values belong to this Session object. They are lost when the session
+// is dropped from the local cache or when it is loaded by a different process.
+// They are also removed when a user logs in or out and when the session is
+// destroyed. Your application must therefore always be able to recompute
+// them. Because all requests for the same session share the cached Session
+// object, local values are also visible to concurrent requests of that
+// session. For values which must be strictly limited to a single request,
+// use the request's context instead.
+//
+// A nil value removes the key.
+func (s *Session) SetLocal(key string, value interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	if value == nil {
+		delete(s.locals, key)
+		return
+	}
+	if s.locals == nil {
+		s.locals = make(map[string]interface{})
+	}
+	s.locals[key] = value
+}
+
+// GetLocal returns a value attached with SetLocal(). If the key does not
+// exist, "def" is returned.
+func (s *Session) GetLocal(key string, def interface{}) interface{} {
+	s.RLock()
+	defer s.RUnlock()
+	if value, ok := s.locals[key]; ok {
+		return value
+	}
+	return def
+}
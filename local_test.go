@@ -0,0 +1,67 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test values which are not persisted.
+func TestSessionLocal(t *testing.T) {
+	defer reset()
+	var saved int
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			saved++
+			return nil
+		},
+	}
+	session := &Session{id: sessionID, data: make(map[string]interface{})}
+	session.SetLocal("tenant", "acme")
+	if value := session.GetLocal("tenant", nil); value != "acme" {
+		t.Errorf("Unexpected local value: %v", value)
+	}
+	if value := session.Get("tenant", nil); value != nil {
+		t.Errorf("Local value visible as session data: %v", value)
+	}
+	if saved != 0 {
+		t.Error("Setting a local value saved the session")
+	}
+
+	// Local values are not serialized.
+	serialized, err := session.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Session
+	if err := decoded.GobDecode(serialized); err != nil {
+		t.Fatal(err)
+	}
+	if value := decoded.GetLocal("tenant", "none"); value != "none" {
+		t.Errorf("Local value was serialized: %v", value)
+	}
+
+	// Removing values.
+	session.SetLocal("tenant", nil)
+	if value := session.GetLocal("tenant", "none"); value != "none" {
+		t.Errorf("Local value was not removed: %v", value)
+	}
+
+	// Logging in and destroying the session clears local values.
+	session.SetLocal("tenant", "acme")
+	if err := session.LogIn(&TestUser{ID: "12345"}, false, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if value := session.GetLocal("tenant", nil); value != nil {
+		t.Errorf("Local value survived login: %v", value)
+	}
+	session.SetLocal("tenant", "acme")
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if err := session.Destroy(httptest.NewRecorder(), request); err != nil {
+		t.Fatal(err)
+	}
+	if value := session.GetLocal("tenant", nil); value != nil {
+		t.Errorf("Local value survived destruction: %v", value)
+	}
+}
@@ -0,0 +1,38 @@
+package sessions
+
+// Logger receives diagnostic messages from this package (see Log). The
+// arguments following the message are alternating keys and values which
+// describe the event, e.g. "session", "a1b2c3d4e5f6a7b8", "error", err. Session
+// IDs are always masked (see MaskSessionID()).
+//
+// The method set corresponds to that of *slog.Logger from the standard
+// library so you may simply assign a slog logger:
+//
+//	sessions.Log = slog.Default()
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// logDebug passes a debug message to Log, if set.
+func logDebug(msg string, args ...interface{}) {
+	if Log != nil {
+		Log.Debug(msg, args...)
+	}
+}
+
+// logWarn passes a warning to Log, if set.
+func logWarn(msg string, args ...interface{}) {
+	if Log != nil {
+		Log.Warn(msg, args...)
+	}
+}
+
+// logError passes an error message to Log, if set.
+func logError(msg string, args ...interface{}) {
+	if Log != nil {
+		Log.Error(msg, args...)
+	}
+}
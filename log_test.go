@@ -0,0 +1,86 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogger records log messages.
+type testLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) log(level, msg string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, fmt.Sprint(level, ": ", msg, " ", args))
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args...) }
+func (l *testLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args...) }
+func (l *testLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args...) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args...) }
+
+// contains returns whether a message with the given prefix was logged.
+func (l *testLogger) contains(prefix string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, message := range l.messages {
+		if strings.HasPrefix(message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Test logging of background failures and anomalies.
+func TestLog(t *testing.T) {
+	defer reset()
+	defer clearCache()
+	logger := &testLogger{}
+	Log = logger
+	AcceptRemoteIP = 4
+
+	// Anomalies.
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.contains("WARN: Session rejected") {
+		t.Errorf("Anomaly was not logged: %v", logger.messages)
+	}
+
+	// Failed deletion of a reference session.
+	SessionIDGracePeriod = time.Millisecond
+	if session, err = Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true); err != nil {
+		t.Fatal(err)
+	}
+	Persistence = ExtendablePersistenceLayer{
+		DeleteSessionFunc: func(id string) error {
+			return errors.New("store unavailable")
+		},
+	}
+	if err := session.RegenerateID(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !logger.contains("ERROR: Could not delete reference session") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Failed deletion was not logged: %v", logger.messages)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,51 @@
+package sessions
+
+import (
+	"time"
+)
+
+// Names of the metrics reported to MetricsSink (see Metrics). They follow the
+// Prometheus naming conventions.
+const (
+	MetricSessionsCreated   = "sessions_created_total"              // Counter: sessions created by Start().
+	MetricCacheHits         = "sessions_cache_hits_total"           // Counter: sessions found in the local cache.
+	MetricCacheMisses       = "sessions_cache_misses_total"         // Counter: sessions which had to be requested from the persistence layer.
+	MetricCacheEvictions    = "sessions_cache_evictions_total"      // Counter: sessions dropped from the local cache to make room or because they were not accessed.
+	MetricAnomalyRejections = "sessions_anomaly_rejections_total"   // Counter: sessions rejected by Start() because of anomalies (see EventHooks.OnAnomalyDetected).
+	MetricCachedSessions    = "sessions_cached"                     // Gauge: sessions currently held in the local cache.
+	MetricPersistenceLoad   = "sessions_persistence_load_seconds"   // Histogram: duration of Persistence.LoadSession() calls.
+	MetricPersistenceSave   = "sessions_persistence_save_seconds"   // Histogram: duration of Persistence.SaveSession() calls.
+	MetricPersistenceDelete = "sessions_persistence_delete_seconds" // Histogram: duration of Persistence.DeleteSession() calls.
+)
+
+// Metrics receives measurements from this package (see MetricsSink). Metric
+// names are given by the Metric constants. Implementations must be safe for
+// concurrent use and they should return quickly because they are called
+// while requests are processed. The subpackage "prometheus" contains an
+// implementation which exposes the metrics to a Prometheus server.
+type Metrics interface {
+	// IncCounter increments the counter with the given name by 1.
+	IncCounter(name string)
+
+	// SetGauge sets the gauge with the given name to the given value.
+	SetGauge(name string, value float64)
+
+	// Observe adds a value to the histogram with the given name. Durations are
+	// reported in seconds.
+	Observe(name string, value float64)
+}
+
+// countMetric increments a counter of MetricsSink, if set.
+func countMetric(name string) {
+	if MetricsSink != nil {
+		MetricsSink.IncCounter(name)
+	}
+}
+
+// observeDuration reports the time passed since "start" to a histogram of
+// MetricsSink, if set.
+func observeDuration(name string, start time.Time) {
+	if MetricsSink != nil {
+		MetricsSink.Observe(name, time.Since(start).Seconds())
+	}
+}
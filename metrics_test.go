@@ -0,0 +1,101 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testMetrics records metrics.
+type testMetrics struct {
+	sync.Mutex
+	counters     map[string]int
+	gauges       map[string]float64
+	observations map[string]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		counters:     make(map[string]int),
+		gauges:       make(map[string]float64),
+		observations: make(map[string]int),
+	}
+}
+
+func (m *testMetrics) IncCounter(name string) {
+	m.Lock()
+	defer m.Unlock()
+	m.counters[name]++
+}
+
+func (m *testMetrics) SetGauge(name string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *testMetrics) Observe(name string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.observations[name]++
+}
+
+// Test feeding metrics to MetricsSink.
+func TestMetrics(t *testing.T) {
+	defer reset()
+	defer clearCache()
+	metrics := newTestMetrics()
+	MetricsSink = metrics
+	AcceptRemoteIP = 4
+
+	// Creation.
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.counters[MetricSessionsCreated] != 1 {
+		t.Errorf("Expected 1 created session, got %d", metrics.counters[MetricSessionsCreated])
+	}
+	if metrics.gauges[MetricCachedSessions] != 1 {
+		t.Errorf("Expected 1 cached session, got %f", metrics.gauges[MetricCachedSessions])
+	}
+	if metrics.observations[MetricPersistenceSave] == 0 {
+		t.Error("Save latency was not observed")
+	}
+
+	// Cache hit.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.counters[MetricCacheHits] != 1 {
+		t.Errorf("Expected 1 cache hit, got %d", metrics.counters[MetricCacheHits])
+	}
+
+	// Cache miss.
+	if _, err := sessions.Get("unknown"); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.counters[MetricCacheMisses] != 1 || metrics.observations[MetricPersistenceLoad] != 1 {
+		t.Errorf("Expected 1 cache miss with load latency, got %d and %d", metrics.counters[MetricCacheMisses], metrics.observations[MetricPersistenceLoad])
+	}
+
+	// Anomaly.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.counters[MetricAnomalyRejections] != 1 {
+		t.Errorf("Expected 1 anomaly rejection, got %d", metrics.counters[MetricAnomalyRejections])
+	}
+
+	// Purging.
+	PurgeSessions()
+	if metrics.gauges[MetricCachedSessions] != 0 {
+		t.Errorf("Expected empty cache, got %f", metrics.gauges[MetricCachedSessions])
+	}
+}
@@ -2,6 +2,7 @@ package sessions
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,6 +29,17 @@ type mutexes struct {
 	acquire    chan interface{}
 	release    chan interface{}
 	purge      chan struct{}
+	done       chan struct{}  // Closed to stop the goroutines. Nil if they are not running.
+	doneMutex  sync.Mutex     // Synchronizes starting and stopping of the goroutines.
+	running    sync.WaitGroup // Waits for the goroutines to stop.
+
+	// Lock statistics (see MeasureLockWaits). Accessed atomically.
+	acquisitions int64 // The number of acquired locks.
+	contended    int64 // The number of acquisitions which had to wait.
+	waitTime     int64 // The total time spent waiting, in nanoseconds.
+	maxWaitTime  int64 // The longest time spent waiting, in nanoseconds.
+	waiting      int64 // The number of goroutines currently in Lock().
+	maxWaiters   int64 // The highest number of waiters on a single key.
 }
 
 // mutexItem is a lockable item.
@@ -46,17 +58,42 @@ func newMutexes() *mutexes {
 		release: make(chan interface{}),
 		purge:   make(chan struct{}),
 	}
+	m.start()
+	return m
+}
+
+// start starts the goroutines of the locking handler if they are not running
+// yet. This includes the goroutine which regularly purges stale mutexes unless
+// BackgroundMutexPurge is false.
+func (m *mutexes) start() {
+	m.doneMutex.Lock()
+	defer m.doneMutex.Unlock()
+	if m.done != nil {
+		return // Already running.
+	}
+	done := make(chan struct{})
+	m.done = done
 
 	// Main goroutine.
+	m.running.Add(1)
 	go func() {
+		defer m.running.Done()
 		for {
 			select {
 
+			// The locking handler was closed.
+			case <-done:
+				return
+
 			// A lock was requested.
 			case key := <-m.acquire:
 				item := m.getItem(key)
 				if item.locks == 0 {
 					item.release <- struct{}{}
+				} else if MeasureLockWaits {
+					// The lock holder and earlier waiters are ahead of us.
+					atomic.AddInt64(&m.contended, 1)
+					storeMax(&m.maxWaiters, int64(item.locks))
 				}
 				item.locks++
 
@@ -87,14 +124,39 @@ func newMutexes() *mutexes {
 	}()
 
 	// Purge items regularly.
-	go func() {
-		for {
-			time.Sleep(mutexCleanupFrequency)
-			m.purge <- struct{}{}
-		}
-	}()
+	if BackgroundMutexPurge {
+		m.running.Add(1)
+		go func() {
+			defer m.running.Done()
+			ticker := time.NewTicker(mutexCleanupFrequency)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					select {
+					case m.purge <- struct{}{}:
+					case <-done:
+						return
+					}
+				}
+			}
+		}()
+	}
+}
 
-	return m
+// Close stops the goroutines of the locking handler and waits for them to
+// return, so they never run alongside the goroutines started by the next call
+// to Lock(). No locks may be held when this function is called.
+func (m *mutexes) Close() {
+	m.doneMutex.Lock()
+	defer m.doneMutex.Unlock()
+	if m.done != nil {
+		close(m.done)
+		m.done = nil
+		m.running.Wait()
+	}
 }
 
 // getItem returns an item for the given key, creating it if it doesn't exist
@@ -120,11 +182,49 @@ func (m *mutexes) getItem(key interface{}) *mutexItem {
 
 // Lock blocks until any other locks held on the given key are released.
 func (m *mutexes) Lock(key interface{}) {
+	m.start()
+	if !MeasureLockWaits {
+		m.acquire <- key
+		<-m.getItem(key).release
+		return
+	}
+
+	// Measure the time we're waiting.
+	start := time.Now()
+	atomic.AddInt64(&m.waiting, 1)
 	m.acquire <- key
 	<-m.getItem(key).release
+	atomic.AddInt64(&m.waiting, -1)
+	wait := int64(time.Since(start))
+	atomic.AddInt64(&m.acquisitions, 1)
+	atomic.AddInt64(&m.waitTime, wait)
+	storeMax(&m.maxWaitTime, wait)
 }
 
 // Unlock releases a previously acquired lock on the given key.
 func (m *mutexes) Unlock(key interface{}) {
 	m.release <- key
 }
+
+// stats returns the lock statistics collected while MeasureLockWaits was true.
+func (m *mutexes) stats() LockStatistics {
+	return LockStatistics{
+		Acquisitions: atomic.LoadInt64(&m.acquisitions),
+		Contended:    atomic.LoadInt64(&m.contended),
+		TotalWait:    time.Duration(atomic.LoadInt64(&m.waitTime)),
+		MaxWait:      time.Duration(atomic.LoadInt64(&m.maxWaitTime)),
+		Waiting:      int(atomic.LoadInt64(&m.waiting)),
+		MaxWaiters:   int(atomic.LoadInt64(&m.maxWaiters)),
+	}
+}
+
+// storeMax atomically sets the value at "addr" to "value" if "value" is
+// larger.
+func storeMax(addr *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(addr)
+		if value <= current || atomic.CompareAndSwapInt64(addr, current, value) {
+			return
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package sessions
 
 import (
+	"runtime"
 	"strconv"
 	"sync"
 	"testing"
@@ -215,3 +216,30 @@ func TestMutexesSizePurge(t *testing.T) {
 		t.Error("Mutex map was not purged")
 	}
 }
+
+// Test stopping and restarting the goroutines of a locking handler.
+func TestMutexesClose(t *testing.T) {
+	defer reset()
+	before := runtime.NumGoroutine()
+	m := newMutexes()
+	m.Close()
+	time.Sleep(10 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines still running after Close()", n-before)
+	}
+
+	// Without background purging.
+	BackgroundMutexPurge = false
+	done := make(chan struct{})
+	go func() {
+		m.Lock("key")
+		m.Unlock("key")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Mutex still blocking after restart")
+	}
+	m.Close()
+}
@@ -0,0 +1,508 @@
+package sessions
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Types of patterns found by AnalyzePassword().
+const (
+	PatternCompromised = "compromised" // A password from a list of compromised passwords, e.g. "123456".
+	PatternDictionary  = "dictionary"  // A dictionary word (see also AddPasswordDictionary()).
+	PatternLeet        = "leet"        // A dictionary word or compromised password with character substitutions, e.g. "p@ssw0rd".
+	PatternKeyboard    = "keyboard"    // Adjacent keys on a keyboard, e.g. "qwerty" or "asdf".
+	PatternSequence    = "sequence"    // A sequence of letters or digits, e.g. "abcd" or "4321".
+	PatternRepeat      = "repeat"      // A repeated character, e.g. "aaa".
+	PatternDate        = "date"        // A date or a year, e.g. "24.12.1990" or "1987".
+	PatternName        = "name"        // One of the names passed to AnalyzePassword().
+)
+
+// MaxAnalyzedPasswordLength is the number of characters (not bytes) at the
+// beginning of a password which AnalyzePassword() searches for patterns. Any
+// further characters are treated as random characters. This bounds the time
+// spent on very long passwords, which are strong anyway.
+const MaxAnalyzedPasswordLength = 64
+
+// PasswordPattern is a part of a password which follows a predictable
+// pattern.
+type PasswordPattern struct {
+	// The type of the pattern, one of the Pattern constants.
+	Type string
+
+	// The part of the password which follows the pattern.
+	Token string
+
+	// The position of the token in the password, in characters (not bytes).
+	// End is exclusive.
+	Start, End int
+}
+
+// PasswordAnalysis is the result of AnalyzePassword().
+type PasswordAnalysis struct {
+	// The estimated entropy of the password in bits, i.e. the binary logarithm
+	// of the number of guesses an attacker who knows the patterns below would
+	// need.
+	Entropy float64
+
+	// A score derived from the entropy and the problems: 0 (very weak), 1
+	// (weak), 2 (fair), 3 (strong), or 4 (very strong). Passwords with problems
+	// never score higher than 1, compromised passwords always score 0.
+	Score int
+
+	// The problems found by DefaultPasswordPolicy().Check(). If not empty, the
+	// password should be rejected.
+	Problems []PasswordProblem
+
+	// The predictable parts of the password, in the order of their position.
+	// Patterns do not overlap.
+	Patterns []PasswordPattern
+
+	// Suggestions in English for how to improve the password. Use Problems
+	// and Patterns to generate your own texts, e.g. in other languages.
+	Suggestions []string
+}
+
+// Character sequences used to detect keyboard walks and simple sequences. They
+// are also detected in reverse order.
+var (
+	keyboardRows = []string{
+		"1234567890",
+		"qwertyuiop",
+		"qwertzuiopü",
+		"azertyuiop",
+		"asdfghjkl",
+		"asdfghjklöä",
+		"qsdfghjklm",
+		"zxcvbnm",
+		"yxcvbnm",
+		"wxcvbn",
+	}
+	characterSequences = []string{
+		"abcdefghijklmnopqrstuvwxyz",
+		"0123456789",
+	}
+)
+
+// datePatterns match dates and years.
+var datePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\d{1,2}[./-]\d{1,2}[./-](?:\d{4}|\d{2})`),
+	regexp.MustCompile(`\d{4}[./-]\d{1,2}[./-]\d{1,2}`),
+	regexp.MustCompile(`(?:19|20)\d{2}`),
+}
+
+// leetSubstitutions maps characters to the letters they commonly replace.
+var leetSubstitutions = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i',
+	'0': 'o', '5': 's', '$': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+// patternSuggestions are the suggestions for the different pattern types.
+var patternSuggestions = map[string]string{
+	PatternCompromised: "This password has appeared in data breaches. Choose a different one.",
+	PatternDictionary:  "Avoid single dictionary words. Combine several unrelated words instead.",
+	PatternLeet:        `Substitutions such as "@" for "a" don't make words much harder to guess.`,
+	PatternKeyboard:    `Avoid keyboard patterns such as "qwerty".`,
+	PatternSequence:    `Avoid sequences such as "abcd" or "1234".`,
+	PatternRepeat:      "Avoid repeated characters.",
+	PatternDate:        "Avoid dates and years, especially those associated with you.",
+	PatternName:        "Avoid your name, email address, and other personal information.",
+}
+
+// AnalyzePassword estimates the strength of a password. Unlike
+// ReasonablePassword(), which only tells you whether a password is
+// acceptable, the result allows user interfaces to show a strength meter and
+// to explain what makes a password weak. The problems are those of
+// ReasonablePassword(), so both functions agree on which passwords to reject.
+//
+// Because strength meters may call this function on every keystroke,
+// CompromisedPasswords (which may send a request to an external service such
+// as "Have I Been Pwned") is only consulted if AnalyzeCompromisedPasswords is
+// true. Otherwise, only the built-in and registered lists of compromised
+// passwords are checked and the password should be checked again with
+// ReasonablePassword() before it is accepted.
+//
+// The entropy estimate first detects predictable patterns (see the Pattern
+// constants), e.g. "P@ssw0rd" is a dictionary word with substitutions and
+// "qwerty" is a keyboard walk. Each pattern only contributes the few bits an
+// attacker needs to guess it. The remaining characters contribute according to
+// the character classes used in the password (lower case, upper case, digits,
+// symbols, others). This is a rough estimate. It is mostly useful to rank
+// passwords, not to predict cracking times. Only the first
+// MaxAnalyzedPasswordLength characters are searched for patterns.
+//
+// The names are handled as in ReasonablePassword(). Parts of the password
+// which contain one of the names are also detected. This function is safe for
+// concurrent use.
+func AnalyzePassword(password string, names []string) PasswordAnalysis {
+	analysis := PasswordAnalysis{
+		Problems: DefaultPasswordPolicy().check(password, names, AnalyzeCompromisedPasswords),
+	}
+	runes := []rune(password)
+	lower := []rune(strings.ToLower(password))
+	if len(lower) != len(runes) {
+		lower = runes // Some characters change their length. Give up on case-insensitivity.
+	}
+
+	// Find all candidate patterns and select the ones which explain the most.
+	// Characters beyond the analyzed length are not covered by any pattern.
+	analyzed := runes
+	if len(analyzed) > MaxAnalyzedPasswordLength {
+		analyzed = runes[:MaxAnalyzedPasswordLength]
+		lower = lower[:MaxAnalyzedPasswordLength]
+	}
+	candidates := findPasswordPatterns(string(analyzed), analyzed, lower, names)
+	pool := passwordCharacterPool(runes)
+	covered := make([]bool, len(runes))
+	for _, candidate := range candidates {
+		overlaps := false
+		for index := candidate.Start; index < candidate.End; index++ {
+			if covered[index] {
+				overlaps = true
+				break
+			}
+		}
+		if overlaps {
+			continue
+		}
+		for index := candidate.Start; index < candidate.End; index++ {
+			covered[index] = true
+		}
+		analysis.Patterns = append(analysis.Patterns, candidate.PasswordPattern)
+		analysis.Entropy += candidate.bits(pool)
+	}
+	for _, c := range covered {
+		if !c {
+			analysis.Entropy += math.Log2(pool)
+		}
+	}
+	sort.Slice(analysis.Patterns, func(i, j int) bool {
+		return analysis.Patterns[i].Start < analysis.Patterns[j].Start
+	})
+
+	// Derive the score.
+	switch {
+	case analysis.Entropy < 28:
+		analysis.Score = 0
+	case analysis.Entropy < 36:
+		analysis.Score = 1
+	case analysis.Entropy < 60:
+		analysis.Score = 2
+	case analysis.Entropy < 80:
+		analysis.Score = 3
+	default:
+		analysis.Score = 4
+	}
+	for _, problem := range analysis.Problems {
+		if problem == PasswordWasCompromised {
+			analysis.Score = 0
+		} else if analysis.Score > 1 {
+			analysis.Score = 1
+		}
+	}
+
+	// Make suggestions.
+	suggested := make(map[string]bool)
+	suggest := func(suggestion string) {
+		if !suggested[suggestion] {
+			suggested[suggestion] = true
+			analysis.Suggestions = append(analysis.Suggestions, suggestion)
+		}
+	}
+	for _, problem := range analysis.Problems {
+		switch problem {
+		case PasswordTooShort:
+			suggest("Use a longer password. A few unrelated words are easy to remember and hard to guess.")
+		case PasswordWasCompromised:
+			suggest(patternSuggestions[PatternCompromised])
+		case PasswordIsAName:
+			suggest(patternSuggestions[PatternName])
+		}
+	}
+	for _, pattern := range analysis.Patterns {
+		suggest(patternSuggestions[pattern.Type])
+	}
+	if analysis.Score < 3 && len(analysis.Suggestions) == 0 {
+		suggest("Add more words or characters.")
+	}
+
+	return analysis
+}
+
+// passwordCandidate is a pattern which may explain a part of a password.
+type passwordCandidate struct {
+	PasswordPattern
+	baseBits float64 // The entropy of the pattern, not counting its length.
+	perChar  bool    // Whether the length adds log2(pool) bits (for repeats).
+}
+
+// bits returns the entropy contributed by this candidate, given the size of the
+// password's character pool.
+func (c passwordCandidate) bits(pool float64) float64 {
+	length := float64(c.End - c.Start)
+	if c.perChar {
+		return math.Log2(pool) + math.Log2(length)
+	}
+	return c.baseBits
+}
+
+// findPasswordPatterns returns all candidate patterns in the given password,
+// the most useful candidates first (see passwordCandidate.better()).
+func findPasswordPatterns(password string, runes, lower []rune, names []string) []passwordCandidate {
+	var candidates []passwordCandidate
+	add := func(patternType string, start, end int, bits float64) {
+		candidates = append(candidates, passwordCandidate{
+			PasswordPattern: PasswordPattern{Type: patternType, Token: string(runes[start:end]), Start: start, End: end},
+			baseBits:        bits,
+		})
+	}
+	var upper bool
+	for _, r := range runes {
+		if unicode.IsUpper(r) {
+			upper = true
+			break
+		}
+	}
+	caseBits := 0.0
+	if upper {
+		caseBits = 1
+	}
+
+	// Names.
+	for _, name := range names {
+		nameRunes := []rune(strings.ToLower(name))
+		if len(nameRunes) < 3 {
+			continue
+		}
+		for _, start := range findRunes(lower, nameRunes) {
+			add(PatternName, start, start+len(nameRunes), 3+caseBits)
+		}
+	}
+
+	// Words and compromised passwords, also with substitutions. We check the
+	// whole password and every run of letters.
+	decoded := make([]rune, len(lower))
+	for index, r := range lower {
+		if letter, ok := leetSubstitutions[r]; ok {
+			decoded[index] = letter
+		} else {
+			decoded[index] = r
+		}
+	}
+	spans := [][2]int{{0, len(lower)}}
+	for _, text := range [][]rune{lower, decoded} {
+		start := -1
+		for index := 0; index <= len(text); index++ {
+			if index < len(text) && unicode.IsLetter(text[index]) {
+				if start < 0 {
+					start = index
+				}
+				continue
+			}
+			if start >= 0 && index-start >= 4 {
+				spans = append(spans, [2]int{start, index})
+			}
+			start = -1
+		}
+	}
+	wordListsMutex.RLock()
+	for _, span := range spans {
+		for _, text := range [][]rune{lower, decoded} {
+			// Substituted characters at the edges are often not part of the
+			// word (e.g. "summer1"), so try without them, too.
+			start, end := span[0], span[1]
+			for start < end && text[start] != lower[start] {
+				start++
+			}
+			for end > start && text[end-1] != lower[end-1] {
+				end--
+			}
+			for _, s := range [][2]int{span, {start, end}} {
+				if s[1]-s[0] < 4 {
+					continue
+				}
+				patternType, bits := knownWord(string(text[s[0]:s[1]]))
+				if patternType == "" {
+					continue
+				}
+				var substitutions int
+				for index := s[0]; index < s[1]; index++ {
+					if text[index] != lower[index] {
+						substitutions++
+					}
+				}
+				if substitutions > 0 {
+					patternType = PatternLeet
+				}
+				add(patternType, s[0], s[1], bits+float64(substitutions)+caseBits)
+			}
+		}
+	}
+	wordListsMutex.RUnlock()
+
+	// Keyboard walks and sequences.
+	for start := 0; start < len(lower)-3; start++ {
+		var (
+			patternType string
+			best        int
+		)
+		for _, rows := range []struct {
+			patternType string
+			sequences   []string
+		}{{PatternSequence, characterSequences}, {PatternKeyboard, keyboardRows}} {
+			for _, row := range rows.sequences {
+				for _, sequence := range []string{row, reverseString(row)} {
+					end := start + 4
+					for end <= len(lower) && strings.Contains(sequence, string(lower[start:end])) {
+						end++
+					}
+					if length := end - 1 - start; length >= 4 && length > best {
+						patternType, best = rows.patternType, length
+					}
+				}
+			}
+		}
+		if best > 0 {
+			add(patternType, start, start+best, 4+math.Log2(float64(best)))
+			start += best - 1
+		}
+	}
+
+	// Repeated characters.
+	for start := 0; start < len(runes); {
+		end := start + 1
+		for end < len(runes) && runes[end] == runes[start] {
+			end++
+		}
+		if end-start >= 3 {
+			candidates = append(candidates, passwordCandidate{
+				PasswordPattern: PasswordPattern{Type: PatternRepeat, Token: string(runes[start:end]), Start: start, End: end},
+				perChar:         true,
+			})
+		}
+		start = end
+	}
+
+	// Dates.
+	for _, pattern := range datePatterns {
+		for _, match := range pattern.FindAllStringIndex(password, -1) {
+			start := utf8.RuneCountInString(password[:match[0]])
+			end := start + utf8.RuneCountInString(password[match[0]:match[1]])
+			bits := 15.0 // About 100 years of days.
+			if end-start == 4 {
+				bits = 7 // About 100 years.
+			}
+			add(PatternDate, start, end, bits)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].better(candidates[j])
+	})
+	return candidates
+}
+
+// better returns whether this candidate should be preferred over the other
+// candidate: longer candidates first, then more specific ones (see rank()),
+// then those with fewer bits.
+func (c passwordCandidate) better(other passwordCandidate) bool {
+	length, otherLength := c.End-c.Start, other.End-other.Start
+	if length != otherLength {
+		return length > otherLength
+	}
+	if rank, otherRank := c.rank(), other.rank(); rank != otherRank {
+		return rank > otherRank // E.g. "12345678" is a compromised password rather than a sequence.
+	}
+	return c.bits(100) < other.bits(100)
+}
+
+// rank returns how specific this candidate's pattern type is. Of two
+// candidates of the same length, the more specific one is preferred. Names are
+// the most specific because they are personal, followed by patterns found in
+// word lists.
+func (c passwordCandidate) rank() int {
+	switch c.Type {
+	case PatternName:
+		return 2
+	case PatternCompromised, PatternDictionary, PatternLeet:
+		return 1
+	}
+	return 0
+}
+
+// knownWord looks up the given lower-case word in the lists of compromised
+// passwords and in the dictionaries. It returns the pattern type and the
+// entropy of a match or an empty string if the word was not found. The caller
+// must hold at least a read lock on wordListsMutex.
+func knownWord(word string) (string, float64) {
+	common, dict := commonPasswords, dictionary
+	if !UseBuiltInPasswordLists {
+		common, dict = nil, nil
+	}
+	if containsWord(common, word) || inWordLists(compromisedLists, word) {
+		return PatternCompromised, 10 // Among the first guesses.
+	}
+	if containsWord(dict, word) || inWordLists(dictionaryLists, word) {
+		return PatternDictionary, 17 // About the size of a dictionary.
+	}
+	return "", 0
+}
+
+// passwordCharacterPool returns the number of characters an attacker would
+// have to try for each character of the password, based on the character
+// classes used in the password.
+func passwordCharacterPool(runes []rune) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	var pool float64
+	for _, class := range []struct {
+		used bool
+		size float64
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		pool = 1
+	}
+	return pool
+}
+
+// findRunes returns the positions of all occurrences of "needle" in
+// "haystack".
+func findRunes(haystack, needle []rune) []int {
+	var positions []int
+	for start := 0; start+len(needle) <= len(haystack); start++ {
+		if string(haystack[start:start+len(needle)]) == string(needle) {
+			positions = append(positions, start)
+		}
+	}
+	return positions
+}
+
+// reverseString returns the given string with its characters in reverse
+// order.
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -0,0 +1,105 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test the analysis of passwords.
+func TestAnalyzePassword(t *testing.T) {
+	defer reset()
+	RemovePasswordList("test")
+	defer RemovePasswordList("test")
+	if err := AddPasswordDictionary("test", strings.NewReader("rhubarb\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		password string
+		names    []string
+		patterns []string // "type:token".
+		maxScore int
+		minScore int
+	}{
+		{"12345678", nil, []string{"compromised:12345678"}, 0, 0},
+		{"qwertyuiop", nil, []string{"compromised:qwertyuiop"}, 0, 0},
+		{"9qwerty!", nil, []string{"keyboard:qwerty"}, 1, 0},
+		{"Rhub4rb!", nil, []string{"leet:Rhub4rb"}, 1, 0},
+		{"xzasdfgqp", nil, []string{"keyboard:asdfg"}, 1, 0},
+		{"mkdcba91", nil, []string{"sequence:dcba"}, 1, 0},
+		{"k24.12.1990v", nil, []string{"date:24.12.1990"}, 1, 0},
+		{"zzzzzzzzzzzzzzzzzzzzzzzzz", nil, []string{"repeat:zzzzzzzzzzzzzzzzzzzzzzzzz"}, 0, 0},
+		{"Frederick#1987#x", []string{"frederick@example.com", "Frederick"}, []string{"name:Frederick", "date:1987"}, 1, 0},
+		{"correct horse battery staple", nil, nil, 4, 2},
+		{"G7#kq2!vLz9@pWx4", nil, nil, 4, 3},
+	} {
+		analysis := AnalyzePassword(test.password, test.names)
+		var patterns []string
+		for _, pattern := range analysis.Patterns {
+			if string([]rune(test.password)[pattern.Start:pattern.End]) != pattern.Token {
+				t.Errorf("%q: pattern %q has wrong position %d-%d", test.password, pattern.Token, pattern.Start, pattern.End)
+			}
+			patterns = append(patterns, pattern.Type+":"+pattern.Token)
+		}
+		for _, expected := range test.patterns {
+			var found bool
+			for _, pattern := range patterns {
+				found = found || pattern == expected
+			}
+			if !found {
+				t.Errorf("%q: expected pattern %s, got %v", test.password, expected, patterns)
+			}
+		}
+		if analysis.Score < test.minScore || analysis.Score > test.maxScore {
+			t.Errorf("%q: expected score %d-%d, got %d (%.1f bits)", test.password, test.minScore, test.maxScore, analysis.Score, analysis.Entropy)
+		}
+		if analysis.Score < 3 && len(analysis.Suggestions) == 0 {
+			t.Errorf("%q: expected suggestions", test.password)
+		}
+		if (len(analysis.Problems) == 0) != (ReasonablePassword(test.password, test.names) == PasswordOK) {
+			t.Errorf("%q: problems %v disagree with ReasonablePassword()", test.password, analysis.Problems)
+		}
+	}
+
+	// Patterns make passwords weaker.
+	if weak, strong := AnalyzePassword("p@ssword2024", nil), AnalyzePassword("v#kqmeyb2s7t", nil); weak.Entropy >= strong.Entropy {
+		t.Errorf("Expected %.1f bits to be less than %.1f bits", weak.Entropy, strong.Entropy)
+	}
+}
+
+// countingChecker is a CompromisedPasswordChecker which reports all passwords
+// as compromised and counts its calls.
+type countingChecker struct {
+	calls int
+}
+
+func (c *countingChecker) Compromised(password string) (bool, error) {
+	c.calls++
+	return true, nil
+}
+
+// Test that AnalyzePassword() only consults CompromisedPasswords if requested.
+func TestAnalyzePasswordCompromisedPasswords(t *testing.T) {
+	defer reset()
+	checker := &countingChecker{}
+	CompromisedPasswords = checker
+	if analysis := AnalyzePassword("G7#kq2!vLz9@pWx4", nil); len(analysis.Problems) > 0 || checker.calls > 0 {
+		t.Errorf("CompromisedPasswords was consulted (problems %v, %d calls)", analysis.Problems, checker.calls)
+	}
+	AnalyzeCompromisedPasswords = true
+	if analysis := AnalyzePassword("G7#kq2!vLz9@pWx4", nil); analysis.Score != 0 || checker.calls != 1 {
+		t.Errorf("CompromisedPasswords was not consulted (score %d, %d calls)", analysis.Score, checker.calls)
+	}
+}
+
+// Test that only the beginning of long passwords is searched for patterns.
+func TestAnalyzePasswordLength(t *testing.T) {
+	prefix := strings.Repeat("G7#kq2!vLz9@pWx4", MaxAnalyzedPasswordLength/16)
+	analysis := AnalyzePassword(prefix+strings.Repeat("qwerty", 10000), nil)
+	if len(analysis.Patterns) > 0 {
+		t.Errorf("Patterns were found beyond the analyzed length: %v", analysis.Patterns)
+	}
+	if short := AnalyzePassword(prefix, nil); analysis.Entropy <= short.Entropy {
+		t.Errorf("Expected %.1f bits to be more than %.1f bits", analysis.Entropy, short.Entropy)
+	}
+}
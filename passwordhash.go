@@ -0,0 +1,177 @@
+package sessions
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2Parameters are the parameters of the Argon2id password hashing
+// function used by HashPassword() (see RFC 9106).
+type Argon2Parameters struct {
+	// The number of passes over the memory.
+	Iterations uint32
+
+	// The amount of memory used, in KiB.
+	Memory uint32
+
+	// The number of threads (lanes) used.
+	Parallelism uint8
+
+	// The length of the random salt, in bytes.
+	SaltLength int
+
+	// The length of the generated hash, in bytes.
+	KeyLength int
+}
+
+// The largest Argon2id parameters accepted in password hashes. Hashes with
+// larger parameters are rejected so a manipulated hash cannot make
+// VerifyPassword() use excessive memory or time. The memory limit is that of
+// the first recommendation of RFC 9106.
+const (
+	maxArgon2Memory      = 2 * 1024 * 1024 // In KiB.
+	maxArgon2Iterations  = 64
+	maxArgon2Parallelism = 64
+)
+
+// ErrInvalidPasswordHash is returned when a password hash cannot be parsed.
+var ErrInvalidPasswordHash = errors.New("Invalid password hash")
+
+// HashPassword returns a hash of the given password which may be stored in a
+// database, e.g. with a user account. It uses Argon2id with the parameters in
+// PasswordHashParameters and a random salt. The result is encoded in the PHC
+// string format which contains the algorithm, its version, and its parameters:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+//
+// This way, hashes remain verifiable when PasswordHashParameters change. Use
+// VerifyPassword() to check a password against the hash and
+// PasswordNeedsRehash() to find out whether a hash should be upgraded.
+//
+// Passwords should be checked with ReasonablePassword() or a PasswordPolicy
+// before they are hashed. Set PasswordPolicy.MaxLength to limit the time spent
+// hashing very long passwords.
+func HashPassword(password string) (string, error) {
+	params := PasswordHashParameters
+	salt := make([]byte, params.SaltLength)
+	if err := readRandom(salt); err != nil {
+		return "", fmt.Errorf("Could not generate salt: %s", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(params.KeyLength))
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// VerifyPassword returns whether the given password matches the given hash.
+// Hashes generated by HashPassword() are supported, regardless of the
+// parameters they were generated with, as well as bcrypt hashes ("$2a$",
+// "$2b$", and "$2y$"), e.g. from systems migrated to this package. The
+// comparison takes constant time. If the hash cannot be parsed, false is
+// returned.
+//
+// After a successful verification, call PasswordNeedsRehash() and, if it
+// returns true, replace the stored hash with a new hash from HashPassword().
+func VerifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	params, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// PasswordReused returns whether the given password matches any of the given
+// hashes, e.g. the hashes of a user's previous passwords, to enforce a "you
+// cannot reuse your last N passwords" rule when a password is changed. The
+// hashes are checked with VerifyPassword(), so the same hash formats are
+// supported. Each check takes as long as verifying a password at login, so
+// keep the history short.
+//
+// Hashes which cannot be parsed are skipped. If none of the other hashes
+// match, ErrInvalidPasswordHash is returned in that case.
+func PasswordReused(newPassword string, oldHashes []string) (bool, error) {
+	var invalid bool
+	for _, hash := range oldHashes {
+		if VerifyPassword(hash, newPassword) {
+			return true, nil
+		}
+		if !validPasswordHash(hash) {
+			invalid = true
+		}
+	}
+	if invalid {
+		return false, ErrInvalidPasswordHash
+	}
+	return false, nil
+}
+
+// validPasswordHash returns whether the given hash has a format supported by
+// VerifyPassword().
+func validPasswordHash(hash string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	}
+	_, _, _, err := parseArgon2Hash(hash)
+	return err == nil
+}
+
+// PasswordNeedsRehash returns whether the given hash was not generated by
+// HashPassword() with the current PasswordHashParameters, e.g. because it is a
+// bcrypt hash or because the parameters were increased since. Such hashes
+// should be replaced the next time the user logs in, i.e. when the password is
+// known. Hashes which cannot be parsed also need to be replaced.
+func PasswordNeedsRehash(hash string) bool {
+	params, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+	current := PasswordHashParameters
+	return params.Iterations != current.Iterations ||
+		params.Memory != current.Memory ||
+		params.Parallelism != current.Parallelism ||
+		len(salt) != current.SaltLength ||
+		len(key) != current.KeyLength
+}
+
+// parseArgon2Hash parses a hash generated by HashPassword(). It returns the
+// parameters (without salt and key lengths), the salt, and the key. Parameters
+// above the maximums defined above lead to ErrInvalidPasswordHash.
+func parseArgon2Hash(hash string) (params Argon2Parameters, salt, key []byte, err error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[0] != "" || fields[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	if params.Memory > maxArgon2Memory || params.Iterations > maxArgon2Iterations || params.Parallelism > maxArgon2Parallelism {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(fields[4]); err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(fields[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,104 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Test hashing and verifying passwords.
+func TestPasswordHash(t *testing.T) {
+	defer reset()
+	PasswordHashParameters = Argon2Parameters{Iterations: 1, Memory: 64, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	hash, err := HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Unexpected hash format %q", hash)
+	}
+	other, err := HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == other {
+		t.Error("Hashes of the same password are identical")
+	}
+	if !VerifyPassword(hash, "correct horse battery staple") {
+		t.Error("Correct password was rejected")
+	}
+	if VerifyPassword(hash, "correct horse battery stapler") {
+		t.Error("Wrong password was accepted")
+	}
+	for _, invalid := range []string{"", "plain", "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=64,t=1000000,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=1024,t=1,p=255$c2FsdA$a2V5", hash + "!"} {
+		if VerifyPassword(invalid, "correct horse battery staple") {
+			t.Errorf("Invalid hash %q was accepted", invalid)
+		}
+	}
+
+	// Upgrades.
+	if PasswordNeedsRehash(hash) {
+		t.Error("Current hash needs a rehash")
+	}
+	PasswordHashParameters.Iterations = 2
+	if !PasswordNeedsRehash(hash) {
+		t.Error("Outdated hash does not need a rehash")
+	}
+	if !VerifyPassword(hash, "correct horse battery staple") {
+		t.Error("Outdated hash was rejected")
+	}
+
+	// Legacy bcrypt hashes.
+	legacy, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyPassword(string(legacy), "secret") || VerifyPassword(string(legacy), "wrong") {
+		t.Error("Bcrypt hash was not verified correctly")
+	}
+	if !PasswordNeedsRehash(string(legacy)) {
+		t.Error("Bcrypt hash does not need a rehash")
+	}
+}
+
+// Test checking passwords against previous password hashes.
+func TestPasswordReused(t *testing.T) {
+	defer reset()
+	PasswordHashParameters = Argon2Parameters{Iterations: 1, Memory: 64, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	var history []string
+	for _, password := range []string{"first password", "second password"} {
+		hash, err := HashPassword(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, hash)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("legacy password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history = append(history, string(legacy))
+
+	for _, password := range []string{"first password", "second password", "legacy password"} {
+		if reused, err := PasswordReused(password, history); err != nil || !reused {
+			t.Errorf("Reuse of %q was not detected (%v)", password, err)
+		}
+	}
+	if reused, err := PasswordReused("new password", history); err != nil || reused {
+		t.Errorf("New password was reported as reused (%v)", err)
+	}
+	if reused, err := PasswordReused("new password", nil); err != nil || reused {
+		t.Errorf("Password was reported as reused without a history (%v)", err)
+	}
+
+	// Invalid hashes.
+	history = append(history, "plain")
+	if reused, err := PasswordReused("second password", history); err != nil || !reused {
+		t.Errorf("Reuse was not detected despite an invalid hash (%v)", err)
+	}
+	if _, err := PasswordReused("new password", history); err != ErrInvalidPasswordHash {
+		t.Errorf("Expected ErrInvalidPasswordHash, got %v", err)
+	}
+}
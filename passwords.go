@@ -6,9 +6,16 @@ import (
 	"encoding/base64"
 	"io/ioutil"
 	"strings"
+	"sync"
 )
 
-// Constants for password problems returned with AnalyzePassword().
+// wordListsMutex synchronizes access to the word lists "dictionary",
+// "commonPasswords", "dictionaryLists", and "compromisedLists". Any code which
+// changes these lists at runtime must hold the write lock.
+var wordListsMutex sync.RWMutex
+
+// Constants for password problems returned by ReasonablePassword() and
+// PasswordPolicy.Check().
 const (
 	PasswordOK                = iota // Password passes our rules.
 	PasswordTooShort                 // Password is too short.
@@ -17,8 +24,118 @@ const (
 	PasswordFoundInDictionary        // Password was found in a dictionary.
 	PasswordRepetitive               // Password consists of just repetetive characters.
 	PasswordSequential               // Password consists of a simple sequence.
+	PasswordTooLong                  // Password is too long.
+	PasswordBanned                   // Password contains one of the banned words.
 )
 
+// PasswordProblem is one of the password constants, describing a problem found
+// by PasswordPolicy.Check().
+type PasswordProblem int
+
+// PasswordPolicy describes the rules a password must follow. Different
+// policies may be used for different purposes, e.g. for different tenants of
+// an application or for administrator accounts. The zero value accepts all
+// passwords. Use DefaultPasswordPolicy() for the rules applied by
+// ReasonablePassword().
+type PasswordPolicy struct {
+	// The minimum length of a password in bytes. 0 means no minimum.
+	MinLength int
+
+	// The maximum length of a password in bytes. 0 means no maximum. Long
+	// passwords should be allowed but a limit protects password hashing from
+	// excessive input.
+	MaxLength int
+
+	// Whether passwords found in the list of compromised passwords are
+	// rejected. If CompromisedPasswords is set, it is consulted, too.
+	CheckBreached bool
+
+	// Whether passwords found in the dictionary are rejected.
+	CheckDictionary bool
+
+	// Whether simple sequences (e.g. "abcdefgh" or "qwertyuiop") are rejected.
+	CheckSequential bool
+
+	// Whether passwords consisting of one repeated character are rejected.
+	CheckRepetitive bool
+
+	// Words which must not be contained in a password, e.g. the name of your
+	// company or of your application. The comparison is case-insensitive.
+	ExtraBanned []string
+}
+
+// DefaultPasswordPolicy returns the policy used by ReasonablePassword(). It
+// follows the NIST SP 800-63B guidelines (section 5.1.1): passwords must be
+// at least 8 bytes long and must not be compromised, dictionary words, simple
+// sequences, or repetitive. No maximum length is set.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:       8,
+		CheckBreached:   true,
+		CheckDictionary: true,
+		CheckSequential: true,
+		CheckRepetitive: true,
+	}
+}
+
+// Check checks a password against this policy and returns all problems found,
+// in the order of the password constants' importance (i.e. a password which is
+// too short is reported before a compromised password). An empty result means
+// that the password follows the policy. The password must also not be equal to
+// any of the given names (case-insensitive), e.g. the user's name or email
+// address.
+//
+// This function is safe for concurrent use.
+func (p PasswordPolicy) Check(password string, names []string) []PasswordProblem {
+	return p.check(password, names, true)
+}
+
+// check implements Check(). CompromisedPasswords is only consulted if
+// "external" is true.
+func (p PasswordPolicy) check(password string, names []string, external bool) []PasswordProblem {
+	var problems []PasswordProblem
+	if p.MinLength > 0 && len(password) < p.MinLength {
+		problems = append(problems, PasswordTooShort)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		problems = append(problems, PasswordTooLong)
+	}
+	lower := strings.ToLower(password)
+	for _, word := range names {
+		if lower == strings.ToLower(word) {
+			problems = append(problems, PasswordIsAName)
+			break
+		}
+	}
+	for _, word := range p.ExtraBanned {
+		if word != "" && strings.Contains(lower, strings.ToLower(word)) {
+			problems = append(problems, PasswordBanned)
+			break
+		}
+	}
+	wordListsMutex.RLock()
+	common, dict := commonPasswords, dictionary
+	if !UseBuiltInPasswordLists {
+		common, dict = nil, nil
+	}
+	compromised := p.CheckBreached && (containsWord(common, password) || inWordLists(compromisedLists, password))
+	inDictionary := p.CheckDictionary && (containsWord(dict, password) || inWordLists(dictionaryLists, lower))
+	wordListsMutex.RUnlock()
+	if compromised || p.CheckBreached && external && compromisedPassword(password) {
+		problems = append(problems, PasswordWasCompromised)
+	}
+	if inDictionary {
+		problems = append(problems, PasswordFoundInDictionary)
+	}
+	if p.CheckRepetitive && repetitivePassword(password) {
+		problems = append(problems, PasswordRepetitive)
+	}
+	if p.CheckSequential && sequentialPassword(lower) {
+		problems = append(problems, PasswordSequential)
+	}
+	return problems
+}
+
 // initPasswords sets up the dictionary and the breached passwords.
 func initPasswords() {
 	uncompress := func(compressed string) []string {
@@ -28,50 +145,81 @@ func initPasswords() {
 		return strings.Split(string(uncompressed), "\n")
 	}
 
-	dictionary = uncompress(dictionaryCompressed)
-	commonPasswords = uncompress(commonPasswordsCompressed)
+	dict := uncompress(dictionaryCompressed)
+	common := uncompress(commonPasswordsCompressed)
+
+	wordListsMutex.Lock()
+	defer wordListsMutex.Unlock()
+	dictionary = dict
+	commonPasswords = common
 }
 
 // ReasonablePassword checks the strength of a password and returns one of the
 // password constants as a result (PasswordOK if no major issues were found).
 //
 // The tests performed by this function follow the NIST SP 800-63B guidelines
-// (section 5.1.1), with two modifications: The list of compromised passwords
-// has been shortened to the top 100,000 and we're using an english dictionary
-// only so far.
+// (section 5.1.1), with two modifications: The built-in list of compromised
+// passwords has been shortened to the top 100,000 (set CompromisedPasswords to
+// check against a complete list) and the built-in dictionary is English only
+// (use AddPasswordDictionary() for other languages). The rules are those of
+// DefaultPasswordPolicy(). Use PasswordPolicy.Check() for different rules or
+// to retrieve all problems instead of only the first one.
+//
+// This function is safe for concurrent use.
 func ReasonablePassword(password string, names []string) int {
-	if len(password) < 8 {
-		return PasswordTooShort
+	problems := DefaultPasswordPolicy().Check(password, names)
+	if len(problems) == 0 {
+		return PasswordOK
 	}
-	for _, word := range names {
-		if strings.ToLower(password) == strings.ToLower(word) {
-			return PasswordIsAName
-		}
+	return int(problems[0])
+}
+
+// compromisedPassword returns whether CompromisedPasswords, if set, reports
+// the password as compromised. If the check fails, the password is accepted
+// (so users can still sign up while the external service is unavailable) and
+// the error is logged.
+func compromisedPassword(password string) bool {
+	checker := CompromisedPasswords
+	if checker == nil {
+		return false
 	}
-	for _, word := range commonPasswords {
-		if password == word {
-			return PasswordWasCompromised
-		}
+	compromised, err := checker.Compromised(password)
+	if err != nil {
+		logWarn("Could not check for compromised password", "error", err)
+		return false
 	}
-	for _, word := range dictionary {
+	return compromised
+}
+
+// containsWord returns whether the given word list contains the password.
+func containsWord(words []string, password string) bool {
+	for _, word := range words {
 		if password == word {
-			return PasswordFoundInDictionary
+			return true
 		}
 	}
+	return false
+}
+
+// repetitivePassword returns whether the password consists of just one
+// repeated character.
+func repetitivePassword(password string) bool {
 	var first rune
 	for index, ch := range password {
 		if index == 0 {
 			first = ch
 		} else {
 			if ch != first {
-				first = 0
-				break
+				return false
 			}
 		}
 	}
-	if first != 0 {
-		return PasswordRepetitive
-	}
+	return first != 0
+}
+
+// sequentialPassword returns whether the lower-case password is part of a
+// simple sequence, e.g. a row on the keyboard or the alphabet.
+func sequentialPassword(lower string) bool {
 	for _, sequence := range []string{
 		"qwertyuiop",
 		"qwertzuiopü",
@@ -83,9 +231,9 @@ func ReasonablePassword(password string, names []string) int {
 		"01234567890",
 		"abcdefghijklmnopqrstuvwxyz",
 	} {
-		if strings.Contains(sequence, strings.ToLower(password)) {
-			return PasswordSequential
+		if strings.Contains(sequence, lower) {
+			return true
 		}
 	}
-	return PasswordOK
+	return false
 }
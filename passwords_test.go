@@ -1,6 +1,10 @@
 package sessions
 
-import "testing"
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
 
 // Test password integrity check.
 func TestReasonablePassword(t *testing.T) {
@@ -20,3 +24,53 @@ func TestReasonablePassword(t *testing.T) {
 		}
 	}
 }
+
+// Test custom password policies.
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:     10,
+		MaxLength:     20,
+		CheckBreached: true,
+		ExtraBanned:   []string{"acme"},
+	}
+	for password, expected := range map[string][]PasswordProblem{
+		"hflIhf.lKK$982ß":           nil,
+		"football":                  {PasswordTooShort, PasswordWasCompromised},
+		"hflIhf.lKK$982ßhflIhf.lKK": {PasswordTooLong},
+		"my-ACME-password":          {PasswordBanned},
+		"John.Doe.1980":             {PasswordIsAName},
+		"aardvarks12":               nil, // Dictionary check is off.
+		"xxxxxxxxxxxxxxx":           nil, // Repetitive check is off.
+	} {
+		computed := policy.Check(password, []string{"john.doe.1980"})
+		if fmt.Sprint(computed) != fmt.Sprint(expected) {
+			t.Errorf("Password %s resulted in %v, expected %v", password, computed, expected)
+		}
+	}
+
+	// The zero value accepts everything.
+	if problems := (PasswordPolicy{}).Check("a", nil); len(problems) != 0 {
+		t.Errorf("Zero policy found problems %v", problems)
+	}
+
+	// The default policy reports all problems.
+	if problems := DefaultPasswordPolicy().Check("aaaa", nil); fmt.Sprint(problems) != fmt.Sprint([]PasswordProblem{PasswordTooShort, PasswordRepetitive}) {
+		t.Errorf("Unexpected problems %v", problems)
+	}
+}
+
+// Test concurrent password checks while the word lists are reloaded.
+func TestReasonablePasswordConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result := ReasonablePassword("football", nil); result != PasswordWasCompromised {
+				t.Errorf("Password check resulted in %d, expected %d", result, PasswordWasCompromised)
+			}
+		}()
+	}
+	initPasswords()
+	wg.Wait()
+}
@@ -1,7 +1,14 @@
 package sessions
 
+import "errors"
+
 // PersistenceLayer provides the methods which read/write user information
 // from/to the permanent data store.
+//
+// Some features require additional methods. They are declared in optional
+// interfaces which a persistence layer may implement as well:
+// SessionDataLoader, TagIndexer, SessionLister, SessionIDGenerator, and
+// TrustedDeviceStore.
 type PersistenceLayer interface {
 	// LoadSession retrieves a session from the permanent data store and returns
 	// it. If no session is found for the given ID, that's not an error. A nil
@@ -74,9 +81,10 @@ type PersistenceLayer interface {
 	// this or, if you can access session data directly:
 	//
 	//   session.referenceID != "" &&
-	//   time.Since(session.lastAccess) >= SessionIDGracePeriod ||
+	//   time.Since(session.created) >= SessionIDGracePeriod ||
 	//   time.Since(session.lastAccess) >= SessionExpiry &&
-	//   time.Since(session.created) >= SessionIDExpiry+SessionIDGracePeriod
+	//   time.Since(session.created) >= SessionIDExpiry+SessionIDGracePeriod ||
+	//   time.Since(session.started) >= SessionMaxLifetime
 	DeleteSession(id string) error
 
 	// UserSessions returns all session IDs of sessions which have the given user
@@ -91,18 +99,139 @@ type PersistenceLayer interface {
 	LoadUser(id interface{}) (User, error)
 }
 
-// ExtendablePersistenceLayer implements the PersistenceLayer interface by doing
-// nothing (or the absolute minimum) or, if one of the field functions are set,
-// calling those instead.
+// SessionDataLoader may be implemented by a PersistenceLayer which can load the
+// custom data of a session (the values stored with Session.Set()) without the
+// rest of the session. It is only used if LazyDataLoading is true. If it is not
+// implemented, the full session is loaded with LoadSession() and its data is
+// used.
+type SessionDataLoader interface {
+	// LoadSessionData retrieves only the custom data of a session from the
+	// permanent data store. If no session is found for the given ID, a nil map
+	// should be returned.
+	//
+	// If LazyDataLoading is true, LoadSession() may omit the session data
+	// because it will be discarded anyway. (This is only possible with your
+	// own serialization, not with the built-in decoders.)
+	LoadSessionData(id string) (map[string]interface{}, error)
+}
+
+// loadSessionData returns the custom data of the session with the given ID
+// from the given persistence layer, using LoadSessionData() if it implements
+// SessionDataLoader or LoadSession() otherwise.
+func loadSessionData(p PersistenceLayer, id string) (map[string]interface{}, error) {
+	if loader, ok := p.(SessionDataLoader); ok {
+		return loader.LoadSessionData(id)
+	}
+	session, err := p.LoadSession(id)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	return session.data, nil
+}
+
+// SessionIDGenerator may be implemented by a PersistenceLayer whose data store
+// wants to control session IDs, e.g. to make them sortable or to encode a shard
+// number. If it is not implemented, this package generates random session IDs
+// (the recommended default).
+type SessionIDGenerator interface {
+	// NewSessionID returns the ID for a new session or for a session whose ID
+	// is changed (see Session.RegenerateID()). Return an empty string to let
+	// this package generate a random ID.
+	//
+	// Generated IDs must be unique and must not be guessable. They must also
+	// consist of 24 Base64 characters (see ValidSessionIDFormat()), otherwise
+	// an error is returned when the session is created.
+	NewSessionID() (string, error)
+}
+
+// TagIndexer may be implemented by a PersistenceLayer whose data store indexes
+// session tags (see Session.SetTag()). It is only used by CountByTag() and
+// DestroySessionsByTag(). If it is not implemented, no sessions are found for
+// any tag.
+type TagIndexer interface {
+	// SessionsByTag returns all session IDs of sessions which have been
+	// assigned the given tag.
+	SessionsByTag(tag string) ([]string, error)
+}
+
+// sessionsByTag returns the IDs of all sessions with the given tag from the
+// given persistence layer if it implements TagIndexer. Otherwise, nil is
+// returned.
+func sessionsByTag(p PersistenceLayer, tag string) ([]string, error) {
+	if indexer, ok := p.(TagIndexer); ok {
+		return indexer.SessionsByTag(tag)
+	}
+	return nil, nil
+}
+
+// ErrNoSessionLister is returned by maintenance functions such as
+// ReEncryptSessions() if the persistence layer does not implement
+// SessionLister.
+var ErrNoSessionLister = errors.New("Persistence layer cannot list sessions")
+
+// SessionLister may be implemented by a PersistenceLayer which can enumerate
+// all stored sessions. It is only used by maintenance functions such as
+// ReEncryptSessions(), which return ErrNoSessionLister if it is not
+// implemented. Implementations which cannot list sessions after all may return
+// ErrNoSessionLister from AllSessions() to the same effect.
+type SessionLister interface {
+	// AllSessions returns the IDs of all sessions in the permanent data store.
+	AllSessions() ([]string, error)
+}
+
+// TrustedDeviceStore may be implemented by a PersistenceLayer to store trusted
+// devices (see IssueTrustedDevice()). If it is not implemented,
+// IssueTrustedDevice() returns ErrNoTrustedDeviceStore and no browser is
+// considered a trusted device. Implementations which cannot store devices
+// after all, e.g. wrappers around other persistence layers, may return
+// ErrNoTrustedDeviceStore from SaveTrustedDevice() to the same effect.
+type TrustedDeviceStore interface {
+	// LoadTrustedDevice retrieves a trusted device (see IssueTrustedDevice())
+	// from the permanent data store and returns it. If no device is found for
+	// the given ID, that's not an error. A nil device should be returned in that
+	// case.
+	LoadTrustedDevice(id string) (*TrustedDevice, error)
+
+	// SaveTrustedDevice saves a trusted device to the permanent data store. The
+	// device's ID is the hash of its token, the token itself is never stored.
+	// Because the TrustedDevice struct has only exported fields, it may be
+	// serialized with encoding/gob or encoding/json. Note that the user ID must
+	// be restored with its original type, otherwise IsTrustedDevice() will not
+	// recognize the user.
+	SaveTrustedDevice(device *TrustedDevice) error
+
+	// DeleteTrustedDevice deletes a trusted device from the permanent data
+	// store. It is not an error if the device ID does not exist.
+	DeleteTrustedDevice(id string) error
+
+	// UserTrustedDevices returns all trusted devices of the user with the given
+	// user ID. This is only used by TrustedDevices(). You may return nil if
+	// you don't intend to list a user's devices.
+	UserTrustedDevices(userID interface{}) ([]*TrustedDevice, error)
+}
+
+// ExtendablePersistenceLayer implements the PersistenceLayer interface and
+// all optional persistence interfaces (e.g. TagIndexer) by doing nothing (or
+// the absolute minimum) or, if one of the field functions are set, calling
+// those instead.
 //
 // Use this type if you only intend to use a small part of this package's
 // functionality.
 type ExtendablePersistenceLayer struct {
-	LoadSessionFunc   func(id string) (*Session, error)
-	SaveSessionFunc   func(id string, session *Session) error
-	DeleteSessionFunc func(id string) error
-	UserSessionsFunc  func(userID interface{}) ([]string, error)
-	LoadUserFunc      func(id interface{}) (User, error)
+	LoadSessionFunc     func(id string) (*Session, error)
+	LoadSessionDataFunc func(id string) (map[string]interface{}, error)
+	SaveSessionFunc     func(id string, session *Session) error
+	DeleteSessionFunc   func(id string) error
+	UserSessionsFunc    func(userID interface{}) ([]string, error)
+	SessionsByTagFunc   func(tag string) ([]string, error)
+	AllSessionsFunc     func() ([]string, error)
+	NewSessionIDFunc    func() (string, error)
+	LoadUserFunc        func(id interface{}) (User, error)
+
+	LoadTrustedDeviceFunc   func(id string) (*TrustedDevice, error)
+	SaveTrustedDeviceFunc   func(device *TrustedDevice) error
+	DeleteTrustedDeviceFunc func(id string) error
+	UserTrustedDevicesFunc  func(userID interface{}) ([]*TrustedDevice, error)
 }
 
 // LoadSession delegates to LoadSessionFunc or returns a nil session.
@@ -113,6 +242,19 @@ func (p ExtendablePersistenceLayer) LoadSession(id string) (*Session, error) {
 	return nil, nil
 }
 
+// LoadSessionData delegates to LoadSessionDataFunc or, if it is not set, loads
+// the full session with LoadSession() and returns its data.
+func (p ExtendablePersistenceLayer) LoadSessionData(id string) (map[string]interface{}, error) {
+	if p.LoadSessionDataFunc != nil {
+		return p.LoadSessionDataFunc(id)
+	}
+	session, err := p.LoadSession(id)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	return session.data, nil
+}
+
 // SaveSession delegates to SaveSessionFunc or does nothing.
 func (p ExtendablePersistenceLayer) SaveSession(id string, session *Session) error {
 	if p.SaveSessionFunc != nil {
@@ -137,6 +279,64 @@ func (p ExtendablePersistenceLayer) UserSessions(userID interface{}) ([]string,
 	return nil, nil
 }
 
+// SessionsByTag delegates to SessionsByTagFunc or returns nil.
+func (p ExtendablePersistenceLayer) SessionsByTag(tag string) ([]string, error) {
+	if p.SessionsByTagFunc != nil {
+		return p.SessionsByTagFunc(tag)
+	}
+	return nil, nil
+}
+
+// AllSessions delegates to AllSessionsFunc or returns ErrNoSessionLister.
+func (p ExtendablePersistenceLayer) AllSessions() ([]string, error) {
+	if p.AllSessionsFunc != nil {
+		return p.AllSessionsFunc()
+	}
+	return nil, ErrNoSessionLister
+}
+
+// NewSessionID delegates to NewSessionIDFunc or returns an empty string, which
+// causes a random session ID to be generated.
+func (p ExtendablePersistenceLayer) NewSessionID() (string, error) {
+	if p.NewSessionIDFunc != nil {
+		return p.NewSessionIDFunc()
+	}
+	return "", nil
+}
+
+// LoadTrustedDevice delegates to LoadTrustedDeviceFunc or returns a nil device.
+func (p ExtendablePersistenceLayer) LoadTrustedDevice(id string) (*TrustedDevice, error) {
+	if p.LoadTrustedDeviceFunc != nil {
+		return p.LoadTrustedDeviceFunc(id)
+	}
+	return nil, nil
+}
+
+// SaveTrustedDevice delegates to SaveTrustedDeviceFunc or returns
+// ErrNoTrustedDeviceStore because the device could not be stored.
+func (p ExtendablePersistenceLayer) SaveTrustedDevice(device *TrustedDevice) error {
+	if p.SaveTrustedDeviceFunc != nil {
+		return p.SaveTrustedDeviceFunc(device)
+	}
+	return ErrNoTrustedDeviceStore
+}
+
+// DeleteTrustedDevice delegates to DeleteTrustedDeviceFunc or does nothing.
+func (p ExtendablePersistenceLayer) DeleteTrustedDevice(id string) error {
+	if p.DeleteTrustedDeviceFunc != nil {
+		return p.DeleteTrustedDeviceFunc(id)
+	}
+	return nil
+}
+
+// UserTrustedDevices delegates to UserTrustedDevicesFunc or returns nil.
+func (p ExtendablePersistenceLayer) UserTrustedDevices(userID interface{}) ([]*TrustedDevice, error) {
+	if p.UserTrustedDevicesFunc != nil {
+		return p.UserTrustedDevicesFunc(userID)
+	}
+	return nil, nil
+}
+
 // LoadUser delegates to LoadUserFunc or returns a nil user.
 func (p ExtendablePersistenceLayer) LoadUser(id interface{}) (User, error) {
 	if p.LoadUserFunc != nil {
@@ -0,0 +1,88 @@
+package sessions
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// minimalPersistence implements only the required methods of
+// PersistenceLayer, none of the optional interfaces. LoadSession() returns the
+// given session.
+type minimalPersistence struct {
+	session *Session
+}
+
+func (p minimalPersistence) LoadSession(id string) (*Session, error)         { return p.session, nil }
+func (minimalPersistence) SaveSession(id string, session *Session) error     { return nil }
+func (minimalPersistence) DeleteSession(id string) error                     { return nil }
+func (minimalPersistence) UserSessions(userID interface{}) ([]string, error) { return nil, nil }
+func (minimalPersistence) LoadUser(id interface{}) (User, error)             { return nil, nil }
+
+// Test that the optional persistence interfaces are detected.
+func TestOptionalPersistence(t *testing.T) {
+	defer reset()
+	var minimal PersistenceLayer = minimalPersistence{}
+	if _, ok := minimal.(TagIndexer); ok {
+		t.Error("Minimal persistence layer implements TagIndexer")
+	}
+	if _, ok := minimal.(TrustedDeviceStore); ok {
+		t.Error("Minimal persistence layer implements TrustedDeviceStore")
+	}
+	if _, ok := minimal.(SessionDataLoader); ok {
+		t.Error("Minimal persistence layer implements SessionDataLoader")
+	}
+	if _, ok := minimal.(SessionLister); ok {
+		t.Error("Minimal persistence layer implements SessionLister")
+	}
+	if _, ok := minimal.(SessionIDGenerator); ok {
+		t.Error("Minimal persistence layer implements SessionIDGenerator")
+	}
+	for _, persistence := range []PersistenceLayer{minimal, NewRetryingPersistence(minimal, 3, 0)} {
+		Persistence = persistence
+		if count, err := CountByTag("tag"); err != nil || count != 0 {
+			t.Errorf("Counted %d sessions without a tag index (%v), expected 0", count, err)
+		}
+		if err := DestroySessionsByTag("tag"); err != nil {
+			t.Error(err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		if _, err := IssueTrustedDevice(httptest.NewRecorder(), req, "user"); !errors.Is(err, ErrNoTrustedDeviceStore) {
+			t.Errorf("Expected ErrNoTrustedDeviceStore, got %v", err)
+		}
+		if trusted, err := IsTrustedDevice(req, "user"); trusted || err != nil {
+			t.Errorf("Device trusted without a device store (%v)", err)
+		}
+		if devices, err := TrustedDevices("user"); devices != nil || err != nil {
+			t.Errorf("Devices returned without a device store (%v)", err)
+		}
+		if err := RevokeTrustedDevice("id"); err != nil {
+			t.Error(err)
+		}
+		if id, err := newSessionID(); err != nil || !ValidSessionIDFormat(id) {
+			t.Errorf("Invalid session ID %q (%v)", id, err)
+		}
+		if _, err := ReEncryptSessions(make([]byte, 32), make([]byte, 32)); !errors.Is(err, ErrNoSessionLister) {
+			t.Errorf("Expected ErrNoSessionLister, got %v", err)
+		}
+	}
+
+	// Session data is taken from the full session.
+	minimal = minimalPersistence{session: &Session{id: sessionID, data: map[string]interface{}{"a": 1}}}
+	for _, persistence := range []PersistenceLayer{minimal, NewRetryingPersistence(minimal, 3, 0)} {
+		data, err := loadSessionData(persistence, sessionID)
+		if err != nil || data["a"] != 1 {
+			t.Errorf("Unexpected session data %v (%v)", data, err)
+		}
+	}
+
+	// Tag index.
+	Persistence = NewRetryingPersistence(ExtendablePersistenceLayer{
+		SessionsByTagFunc: func(tag string) ([]string, error) {
+			return []string{sessionID}, nil
+		},
+	}, 3, 0)
+	if count, err := CountByTag("tag"); err != nil || count != 1 {
+		t.Errorf("Counted %d sessions (%v), expected 1", count, err)
+	}
+}
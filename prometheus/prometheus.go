@@ -0,0 +1,162 @@
+/*
+Package prometheus exposes the metrics of the sessions package to a Prometheus
+server. It implements the sessions.Metrics interface and serves the collected
+metrics in the Prometheus text exposition format:
+
+	collector := prometheus.New()
+	sessions.MetricsSink = collector
+	http.Handle("/metrics", collector)
+
+The package has no dependencies other than the standard library. If your
+application already uses the official Prometheus client library, you may
+prefer to implement sessions.Metrics with its types instead.
+*/
+package prometheus
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the histogram buckets
+// used by New().
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram holds the state of one histogram.
+type histogram struct {
+	counts []uint64 // Number of observations per bucket (not cumulative).
+	count  uint64   // Total number of observations.
+	sum    float64  // Sum of all observations.
+}
+
+// Collector collects the metrics reported by the sessions package. It
+// implements sessions.Metrics and http.Handler. It is safe for concurrent use.
+type Collector struct {
+	sync.Mutex
+	buckets    []float64
+	counters   map[string]uint64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+}
+
+// New returns a new collector which uses DefaultBuckets for its histograms.
+func New() *Collector {
+	return NewWithBuckets(DefaultBuckets)
+}
+
+// NewWithBuckets returns a new collector which uses the given bucket upper
+// bounds for its histograms. The bounds must be sorted in increasing order.
+// The "+Inf" bucket is added automatically.
+func NewWithBuckets(buckets []float64) *Collector {
+	return &Collector{
+		buckets:    append([]float64(nil), buckets...),
+		counters:   make(map[string]uint64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// IncCounter increments the counter with the given name by 1.
+func (c *Collector) IncCounter(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.counters[name]++
+}
+
+// SetGauge sets the gauge with the given name to the given value.
+func (c *Collector) SetGauge(name string, value float64) {
+	c.Lock()
+	defer c.Unlock()
+	c.gauges[name] = value
+}
+
+// Observe adds a value to the histogram with the given name.
+func (c *Collector) Observe(name string, value float64) {
+	c.Lock()
+	defer c.Unlock()
+	h, ok := c.histograms[name]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(c.buckets))}
+		c.histograms[name] = h
+	}
+	h.count++
+	h.sum += value
+	if index := sort.SearchFloat64s(c.buckets, value); index < len(c.buckets) {
+		h.counts[index]++
+	}
+}
+
+// ServeHTTP writes all collected metrics in the Prometheus text exposition
+// format.
+func (c *Collector) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(response)
+}
+
+// WriteTo writes all collected metrics in the Prometheus text exposition
+// format to the given writer. Metrics are sorted by name.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var (
+		total int64
+		err   error
+	)
+	printf := func(format string, args ...interface{}) {
+		if err != nil {
+			return
+		}
+		var n int
+		n, err = fmt.Fprintf(w, format, args...)
+		total += int64(n)
+	}
+
+	for _, name := range sortedKeys(c.counters) {
+		printf("# TYPE %s counter\n%s %d\n", name, name, c.counters[name])
+	}
+	for _, name := range sortedKeys(c.gauges) {
+		printf("# TYPE %s gauge\n%s %s\n", name, name, formatFloat(c.gauges[name]))
+	}
+	for _, name := range sortedKeys(c.histograms) {
+		h := c.histograms[name]
+		printf("# TYPE %s histogram\n", name)
+		var cumulative uint64
+		for index, bound := range c.buckets {
+			cumulative += h.counts[index]
+			printf("%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+		}
+		printf("%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		printf("%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+	}
+
+	return total, err
+}
+
+// sortedKeys returns the keys of the given map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatFloat formats a number for the Prometheus text exposition format.
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,42 @@
+package prometheus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rivo/sessions"
+)
+
+// Test collecting and exposing metrics.
+func TestCollector(t *testing.T) {
+	collector := NewWithBuckets([]float64{0.1, 1})
+	var _ sessions.Metrics = collector
+
+	collector.IncCounter(sessions.MetricCacheHits)
+	collector.IncCounter(sessions.MetricCacheHits)
+	collector.SetGauge(sessions.MetricCachedSessions, 3)
+	collector.Observe(sessions.MetricPersistenceLoad, 0.05)
+	collector.Observe(sessions.MetricPersistenceLoad, 0.5)
+	collector.Observe(sessions.MetricPersistenceLoad, 5)
+
+	recorder := httptest.NewRecorder()
+	collector.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected content type %q", recorder.Header().Get("Content-Type"))
+	}
+	expected := `# TYPE sessions_cache_hits_total counter
+sessions_cache_hits_total 2
+# TYPE sessions_cached gauge
+sessions_cached 3
+# TYPE sessions_persistence_load_seconds histogram
+sessions_persistence_load_seconds_bucket{le="0.1"} 1
+sessions_persistence_load_seconds_bucket{le="1"} 2
+sessions_persistence_load_seconds_bucket{le="+Inf"} 3
+sessions_persistence_load_seconds_sum 5.55
+sessions_persistence_load_seconds_count 3
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("Unexpected output:\n%s\nExpected:\n%s", body, expected)
+	}
+}
@@ -0,0 +1,70 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"sync"
+)
+
+var (
+	randomMutex  sync.RWMutex               // Guards randomSource.
+	randomSource io.Reader    = rand.Reader // The source of all random IDs and tokens (see SetDeterministicSource()).
+)
+
+// deterministicSource is a concurrency-safe reader of pseudo-random bytes.
+type deterministicSource struct {
+	sync.Mutex
+	random *mathrand.Rand
+}
+
+// Read implements io.Reader.
+func (d *deterministicSource) Read(b []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.random.Read(b)
+}
+
+// SetDeterministicSource replaces the cryptographically secure random number
+// generator of this package with a pseudo-random number generator initialized
+// with the given seed. From then on, session IDs, RandomID(), CSRF tokens, and
+// trusted device tokens are generated from the same sequence with every run of
+// your program. This allows you to write tests which compare exact session IDs,
+// e.g. against golden files. Note that the sequence only repeats if the same
+// functions are called in the same order. CUID() does not use random numbers.
+// It depends on the current time.
+//
+// This function is for tests ONLY. The generated IDs and tokens are easy to
+// predict, making sessions trivial to hijack. Never call it in production code.
+// Call ResetRandomSource() to restore the secure generator. The nonces used to
+// encrypt sealed sessions (see Session.Seal()) are always generated securely.
+func SetDeterministicSource(seed int64) {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	randomSource = &deterministicSource{random: mathrand.New(mathrand.NewSource(seed))}
+}
+
+// ResetRandomSource restores the cryptographically secure random number
+// generator after a call to SetDeterministicSource().
+func ResetRandomSource() {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	randomSource = rand.Reader
+}
+
+// readRandom fills the given slice with random bytes from the current random
+// source.
+func readRandom(b []byte) error {
+	randomMutex.RLock()
+	source := randomSource
+	randomMutex.RUnlock()
+	n, err := io.ReadFull(source, b)
+	if err != nil {
+		return err
+	}
+	if n < len(b) {
+		return errors.New("Unable to generate random number")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package sessions
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Test reproducible IDs with a deterministic random source.
+func TestDeterministicSource(t *testing.T) {
+	defer reset()
+	generate := func() (string, string, string) {
+		sessionID, err := generateSessionID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		randomID, err := RandomID(22)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := session.CSRFToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sessionID, randomID, token
+	}
+
+	// Same seed, same IDs.
+	SetDeterministicSource(42)
+	sessionID1, randomID1, token1 := generate()
+	SetDeterministicSource(42)
+	sessionID2, randomID2, token2 := generate()
+	if sessionID1 != sessionID2 || randomID1 != randomID2 || token1 != token2 {
+		t.Errorf("IDs differ for the same seed: %s/%s, %s/%s, %s/%s", sessionID1, sessionID2, randomID1, randomID2, token1, token2)
+	}
+	if !ValidSessionIDFormat(sessionID1) {
+		t.Errorf("Invalid session ID %q", sessionID1)
+	}
+
+	// Different seed, different IDs.
+	SetDeterministicSource(43)
+	if sessionID3, _, _ := generate(); sessionID3 == sessionID1 {
+		t.Error("Session IDs are equal for different seeds")
+	}
+
+	// Secure source.
+	ResetRandomSource()
+	if sessionID4, _, _ := generate(); sessionID4 == sessionID1 {
+		t.Error("Secure source returned the deterministic session ID")
+	}
+}
@@ -0,0 +1,79 @@
+package sessions
+
+import (
+	"net/http"
+	"time"
+)
+
+// SetRememberMe selects the lifetime of this session, typically following the
+// "remember me" checkbox of a login form. If RememberMeExpiry is positive,
+// sessions which are remembered expire after that duration of inactivity and
+// keep their persistent cookie (see NewSessionCookie). All other sessions
+// expire after SessionExpiry and their cookies are turned into browser session
+// cookies which are deleted when the browser is closed. The flag is saved with
+// the session. It is usually set right after LogIn():
+//
+//	if err := session.LogIn(user, false, response); err != nil {
+//		return err
+//	}
+//	if err := session.SetRememberMe(request.FormValue("remember") != "", response); err != nil {
+//		return err
+//	}
+//
+// The session cookie is sent again so its lifetime matches the new setting. If
+// RememberMeExpiry is 0, the flag is saved but has no effect.
+//
+// Note that since the sessions cache is write-through, this will also result in
+// a call to SaveSession() of the persistence layer. The error returned is the
+// error from SaveSession().
+func (s *Session) SetRememberMe(remember bool, response http.ResponseWriter) error {
+	s.Lock()
+	s.rememberMe = remember
+	var cookie *http.Cookie
+	if s.cookie != nil {
+		c := *s.cookie
+		cookie = &c
+	} else {
+		cookie = SessionCookieFor(nil)
+	}
+	cookie.Value = s.id
+	s.Unlock()
+	setCookie(response, applyCookieLifetime(cookie, remember))
+	return s.save()
+}
+
+// RememberMe returns whether this session was selected to be remembered with
+// SetRememberMe().
+func (s *Session) RememberMe() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.rememberMe
+}
+
+// idleTimeout returns the duration of inactivity after which this session
+// expires. This is RememberMeExpiry for remembered sessions, if positive, and
+// SessionExpiry otherwise. The session must be locked (at least for reading)
+// while this function is called.
+func (s *Session) idleTimeout() time.Duration {
+	return sessionIdleTimeout(s.rememberMe, SessionExpiry, RememberMeExpiry)
+}
+
+// sessionIdleTimeout returns the idle timeout for a session with the given
+// remember-me flag (see Session.idleTimeout()).
+func sessionIdleTimeout(remember bool, expiry, rememberMeExpiry time.Duration) time.Duration {
+	if remember && rememberMeExpiry > 0 {
+		return rememberMeExpiry
+	}
+	return expiry
+}
+
+// applyCookieLifetime turns the given session cookie into a browser session
+// cookie if RememberMeExpiry is positive and the session is not remembered
+// (see Session.SetRememberMe()). The cookie is returned.
+func applyCookieLifetime(cookie *http.Cookie, remember bool) *http.Cookie {
+	if RememberMeExpiry > 0 && !remember {
+		cookie.Expires = time.Time{}
+		cookie.MaxAge = 0
+	}
+	return cookie
+}
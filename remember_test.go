@@ -0,0 +1,74 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test the different lifetimes of remembered and regular sessions.
+func TestRememberMe(t *testing.T) {
+	defer reset()
+	defer clearCache()
+	SessionExpiry = time.Hour
+	RememberMeExpiry = 24 * time.Hour
+
+	// New sessions get browser session cookies.
+	response := httptest.NewRecorder()
+	session, err := Start(response, httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge != 0 || !cookies[0].Expires.IsZero() {
+		t.Fatalf("Expected a browser session cookie, got %v", cookies)
+	}
+
+	// Remembered sessions get persistent cookies.
+	response = httptest.NewRecorder()
+	if err := session.SetRememberMe(true, response); err != nil {
+		t.Fatal(err)
+	}
+	cookies = response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge <= 0 || cookies[0].Value != session.id {
+		t.Fatalf("Expected a persistent cookie, got %v", cookies)
+	}
+	if !session.RememberMe() {
+		t.Error("Session is not remembered")
+	}
+
+	// Remembered sessions survive longer.
+	session.Lock()
+	session.lastAccess = time.Now().Add(-2 * time.Hour)
+	session.created = session.lastAccess
+	session.Unlock()
+	if session.Expired() {
+		t.Error("Remembered session expired after SessionExpiry")
+	}
+	if remaining := session.RemainingIdleTime(); remaining < 21*time.Hour || remaining > 22*time.Hour {
+		t.Errorf("Unexpected remaining idle time %s", remaining)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if s, err := Start(httptest.NewRecorder(), req, false); err != nil || s == nil {
+		t.Fatalf("Remembered session was rejected (error %v)", err)
+	}
+
+	// Regular sessions don't.
+	if err := session.SetRememberMe(false, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	session.Lock()
+	session.lastAccess = time.Now().Add(-2 * time.Hour)
+	session.created = session.lastAccess
+	session.Unlock()
+	if !session.Expired() {
+		t.Error("Regular session did not expire after SessionExpiry")
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if s, err := Start(httptest.NewRecorder(), req, false); err != nil || s != nil {
+		t.Fatalf("Regular session was not rejected (error %v)", err)
+	}
+}
@@ -0,0 +1,90 @@
+package sessions
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// remoteAddress returns the remote address (IP:port) of the client which sent
+// the given request, as determined by RemoteIPFromRequest. If that function is
+// nil or returns nil, request.RemoteAddr is returned. Otherwise, the port is
+// taken from request.RemoteAddr (or set to 0 if it has none) because the
+// session's remote addresses always carry a port.
+func remoteAddress(request *http.Request) string {
+	if RemoteIPFromRequest == nil {
+		return request.RemoteAddr
+	}
+	ip := RemoteIPFromRequest(request)
+	if ip == nil {
+		return request.RemoteAddr
+	}
+	_, port, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil || port == "" {
+		port = "0"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// ForwardedRemoteIP returns the IP address of the client which sent the given
+// request, taking reverse proxies into account. It is the default for
+// RemoteIPFromRequest.
+//
+// If the request was not sent by one of the TrustedProxies, the IP address
+// from request.RemoteAddr is returned. Otherwise, the "X-Forwarded-For" header
+// is read from right to left and the first IP address which does not belong
+// to a trusted proxy is returned. If that header is missing, the
+// "X-Real-IP" header is used. Headers sent by untrusted clients are never
+// consulted because they can be forged easily. nil is returned if no IP
+// address can be determined.
+func ForwardedRemoteIP(request *http.Request) net.IP {
+	host := remoteHost(request.RemoteAddr)
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxy(ip) {
+		return ip
+	}
+
+	// Walk the X-Forwarded-For chain from the closest proxy backwards.
+	forwarded := request.Header.Values("X-Forwarded-For")
+	if len(forwarded) > 0 {
+		addresses := strings.Split(strings.Join(forwarded, ","), ",")
+		for index := len(addresses) - 1; index >= 0; index-- {
+			forwardedIP := net.ParseIP(strings.TrimSpace(addresses[index]))
+			if forwardedIP == nil {
+				break // A malformed entry. Don't trust anything before it.
+			}
+			ip = forwardedIP
+			if !trustedProxy(ip) {
+				break
+			}
+		}
+		return ip
+	}
+
+	// Try X-Real-IP.
+	if realIP := net.ParseIP(strings.TrimSpace(request.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP
+	}
+
+	return ip
+}
+
+// trustedProxy returns whether the given IP address belongs to one of the
+// TrustedProxies. Invalid entries are ignored (see ValidateConfig()).
+func trustedProxy(ip net.IP) bool {
+	for _, proxy := range TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
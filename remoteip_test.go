@@ -0,0 +1,62 @@
+package sessions
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test determining client IP addresses behind proxies.
+func TestForwardedRemoteIP(t *testing.T) {
+	defer reset()
+	TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	for index, test := range []struct {
+		remoteAddr, forwarded, realIP, expected string
+	}{
+		{"198.51.100.7:1234", "", "", "198.51.100.7"},                               // No proxy.
+		{"198.51.100.7:1234", "203.0.113.5", "203.0.113.6", "198.51.100.7"},         // Untrusted sender.
+		{"10.1.2.3:1234", "203.0.113.5", "", "203.0.113.5"},                         // Trusted proxy.
+		{"10.1.2.3:1234", "203.0.113.9, 203.0.113.5, 192.0.2.1", "", "203.0.113.5"}, // Chain of proxies, forged first entry.
+		{"10.1.2.3:1234", "203.0.113.5, garbage, 10.0.0.2", "", "10.0.0.2"},         // Malformed entry.
+		{"10.1.2.3:1234", "", "203.0.113.6", "203.0.113.6"},                         // X-Real-IP.
+		{"10.1.2.3:1234", "", "", "10.1.2.3"},                                       // No headers.
+		{"[2001:db8::1]:1234", "", "", "2001:db8::1"},                               // IPv6.
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			req.Header.Set("X-Real-IP", test.realIP)
+		}
+		if ip := ForwardedRemoteIP(req); !ip.Equal(net.ParseIP(test.expected)) {
+			t.Errorf("Test %d: Expected %s, got %s", index, test.expected, ip)
+		}
+	}
+}
+
+// Test that Start() records the forwarded client address.
+func TestStartBehindProxy(t *testing.T) {
+	defer reset()
+	TrustedProxies = []string{"10.0.0.1"}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:4711"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	session, err := Start(httptest.NewRecorder(), req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.lastIP != "203.0.113.5:4711" {
+		t.Errorf("Unexpected remote address %s", session.lastIP)
+	}
+
+	// Without a function, the proxy's address is used.
+	RemoteIPFromRequest = nil
+	if session, err = Start(httptest.NewRecorder(), req, true); err != nil {
+		t.Fatal(err)
+	}
+	if session.lastIP != "10.0.0.1:4711" {
+		t.Errorf("Unexpected remote address %s", session.lastIP)
+	}
+}
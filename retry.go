@@ -0,0 +1,187 @@
+package sessions
+
+import "time"
+
+// retryingPersistence is a persistence layer which retries the operations of
+// another persistence layer (see NewRetryingPersistence()).
+type retryingPersistence struct {
+	inner    PersistenceLayer
+	attempts int
+	backoff  time.Duration
+}
+
+// NewRetryingPersistence returns a persistence layer which calls the functions
+// of the given persistence layer and, if they fail, calls them again, up to
+// the given number of attempts in total. The first retry happens after the
+// given backoff duration. The delay doubles with every further retry. If all
+// attempts fail, the error of the last attempt is returned. Use this with a
+// network-backed data store to survive brief outages without failing requests:
+//
+//	Persistence = NewRetryingPersistence(myStore, 3, 50*time.Millisecond)
+//
+// All functions of the persistence layer are retried. This is safe because
+// loading is free of side effects and saving or deleting the same object twice
+// has the same effect as doing it once. Note, however, that retries block the
+// calling request, often while the session ID is locked. Keep the number of
+// attempts and the backoff small. WriteBehind is an alternative for failed
+// saves which does not block requests.
+//
+// If "attempts" is less than 1, each function is called once.
+func NewRetryingPersistence(inner PersistenceLayer, attempts int, backoff time.Duration) PersistenceLayer {
+	return &retryingPersistence{inner: inner, attempts: attempts, backoff: backoff}
+}
+
+// retry calls the given function until it succeeds or until the maximum number
+// of attempts is reached. The last error is returned.
+func (p *retryingPersistence) retry(f func() error) error {
+	delay := p.backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = f(); err == nil || attempt+1 >= p.attempts {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// LoadSession retries the inner LoadSession().
+func (p *retryingPersistence) LoadSession(id string) (session *Session, err error) {
+	err = p.retry(func() error {
+		session, err = p.inner.LoadSession(id)
+		return err
+	})
+	return
+}
+
+// LoadSessionData retries the inner LoadSessionData() or, if it is not
+// implemented (see SessionDataLoader), the inner LoadSession().
+func (p *retryingPersistence) LoadSessionData(id string) (data map[string]interface{}, err error) {
+	err = p.retry(func() error {
+		data, err = loadSessionData(p.inner, id)
+		return err
+	})
+	return
+}
+
+// SaveSession retries the inner SaveSession().
+func (p *retryingPersistence) SaveSession(id string, session *Session) error {
+	return p.retry(func() error {
+		return p.inner.SaveSession(id, session)
+	})
+}
+
+// DeleteSession retries the inner DeleteSession().
+func (p *retryingPersistence) DeleteSession(id string) error {
+	return p.retry(func() error {
+		return p.inner.DeleteSession(id)
+	})
+}
+
+// UserSessions retries the inner UserSessions().
+func (p *retryingPersistence) UserSessions(userID interface{}) (ids []string, err error) {
+	err = p.retry(func() error {
+		ids, err = p.inner.UserSessions(userID)
+		return err
+	})
+	return
+}
+
+// SessionsByTag retries the inner SessionsByTag(), if implemented (see
+// TagIndexer).
+func (p *retryingPersistence) SessionsByTag(tag string) (ids []string, err error) {
+	err = p.retry(func() error {
+		ids, err = sessionsByTag(p.inner, tag)
+		return err
+	})
+	return
+}
+
+// AllSessions retries the inner AllSessions(), if implemented (see
+// SessionLister).
+func (p *retryingPersistence) AllSessions() (ids []string, err error) {
+	lister, ok := p.inner.(SessionLister)
+	if !ok {
+		return nil, ErrNoSessionLister
+	}
+	err = p.retry(func() error {
+		ids, err = lister.AllSessions()
+		return err
+	})
+	return
+}
+
+// NewSessionID retries the inner NewSessionID() or, if it is not implemented
+// (see SessionIDGenerator), returns an empty string.
+func (p *retryingPersistence) NewSessionID() (id string, err error) {
+	generator, ok := p.inner.(SessionIDGenerator)
+	if !ok {
+		return "", nil
+	}
+	err = p.retry(func() error {
+		id, err = generator.NewSessionID()
+		return err
+	})
+	return
+}
+
+// LoadTrustedDevice retries the inner LoadTrustedDevice(), if implemented (see
+// TrustedDeviceStore).
+func (p *retryingPersistence) LoadTrustedDevice(id string) (device *TrustedDevice, err error) {
+	store, ok := p.inner.(TrustedDeviceStore)
+	if !ok {
+		return nil, nil
+	}
+	err = p.retry(func() error {
+		device, err = store.LoadTrustedDevice(id)
+		return err
+	})
+	return
+}
+
+// SaveTrustedDevice retries the inner SaveTrustedDevice(), if implemented (see
+// TrustedDeviceStore).
+func (p *retryingPersistence) SaveTrustedDevice(device *TrustedDevice) error {
+	store, ok := p.inner.(TrustedDeviceStore)
+	if !ok {
+		return ErrNoTrustedDeviceStore
+	}
+	return p.retry(func() error {
+		return store.SaveTrustedDevice(device)
+	})
+}
+
+// DeleteTrustedDevice retries the inner DeleteTrustedDevice(), if implemented
+// (see TrustedDeviceStore).
+func (p *retryingPersistence) DeleteTrustedDevice(id string) error {
+	store, ok := p.inner.(TrustedDeviceStore)
+	if !ok {
+		return nil
+	}
+	return p.retry(func() error {
+		return store.DeleteTrustedDevice(id)
+	})
+}
+
+// UserTrustedDevices retries the inner UserTrustedDevices(), if implemented
+// (see TrustedDeviceStore).
+func (p *retryingPersistence) UserTrustedDevices(userID interface{}) (devices []*TrustedDevice, err error) {
+	store, ok := p.inner.(TrustedDeviceStore)
+	if !ok {
+		return nil, nil
+	}
+	err = p.retry(func() error {
+		devices, err = store.UserTrustedDevices(userID)
+		return err
+	})
+	return
+}
+
+// LoadUser retries the inner LoadUser().
+func (p *retryingPersistence) LoadUser(id interface{}) (user User, err error) {
+	err = p.retry(func() error {
+		user, err = p.inner.LoadUser(id)
+		return err
+	})
+	return
+}
@@ -0,0 +1,65 @@
+package sessions
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test retrying persistence layer functions.
+func TestRetryingPersistence(t *testing.T) {
+	defer reset()
+	storeErr := errors.New("Data store unavailable")
+	var calls, failures int
+	persistence := NewRetryingPersistence(ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			calls++
+			if calls <= failures {
+				return nil, storeErr
+			}
+			return &Session{id: id}, nil
+		},
+		SaveSessionFunc: func(id string, session *Session) error {
+			calls++
+			if calls <= failures {
+				return storeErr
+			}
+			return nil
+		},
+	}, 3, time.Millisecond)
+
+	// Success after retries.
+	failures = 2
+	session, err := persistence.LoadSession("s1")
+	if err != nil || session == nil || calls != 3 {
+		t.Errorf("Load failed after %d calls: %v", calls, err)
+	}
+
+	// Too many failures.
+	calls, failures = 0, 3
+	start := time.Now()
+	if err := persistence.SaveSession("s1", session); !errors.Is(err, storeErr) || calls != 3 {
+		t.Errorf("Expected store error after 3 calls, got %v after %d calls", err, calls)
+	}
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Errorf("Backoff was too short: %s", elapsed)
+	}
+
+	// No retries without errors.
+	calls, failures = 0, 0
+	if err := persistence.SaveSession("s1", session); err != nil || calls != 1 {
+		t.Errorf("Save took %d calls: %v", calls, err)
+	}
+
+	// At least one attempt.
+	calls, failures = 0, 1
+	once := NewRetryingPersistence(ExtendablePersistenceLayer{
+		DeleteSessionFunc: func(id string) error {
+			calls++
+			return storeErr
+		},
+	}, 0, time.Millisecond)
+	if err := once.DeleteSession("s1"); err == nil || calls != 1 {
+		t.Errorf("Delete took %d calls: %v", calls, err)
+	}
+}
@@ -0,0 +1,266 @@
+package sessions
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// ErrNoSealKey is returned when the data of a sealed session is accessed but
+// no SealKey is configured.
+var ErrNoSealKey = errors.New("No seal key configured")
+
+// Seal encrypts this session's data with SealKey. From now on, the data is
+// kept encrypted in the local cache and in the serialized session which is
+// handed to the persistence layer. It is only decrypted temporarily while it is
+// accessed, e.g. by Get() or Set(). This limits the exposure of the most
+// sensitive sessions, e.g. in memory dumps or in the data store. Because every
+// access requires a decryption (and every change an encryption), sealed
+// sessions are slower than regular sessions.
+//
+// Sealing a session which is already sealed has no effect. If SealKey is not
+// set, ErrNoSealKey is returned. Note that since the sessions cache is
+// write-through, this will also result in a call to SaveSession() of the
+// persistence layer.
+func (s *Session) Seal() error {
+	if err := s.loadData(); err != nil {
+		return err
+	}
+	s.Lock()
+	if s.sealed != nil {
+		s.Unlock()
+		return nil
+	}
+	sealed, err := sealData(s.data)
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+	s.sealed = sealed
+	s.data = nil
+	s.Unlock()
+	return s.save()
+}
+
+// Unseal decrypts the data of a session sealed with Seal() and turns it back
+// into a regular session. Unsealing a session which is not sealed has no
+// effect. If SealKey is not set, ErrNoSealKey is returned. An error is also
+// returned if the data cannot be decrypted, e.g. because SealKey has changed.
+// The session remains sealed in this case.
+//
+// Note that since the sessions cache is write-through, this will also result in
+// a call to SaveSession() of the persistence layer.
+func (s *Session) Unseal() error {
+	s.Lock()
+	if s.sealed == nil {
+		s.Unlock()
+		return nil
+	}
+	data, err := unsealData(s.sealed)
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+	s.data = data
+	s.sealed = nil
+	s.Unlock()
+	return s.save()
+}
+
+// IsSealed returns whether this session's data is encrypted (see Seal()).
+func (s *Session) IsSealed() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.sealed != nil
+}
+
+// openData returns the session data, decrypting it if the session is sealed.
+// The session must be locked (at least for reading) while this function is
+// called. For sealed sessions, changes to the returned map must be written
+// back with closeData().
+func (s *Session) openData() (map[string]interface{}, error) {
+	if s.sealed == nil {
+		return s.data, nil
+	}
+	return unsealData(s.sealed)
+}
+
+// closeData writes back the session data returned by openData(), encrypting it
+// if the session is sealed. The session must be locked while this function is
+// called.
+func (s *Session) closeData(data map[string]interface{}) error {
+	if s.sealed == nil {
+		s.data = data
+		return nil
+	}
+	sealed, err := sealData(data)
+	if err != nil {
+		return err
+	}
+	s.sealed = sealed
+	return nil
+}
+
+// ReEncryptSessions re-encrypts the data of all sealed sessions (see
+// Session.Seal()) which were encrypted with "oldKey", using "newKey". The
+// number of re-encrypted sessions is returned. This requires that the
+// persistence layer implements SessionLister, returning the IDs of all stored
+// sessions. Otherwise, ErrNoSessionLister is returned.
+//
+// To rotate the seal key while your application keeps serving requests, set
+// SealKey to the new key and add the old key to PreviousSealKeys first. Sealed
+// sessions can then be accessed with either key while this function runs.
+// Sessions which are already encrypted with the new key are skipped, so this
+// function may be run again if it was interrupted. Once it has completed
+// successfully, the old key may be removed from PreviousSealKeys.
+//
+// If a session cannot be re-encrypted, the remaining sessions are still
+// processed. The returned error then contains one error per failed session.
+func ReEncryptSessions(oldKey, newKey []byte) (int, error) {
+	if oldKey == nil || newKey == nil {
+		return 0, ErrNoSealKey
+	}
+	lister, ok := Persistence.(SessionLister)
+	if !ok {
+		return 0, ErrNoSessionLister
+	}
+	sessionIDs, err := lister.AllSessions()
+	if err != nil {
+		return 0, fmt.Errorf("Could not retrieve session IDs: %w", err)
+	}
+
+	var (
+		count int
+		errs  []error
+	)
+	for _, sessionID := range sessionIDs {
+		migrated, err := reEncryptSession(sessionID, oldKey, newKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Could not re-encrypt session %s: %w", MaskSessionID(sessionID), err))
+			continue
+		}
+		if migrated {
+			count++
+		}
+	}
+
+	return count, errors.Join(errs...)
+}
+
+// reEncryptSession re-encrypts the data of the session with the given ID from
+// "oldKey" to "newKey". It returns false if the session is not sealed or if it
+// is already encrypted with the new key.
+func reEncryptSession(id string, oldKey, newKey []byte) (bool, error) {
+	sessionIDMutexes.Lock(id)
+	defer sessionIDMutexes.Unlock(id)
+
+	session, err := sessions.Get(id)
+	if err != nil || session == nil {
+		return false, err
+	}
+
+	session.Lock()
+	if session.sealed == nil {
+		session.Unlock()
+		return false, nil
+	}
+	data, err := decryptData(oldKey, session.sealed)
+	if err != nil {
+		_, newErr := decryptData(newKey, session.sealed)
+		session.Unlock()
+		if newErr == nil {
+			return false, nil // Already re-encrypted.
+		}
+		return false, err
+	}
+	sealed, err := encryptData(newKey, data)
+	if err != nil {
+		session.Unlock()
+		return false, err
+	}
+	session.sealed = sealed
+	session.Unlock()
+
+	return true, session.save()
+}
+
+// sealData gob-encodes the given session data and encrypts it with SealKey.
+func sealData(data map[string]interface{}) ([]byte, error) {
+	if SealKey == nil {
+		return nil, ErrNoSealKey
+	}
+	return encryptData(SealKey, data)
+}
+
+// unsealData decrypts session data encrypted with sealData(). SealKey is tried
+// first, then the keys in PreviousSealKeys.
+func unsealData(sealed []byte) (map[string]interface{}, error) {
+	if SealKey == nil && len(PreviousSealKeys) == 0 {
+		return nil, ErrNoSealKey
+	}
+	var err error
+	for _, key := range append([][]byte{SealKey}, PreviousSealKeys...) {
+		if key == nil {
+			continue
+		}
+		var data map[string]interface{}
+		if data, err = decryptData(key, sealed); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+// sealCipher returns the AES-GCM cipher for the given key.
+func sealCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid seal key: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptData gob-encodes the given session data and encrypts it with the
+// given key. The random nonce is prepended to the result.
+func encryptData(key []byte, data map[string]interface{}) ([]byte, error) {
+	aead, err := sealCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(data); err != nil {
+		return nil, fmt.Errorf("Unable to encode session data: %s", err)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+buffer.Len()+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Could not generate nonce: %s", err)
+	}
+	return aead.Seal(nonce, nonce, buffer.Bytes(), nil), nil
+}
+
+// decryptData decrypts session data encrypted with encryptData().
+func decryptData(key []byte, sealed []byte) (map[string]interface{}, error) {
+	aead, err := sealCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Sealed session data is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt session data: %s", err)
+	}
+	var data map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&data); err != nil {
+		return nil, fmt.Errorf("Unable to decode session data: %s", err)
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	return data, nil
+}
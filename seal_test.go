@@ -0,0 +1,201 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test sealing and unsealing sessions.
+func TestSessionSeal(t *testing.T) {
+	defer reset()
+	SealKey = []byte("0123456789abcdef0123456789abcdef")
+	session := &Session{
+		created:    time.Now(),
+		lastAccess: time.Now(),
+		data:       map[string]interface{}{"secret": "value"},
+	}
+
+	// Seal the session.
+	if err := session.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	if !session.IsSealed() || session.data != nil {
+		t.Fatal("Session data was not sealed")
+	}
+	if bytes.Contains(session.sealed, []byte("value")) {
+		t.Error("Sealed data contains plain text")
+	}
+
+	// Access it transparently.
+	if value := session.Get("secret", nil); value != "value" {
+		t.Errorf("Unexpected value %v", value)
+	}
+	if err := session.Set("other", 42); err != nil {
+		t.Fatal(err)
+	}
+	if value := session.Get("other", nil); value != 42 {
+		t.Errorf("Unexpected value %v", value)
+	}
+	if session.data != nil {
+		t.Error("Plain text data was kept in the session")
+	}
+
+	// Round trips.
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(session); err != nil {
+		t.Fatal(err)
+	}
+	var gobSession Session
+	if err := gob.NewDecoder(&buffer).Decode(&gobSession); err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jsonSession Session
+	if err := json.Unmarshal(jsonData, &jsonSession); err != nil {
+		t.Fatal(err)
+	}
+	binaryData, err := session.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var binarySession Session
+	if err := binarySession.UnmarshalBinary(binaryData); err != nil {
+		t.Fatal(err)
+	}
+	for name, recovered := range map[string]*Session{"gob": &gobSession, "JSON": &jsonSession, "binary": &binarySession} {
+		if !recovered.IsSealed() {
+			t.Errorf("%s session is not sealed", name)
+			continue
+		}
+		if value := recovered.Get("secret", nil); value != "value" {
+			t.Errorf("Unexpected value %v in %s session", value, name)
+		}
+		if value := recovered.Get("other", nil); value != 42 {
+			t.Errorf("Unexpected value %v in %s session", value, name) // Types are preserved, even in JSON.
+		}
+	}
+
+	// Missing key.
+	SealKey = nil
+	if _, _, err := session.Lookup("secret"); !errors.Is(err, ErrNoSealKey) {
+		t.Errorf("Expected missing key error, got %v", err)
+	}
+	if err := session.Set("key", "value"); !errors.Is(err, ErrNoSealKey) {
+		t.Errorf("Expected missing key error, got %v", err)
+	}
+	if err := session.Unseal(); !errors.Is(err, ErrNoSealKey) {
+		t.Errorf("Expected missing key error, got %v", err)
+	}
+
+	// Wrong key.
+	SealKey = []byte("fedcba9876543210fedcba9876543210")
+	if _, _, err := session.Lookup("secret"); err == nil {
+		t.Error("Data was decrypted with the wrong key")
+	}
+	if value := session.Get("secret", "default"); value != "default" {
+		t.Errorf("Expected default value, got %v", value)
+	}
+
+	// Unseal.
+	SealKey = []byte("0123456789abcdef0123456789abcdef")
+	if err := session.Unseal(); err != nil {
+		t.Fatal(err)
+	}
+	if session.IsSealed() || session.data["secret"] != "value" {
+		t.Error("Session was not unsealed")
+	}
+}
+
+// Test rotating the seal key.
+func TestReEncryptSessions(t *testing.T) {
+	defer reset()
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	stored := make(map[string][]byte)
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			data, ok := stored[id]
+			if !ok {
+				return nil, nil
+			}
+			var session Session
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session); err != nil {
+				return nil, err
+			}
+			return &session, nil
+		},
+		SaveSessionFunc: func(id string, session *Session) error {
+			var buffer bytes.Buffer
+			if err := gob.NewEncoder(&buffer).Encode(session); err != nil {
+				return err
+			}
+			stored[id] = buffer.Bytes()
+			return nil
+		},
+		AllSessionsFunc: func() ([]string, error) {
+			var ids []string
+			for id := range stored {
+				ids = append(ids, id)
+			}
+			return ids, nil
+		},
+	}
+
+	// Store some sessions.
+	SealKey = oldKey
+	for _, id := range []string{"sealed1", "sealed2", "plain"} {
+		session := &Session{id: id, created: time.Now(), data: map[string]interface{}{"key": id}}
+		if err := sessions.Set(session); err != nil {
+			t.Fatal(err)
+		}
+		if id != "plain" {
+			if err := session.Seal(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	PurgeSessions()
+
+	// Rotate the key.
+	SealKey = newKey
+	PreviousSealKeys = [][]byte{oldKey}
+	count, err := ReEncryptSessions(oldKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 re-encrypted sessions, got %d", count)
+	}
+	if count, err = ReEncryptSessions(oldKey, newKey); err != nil || count != 0 {
+		t.Errorf("Sessions were re-encrypted twice (%d, error %v)", count, err)
+	}
+
+	// The old key is not needed anymore.
+	PreviousSealKeys = nil
+	PurgeSessions()
+	for _, id := range []string{"sealed1", "sealed2", "plain"} {
+		session, err := sessions.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, _, err := session.Lookup("key"); err != nil || value != id {
+			t.Errorf("Session %s: unexpected value %v (error %v)", id, value, err)
+		}
+	}
+}
+
+// Test that re-encryption fails with the default persistence layer, which
+// cannot list sessions.
+func TestReEncryptSessionsDefaultPersistence(t *testing.T) {
+	defer reset()
+	if count, err := ReEncryptSessions(make([]byte, 32), make([]byte, 32)); count != 0 || !errors.Is(err, ErrNoSessionLister) {
+		t.Errorf("Expected ErrNoSessionLister, got %d sessions (%v)", count, err)
+	}
+}
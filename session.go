@@ -2,18 +2,26 @@ package sessions
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"net"
 	"net/http"
-	"regexp"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// maxReferenceHops is the maximum number of reference sessions which are
+// followed to get to the current session.
+const maxReferenceHops = 8
+
 // Session represents a browser session which may persist across multiple HTTP
 // requests. A session is usually generated with the Start() function and may
 // be destroyed with the Destroy() function.
@@ -33,8 +41,34 @@ type Session struct {
 	lastAccess        time.Time              // The last time the session was accessed through this API.
 	lastIP            string                 // The remote address (IP:port) of the last request. If empty, it will not be compared.
 	lastUserAgentHash uint64                 // A hash of the remote user agent string of the last request. If 0, it will not be compared.
+	ipHistory         []string               // Earlier remote addresses which differ from lastIP, most recent first (see RemoteHistorySize).
+	userAgentHistory  []uint64               // Earlier user agent hashes which differ from lastUserAgentHash, most recent first (see RemoteHistorySize).
+	pendingUserID     interface{}            // If not nil, the ID of the session user which has not been loaded yet (see LazyUserLoading). "user" is nil then.
 	referenceID       string                 // If this session's ID was replaced, this is the ID of the newer session.
 	data              map[string]interface{} // Any custom data stored in the session.
+	authPending       bool                   // Whether the user's authentication has not been completed yet (e.g. a second factor is missing).
+	authPendingReason string                 // An application-defined reason why authentication is still pending.
+	tag               string                 // An application-defined label used to group sessions.
+	tlsFingerprint    string                 // The TLS fingerprint of the request which created the session. If empty, it will not be compared.
+	uses              int                    // The number of requests which accessed the session under its current ID.
+	lastLanguageHash  uint64                 // A hash of the Accept-Language header of the last request. If 0, it will not be compared.
+	redirected        bool                   // For reference sessions, whether the browser's cookie was already redirected. Will not be saved with the session.
+	dataPending       bool                   // Whether "data" has not been loaded yet (see LazyDataLoading). Will not be saved with the session.
+	sealed            []byte                 // If not nil, the encrypted data, replacing "data" (see Seal()).
+	cookie            *http.Cookie           // The session cookie (without value) for the last request if NewSessionCookieForRequest is set. Will not be saved with the session.
+	subscribers       []chan SessionEvent    // The channels of subscribers to this session's changes (see Subscribe()). Will not be saved with the session.
+	locals            map[string]interface{} // In-process values which are never serialized (see SetLocal()). Will not be saved with the session.
+	cachedAt          time.Time              // The time the session was added to the cache or last read from the persistence layer (see SessionCacheMaxAge). Will not be saved with the session.
+	nearExpiry        bool                   // Whether OnSessionNearExpiry was called for the current idle period. Will not be saved with the session.
+	assuranceLevel    int                    // The authentication assurance level of the user (see SetAssuranceLevel()).
+	authTime          time.Time              // The time the user's authentication was completed (see LogIn() and CompleteAuth()). Zero if not logged in or still pending.
+	expiresAt         time.Time              // If not zero, the time when the session ends regardless of its activity (see SetExpiryAt()).
+	lastInstance      string                 // The InstanceID of the process which last accessed the session. Empty if unknown.
+	location          Location               // The location of the client which last accessed the session (see Locator).
+	started           time.Time              // The time when the session was started. Unlike "created", this is kept when the session ID changes. Zero for sessions stored by older versions.
+	rememberMe        bool                   // Whether the session is remembered, i.e. it has a longer lifetime (see SetRememberMe()).
+	userMAC           []byte                 // The MAC binding the user to the session ID, as read from the persistence layer (see UserIntegrityKey).
+	saveMutex         sync.Mutex             // Serializes saves of this session with session ID changes (see save()).
 }
 
 // Start returns a session for the given HTTP request. Because this function
@@ -54,29 +88,93 @@ type Session struct {
 // comments for details):
 //
 //   - SessionExpiry
+//   - SessionMaxLifetime
+//   - RememberMeExpiry
 //   - SessionIDExpiry
+//   - SessionIDExpiryJitter
+//   - SessionIDMaxUses
 //   - SessionCookie
 //   - NewSessionCookie
+//   - SkipCreateFor
+//   - TerminatedSessionExpiry
+//   - NearExpiryWindow
+//
+// If the browser presents the ID of a session which was recently destroyed,
+// ErrSessionTerminated may be returned (see TerminatedSessionExpiry).
 func Start(response http.ResponseWriter, request *http.Request, createIfNew bool) (*Session, error) {
 	// We may need this hash later.
-	var agentHash uint64
-	hash := fnv.New64a()
 	userAgent := request.Header.Get("User-Agent")
-	if userAgent != "" {
-		fmt.Fprint(hash, userAgent)
-		agentHash = hash.Sum64()
+	agentHash := userAgentHash(userAgent)
+	var legacyAgentHash uint64 // Sessions stored before normalization was introduced.
+	if userAgent != "" && NormalizeUserAgent != nil {
+		if normalized := NormalizeUserAgent(userAgent); normalized != userAgent {
+			legacyAgentHash = agentHash
+			agentHash = userAgentHash(normalized)
+		}
 	}
+	var languageHash uint64
+	if language := request.Header.Get("Accept-Language"); language != "" {
+		hash := fnv.New64a()
+		fmt.Fprint(hash, strings.ToLower(strings.Replace(language, " ", "", -1)))
+		languageHash = hash.Sum64()
+	}
+	var fingerprint string
+	if TLSFingerprint != nil {
+		fingerprint = TLSFingerprint(request)
+	}
+	remoteAddr := remoteAddress(request)
 
-	// Get the session ID from the cookie.
+	// Get the session ID from the cookie. Move it to the current cookie name if
+	// it was sent under an old name.
 	var id string // The session ID. Empty if it could not be determined.
-	cookie, err := request.Cookie(SessionCookie)
-	if err == nil {
+	cookie, alias := requestSessionCookie(request)
+	if cookie != nil {
 		id = cookie.Value
+		if alias {
+			migrateCookie(response, request, cookie)
+		}
+	}
+
+	// Report sessions near their idle timeout after the session ID was
+	// unlocked.
+	var nearExpiry *Session
+	if OnSessionNearExpiry != nil {
+		defer func() {
+			if nearExpiry != nil {
+				OnSessionNearExpiry(nearExpiry)
+			}
+		}()
 	}
 
 	// Get this session from the session cache.
-	var session *Session
-	if len(id) == 24 {
+	var (
+		session *Session
+		err     error
+	)
+	if id != "" && !ValidSessionIDFormat(id) {
+		// The cookie is malformed. Delete it so the browser stops sending it.
+		deleteCookie(response, request)
+	} else if id != "" {
+		// Most requests come with a valid, cached session. Skip all the locking.
+		if session, near := startCached(id, request, remoteAddr, agentHash, languageHash, fingerprint); session != nil {
+			countMetric(MetricCacheHits)
+			if near {
+				nearExpiry = session
+			}
+			return session, nil
+		}
+
+		// Report unknown session IDs after the session ID was unlocked.
+		var unknown bool
+		if OnUnknownSessionID != nil {
+			unknownID := id
+			defer func() {
+				if unknown {
+					OnUnknownSessionID(unknownID, request)
+				}
+			}()
+		}
+
 		// Lock this session ID.
 		sessionIDMutexes.Lock(id)
 		defer sessionIDMutexes.Unlock(id)
@@ -84,66 +182,78 @@ func Start(response http.ResponseWriter, request *http.Request, createIfNew bool
 		// Get the session.
 		session, err = sessions.Get(id)
 		if err != nil {
-			return nil, fmt.Errorf("Could not get session from cache: %s", err)
+			return nil, fmt.Errorf("Could not get session from cache: %w", err)
+		}
+
+		// Was this session destroyed recently? Let the caller know.
+		if session == nil && terminated(id) {
+			deleteCookie(response, request)
+			return nil, ErrSessionTerminated
 		}
 
 		// If session could not be found, delete the cookie.
 		if session == nil {
-			deleteCookie(cookie, response)
+			unknown = true
+			deleteCookie(response, request)
+			writeAudit(AuditRecord{
+				Event:     AuditUnknownSessionID,
+				SessionID: id,
+				RemoteIP:  remoteHost(remoteAddr),
+			})
 		}
 	}
 
 	if session != nil {
+		// We have a session for this user. Check if it's valid.
+		info := requestInfo{
+			now:             time.Now(),
+			remoteAddr:      remoteAddr,
+			agentHash:       agentHash,
+			legacyAgentHash: legacyAgentHash,
+			languageHash:    languageHash,
+			fingerprint:     fingerprint,
+		}
 		session.RLock()
-		timeUntouched := time.Since(session.lastAccess)
-		age := time.Since(session.created)
-		ip := session.lastIP
+		age := info.now.Sub(session.created)
+		uses := session.uses
+		valid, reason := evaluateSession(session, info, currentAnomalyConfig())
 		session.RUnlock()
 
-		// We have a valid session for this user. Check if it's valid.
-		valid := true
-
-		// Is it stale?
-		if timeUntouched >= SessionExpiry {
-			valid = false
-		}
-
-		// Has the remote IP changed too much?
-		if valid && AcceptRemoteIP > 1 {
-			ipFormat := regexp.MustCompile(`^(\d+).(\d+).(\d+).(\d+):\d+$`)
-			previousIP := ipFormat.FindStringSubmatch(ip)
-			currentIP := ipFormat.FindStringSubmatch(request.RemoteAddr)
-			if len(previousIP) == 5 && len(currentIP) == 5 && AcceptRemoteIP <= 4 {
-				for i := 1; i < AcceptRemoteIP; i++ {
-					if previousIP[i] != currentIP[i] {
-						valid = false
-						break
-					}
-				}
-			}
-		}
-
-		// Has the remote user agent changed?
-		if valid && !AcceptChangingUserAgent {
-			valid = session.lastUserAgentHash == 0 || session.lastUserAgentHash == agentHash
-		}
-
 		if !valid {
 			// Session is invalid. Delete it.
+			session.audit(AuditRecord{
+				Event:       AuditSessionRejected,
+				RemoteIP:    remoteHost(remoteAddr),
+				Reason:      reason,
+				Fingerprint: fingerprint,
+			})
+			if anomalyReason(reason) {
+				countMetric(MetricAnomalyRejections)
+				logWarn("Session rejected", "session", MaskSessionID(id), "reason", reason, "ip", remoteHost(remoteAddr))
+				if Events.OnAnomalyDetected != nil {
+					Events.OnAnomalyDetected(session, reason)
+				}
+			}
 			if err = session.Destroy(response, request); err != nil {
 				return nil, fmt.Errorf("Could not destroy expired session: %s", err)
 			}
 			session = nil
 		} else {
 			// It's not stale. Switch IDs?
-			if session.referenceID == "" && age >= SessionIDExpiry {
+			if session.referenceID == "" && (age >= sessionIDExpiry(id) || SessionIDMaxUses > 0 && uses >= SessionIDMaxUses) {
 				// Yes, this ID should be replaced.
+				if NewSessionCookieForRequest != nil {
+					session.Lock()
+					session.cookie = SessionCookieFor(request)
+					session.Unlock()
+				}
 				err = session.RegenerateID(response)
 				if err != nil {
 					return nil, err
 				}
-			} else if age >= SessionIDExpiry+SessionIDGracePeriod {
-				// Grace period expired. Remove this session.
+			} else if session.referenceID != "" && age >= SessionIDGracePeriod {
+				// Grace period expired. Remove this session. (Reference sessions
+				// are created when their ID is replaced.)
 				if err = sessions.Delete(id); err != nil {
 					return nil, fmt.Errorf("Could not delete session with expired ID: %s", err)
 				}
@@ -154,66 +264,218 @@ func Start(response http.ResponseWriter, request *http.Request, createIfNew bool
 				return nil, errors.New("Session expired")
 			}
 
-			// If this is a reference session, get the original one.
+			// If this is a reference session, get the original one. The
+			// referenced session may itself have been replaced in the meantime so
+			// we follow the chain of references until we reach the current
+			// session. Because the cache holds only one object per session ID, we
+			// return the same object as requests which use the new ID.
 			if session.referenceID != "" {
-				// Redirect cookie to reference session.
-				cookie = NewSessionCookie()
-				cookie.Name = SessionCookie
-				cookie.Value = session.referenceID
-				http.SetCookie(response, cookie)
-
-				// Get the referenced session.
-				session, err = sessions.Get(session.referenceID)
-				if err != nil {
-					return nil, fmt.Errorf("Could not get referenced session: %s", err)
+				// Only redirect the cookie once if requested.
+				session.Lock()
+				redirect := !RedirectCookieOnce || !session.redirected
+				session.redirected = true
+				session.Unlock()
+
+				for hops := 0; ; hops++ {
+					session.RLock()
+					referenceID := session.referenceID
+					session.RUnlock()
+					if referenceID == "" {
+						break
+					}
+					if hops >= maxReferenceHops {
+						return nil, errors.New("Too many reference sessions")
+					}
+					session, err = sessions.Get(referenceID)
+					if err != nil {
+						return nil, fmt.Errorf("Could not get referenced session: %s", err)
+					}
+					if session == nil {
+						return nil, errors.New("Reference session not found")
+					}
 				}
-				if session == nil {
-					return nil, errors.New("Reference session not found")
+
+				// Redirect cookie to referenced session.
+				if redirect {
+					session.RLock()
+					cookie = SessionCookieFor(request)
+					cookie.Value = session.id
+					applyCookieLifetime(cookie, session.rememberMe)
+					session.RUnlock()
+					setCookie(response, cookie)
 				}
 			}
 
+			// Locate the client again if its IP address changed.
+			var location Location
+			session.RLock()
+			relocate := Locator != nil && remoteHost(session.lastIP) != remoteHost(remoteAddr)
+			session.RUnlock()
+			if relocate {
+				location = locate(remoteAddr)
+			}
+
 			// We have a valid session.
 			session.Lock()
 			defer session.Unlock()
+			if relocate {
+				session.location = location
+			}
+			if session.checkNearExpiry() {
+				nearExpiry = session
+			}
+			if legacyAgentHash != 0 && session.lastUserAgentHash == legacyAgentHash {
+				session.lastUserAgentHash = agentHash // Switch to the normalized hash.
+			}
+			session.recordRemote(remoteAddr, agentHash)
 			session.lastAccess = time.Now()
-			session.lastIP = request.RemoteAddr
+			session.lastIP = remoteAddr
 			session.lastUserAgentHash = agentHash
+			if languageHash != 0 {
+				session.lastLanguageHash = languageHash
+			}
+			if session.tlsFingerprint == "" {
+				session.tlsFingerprint = fingerprint
+			}
+			if InstanceID != "" {
+				session.lastInstance = InstanceID
+			}
+			session.uses++
+			if NewSessionCookieForRequest != nil {
+				session.cookie = SessionCookieFor(request)
+			}
 			return session, nil
 		}
 	}
 
 	if session == nil {
 		// We don't have a session for this user.
-		if !createIfNew {
+		if !createIfNew || SkipCreateFor != nil && SkipCreateFor(request) {
 			// And we don't want any.
 			return nil, nil
 		}
 
 		// Create a new session for this user.
-		id, err = generateSessionID()
+		id, err = newSessionID()
 		if err != nil {
 			return nil, fmt.Errorf("Could not generate new session ID: %s", err)
 		}
+		now := time.Now()
 		session = &Session{
 			id:                id,
-			created:           time.Now(),
-			lastAccess:        time.Now(),
-			lastIP:            request.RemoteAddr,
+			created:           now,
+			started:           now,
+			lastAccess:        now,
+			lastIP:            remoteAddr,
 			lastUserAgentHash: agentHash,
+			lastLanguageHash:  languageHash,
+			tlsFingerprint:    fingerprint,
+			lastInstance:      InstanceID,
+			location:          locate(remoteAddr),
+			uses:              1,
 			data:              make(map[string]interface{}),
 		}
-		sessions.Set(session)
+		cookie = SessionCookieFor(request)
+		if NewSessionCookieForRequest != nil {
+			session.cookie = cookie
+		}
+		cookie = applyCookieLifetime(cookie, false)
+		if err := sessions.Set(session); err != nil {
+			logError("Could not save new session", "session", MaskSessionID(id), "error", err)
+		}
+		session.audit(AuditRecord{Event: AuditSessionCreated})
+		countMetric(MetricSessionsCreated)
+		if Events.OnCreated != nil {
+			Events.OnCreated(session)
+		}
 
 		// Also set the cookie.
-		cookie = NewSessionCookie()
-		cookie.Name = SessionCookie
 		cookie.Value = id
-		http.SetCookie(response, cookie)
+		setCookie(response, cookie)
 	}
 
 	return session, nil
 }
 
+// startCached is the fast path of Start() for the common case of a cached
+// session which is valid and whose ID does not need to be replaced. The session
+// is updated under a single lock. The session ID is not locked because no
+// session is loaded or saved here. If the session is not cached or if any of
+// the checks in Start() could fail or lead to a change of the session ID, nil
+// is returned and Start() must take the regular path. The second return value
+// indicates whether OnSessionNearExpiry must be called for the session (see
+// checkNearExpiry()).
+func startCached(id string, request *http.Request, remoteAddr string, agentHash, languageHash uint64, fingerprint string) (*Session, bool) {
+	session := sessions.cached(id)
+	if session == nil {
+		return nil, false
+	}
+	session.Lock()
+	defer session.Unlock()
+
+	// Anything other than a regular session whose ID is still fresh?
+	if session.id != id || session.referenceID != "" ||
+		time.Since(session.lastAccess) >= session.idleTimeout() ||
+		session.lifetimeExceeded() ||
+		!session.expiresAt.IsZero() && !time.Now().Before(session.expiresAt) ||
+		cacheEntryStale(session) ||
+		time.Since(session.created) >= sessionIDExpiry(id) ||
+		SessionIDMaxUses > 0 && session.uses >= SessionIDMaxUses {
+		return nil, false
+	}
+
+	// Anything that was checked for anomalies (or that leads to a new location)
+	// must be unchanged.
+	if (currentAnomalyConfig().checksRemoteIP() || Locator != nil) && remoteHost(session.lastIP) != remoteHost(remoteAddr) ||
+		!AcceptChangingUserAgent && session.lastUserAgentHash != agentHash ||
+		!AcceptChangingLanguage && session.lastLanguageHash != languageHash ||
+		TLSFingerprint != nil && session.tlsFingerprint != fingerprint {
+		return nil, false
+	}
+
+	// We have a valid session.
+	nearExpiry := session.checkNearExpiry()
+	session.recordRemote(remoteAddr, agentHash)
+	session.lastAccess = time.Now()
+	session.lastIP = remoteAddr
+	session.lastUserAgentHash = agentHash
+	if languageHash != 0 {
+		session.lastLanguageHash = languageHash
+	}
+	if session.tlsFingerprint == "" {
+		session.tlsFingerprint = fingerprint
+	}
+	if InstanceID != "" {
+		session.lastInstance = InstanceID
+	}
+	session.uses++
+	if NewSessionCookieForRequest != nil {
+		session.cookie = SessionCookieFor(request)
+	}
+	return session, nearExpiry
+}
+
+// remoteHost returns the host part of a remote address (IP:port). If the
+// address has no port, it is returned unchanged.
+func remoteHost(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// sessionIDExpiry returns the duration after which the given session ID is to be
+// replaced. This is SessionIDExpiry minus a jitter between 0 and
+// SessionIDExpiryJitter which is derived from the session ID.
+func sessionIDExpiry(id string) time.Duration {
+	if SessionIDExpiryJitter <= 0 {
+		return SessionIDExpiry
+	}
+	hash := fnv.New64a()
+	fmt.Fprint(hash, id)
+	return SessionIDExpiry - time.Duration(hash.Sum64()%uint64(SessionIDExpiryJitter))
+}
+
 // RegenerateID generates a new session ID and replaces it in the current
 // session. Use this every time there is a change in user privilege level or a
 // related change, e.g. when the user access rights change or when their
@@ -223,52 +485,102 @@ func Start(response http.ResponseWriter, request *http.Request, createIfNew bool
 // the same session ID come in at the same time, the old session (with the old
 // key) is turned into a reference session which will be valid for a grace
 // period (defined in SessionIDGracePeriod). When that reference session is
-// requested, the new session will be returned in its place.
+// requested, the new session will be returned in its place. As long as the
+// session is held in the local cache, this is the same *Session object that is
+// returned for the new session ID. Changes made via either session ID are
+// therefore immediately visible to all requests.
+//
+// It is safe to change the session's data from other goroutines (e.g.
+// concurrent requests for the same session) while the ID is changed. Such
+// changes are always saved under the new ID. They are never written to the
+// old ID, where they would overwrite the reference session.
 func (s *Session) RegenerateID(response http.ResponseWriter) error {
-	// Save this session under a new ID.
-	oldID := s.id
-	id, err := generateSessionID()
+	id, err := newSessionID()
 	if err != nil {
 		return fmt.Errorf("Could not generate replacement session ID: %s", err)
 	}
+	if err = s.loadData(); err != nil {
+		return err // The data can only be loaded under the old ID.
+	}
+
+	// Concurrent data changes (e.g. Set()) must not be saved under the old ID
+	// once it has been replaced by the reference session below. They are
+	// therefore held back until the ID change is complete. Changes made before
+	// that are included when the session is saved under its new ID.
+	var regenerated bool
+	if Events.OnRegeneratedID != nil {
+		defer func() {
+			if regenerated {
+				Events.OnRegeneratedID(s) // After saveMutex was unlocked.
+			}
+		}()
+	}
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	// Save this session under a new ID.
 	s.Lock()
+	oldID := s.id
 	s.id = id
+	s.started = s.startTime()
 	s.created = time.Now()
-	s.Unlock()
-	if err = sessions.Set(s); err != nil {
-		return fmt.Errorf("Could not save session under new session ID: %s", err)
-	}
-
-	// Save a reference session under the old ID.
+	s.uses = 0
 	refSession := &Session{
 		id:                oldID,
 		created:           s.created,
 		lastAccess:        time.Now().Add(-SessionIDExpiry),
 		lastIP:            s.lastIP,
 		lastUserAgentHash: s.lastUserAgentHash,
+		lastLanguageHash:  s.lastLanguageHash,
+		ipHistory:         s.ipHistory,
+		userAgentHistory:  s.userAgentHistory,
+		tlsFingerprint:    s.tlsFingerprint,
+		expiresAt:         s.expiresAt,
+		lastInstance:      s.lastInstance,
+		location:          s.location,
+		started:           s.started,
+		rememberMe:        s.rememberMe,
 		referenceID:       id,
 	}
+	s.Unlock()
+	if err = sessions.Set(s); err != nil {
+		return fmt.Errorf("Could not save session under new session ID: %s", err)
+	}
+
+	// Save a reference session under the old ID.
 	if err = sessions.Set(refSession); err != nil {
 		return fmt.Errorf("Could not save reference session: %s", err)
 	}
 
+	s.audit(AuditRecord{Event: AuditIDChanged, PreviousSessionID: oldID})
+	regenerated = true
+
 	// Delete that reference session after the grace period.
-	go func() {
-		time.Sleep(SessionIDGracePeriod)
-		sessions.Delete(oldID)
-	}()
-
-	// Change the cookie.
-	cookie := NewSessionCookie()
-	cookie.Name = SessionCookie
+	scheduleReferenceDeletion(oldID)
+
+	// Change the cookie. We use the cookie attributes of the last request, if
+	// available.
+	s.RLock()
+	var cookie *http.Cookie
+	if s.cookie != nil {
+		c := *s.cookie
+		cookie = &c
+	} else {
+		cookie = SessionCookieFor(nil)
+	}
+	applyCookieLifetime(cookie, s.rememberMe)
+	s.RUnlock()
 	cookie.Value = id
-	http.SetCookie(response, cookie)
+	setCookie(response, cookie)
 
 	return nil
 }
 
 // Destroy marks the end of this session. It is deleted from the session cache,
 // the persistence layer, and the user's browser cookie is marked as expired.
+// If TerminatedSessionExpiry is positive, the session ID is remembered so that
+// Start() can tell requests with the old ID (e.g. from other browser tabs)
+// apart from requests with unknown session IDs.
 //
 // The session should not be used anymore after this call.
 func (s *Session) Destroy(response http.ResponseWriter, request *http.Request) error {
@@ -276,31 +588,59 @@ func (s *Session) Destroy(response http.ResponseWriter, request *http.Request) e
 	if err := sessions.Delete(s.id); err != nil {
 		return fmt.Errorf("Could not delete session from cache: %s", err)
 	}
+	markTerminated(s.id)
+	s.Lock()
+	s.locals = nil
+	s.Unlock()
+	s.notify(SessionEventDestroy, "")
+	s.audit(AuditRecord{Event: AuditSessionDestroyed})
+	if Events.OnDestroyed != nil {
+		Events.OnDestroyed(s)
+	}
 
 	// Get the session cookie and delete it.
-	cookie, err := request.Cookie(SessionCookie)
-	if err != nil {
-		return fmt.Errorf("Could not retrieve session cookie: %s", err)
+	cookie, alias := requestSessionCookie(request)
+	if cookie == nil {
+		return fmt.Errorf("Could not retrieve session cookie: %s", http.ErrNoCookie)
+	}
+	deleteCookie(response, request)
+	if alias {
+		deleteCookieNamed(response, request, cookie.Name)
 	}
-	deleteCookie(cookie, response)
 
 	return nil
 }
 
-// deleteCookie deletes a cookie from the user's browser.
-func deleteCookie(cookie *http.Cookie, response http.ResponseWriter) {
-	delCookie := *cookie
-	delCookie.Value = "deleted"
-	delCookie.Expires = time.Unix(0, 0)
-	delCookie.MaxAge = -1
-	http.SetCookie(response, &delCookie)
+// deleteCookie deletes the session cookie from the user's browser. Browsers
+// only delete a cookie if the deleting cookie has the same name, path, and
+// domain as the original cookie. Since browsers do not send the path and domain
+// with the cookie, we take them from SessionCookieFor(). The value of the
+// deleting cookie is DeletedCookieValue.
+func deleteCookie(response http.ResponseWriter, request *http.Request) {
+	deleteCookieNamed(response, request, SessionCookie)
+}
+
+// deleteCookieNamed is like deleteCookie() but deletes the cookie with the
+// given name, e.g. one of the SessionCookieAliases.
+func deleteCookieNamed(response http.ResponseWriter, request *http.Request, name string) {
+	cookie := SessionCookieFor(request)
+	cookie.Name = name
+	cookie.Value = DeletedCookieValue
+	cookie.Expires = time.Unix(0, 0)
+	cookie.MaxAge = -1
+	setCookie(response, cookie)
 }
 
-// GobDecode unserializes a session from the given byte array.
+// GobDecode unserializes a session from the given byte array. Sessions
+// compressed by GobEncode() (see CompressSessions) are decompressed first.
 func (s *Session) GobDecode(from []byte) error {
 	s.Lock()
 	defer s.Unlock()
 
+	from, err := decompressSession(from)
+	if err != nil {
+		return err
+	}
 	buffer := bytes.NewReader(from)
 	decoder := gob.NewDecoder(buffer)
 
@@ -348,8 +688,9 @@ func (s *Session) GobDecode(from []byte) error {
 		if err := decoder.Decode(&userID); err != nil {
 			return fmt.Errorf("Unable to decode user ID: %s", err)
 		}
-		s.user, e = Persistence.LoadUser(userID.V)
-		if e != nil {
+		if LazyUserLoading {
+			s.pendingUserID = userID.V
+		} else if s.user, e = loadSessionUser(userID.V); e != nil {
 			return fmt.Errorf("Failed to load user: %s", e)
 		}
 	}
@@ -359,19 +700,141 @@ func (s *Session) GobDecode(from []byte) error {
 		return fmt.Errorf("Unable to decode session data: %s", err)
 	}
 
+	// Pending authentication.
+	if version >= 2 {
+		if err := decoder.Decode(&s.authPending); err != nil {
+			return fmt.Errorf("Unable to decode pending authentication state: %s", err)
+		}
+		if err := decoder.Decode(&s.authPendingReason); err != nil {
+			return fmt.Errorf("Unable to decode pending authentication reason: %s", err)
+		}
+	}
+
+	// Tag.
+	if version >= 3 {
+		if err := decoder.Decode(&s.tag); err != nil {
+			return fmt.Errorf("Unable to decode session tag: %s", err)
+		}
+	}
+
+	// TLS fingerprint.
+	if version >= 4 {
+		if err := decoder.Decode(&s.tlsFingerprint); err != nil {
+			return fmt.Errorf("Unable to decode session TLS fingerprint: %s", err)
+		}
+	}
+
+	// Number of uses.
+	if version >= 5 {
+		if err := decoder.Decode(&s.uses); err != nil {
+			return fmt.Errorf("Unable to decode session ID uses: %s", err)
+		}
+	}
+
+	// Hash of remote Accept-Language header.
+	if version >= 6 {
+		if err := decoder.Decode(&s.lastLanguageHash); err != nil {
+			return fmt.Errorf("Unable to decode hash of session remote language: %s", err)
+		}
+	}
+
+	// Sealed data.
+	if version >= 7 {
+		if err := decoder.Decode(&s.sealed); err != nil {
+			return fmt.Errorf("Unable to decode sealed session data: %s", err)
+		}
+		if len(s.sealed) == 0 {
+			s.sealed = nil
+		}
+	}
+
+	// Remote IP and user agent history.
+	if version >= 8 {
+		if err := decoder.Decode(&s.ipHistory); err != nil {
+			return fmt.Errorf("Unable to decode session remote IP history: %s", err)
+		}
+		if err := decoder.Decode(&s.userAgentHistory); err != nil {
+			return fmt.Errorf("Unable to decode session remote user agent history: %s", err)
+		}
+	}
+
+	// User integrity MAC.
+	if version >= 9 {
+		if err := decoder.Decode(&s.userMAC); err != nil {
+			return fmt.Errorf("Unable to decode session user MAC: %s", err)
+		}
+		if len(s.userMAC) == 0 {
+			s.userMAC = nil
+		}
+	}
+
+	// Fixed expiry time.
+	if version >= 10 {
+		if err := decoder.Decode(&s.expiresAt); err != nil {
+			return fmt.Errorf("Unable to decode session expiry time: %s", err)
+		}
+	}
+
+	// Authentication assurance level.
+	if version >= 11 {
+		if err := decoder.Decode(&s.assuranceLevel); err != nil {
+			return fmt.Errorf("Unable to decode session assurance level: %s", err)
+		}
+	}
+
+	// Last instance ID.
+	if version >= 12 {
+		if err := decoder.Decode(&s.lastInstance); err != nil {
+			return fmt.Errorf("Unable to decode session instance ID: %s", err)
+		}
+	}
+
+	// Location.
+	if version >= 13 {
+		if err := decoder.Decode(&s.location); err != nil {
+			return fmt.Errorf("Unable to decode session location: %s", err)
+		}
+	}
+
+	// Start time.
+	if version >= 14 {
+		if err := decoder.Decode(&s.started); err != nil {
+			return fmt.Errorf("Unable to decode session start time: %s", err)
+		}
+	}
+
+	// Remember-me flag.
+	if version >= 15 {
+		if err := decoder.Decode(&s.rememberMe); err != nil {
+			return fmt.Errorf("Unable to decode session remember-me flag: %s", err)
+		}
+	}
+
+	// Authentication time.
+	if version >= 16 {
+		if err := decoder.Decode(&s.authTime); err != nil {
+			return fmt.Errorf("Unable to decode session authentication time: %s", err)
+		}
+	}
+
 	return nil
 }
 
-// GobEncode serializes a session to a byte array.
+// GobEncode serializes a session to a byte array. If CompressSessions is
+// true, large sessions are compressed.
+//
+// The session is copied first (while it is locked) and the copy is then
+// encoded. Concurrent changes to the session, e.g. with Set(), are therefore
+// safe and do not have to wait for the encoding to finish. The values stored in
+// the session are not copied, however (see Set()).
 func (s *Session) GobEncode() ([]byte, error) {
-	s.RLock()
-	defer s.RUnlock()
+	s = s.snapshot()
 
 	var buffer bytes.Buffer
 	encoder := gob.NewEncoder(&buffer)
 
 	// Add a version number first.
-	if err := encoder.Encode(uint8(1)); err != nil {
+	if err := encoder.Encode(uint8(16)); err != nil {
 		return nil, fmt.Errorf("Unable to encode session version: %s", err)
 	}
 
@@ -401,11 +864,12 @@ func (s *Session) GobEncode() ([]byte, error) {
 	}
 
 	// User ID.
-	if err := encoder.Encode(s.user != nil); err != nil {
+	userID, loggedIn := s.userID()
+	if err := encoder.Encode(loggedIn); err != nil {
 		return nil, fmt.Errorf("Unable to encode log-in state: %s", err)
 	}
-	if s.user != nil {
-		if err := encoder.Encode(struct{ V interface{} }{V: s.user.GetID()}); err != nil {
+	if loggedIn {
+		if err := encoder.Encode(struct{ V interface{} }{V: userID}); err != nil {
 			return nil, fmt.Errorf("Unable to encode user ID: %s", err)
 		}
 	}
@@ -415,27 +879,161 @@ func (s *Session) GobEncode() ([]byte, error) {
 		return nil, fmt.Errorf("Unable to encode session data: %s", err)
 	}
 
-	return buffer.Bytes(), nil
+	// Pending authentication.
+	if err := encoder.Encode(s.authPending); err != nil {
+		return nil, fmt.Errorf("Unable to encode pending authentication state: %s", err)
+	}
+	if err := encoder.Encode(s.authPendingReason); err != nil {
+		return nil, fmt.Errorf("Unable to encode pending authentication reason: %s", err)
+	}
+
+	// Tag.
+	if err := encoder.Encode(s.tag); err != nil {
+		return nil, fmt.Errorf("Unable to encode session tag: %s", err)
+	}
+
+	// TLS fingerprint.
+	if err := encoder.Encode(s.tlsFingerprint); err != nil {
+		return nil, fmt.Errorf("Unable to encode session TLS fingerprint: %s", err)
+	}
+
+	// Number of uses.
+	if err := encoder.Encode(s.uses); err != nil {
+		return nil, fmt.Errorf("Unable to encode session ID uses: %s", err)
+	}
+
+	// Hash of remote Accept-Language header.
+	if err := encoder.Encode(s.lastLanguageHash); err != nil {
+		return nil, fmt.Errorf("Unable to encode hash of session remote language: %s", err)
+	}
+
+	// Sealed data.
+	if err := encoder.Encode(s.sealed); err != nil {
+		return nil, fmt.Errorf("Unable to encode sealed session data: %s", err)
+	}
+
+	// Remote IP and user agent history.
+	if err := encoder.Encode(s.ipHistory); err != nil {
+		return nil, fmt.Errorf("Unable to encode session remote IP history: %s", err)
+	}
+	if err := encoder.Encode(s.userAgentHistory); err != nil {
+		return nil, fmt.Errorf("Unable to encode session remote user agent history: %s", err)
+	}
+
+	// User integrity MAC.
+	if err := encoder.Encode(s.computeUserMAC(s.id)); err != nil {
+		return nil, fmt.Errorf("Unable to encode session user MAC: %s", err)
+	}
+
+	// Fixed expiry time.
+	if err := encoder.Encode(s.expiresAt); err != nil {
+		return nil, fmt.Errorf("Unable to encode session expiry time: %s", err)
+	}
+
+	// Authentication assurance level.
+	if err := encoder.Encode(s.assuranceLevel); err != nil {
+		return nil, fmt.Errorf("Unable to encode session assurance level: %s", err)
+	}
+
+	// Last instance ID.
+	if err := encoder.Encode(s.lastInstance); err != nil {
+		return nil, fmt.Errorf("Unable to encode session instance ID: %s", err)
+	}
+
+	// Location.
+	if err := encoder.Encode(s.location); err != nil {
+		return nil, fmt.Errorf("Unable to encode session location: %s", err)
+	}
+
+	// Start time.
+	if err := encoder.Encode(s.started); err != nil {
+		return nil, fmt.Errorf("Unable to encode session start time: %s", err)
+	}
+
+	// Remember-me flag.
+	if err := encoder.Encode(s.rememberMe); err != nil {
+		return nil, fmt.Errorf("Unable to encode session remember-me flag: %s", err)
+	}
+
+	// Authentication time.
+	if err := encoder.Encode(s.authTime); err != nil {
+		return nil, fmt.Errorf("Unable to encode session authentication time: %s", err)
+	}
+
+	return compressSession(buffer.Bytes())
 }
 
-// MarshalJSON serializes the session into JSON.
+// MarshalJSON serializes the session into JSON. Like GobEncode(), it
+// operates on a copy of the session.
 func (s *Session) MarshalJSON() ([]byte, error) {
-	s.RLock()
-	defer s.RUnlock()
+	s = s.snapshot()
 
 	m := map[string]interface{}{
-		"v":  1, // Version
+		"v":  16, // Version
 		"cr": s.created.Format(time.RFC3339),
 		"la": s.lastAccess.Format(time.RFC3339),
 		"ip": s.lastIP,
 		"ua": strconv.FormatUint(s.lastUserAgentHash, 36),
-		"da": s.data,
+	}
+	if s.sealed != nil {
+		m["sd"] = s.sealed
+	} else {
+		m["da"] = s.data
 	}
 	if s.referenceID != "" {
 		m["rf"] = s.referenceID
 	}
-	if s.user != nil {
-		m["us"] = s.user.GetID()
+	if userID, ok := s.userID(); ok {
+		m["us"] = userID
+	}
+	if s.authPending {
+		m["ap"] = s.authPendingReason
+	}
+	if s.tag != "" {
+		m["tg"] = s.tag
+	}
+	if s.tlsFingerprint != "" {
+		m["tf"] = s.tlsFingerprint
+	}
+	if s.uses != 0 {
+		m["uc"] = s.uses
+	}
+	if s.lastLanguageHash != 0 {
+		m["al"] = strconv.FormatUint(s.lastLanguageHash, 36)
+	}
+	if len(s.ipHistory) > 0 {
+		m["ih"] = s.ipHistory
+	}
+	if len(s.userAgentHistory) > 0 {
+		hashes := make([]string, len(s.userAgentHistory))
+		for index, hash := range s.userAgentHistory {
+			hashes[index] = strconv.FormatUint(hash, 36)
+		}
+		m["uh"] = hashes
+	}
+	if mac := s.computeUserMAC(s.id); mac != nil {
+		m["um"] = mac
+	}
+	if !s.expiresAt.IsZero() {
+		m["ea"] = s.expiresAt.Format(time.RFC3339)
+	}
+	if s.assuranceLevel != 0 {
+		m["aa"] = s.assuranceLevel
+	}
+	if s.lastInstance != "" {
+		m["in"] = s.lastInstance
+	}
+	if !s.location.IsZero() {
+		m["lo"] = []interface{}{s.location.Country, s.location.City, s.location.Latitude, s.location.Longitude}
+	}
+	if !s.started.IsZero() {
+		m["st"] = s.started.Format(time.RFC3339)
+	}
+	if s.rememberMe {
+		m["rm"] = true
+	}
+	if !s.authTime.IsZero() {
+		m["at"] = s.authTime.Format(time.RFC3339)
 	}
 	return json.Marshal(m)
 }
@@ -451,6 +1049,8 @@ func (s *Session) UnmarshalJSON(data []byte) error {
 	}
 	var (
 		v, cr, la, da, ip, ua, rf, us  interface{}
+		ap, tg, tf, uc, al, sd, ih, uh interface{}
+		um, ea, aa, in, lo, st, rm, at interface{}
 		created, lastAccess, agentHash string
 		version                        float64
 		ok                             bool
@@ -462,7 +1062,7 @@ func (s *Session) UnmarshalJSON(data []byte) error {
 	if version, ok = v.(float64); !ok {
 		return fmt.Errorf("Invalid version type %T", v)
 	}
-	if version != 1 {
+	if version < 1 || version > 16 {
 		return fmt.Errorf("Invalid version: %f", version)
 	}
 	if cr, ok = obj["cr"]; !ok {
@@ -504,55 +1104,554 @@ func (s *Session) UnmarshalJSON(data []byte) error {
 		}
 	}
 	if us, ok = obj["us"]; ok {
-		s.user, err = Persistence.LoadUser(us)
-		if err != nil {
+		if LazyUserLoading {
+			s.pendingUserID = us
+		} else if s.user, err = loadSessionUser(us); err != nil {
 			return fmt.Errorf("Error loading user: %s", err)
 		}
 	}
-	if da, ok = obj["da"]; !ok {
-		return errors.New("Missing session data")
+	if sd, ok = obj["sd"]; ok {
+		sealed, ok := sd.(string)
+		if !ok {
+			return fmt.Errorf("Invalid sealed session data type %T", sd)
+		}
+		if s.sealed, err = base64.StdEncoding.DecodeString(sealed); err != nil {
+			return fmt.Errorf("Invalid sealed session data: %s", err)
+		}
+	} else {
+		if da, ok = obj["da"]; !ok {
+			return errors.New("Missing session data")
+		}
+		if s.data, ok = da.(map[string]interface{}); !ok {
+			return fmt.Errorf("Invalid session data type %T", da)
+		}
 	}
-	if s.data, ok = da.(map[string]interface{}); !ok {
-		return fmt.Errorf("Invalid session data type %T", da)
+	if ap, ok = obj["ap"]; ok {
+		if s.authPendingReason, ok = ap.(string); !ok {
+			return fmt.Errorf("Invalid pending authentication reason type %T", ap)
+		}
+		s.authPending = true
 	}
-	return nil
-}
-
-// Expired returns whether or not this session has expired. This is useful to
-// frequently purge the session store.
-func (s *Session) Expired() bool {
-	s.RLock()
-	defer s.RUnlock()
-	return s.referenceID != "" && time.Since(s.lastAccess) >= SessionIDGracePeriod ||
-		time.Since(s.lastAccess) >= SessionExpiry &&
-			time.Since(s.created) >= SessionIDExpiry+SessionIDGracePeriod
-}
-
-// LastAccess returns the time this session was last accessed.
-func (s *Session) LastAccess() time.Time {
-	s.RLock()
-	defer s.RUnlock()
-	return s.lastAccess
-}
-
-// User returns the user for this session or nil if no user is attached to it,
-// i.e. if the user is logged out. When checking for nil, it is not enough to
-// just check for a nil (User) interface. You may also need to cast the
-// interface to your own user type and check if it is nil.
-func (s *Session) User() User {
-	s.RLock()
-	defer s.RUnlock()
-	return s.user
-}
-
-// LogIn assigns a user to this session, replacing any previously assigned user.
-// If "exclusive" is set to true, all other sessions of this user will be
-// deleted, effectively logging them out of any existing sessions first. This
-// requires that Persistence.UserSessions() returns all of a user's sessions.
-//
+	if tg, ok = obj["tg"]; ok {
+		if s.tag, ok = tg.(string); !ok {
+			return fmt.Errorf("Invalid session tag type %T", tg)
+		}
+	}
+	if tf, ok = obj["tf"]; ok {
+		if s.tlsFingerprint, ok = tf.(string); !ok {
+			return fmt.Errorf("Invalid session TLS fingerprint type %T", tf)
+		}
+	}
+	if uc, ok = obj["uc"]; ok {
+		uses, ok := uc.(float64)
+		if !ok {
+			return fmt.Errorf("Invalid session ID uses type %T", uc)
+		}
+		s.uses = int(uses)
+	}
+	if al, ok = obj["al"]; ok {
+		languageHash, ok := al.(string)
+		if !ok {
+			return fmt.Errorf("Invalid hash of session remote language type %T", al)
+		}
+		if s.lastLanguageHash, err = strconv.ParseUint(languageHash, 36, 64); err != nil {
+			return fmt.Errorf(`Invalid hash of session remote language "%s": %s`, languageHash, err)
+		}
+	}
+	if ih, ok = obj["ih"]; ok {
+		ips, ok := ih.([]interface{})
+		if !ok {
+			return fmt.Errorf("Invalid session remote IP history type %T", ih)
+		}
+		s.ipHistory = make([]string, len(ips))
+		for index, ip := range ips {
+			if s.ipHistory[index], ok = ip.(string); !ok {
+				return fmt.Errorf("Invalid session remote IP type %T", ip)
+			}
+		}
+	}
+	if uh, ok = obj["uh"]; ok {
+		hashes, ok := uh.([]interface{})
+		if !ok {
+			return fmt.Errorf("Invalid session remote user agent history type %T", uh)
+		}
+		s.userAgentHistory = make([]uint64, len(hashes))
+		for index, hash := range hashes {
+			agentHash, ok := hash.(string)
+			if !ok {
+				return fmt.Errorf("Invalid hash of session remote user agent type %T", hash)
+			}
+			if s.userAgentHistory[index], err = strconv.ParseUint(agentHash, 36, 64); err != nil {
+				return fmt.Errorf(`Invalid hash of session remote user agent "%s": %s`, agentHash, err)
+			}
+		}
+	}
+	if um, ok = obj["um"]; ok {
+		mac, ok := um.(string)
+		if !ok {
+			return fmt.Errorf("Invalid session user MAC type %T", um)
+		}
+		if s.userMAC, err = base64.StdEncoding.DecodeString(mac); err != nil {
+			return fmt.Errorf("Invalid session user MAC: %s", err)
+		}
+	}
+	if ea, ok = obj["ea"]; ok {
+		expiresAt, ok := ea.(string)
+		if !ok {
+			return fmt.Errorf("Invalid session expiry time type %T", ea)
+		}
+		if s.expiresAt, err = time.Parse(time.RFC3339, expiresAt); err != nil {
+			return fmt.Errorf("Cannot parse session expiry time: %s", err)
+		}
+	}
+	if aa, ok = obj["aa"]; ok {
+		level, ok := aa.(float64)
+		if !ok {
+			return fmt.Errorf("Invalid session assurance level type %T", aa)
+		}
+		s.assuranceLevel = int(level)
+	}
+	if in, ok = obj["in"]; ok {
+		if s.lastInstance, ok = in.(string); !ok {
+			return fmt.Errorf("Invalid session instance ID type %T", in)
+		}
+	}
+	if lo, ok = obj["lo"]; ok {
+		fields, ok := lo.([]interface{})
+		if !ok || len(fields) != 4 {
+			return fmt.Errorf("Invalid session location %v", lo)
+		}
+		country, ok1 := fields[0].(string)
+		city, ok2 := fields[1].(string)
+		latitude, ok3 := fields[2].(float64)
+		longitude, ok4 := fields[3].(float64)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			return fmt.Errorf("Invalid session location %v", lo)
+		}
+		s.location = Location{Country: country, City: city, Latitude: latitude, Longitude: longitude}
+	}
+	if st, ok = obj["st"]; ok {
+		started, ok := st.(string)
+		if !ok {
+			return fmt.Errorf("Invalid session start time type %T", st)
+		}
+		if s.started, err = time.Parse(time.RFC3339, started); err != nil {
+			return fmt.Errorf("Cannot parse session start time: %s", err)
+		}
+	}
+	if rm, ok = obj["rm"]; ok {
+		if s.rememberMe, ok = rm.(bool); !ok {
+			return fmt.Errorf("Invalid session remember-me flag type %T", rm)
+		}
+	}
+	if at, ok = obj["at"]; ok {
+		authTime, ok := at.(string)
+		if !ok {
+			return fmt.Errorf("Invalid session authentication time type %T", at)
+		}
+		if s.authTime, err = time.Parse(time.RFC3339, authTime); err != nil {
+			return fmt.Errorf("Cannot parse session authentication time: %s", err)
+		}
+	}
+	return nil
+}
+
+// Expired returns whether or not this session has expired. This is useful to
+// frequently purge the session store.
+func (s *Session) Expired() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.referenceID != "" && time.Since(s.created) >= SessionIDGracePeriod ||
+		time.Since(s.lastAccess) >= s.idleTimeout() &&
+			time.Since(s.created) >= SessionIDExpiry+SessionIDGracePeriod ||
+		s.lifetimeExceeded() ||
+		!s.expiresAt.IsZero() && !time.Now().Before(s.expiresAt)
+}
+
+// startTime returns the time when this session was started, regardless of any
+// session ID changes. For sessions stored by older versions of this package,
+// which did not record this time, the creation time of the current session ID
+// is returned. The session must be locked (at least for reading) while this
+// function is called.
+func (s *Session) startTime() time.Time {
+	if s.started.IsZero() {
+		return s.created
+	}
+	return s.started
+}
+
+// lifetimeExceeded returns whether this session was started longer than
+// SessionMaxLifetime ago. Sessions without a known start time never exceed
+// it. The session must be locked (at least for reading) while this function is
+// called.
+func (s *Session) lifetimeExceeded() bool {
+	started := s.startTime()
+	return !started.IsZero() && time.Since(started) >= SessionMaxLifetime
+}
+
+// Started returns the time when this session was started. Unlike the creation
+// time of the session ID, it does not change when the session ID is replaced
+// (see SessionMaxLifetime).
+func (s *Session) Started() time.Time {
+	s.RLock()
+	defer s.RUnlock()
+	return s.startTime()
+}
+
+// RemainingAbsoluteTime returns the duration after which this session will
+// expire regardless of its activity, i.e. when SessionMaxLifetime is reached
+// or, if it comes earlier, at the time set with SetExpiryAt(). If neither
+// applies, math.MaxInt64 is returned. The returned value is never negative.
+func (s *Session) RemainingAbsoluteTime() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	remaining := time.Duration(math.MaxInt64)
+	if started := s.startTime(); SessionMaxLifetime != math.MaxInt64 && !started.IsZero() {
+		remaining = SessionMaxLifetime - time.Since(started)
+	}
+	if !s.expiresAt.IsZero() {
+		if untilDeadline := time.Until(s.expiresAt); untilDeadline < remaining {
+			remaining = untilDeadline
+		}
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// ErrSessionNotFound is returned by Session.Reload() if the persistence layer
+// has no session with the session's ID.
+var ErrSessionNotFound = errors.New("Session not found")
+
+// Reload replaces the content of this session with the session stored under
+// its ID in the persistence layer. Because this package assumes that sessions
+// are only changed through this package, the local cache is normally never
+// refreshed from the persistence layer. If a session was changed elsewhere,
+// e.g. by a background job or by another process, the cached copy is stale.
+// Call this function if you know that this happened to force a fresh read.
+//
+// Use this sparingly. Each call bypasses the cache and any local changes which
+// have not been saved yet (e.g. because of WriteBehind) are lost. Values
+// attached with SetLocal() and subscriptions are kept. If the persistence
+// layer does not have the session anymore, ErrSessionNotFound is returned and
+// the session remains unchanged.
+func (s *Session) Reload() error {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	s.RLock()
+	id := s.id
+	s.RUnlock()
+
+	stored, err := Persistence.LoadSession(id)
+	if err != nil {
+		return fmt.Errorf("Could not load session: %s", err)
+	}
+	if stored == nil {
+		return ErrSessionNotFound
+	}
+
+	stored.RLock()
+	defer stored.RUnlock()
+	if !stored.verifyUserMAC(id) {
+		return ErrUserMismatch
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.user = stored.user
+	s.pendingUserID = stored.pendingUserID
+	s.created = stored.created
+	s.lastAccess = stored.lastAccess
+	s.lastIP = stored.lastIP
+	s.lastUserAgentHash = stored.lastUserAgentHash
+	s.ipHistory = stored.ipHistory
+	s.userAgentHistory = stored.userAgentHistory
+	s.referenceID = stored.referenceID
+	s.data = stored.data
+	if s.data == nil && stored.sealed == nil {
+		s.data = make(map[string]interface{})
+	}
+	s.dataPending = false
+	s.sealed = stored.sealed
+	s.authPending = stored.authPending
+	s.authPendingReason = stored.authPendingReason
+	s.tag = stored.tag
+	s.tlsFingerprint = stored.tlsFingerprint
+	s.uses = stored.uses
+	s.lastLanguageHash = stored.lastLanguageHash
+	s.expiresAt = stored.expiresAt
+	s.assuranceLevel = stored.assuranceLevel
+	s.authTime = stored.authTime
+	s.lastInstance = stored.lastInstance
+	s.location = stored.location
+	s.started = stored.started
+	s.rememberMe = stored.rememberMe
+	s.userMAC = stored.userMAC
+	s.cachedAt = time.Now()
+
+	return nil
+}
+
+// Equal returns whether this session and the other session have the same
+// content. This includes all attributes which are serialized (timestamps,
+// remote IP, user agent hash, reference ID, custom data etc.) but not the
+// session ID. Users are compared by their IDs (as returned by GetID()) rather
+// than by identity. User IDs and custom data are compared with
+// reflect.DeepEqual().
+//
+// This function is mainly intended for tests and for consistency checks of
+// session caches.
+func (s *Session) Equal(other *Session) bool {
+	if s == other {
+		return true
+	}
+	if s == nil || other == nil {
+		return false
+	}
+
+	// Make a copy of the other session first so we never hold two locks.
+	o := other.snapshot()
+
+	s.RLock()
+	defer s.RUnlock()
+	if !s.created.Equal(o.created) ||
+		!s.lastAccess.Equal(o.lastAccess) ||
+		s.lastIP != o.lastIP ||
+		s.lastUserAgentHash != o.lastUserAgentHash ||
+		s.lastLanguageHash != o.lastLanguageHash ||
+		s.referenceID != o.referenceID ||
+		s.authPending != o.authPending ||
+		s.authPendingReason != o.authPendingReason ||
+		s.tag != o.tag ||
+		s.tlsFingerprint != o.tlsFingerprint ||
+		s.uses != o.uses ||
+		!bytes.Equal(s.sealed, o.sealed) ||
+		!reflect.DeepEqual(s.ipHistory, o.ipHistory) ||
+		!reflect.DeepEqual(s.userAgentHistory, o.userAgentHistory) ||
+		!s.expiresAt.Equal(o.expiresAt) ||
+		s.assuranceLevel != o.assuranceLevel ||
+		!s.authTime.Equal(o.authTime) ||
+		s.lastInstance != o.lastInstance ||
+		s.location != o.location ||
+		!s.started.Equal(o.started) ||
+		s.rememberMe != o.rememberMe {
+		return false
+	}
+	userID, loggedIn := s.userID()
+	otherUserID, otherLoggedIn := o.userID()
+	if loggedIn != otherLoggedIn || !reflect.DeepEqual(userID, otherUserID) {
+		return false
+	}
+	if len(s.data) != len(o.data) {
+		return false
+	}
+	for key, value := range s.data {
+		otherValue, ok := o.data[key]
+		if !ok || !reflect.DeepEqual(value, otherValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshot returns a copy of this session's serialized fields which can be
+// read without holding the session's lock. The data map and the remote
+// histories are copied, too, so later changes to this session do not affect
+// the snapshot. The values stored in the data map, however, are shared (see
+// Set()). The session must not be locked when this function is called.
+func (s *Session) snapshot() *Session {
+	s.RLock()
+	defer s.RUnlock()
+	snapshot := &Session{
+		id:                s.id,
+		created:           s.created,
+		lastAccess:        s.lastAccess,
+		lastIP:            s.lastIP,
+		lastUserAgentHash: s.lastUserAgentHash,
+		lastLanguageHash:  s.lastLanguageHash,
+		referenceID:       s.referenceID,
+		user:              s.user,
+		pendingUserID:     s.pendingUserID,
+		authPending:       s.authPending,
+		authPendingReason: s.authPendingReason,
+		tag:               s.tag,
+		tlsFingerprint:    s.tlsFingerprint,
+		uses:              s.uses,
+		sealed:            s.sealed,
+		ipHistory:         append([]string(nil), s.ipHistory...),
+		userAgentHistory:  append([]uint64(nil), s.userAgentHistory...),
+		expiresAt:         s.expiresAt,
+		assuranceLevel:    s.assuranceLevel,
+		authTime:          s.authTime,
+		lastInstance:      s.lastInstance,
+		location:          s.location,
+		started:           s.started,
+		rememberMe:        s.rememberMe,
+	}
+	if s.data != nil {
+		snapshot.data = make(map[string]interface{}, len(s.data))
+		for key, value := range s.data {
+			snapshot.data[key] = value
+		}
+	}
+	return snapshot
+}
+
+// RemainingIdleTime returns the duration after which this session will expire
+// if it is not accessed again (see SessionExpiry and RememberMeExpiry). This
+// may be used, for example, to show a countdown to the user or to refresh the
+// session before it expires. If a time was set with SetExpiryAt(), the result
+// does not extend beyond it. If sessions never expire, math.MaxInt64 is
+// returned. The returned value is never negative.
+func (s *Session) RemainingIdleTime() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	remaining := time.Duration(math.MaxInt64)
+	if timeout := s.idleTimeout(); timeout != math.MaxInt64 {
+		remaining = timeout - time.Since(s.lastAccess)
+	}
+	if !s.expiresAt.IsZero() {
+		if untilDeadline := time.Until(s.expiresAt); untilDeadline < remaining {
+			remaining = untilDeadline
+		}
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// checkNearExpiry returns whether OnSessionNearExpiry must be called for this
+// session because it is being accessed within NearExpiryWindow of its idle
+// timeout. It returns true only once per idle period: concurrent requests which
+// all see the same last access time do not lead to multiple calls. Because the
+// access resets the idle timeout, the next idle period will then start. This
+// function must be called before the session's last access time is updated and
+// while the session is locked.
+func (s *Session) checkNearExpiry() bool {
+	timeout := s.idleTimeout()
+	if OnSessionNearExpiry == nil || NearExpiryWindow <= 0 || timeout == math.MaxInt64 {
+		return false
+	}
+	if timeout-time.Since(s.lastAccess) >= NearExpiryWindow {
+		s.nearExpiry = false
+		return false
+	}
+	if s.nearExpiry {
+		return false
+	}
+	s.nearExpiry = true
+	return true
+}
+
+// SetExpiryAt sets a fixed time at which this session ends, regardless of its
+// activity, e.g. at the end of a timed exam or before a scheduled maintenance
+// window. Once this time has passed, Start() rejects the session (with
+// ReasonDeadline) and Expired() returns true. This is independent of
+// SessionExpiry, which ends inactive sessions. A zero time removes the
+// deadline.
+//
+// Note that since the sessions cache is write-through, this will also result in
+// a call to SaveSession() of the persistence layer. The error returned is the
+// error from SaveSession().
+func (s *Session) SetExpiryAt(t time.Time) error {
+	s.Lock()
+	s.expiresAt = t
+	s.Unlock()
+	return s.save()
+}
+
+// ExpiresAt returns the time set with SetExpiryAt() at which this session
+// ends. The second return value is false if no such time was set.
+func (s *Session) ExpiresAt() (time.Time, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.expiresAt, !s.expiresAt.IsZero()
+}
+
+// LastAccess returns the time this session was last accessed.
+func (s *Session) LastAccess() time.Time {
+	s.RLock()
+	defer s.RUnlock()
+	return s.lastAccess
+}
+
+// LastInstance returns the InstanceID of the process which last accessed this
+// session. An empty string is returned if InstanceID was not set at the time.
+// This is for diagnostic purposes only, e.g. to find out whether requests for
+// the same session are handled by different nodes.
+func (s *Session) LastInstance() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.lastInstance
+}
+
+// TLSFingerprint returns the TLS fingerprint recorded when this session was
+// created (see the TLSFingerprint package variable). An empty string is
+// returned if no fingerprint was recorded.
+func (s *Session) TLSFingerprint() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.tlsFingerprint
+}
+
+// User returns the user for this session or nil if no user is attached to it,
+// i.e. if the user is logged out. When checking for nil, it is not enough to
+// just check for a nil (User) interface. You may also need to cast the
+// interface to your own user type and check if it is nil.
+//
+// If LazyUserLoading is true, the user is loaded with Persistence.LoadUser()
+// when this function is called for the first time. If that fails, nil is
+// returned and the user will be loaded again with the next call.
+func (s *Session) User() User {
+	if s.loadUser() != nil {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.user
+}
+
+// EffectiveUser is like User() but returns nil while the user's authentication
+// is still pending (see LogInPending()). Use this function for authorization
+// decisions.
+func (s *Session) EffectiveUser() User {
+	if s.loadUser() != nil {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	if s.authPending {
+		return nil
+	}
+	return s.user
+}
+
+// LogIn assigns a user to this session, replacing any previously assigned user.
+// If "exclusive" is set to true, all other sessions of this user will be
+// deleted, effectively logging them out of any existing sessions first. This
+// requires that Persistence.UserSessions() returns all of a user's sessions.
+//
 // A call to this function also causes a session ID change for security reasons.
-// It must be called before any non-header content is sent to the browser.
+// It must be called before any non-header content is sent to the browser. If
+// ClearDataOnLogIn is true, all session data except anonymous values (see
+// SetAnon()) is removed. The session's CSRF token (see CSRFToken()) is always
+// replaced.
 func (s *Session) LogIn(user User, exclusive bool, response http.ResponseWriter) error {
+	return s.logIn(user, exclusive, false, "", response)
+}
+
+// LogInPending is like LogIn but marks the user's authentication as pending,
+// e.g. because the password was verified but a second factor is still
+// missing. The "reason" may be used by the application to remember what is
+// still required. While authentication is pending, EffectiveUser() returns nil.
+// Call CompleteAuth() once the user has been fully authenticated.
+func (s *Session) LogInPending(user User, exclusive bool, reason string, response http.ResponseWriter) error {
+	return s.logIn(user, exclusive, true, reason, response)
+}
+
+// logIn implements LogIn() and LogInPending().
+func (s *Session) logIn(user User, exclusive, pending bool, reason string, response http.ResponseWriter) error {
 	// First, log user out of existing sessions.
 	if exclusive {
 		if err := LogOut(user.GetID()); err != nil {
@@ -562,9 +1661,107 @@ func (s *Session) LogIn(user User, exclusive bool, response http.ResponseWriter)
 		s.LogOut()
 	}
 
-	// Log user into this session.
+	// Log user into this session. Saving it requires its data anyway.
+	if err := s.loadData(); err != nil {
+		return err
+	}
+	s.Lock()
+	var removed []string
+	if ClearDataOnLogIn {
+		var err error
+		if removed, err = s.clearData(); err != nil {
+			s.Unlock()
+			return fmt.Errorf("Could not clear session data: %s", err)
+		}
+	}
+	if err := s.removeCSRFToken(); err != nil {
+		s.Unlock()
+		return fmt.Errorf("Could not rotate CSRF token: %s", err)
+	}
+	s.setUser(user)
+	s.authPending = pending
+	s.authPendingReason = reason
+	s.assuranceLevel = 0
+	s.authTime = time.Time{}
+	if !pending {
+		s.authTime = time.Now()
+	}
+	s.locals = nil
+	s.Unlock()
+	for _, key := range removed {
+		s.notify(SessionEventDelete, key)
+	}
+	if err := sessions.Set(s); err != nil {
+		return fmt.Errorf("Could not update session cache: %s", err)
+	}
+
+	// Switch session ID. Locking the old ID keeps Start() from loading the
+	// session from the persistence layer under that ID while it is replaced.
+	// Concurrent data changes are handled by RegenerateID().
+	sessionIDMutexes.Lock(s.id)
+	defer sessionIDMutexes.Unlock(s.id)
+	if err := s.RegenerateID(response); err != nil {
+		return fmt.Errorf("Could not switch session ID: %s", err)
+	}
+
+	event := AuditLogIn
+	if pending {
+		event = AuditLogInPending
+	}
+	s.audit(AuditRecord{Event: event})
+	if Events.OnLogin != nil {
+		Events.OnLogin(s)
+	}
+
+	return nil
+}
+
+// SetAuthPending marks the authentication of the session's user as pending.
+// This is typically the state between a successful password check and the
+// successful check of a second factor. The "reason" is stored with the session
+// and may be retrieved with IsAuthPending(). Use CompleteAuth() to end this
+// state.
+//
+// Since the sessions cache is write-through, this will also result in a call to
+// SaveSession() of the persistence layer. The error returned is the error from
+// SaveSession().
+func (s *Session) SetAuthPending(reason string) error {
 	s.Lock()
-	s.user = user
+	s.authPending = true
+	s.authPendingReason = reason
+	s.Unlock()
+	return s.save()
+}
+
+// IsAuthPending returns whether the authentication of the session's user is
+// still pending and, if so, the reason provided to SetAuthPending() or
+// LogInPending().
+func (s *Session) IsAuthPending() (bool, string) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.authPending, s.authPendingReason
+}
+
+// CompleteAuth finalizes a pending authentication (see LogInPending() and
+// SetAuthPending()). Because this changes the user's privilege level, it also
+// causes a session ID change. It must therefore be called before any
+// non-header content is sent to the browser.
+//
+// If no user is attached to this session, an error is returned. If the
+// authentication is not pending, nothing happens.
+func (s *Session) CompleteAuth(response http.ResponseWriter) error {
+	s.Lock()
+	if _, loggedIn := s.userID(); !loggedIn {
+		s.Unlock()
+		return errors.New("No user is logged into this session")
+	}
+	if !s.authPending {
+		s.Unlock()
+		return nil
+	}
+	s.authPending = false
+	s.authPendingReason = ""
+	s.authTime = time.Now()
 	s.Unlock()
 	if err := sessions.Set(s); err != nil {
 		return fmt.Errorf("Could not update session cache: %s", err)
@@ -577,55 +1774,360 @@ func (s *Session) LogIn(user User, exclusive bool, response http.ResponseWriter)
 		return fmt.Errorf("Could not switch session ID: %s", err)
 	}
 
+	s.audit(AuditRecord{Event: AuditLogIn})
+	if Events.OnLogin != nil {
+		Events.OnLogin(s)
+	}
+
 	return nil
 }
 
-// Set stores a value under a key in the session which can then be retrieved
-// with Get(). Any previous value stored under the same key will be overwritten.
+// SetAssuranceLevel records how strongly the session's user was authenticated,
+// e.g. following the NIST authentication assurance levels: 1 for a password,
+// 2 for a password plus a second factor, 3 for a hardware-based authenticator.
+// The meaning of the levels is up to the application. Set the level after
+// LogIn() or CompleteAuth(), and raise it after a step-up authentication.
+// Use RequireAssurance() to check it before sensitive operations.
+//
+// The level is reset to 0 when a user logs in or out. Because raising the
+// level grants additional privileges, you should also call RegenerateID()
+// unless the session ID was just changed by LogIn() or CompleteAuth().
+//
 // Note that since the sessions cache is write-through, this will also result in
 // a call to SaveSession() of the persistence layer. The error returned is the
 // error from SaveSession().
-func (s *Session) Set(key string, value interface{}) error {
+func (s *Session) SetAssuranceLevel(level int) error {
 	s.Lock()
-	s.data[key] = value
+	s.assuranceLevel = level
 	s.Unlock()
-	return Persistence.SaveSession(s.id, s)
+	return s.save()
+}
+
+// AssuranceLevel returns the authentication assurance level set with
+// SetAssuranceLevel() or 0 if none was set.
+func (s *Session) AssuranceLevel() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.assuranceLevel
+}
+
+// RequireAssurance returns whether a user is logged into this session whose
+// authentication is not pending (see LogInPending()) and whose authentication
+// assurance level (see SetAssuranceLevel()) is at least "min".
+func (s *Session) RequireAssurance(min int) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, loggedIn := s.userID()
+	return loggedIn && !s.authPending && s.assuranceLevel >= min
+}
+
+// loadData loads the session data from the persistence layer (see
+// SessionDataLoader) if it was omitted from the cached session (see
+// LazyDataLoading). Nothing happens if the data has already been loaded.
+func (s *Session) loadData() error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.dataPending {
+		return nil
+	}
+	data, err := loadSessionData(Persistence, s.id)
+	if err != nil {
+		return fmt.Errorf("Could not load session data: %s", err)
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	s.data = data
+	s.dataPending = false
+	return nil
+}
+
+// ErrTooManyKeys is returned when a new key is added to a session which
+// already holds MaxSessionKeys keys.
+var ErrTooManyKeys = errors.New("Too many session keys")
+
+// errUnchanged may be returned by the function passed to mutate() to leave the
+// session unchanged without reporting an error.
+var errUnchanged = errors.New("Session data unchanged")
+
+// mutate applies a change to the session data and saves the session. The given
+// function receives a copy of the session data which it may modify freely. It
+// is called while the session is locked. If it returns an error, the changes
+// are discarded and the error is returned (nil for errUnchanged). The same
+// happens with ErrTooManyKeys if the modified data holds more than
+// MaxSessionKeys keys and more keys than before. Otherwise, the modified copy
+// replaces the session data, SessionEventDelete and SessionEventSet events are
+// sent for the keys which were deleted or whose values changed, and the session
+// is saved.
+func (s *Session) mutate(change func(data map[string]interface{}) error) error {
+	if err := s.loadData(); err != nil {
+		return err
+	}
+	s.Lock()
+	data, err := s.openData()
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+	changed := make(map[string]interface{}, len(data)+1)
+	for key, value := range data {
+		changed[key] = value
+	}
+	if err := change(changed); err != nil {
+		s.Unlock()
+		if err == errUnchanged {
+			return nil
+		}
+		return err
+	}
+	if MaxSessionKeys > 0 && len(changed) > MaxSessionKeys && len(changed) > len(data) {
+		s.Unlock()
+		return ErrTooManyKeys
+	}
+	var set, deleted []string
+	for key, value := range changed {
+		if old, ok := data[key]; !ok || !reflect.DeepEqual(old, value) {
+			set = append(set, key)
+		}
+	}
+	for key := range data {
+		if _, ok := changed[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	if AutoRegisterGobTypes {
+		RegisterCommonTypes()
+		for _, key := range set {
+			registerGobType(changed[key])
+		}
+	}
+	if err := s.closeData(changed); err != nil {
+		s.Unlock()
+		return err
+	}
+	s.Unlock()
+	for _, key := range deleted {
+		s.notify(SessionEventDelete, key)
+	}
+	for _, key := range set {
+		s.notify(SessionEventSet, key)
+	}
+	return s.save()
+}
+
+// Set stores a value under a key in the session which can then be retrieved
+// with Get(). Any previous value stored under the same key will be overwritten.
+// Note that since the sessions cache is write-through, this will also result in
+// a call to SaveSession() of the persistence layer. The error returned is the
+// error from SaveSession() or, for sealed sessions (see Seal()), an error
+// which occurred during encryption. If the key is new and the session already
+// holds MaxSessionKeys keys, ErrTooManyKeys is returned.
+//
+// The value itself is not copied. It is shared with anyone who retrieves it
+// with Get() and it is read when the session is serialized, possibly in other
+// goroutines. If the value is a map, a slice, or a pointer, it must therefore
+// not be changed after it was stored. To change it, store a modified copy
+// with Set() instead.
+func (s *Session) Set(key string, value interface{}) error {
+	return s.mutate(func(data map[string]interface{}) error {
+		data[key] = value
+		return nil
+	})
+}
+
+// Swap stores a value under a key in the session, like Set(), and returns the
+// value previously stored under that key. The second return value indicates
+// whether the key existed before. Both happen atomically, so no other change
+// can occur in between.
+//
+// Note that since the sessions cache is write-through, this will also result in
+// a call to SaveSession() of the persistence layer. The error returned is the
+// error from SaveSession(). The previous value is returned even then. Like
+// Set(), this function returns ErrTooManyKeys if the key is new and the session
+// already holds MaxSessionKeys keys.
+func (s *Session) Swap(key string, value interface{}) (interface{}, bool, error) {
+	var (
+		old     interface{}
+		existed bool
+	)
+	err := s.mutate(func(data map[string]interface{}) error {
+		old, existed = data[key]
+		data[key] = value
+		return nil
+	})
+	return old, existed, err
+}
+
+// CompareAndSwap stores the value "new" under a key in the session, like
+// Set(), but only if the value currently stored under that key equals "old".
+// It returns whether the value was stored. The comparison and the change
+// happen atomically, so this function may be used for optimistic concurrency
+// control, e.g. with a version counter which is read by concurrent requests.
+//
+// Values are compared with reflect.DeepEqual(). That is, they must be of the
+// same type. Note that sessions decoded from JSON hold all numbers as float64
+// values so an "old" value of int(1) does not equal a stored float64(1). A key
+// which does not exist is treated as holding nil, i.e. passing nil for "old"
+// stores "new" only if the key does not exist yet (or holds nil).
+//
+// Note that since the sessions cache is write-through, a successful swap will
+// also result in a call to SaveSession() of the persistence layer. The error
+// returned is the error from SaveSession(). Like Set(), this function returns
+// ErrTooManyKeys if the key is new and the session already holds
+// MaxSessionKeys keys.
+func (s *Session) CompareAndSwap(key string, old, new interface{}) (bool, error) {
+	var swapped bool
+	err := s.mutate(func(data map[string]interface{}) error {
+		if !reflect.DeepEqual(data[key], old) {
+			return errUnchanged
+		}
+		data[key] = new
+		swapped = true
+		return nil
+	})
+	return swapped, err
 }
 
 // Get returns a value stored in the session under the given key. If the key is
-// not contained, the default "def" is returned.
+// not contained, the default "def" is returned. This is also the case if
+// LazyDataLoading is enabled and the session data could not be loaded or if
+// the session is sealed (see Seal()) and its data could not be decrypted. Use
+// Lookup() to distinguish these cases.
 func (s *Session) Get(key string, def interface{}) interface{} {
+	value, ok, err := s.Lookup(key)
+	if err != nil || !ok {
+		return def
+	}
+	return value
+}
+
+// Lookup returns a value stored in the session under the given key. The second
+// return value indicates whether the key is contained in the session. An error
+// is returned if the session data could not be accessed, e.g. because the
+// session is sealed (see Seal()) and no SealKey is configured.
+func (s *Session) Lookup(key string) (interface{}, bool, error) {
+	if err := s.loadData(); err != nil {
+		return nil, false, err
+	}
 	s.RLock()
 	defer s.RUnlock()
-	value, ok := s.data[key]
-	if ok {
-		return value
+	data, err := s.openData()
+	if err != nil {
+		return nil, false, err
 	}
-	return def
+	value, ok := data[key]
+	return value, ok, nil
 }
 
 // GetAndDelete returns a value stored in the session under the given key. If
 // the key is not contained, the default "def" is returned. The key is also
-// deleted from the session.
+// deleted from the session. If the session data could not be accessed (see
+// Get()), "def" is returned.
 func (s *Session) GetAndDelete(key string, def interface{}) interface{} {
+	if s.loadData() != nil {
+		return def
+	}
 	s.Lock()
-	defer s.Unlock()
-	value, ok := s.data[key]
-	if ok {
-		delete(s.data, key)
-		return value
+	data, err := s.openData()
+	if err != nil {
+		s.Unlock()
+		return def
 	}
-	return def
+	value, ok := data[key]
+	if !ok {
+		s.Unlock()
+		return def
+	}
+	delete(data, key)
+	if s.closeData(data) != nil {
+		s.Unlock()
+		return def
+	}
+	s.Unlock()
+	s.notify(SessionEventDelete, key)
+	return value
+}
+
+// Move moves the value stored under the key "fromKey" to the key "toKey",
+// overwriting any value previously stored under "toKey". This happens
+// atomically. If "fromKey" does not exist, nothing happens and false is
+// returned.
+//
+// Note that since the sessions cache is write-through, a successful move will
+// also result in a call to SaveSession() of the persistence layer. The error
+// returned is the error from SaveSession().
+func (s *Session) Move(fromKey, toKey string) (bool, error) {
+	var moved bool
+	err := s.mutate(func(data map[string]interface{}) error {
+		value, ok := data[fromKey]
+		if !ok {
+			return errUnchanged
+		}
+		delete(data, fromKey)
+		data[toKey] = value
+		moved = true
+		return nil
+	})
+	return moved, err
 }
 
 // Delete deletes a key from the session. Note that since the sessions cache is
 // write-through, this will also result in a call to SaveSession() of the
 // persistence layer. The error returned is the error from SaveSession().
 func (s *Session) Delete(key string) error {
+	return s.mutate(func(data map[string]interface{}) error {
+		delete(data, key)
+		return nil
+	})
+}
+
+// Update applies several changes to the session data at once and saves the
+// session only once. The provided function receives a copy of the session data
+// which it may modify freely:
+//
+//	err := session.Update(func(data map[string]interface{}) error {
+//		data["step"] = 3
+//		data["shipping"] = address
+//		delete(data, "coupon")
+//		return nil
+//	})
+//
+// If the function returns an error, the changes are discarded and the error is
+// returned. Otherwise, the modified copy replaces the session data atomically,
+// i.e. no other change can occur in between. The session is locked while the
+// function runs so it must not call any other methods of this session and it
+// should return quickly. The caveats of Set() regarding shared values apply.
+//
+// Note that since the sessions cache is write-through, this will also result in
+// a call to SaveSession() of the persistence layer. The error returned is then
+// the error from SaveSession(). If the modified data holds more than
+// MaxSessionKeys keys and more keys than before, ErrTooManyKeys is returned and
+// the changes are discarded.
+func (s *Session) Update(update func(data map[string]interface{}) error) error {
+	return s.mutate(update)
+}
+
+// SetTag assigns a label to this session, replacing any previous label. Tags
+// may be used to group sessions, e.g. by tenant or by experiment cohort, and
+// to operate on such groups with CountByTag() and DestroySessionsByTag(). An
+// empty string removes the tag.
+//
+// Note that since the sessions cache is write-through, this will also result in
+// a call to SaveSession() of the persistence layer. The error returned is the
+// error from SaveSession().
+func (s *Session) SetTag(tag string) error {
 	s.Lock()
-	delete(s.data, key)
+	s.tag = tag
 	s.Unlock()
-	return Persistence.SaveSession(s.id, s)
+	return s.save()
+}
+
+// Tag returns the label assigned to this session with SetTag() or an empty
+// string if there is none.
+func (s *Session) Tag() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.tag
 }
 
 // LogOut logs the currently logged in user out of this session.
@@ -638,21 +2140,36 @@ func (s *Session) LogOut() error {
 	s.Lock()
 
 	// Do we have a user at all?
-	if s.user == nil {
+	userID, loggedIn := s.userID()
+	if !loggedIn {
 		s.Unlock()
 		return nil
 	}
 
 	// Log user out of this session.
-	s.user = nil
+	s.setUser(nil)
+	s.authPending = false
+	s.authPendingReason = ""
+	s.assuranceLevel = 0
+	s.authTime = time.Time{}
+	s.locals = nil
 	s.Unlock()
+	s.notify(SessionEventLogOut, "")
+	s.audit(AuditRecord{Event: AuditLogOut, UserID: userID})
+	if Events.OnLogout != nil {
+		Events.OnLogout(s, userID)
+	}
 
-	return Persistence.SaveSession(s.id, s)
+	return s.save()
 }
 
 // LogOut logs the user with the given ID out of all sessions. This requires
 // that Persistence.UserSessions() be implemented, returning all IDs of sessions
 // that contain this user.
+//
+// If a session cannot be updated, the remaining sessions are still processed.
+// The returned error then contains one error per failed session (see
+// errors.Join()).
 func LogOut(userID interface{}) error {
 	// Get all sessions of this user.
 	sessionIDs, err := Persistence.UserSessions(userID)
@@ -661,20 +2178,72 @@ func LogOut(userID interface{}) error {
 	}
 
 	// Unset user in each session.
+	var errs []error
 	for _, sessionID := range sessionIDs {
 		session, err := sessions.Get(sessionID)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("Could not get session %s: %w", MaskSessionID(sessionID), err))
+			continue
+		}
+		if session == nil {
+			continue
 		}
 		session.Lock()
-		session.user = nil
+		session.setUser(nil)
+		session.authPending = false
+		session.authPendingReason = ""
+		session.assuranceLevel = 0
+		session.authTime = time.Time{}
+		session.locals = nil
 		session.Unlock()
+		session.notify(SessionEventLogOut, "")
+		session.audit(AuditRecord{Event: AuditLogOut, UserID: userID})
+		if Events.OnLogout != nil {
+			Events.OnLogout(session, userID)
+		}
 		if err := sessions.Set(session); err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("Could not save session %s: %w", MaskSessionID(sessionID), err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// IsUserLoggedIn returns whether the user with the given ID is logged into at
+// least one active session. Reference sessions (see RegenerateID()) and
+// sessions which have not been accessed within SessionExpiry are not
+// considered. Users whose authentication is still pending are considered to be
+// logged in. User IDs are compared with reflect.DeepEqual(). This requires
+// that Persistence.UserSessions() be implemented, returning all IDs of sessions
+// that contain this user.
+func IsUserLoggedIn(userID interface{}) (bool, error) {
+	// Get all sessions of this user.
+	sessionIDs, err := Persistence.UserSessions(userID)
+	if err != nil {
+		return false, err
+	}
+
+	// Find an active session.
+	for _, sessionID := range sessionIDs {
+		session, err := sessions.Get(sessionID)
+		if err != nil {
+			return false, err
+		}
+		if session == nil {
+			continue
+		}
+		session.RLock()
+		id, loggedIn := session.userID()
+		active := session.referenceID == "" &&
+			time.Since(session.lastAccess) < session.idleTimeout() &&
+			loggedIn && reflect.DeepEqual(id, userID)
+		session.RUnlock()
+		if active {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
 // RefreshUser gets all sessions for the given user and updates their user
@@ -688,8 +2257,11 @@ func LogOut(userID interface{}) error {
 // user ID (as it is with the provided default serlization functions GobEncode()
 // and MarshalJSON()).
 //
-// Note that this call will fail if the user ID itself was changed. Such a
-// change is more difficult and is not covered here.
+// Note that this call will fail if the user ID itself was changed. Use
+// ReassignUserID() for such a change.
+//
+// If a session cannot be updated, the remaining sessions are still processed.
+// The returned error then contains one error per failed session.
 func RefreshUser(user User) error {
 	// Get all sessions of this user.
 	sessionIDs, err := Persistence.UserSessions(user.GetID())
@@ -698,18 +2270,142 @@ func RefreshUser(user User) error {
 	}
 
 	// Set new user in each session.
+	var errs []error
 	for _, sessionID := range sessionIDs {
 		session, err := sessions.Get(sessionID)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("Could not get session %s: %w", MaskSessionID(sessionID), err))
+			continue
+		}
+		if session == nil {
+			continue
 		}
 		session.Lock()
-		session.user = user
+		session.setUser(user)
 		session.Unlock()
 		if err := sessions.Set(session); err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("Could not save session %s: %w", MaskSessionID(sessionID), err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// ReassignUserID attaches the given user to all sessions which are currently
+// attached to the user with the ID "oldID". This is needed when a user's ID
+// changes, e.g. when accounts are merged or when user IDs are migrated to a
+// different scheme. "newID" must be equal to the ID returned by
+// newUser.GetID(). User IDs are compared with reflect.DeepEqual() so IDs which
+// are not comparable, e.g. slices, are supported. This requires that
+// Persistence.UserSessions() be implemented, returning all IDs of sessions that
+// contain the user with the old ID.
+//
+// Each session is saved via the persistence layer after the change. If your
+// data store indexes sessions by user ID, SaveSession() must therefore update
+// that index so that Persistence.UserSessions() subsequently returns the
+// sessions for "newID" (and not for "oldID" anymore). If a session cannot be
+// updated, the remaining sessions are still processed. The returned error then
+// contains one error per failed session.
+func ReassignUserID(oldID, newID interface{}, newUser User) error {
+	if newUser == nil {
+		return errors.New("No new user provided")
+	}
+	if !reflect.DeepEqual(newUser.GetID(), newID) {
+		return fmt.Errorf("New user ID %v does not match the ID of the new user %v", newID, newUser.GetID())
+	}
+
+	// Get all sessions of the old user.
+	sessionIDs, err := Persistence.UserSessions(oldID)
+	if err != nil {
+		return err
+	}
+
+	// Set new user in each session.
+	var errs []error
+	for _, sessionID := range sessionIDs {
+		session, err := sessions.Get(sessionID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Could not get session %s: %w", MaskSessionID(sessionID), err))
+			continue
+		}
+		if session == nil {
+			continue
+		}
+		session.Lock()
+		if id, loggedIn := session.userID(); !loggedIn || !reflect.DeepEqual(id, oldID) {
+			// This session was changed in the meantime.
+			session.Unlock()
+			continue
+		}
+		session.setUser(newUser)
+		session.Unlock()
+		if err := sessions.Set(session); err != nil {
+			errs = append(errs, fmt.Errorf("Could not save session %s: %w", MaskSessionID(sessionID), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CountByTag returns the number of sessions which have been assigned the given
+// tag (see Session.SetTag()). This requires that the persistence layer
+// implements TagIndexer, returning all IDs of sessions with this tag.
+func CountByTag(tag string) (int, error) {
+	sessionIDs, err := sessionsByTag(Persistence, tag)
+	if err != nil {
+		return 0, err
+	}
+	return len(sessionIDs), nil
+}
+
+// DestroySessionsByTag deletes all sessions which have been assigned the given
+// tag (see Session.SetTag()) from the session cache and the persistence layer.
+// Any users logged into these sessions are thus logged out. This requires that
+// the persistence layer implements TagIndexer, returning all IDs of sessions
+// with this tag.
+//
+// Browser cookies are not touched here. They will be deleted when the
+// respective sessions are requested next. Like Session.Destroy(), this function
+// remembers the session IDs if TerminatedSessionExpiry is positive. If
+// Events.OnDestroyed is set, sessions which are not held in the local cache are
+// loaded from the persistence layer before they are deleted so they can be
+// passed to it. Sessions which cannot be found there are deleted without
+// calling it.
+//
+// If a session cannot be loaded or deleted, the remaining sessions are still processed.
+// The returned error then contains one error per failed session.
+func DestroySessionsByTag(tag string) error {
+	// Get all sessions with this tag.
+	sessionIDs, err := sessionsByTag(Persistence, tag)
+	if err != nil {
+		return err
+	}
+
+	// Delete each session.
+	var errs []error
+	for _, sessionID := range sessionIDs {
+		// Get the session for the OnDestroyed hook, bypassing the cache.
+		session := sessions.cached(sessionID)
+		if session == nil && Events.OnDestroyed != nil {
+			session, err = Persistence.LoadSession(sessionID)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Could not load session %s: %w", MaskSessionID(sessionID), err))
+				continue
+			}
+			if session != nil {
+				session.id = sessionID
+			}
+		}
+		if err := sessions.Delete(sessionID); err != nil {
+			errs = append(errs, fmt.Errorf("Could not delete session %s: %w", MaskSessionID(sessionID), err))
+			continue
+		}
+		markTerminated(sessionID)
+		writeAudit(AuditRecord{Event: AuditSessionDestroyed, SessionID: sessionID})
+		if Events.OnDestroyed != nil && session != nil {
+			Events.OnDestroyed(session)
+		}
+	}
+
+	return errors.Join(errs...)
 }
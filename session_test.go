@@ -13,6 +13,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,10 +24,43 @@ const sessionID = "01234567890123456789----"
 func reset() {
 	Persistence = ExtendablePersistenceLayer{}
 	SessionExpiry = math.MaxInt64
+	SessionMaxLifetime = math.MaxInt64
+	RememberMeExpiry = 0
+	CompromisedPasswords = nil
+	AnalyzeCompromisedPasswords = false
+	UseBuiltInPasswordLists = true
+	PasswordHashParameters = Argon2Parameters{Iterations: 3, Memory: 64 * 1024, Parallelism: 4, SaltLength: 16, KeyLength: 32}
 	SessionIDExpiry = time.Hour
 	SessionIDGracePeriod = 5 * time.Minute
+	SessionIDExpiryJitter = 0
+	SessionIDMaxUses = 0
+	TerminatedSessionExpiry = 0
+	NearExpiryWindow = 0
+	OnSessionNearExpiry = nil
 	AcceptRemoteIP = 1
+	AcceptRemoteIPv4Prefix = 0
+	AcceptRemoteIPv6Prefix = 0
+	AcceptRemoteIPFamilyChange = false
+	RemoteIPFromRequest = ForwardedRemoteIP
+	TrustedProxies = nil
+	RemoteHistorySize = 1
+	AcceptChangingLanguage = true
+	NormalizeUserAgent = normalizeUserAgent
+	HashUserAgent = FNVUserAgentHash
+	AcceptMissingLanguage = true
+	TLSFingerprint = nil
+	Locator = nil
+	OnUnknownSessionID = nil
+	Events = EventHooks{}
+	Log = nil
+	MetricsSink = nil
+	AuditLogger = nil
+	AuditMaskSessionIDs = false
+	SessionIDMaskPrefix = 0
+	RedirectCookieOnce = false
 	SessionCookie = "sessionid"
+	SessionCookieAliases = nil
+	CookieSameSite = 0
 	NewSessionCookie = func() *http.Cookie {
 		return &http.Cookie{
 			Expires:  time.Now().Add(10 * 365 * 24 * time.Hour),
@@ -34,7 +68,46 @@ func reset() {
 			HttpOnly: true,
 		}
 	}
-	sessions.sessions = make(map[string]*Session)
+	DeletedCookieValue = "deleted"
+	TrustedDeviceCookie = "trusteddevice"
+	TrustedDeviceExpiry = 30 * 24 * time.Hour
+	MaxSessionCacheSize = 1024 * 1024
+	SessionCacheExpiry = time.Hour
+	SessionCacheMaxAge = 0
+	InstanceID = ""
+	CacheIsAuthoritative = false
+	WriteBehind = false
+	LazyDataLoading = false
+	LazyUserLoading = false
+	OnLoadUserError = nil
+	ClearDataOnLogIn = false
+	MaxSessionKeys = 0
+	CompressSessions = false
+	CompressSessionsThreshold = 1024
+	AutoRegisterGobTypes = false
+	SealKey = nil
+	PreviousSealKeys = nil
+	UserIntegrityKey = nil
+	ScopedCSRFTokenExpiry = time.Hour
+	MaxScopedCSRFTokens = 32
+	NewSessionCookieForRequest = nil
+	PartitionedCookies = false
+	SkipCreateFor = nil
+	BackgroundMutexPurge = true
+	MeasureLockWaits = false
+	ResetRandomSource()
+	clearCache()
+}
+
+// waitFor polls the given condition until it is true or a second has passed.
+// It returns the condition's last result.
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
 }
 
 // Test the gob-part for sessions, including Base64 encoding, without logged-in
@@ -53,6 +126,7 @@ func TestSessionGob(t *testing.T) {
 		created:     date,
 		lastAccess:  date,
 		lastIP:      "192.168.178.1:80",
+		ipHistory:   []string{"10.0.0.1:1234"},
 		data:        data,
 	}
 
@@ -78,30 +152,8 @@ func TestSessionGob(t *testing.T) {
 	}
 
 	// Compare sessions.
-	if !recoveredSession.created.Equal(session.created) {
-		t.Errorf("Recovered session has different creation time (%s) than expected (%s)", recoveredSession.created, session.created)
-	}
-	if !recoveredSession.lastAccess.Equal(session.lastAccess) {
-		t.Errorf("Recovered session has different last access time (%s) than expected (%s)", recoveredSession.lastAccess, session.lastAccess)
-	}
-	if recoveredSession.referenceID != session.referenceID {
-		t.Errorf("Recovered session has different reference ID (%s) than expected (%s)", recoveredSession.referenceID, session.referenceID)
-	}
-	if recoveredSession.User() != nil {
-		t.Errorf("Recovered session has a user (%v) instead of nil", recoveredSession.user)
-	}
-	if len(recoveredSession.data) != len(session.data) {
-		t.Errorf("Recovered session data has different size (%d) than expected (%d)", len(recoveredSession.data), len(session.data))
-	}
-	for field, value := range data {
-		recoveredValue, ok := recoveredSession.data[field]
-		if !ok {
-			t.Errorf("Field %s not in recovered session data", field)
-			continue
-		}
-		if recoveredValue != value {
-			t.Errorf("Value %s for field %s not as expected (%s)", recoveredValue, field, value)
-		}
+	if !recoveredSession.Equal(session) {
+		t.Error("Recovered session differs from original session")
 	}
 }
 
@@ -121,6 +173,15 @@ func TestSessionJSON(t *testing.T) {
 		lastAccess:        date,
 		lastIP:            "192.168.178.1:80",
 		lastUserAgentHash: 12345,
+		ipHistory:         []string{"10.0.0.1:1234"},
+		userAgentHistory:  []uint64{67890},
+		expiresAt:         date.Add(time.Hour),
+		assuranceLevel:    2,
+		lastInstance:      "node-1",
+		location:          Location{Country: "DE", City: "Berlin", Latitude: 52.52, Longitude: 13.405},
+		started:           date.Add(-time.Hour),
+		rememberMe:        true,
+		authTime:          date.Add(-time.Minute),
 		data:              data,
 	}
 
@@ -138,36 +199,8 @@ func TestSessionJSON(t *testing.T) {
 	}
 
 	// Compare sessions.
-	if !recoveredSession.created.Equal(session.created) {
-		t.Errorf("Recovered session has different creation time (%s) than expected (%s)", recoveredSession.created, session.created)
-	}
-	if !recoveredSession.lastAccess.Equal(session.lastAccess) {
-		t.Errorf("Recovered session has different last access time (%s) than expected (%s)", recoveredSession.lastAccess, session.lastAccess)
-	}
-	if recoveredSession.referenceID != session.referenceID {
-		t.Errorf("Recovered session has different reference ID (%s) than expected (%s)", recoveredSession.referenceID, session.referenceID)
-	}
-	if recoveredSession.lastIP != session.lastIP {
-		t.Errorf("Recovered session has different IP (%s) than expected (%s)", recoveredSession.lastIP, session.lastIP)
-	}
-	if recoveredSession.lastUserAgentHash != session.lastUserAgentHash {
-		t.Errorf("Recovered session has different user agent hash (%d) than expected (%d)", recoveredSession.lastUserAgentHash, session.lastUserAgentHash)
-	}
-	if recoveredSession.User() != nil {
-		t.Errorf("Recovered session has a user (%v) instead of nil", recoveredSession.user)
-	}
-	if len(recoveredSession.data) != len(session.data) {
-		t.Errorf("Recovered session data has different size (%d) than expected (%d)", len(recoveredSession.data), len(session.data))
-	}
-	for field, value := range data {
-		recoveredValue, ok := recoveredSession.data[field]
-		if !ok {
-			t.Errorf("Field %s not in recovered session data", field)
-			continue
-		}
-		if recoveredValue != value {
-			t.Errorf("Value %s for field %s not as expected (%s)", recoveredValue, field, value)
-		}
+	if !recoveredSession.Equal(session) {
+		t.Error("Recovered session differs from original session")
 	}
 }
 
@@ -221,36 +254,8 @@ func TestSessionGobWithUser(t *testing.T) {
 	}
 
 	// Compare sessions.
-	if !recoveredSession.created.Equal(session.created) {
-		t.Errorf("Recovered session has different creation time (%s) than expected (%s)", recoveredSession.created, session.created)
-	}
-	if !recoveredSession.lastAccess.Equal(session.lastAccess) {
-		t.Errorf("Recovered session has different last access time (%s) than expected (%s)", recoveredSession.lastAccess, session.lastAccess)
-	}
-	if recoveredSession.referenceID != session.referenceID {
-		t.Errorf("Recovered session has different reference ID (%s) than expected (%s)", recoveredSession.referenceID, session.referenceID)
-	}
-	if recoveredSession.lastIP != session.lastIP {
-		t.Errorf("Recovered session has different IP (%s) than expected (%s)", recoveredSession.lastIP, session.lastIP)
-	}
-	if recoveredSession.lastUserAgentHash != session.lastUserAgentHash {
-		t.Errorf("Recovered session has different user agent hash (%d) than expected (%d)", recoveredSession.lastUserAgentHash, session.lastUserAgentHash)
-	}
-	if recoveredSession.User() != session.User() {
-		t.Errorf("Recovered session has different user (%v) than expected (%v)", recoveredSession.user, session.user)
-	}
-	if len(recoveredSession.data) != len(session.data) {
-		t.Errorf("Recovered session data has different size (%d) than expected (%d)", len(recoveredSession.data), len(session.data))
-	}
-	for field, value := range data {
-		recoveredValue, ok := recoveredSession.data[field]
-		if !ok {
-			t.Errorf("Field %s not in recovered session data", field)
-			continue
-		}
-		if recoveredValue != value {
-			t.Errorf("Value %s for field %s not as expected (%s)", recoveredValue, field, value)
-		}
+	if !recoveredSession.Equal(session) {
+		t.Error("Recovered session differs from original session")
 	}
 }
 
@@ -295,30 +300,113 @@ func TestSessionJSONWithUser(t *testing.T) {
 	}
 
 	// Compare sessions.
-	if !recoveredSession.created.Equal(session.created) {
-		t.Errorf("Recovered session has different creation time (%s) than expected (%s)", recoveredSession.created, session.created)
+	if !recoveredSession.Equal(session) {
+		t.Error("Recovered session differs from original session")
 	}
-	if !recoveredSession.lastAccess.Equal(session.lastAccess) {
-		t.Errorf("Recovered session has different last access time (%s) than expected (%s)", recoveredSession.lastAccess, session.lastAccess)
+}
+
+// Test the remaining idle time of a session.
+func TestSessionRemainingIdleTime(t *testing.T) {
+	defer reset()
+	session := &Session{lastAccess: time.Now().Add(-time.Minute)}
+	if session.RemainingIdleTime() != math.MaxInt64 {
+		t.Error("Session without expiry has a limited idle time")
 	}
-	if recoveredSession.referenceID != session.referenceID {
-		t.Errorf("Recovered session has different reference ID (%s) than expected (%s)", recoveredSession.referenceID, session.referenceID)
+	SessionExpiry = time.Hour
+	if remaining := session.RemainingIdleTime(); remaining > 59*time.Minute || remaining < 58*time.Minute {
+		t.Errorf("Unexpected remaining idle time: %s", remaining)
 	}
-	if recoveredSession.User() != session.User() {
-		t.Errorf("Recovered session has different user (%v) than expected (%v)", recoveredSession.user, session.user)
+	session.lastAccess = time.Now().Add(-2 * time.Hour)
+	if remaining := session.RemainingIdleTime(); remaining != 0 {
+		t.Errorf("Expired session has remaining idle time: %s", remaining)
 	}
-	if len(recoveredSession.data) != len(session.data) {
-		t.Errorf("Recovered session data has different size (%d) than expected (%d)", len(recoveredSession.data), len(session.data))
+
+	// A fixed deadline cuts it short.
+	session.lastAccess = time.Now()
+	session.expiresAt = time.Now().Add(10 * time.Minute)
+	if remaining := session.RemainingIdleTime(); remaining > 10*time.Minute || remaining < 9*time.Minute {
+		t.Errorf("Unexpected remaining idle time before deadline: %s", remaining)
 	}
-	for field, value := range data {
-		recoveredValue, ok := recoveredSession.data[field]
-		if !ok {
-			t.Errorf("Field %s not in recovered session data", field)
-			continue
-		}
-		if recoveredValue != value {
-			t.Errorf("Value %s for field %s not as expected (%s)", recoveredValue, field, value)
-		}
+	SessionExpiry = math.MaxInt64
+	if remaining := session.RemainingIdleTime(); remaining > 10*time.Minute || remaining < 9*time.Minute {
+		t.Errorf("Unexpected remaining idle time without expiry: %s", remaining)
+	}
+	session.expiresAt = time.Now().Add(-time.Minute)
+	if remaining := session.RemainingIdleTime(); remaining != 0 {
+		t.Errorf("Session past its deadline has remaining idle time: %s", remaining)
+	}
+}
+
+// Test the remaining absolute time of a session.
+func TestSessionRemainingAbsoluteTime(t *testing.T) {
+	defer reset()
+	session := &Session{started: time.Now().Add(-time.Hour), lastAccess: time.Now()}
+	if session.RemainingAbsoluteTime() != math.MaxInt64 {
+		t.Error("Session without maximum lifetime has a limited absolute time")
+	}
+	SessionMaxLifetime = 2 * time.Hour
+	if remaining := session.RemainingAbsoluteTime(); remaining > time.Hour || remaining < 59*time.Minute {
+		t.Errorf("Unexpected remaining absolute time: %s", remaining)
+	}
+	session.expiresAt = time.Now().Add(10 * time.Minute)
+	if remaining := session.RemainingAbsoluteTime(); remaining > 10*time.Minute || remaining < 9*time.Minute {
+		t.Errorf("Unexpected remaining absolute time before deadline: %s", remaining)
+	}
+	session.expiresAt = time.Time{}
+	session.started = time.Now().Add(-3 * time.Hour)
+	if remaining := session.RemainingAbsoluteTime(); remaining != 0 {
+		t.Errorf("Expired session has remaining absolute time: %s", remaining)
+	}
+
+	// Older sessions fall back to their creation time.
+	session.started = time.Time{}
+	session.created = time.Now().Add(-90 * time.Minute)
+	if remaining := session.RemainingAbsoluteTime(); remaining > 30*time.Minute || remaining < 29*time.Minute {
+		t.Errorf("Unexpected remaining absolute time of legacy session: %s", remaining)
+	}
+}
+
+// Test session comparison.
+func TestSessionEqual(t *testing.T) {
+	date, _ := time.Parse("2006-01-02", "2017-06-27")
+	a := &Session{
+		user:       &TestUser{ID: "12345"},
+		created:    date,
+		lastAccess: date,
+		data:       map[string]interface{}{"field": []string{"a", "b"}},
+	}
+	b := &Session{
+		user:       &TestUser{ID: "12345"},
+		created:    date,
+		lastAccess: date,
+		data:       map[string]interface{}{"field": []string{"a", "b"}},
+	}
+	if !a.Equal(b) {
+		t.Error("Equal sessions were not found to be equal")
+	}
+	b.data["field"] = []string{"a", "c"}
+	if a.Equal(b) {
+		t.Error("Sessions with different data were found to be equal")
+	}
+	b.data["field"] = []string{"a", "b"}
+	b.user = &TestUser{ID: "67890"}
+	if a.Equal(b) {
+		t.Error("Sessions with different users were found to be equal")
+	}
+	b.user = nil
+	if a.Equal(b) || b.Equal(a) {
+		t.Error("Sessions with and without user were found to be equal")
+	}
+
+	// User IDs which are not comparable with ==.
+	a.user = &sliceIDUser{id: []string{"tenant", "12345"}}
+	b.user = &sliceIDUser{id: []string{"tenant", "12345"}}
+	if !a.Equal(b) {
+		t.Error("Sessions with equal slice user IDs were found to be different")
+	}
+	b.user = &sliceIDUser{id: []string{"tenant", "67890"}}
+	if a.Equal(b) {
+		t.Error("Sessions with different slice user IDs were found to be equal")
 	}
 }
 
@@ -334,6 +422,28 @@ func TestNoSession(t *testing.T) {
 	}
 }
 
+// Session start does not create sessions for bots.
+func TestSkipCreateFor(t *testing.T) {
+	defer reset()
+	SkipCreateFor = func(request *http.Request) bool {
+		return ParseUserAgent(request.UserAgent()).Bot
+	}
+	req := httptest.NewRequest("", "/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	res := httptest.NewRecorder()
+	session, err := Start(res, req, true)
+	if err != nil {
+		t.Error(err)
+	}
+	if session != nil || len(res.Result().Cookies()) > 0 {
+		t.Error("Session was created for a bot")
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/118.0")
+	if session, _ := Start(httptest.NewRecorder(), req, true); session == nil {
+		t.Error("Session was not created for a browser")
+	}
+}
+
 // Session start returns no session because it doesn't exist.
 func TestNonExistingSession(t *testing.T) {
 	req := httptest.NewRequest("", "/", nil)
@@ -351,6 +461,45 @@ func TestNonExistingSession(t *testing.T) {
 	}
 }
 
+// Session start reports unknown session IDs.
+func TestUnknownSessionID(t *testing.T) {
+	defer reset()
+	var reported []string
+	OnUnknownSessionID = func(id string, request *http.Request) {
+		reported = append(reported, id)
+	}
+	for _, value := range []string{sessionID, "short"} {
+		req := httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: value})
+		if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(reported) != 1 || reported[0] != sessionID {
+		t.Errorf("Unexpected reported session IDs: %v", reported)
+	}
+}
+
+// Session start deletes a malformed cookie.
+func TestMalformedSessionCookie(t *testing.T) {
+	defer reset()
+	for _, value := range []string{"short", "0123456789012345678901234", "01234567890123456789!!!!"} {
+		req := httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: value})
+		res := httptest.NewRecorder()
+		session, err := Start(res, req, false)
+		if err != nil {
+			t.Error(err)
+		}
+		if session != nil {
+			t.Error("Expected nil session, received non-empty session")
+		}
+		if !strings.Contains(res.Header().Get("Set-Cookie"), fmt.Sprintf("%s=deleted", SessionCookie)) {
+			t.Errorf("Malformed cookie %s was not deleted", value)
+		}
+	}
+}
+
 // Session start returns anonymous session.
 func TestAnonSession(t *testing.T) {
 	defer reset()
@@ -372,7 +521,7 @@ func TestAnonSession(t *testing.T) {
 		t.Error("Expected session, received nil")
 		return
 	}
-	if len(sessions.sessions) != 1 {
+	if len(cachedSessions()) != 1 {
 		t.Error("Cache is not size 1")
 	}
 	cookie := regexp.MustCompile("^" + SessionCookie + "=[0-9a-zA-Z=+/]{24}")
@@ -412,6 +561,47 @@ func TestExistingSession(t *testing.T) {
 	}
 }
 
+// Session start takes the fast path for cached sessions but still detects
+// anomalies.
+func TestCachedSession(t *testing.T) {
+	defer reset()
+	AcceptRemoteIP = 3
+	var loaded int
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			loaded++
+			return &Session{created: time.Now(), lastAccess: time.Now(), lastIP: "192.168.178.1:80"}, nil
+		},
+	}
+	start := func(remoteAddr string) *Session {
+		req := httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+		req.RemoteAddr = remoteAddr
+		session, err := Start(httptest.NewRecorder(), req, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+
+	// Load the session, then use the cached one.
+	first := start("192.168.178.1:80")
+	if first == nil {
+		t.Fatal("Expected session, received nil")
+	}
+	if second := start("192.168.178.1:8080"); second != first || loaded != 1 {
+		t.Error("Cached session was not returned")
+	}
+	if first.uses != 2 || first.lastIP != "192.168.178.1:8080" {
+		t.Errorf("Cached session was not updated (uses %d, IP %s)", first.uses, first.lastIP)
+	}
+
+	// An anomaly must still be detected.
+	if start("192.100.100.50:8080") != nil {
+		t.Error("Session returned despite IP change, nil session expected")
+	}
+}
+
 // Session start returns an expired session.
 func TestExpiredSession(t *testing.T) {
 	defer reset()
@@ -436,11 +626,61 @@ func TestExpiredSession(t *testing.T) {
 	}
 }
 
+// Sessions which were started too long ago are rejected even if they are in use.
+func TestSessionMaxLifetime(t *testing.T) {
+	defer reset()
+	defer clearCache()
+	SessionMaxLifetime = time.Hour
+	for name, test := range map[string]struct {
+		session *Session
+		expired bool
+	}{
+		"started": {&Session{started: time.Now().Add(-2 * time.Hour), created: time.Now().Add(-time.Minute), lastAccess: time.Now()}, true},
+		"legacy":  {&Session{created: time.Now().Add(-2 * time.Hour), lastAccess: time.Now()}, true},
+		"recent":  {&Session{started: time.Now().Add(-time.Minute), created: time.Now().Add(-time.Minute), lastAccess: time.Now()}, false},
+	} {
+		clearCache()
+		Persistence = ExtendablePersistenceLayer{
+			LoadSessionFunc: func(id string) (*Session, error) {
+				return test.session, nil
+			},
+		}
+		if test.session.Expired() != test.expired {
+			t.Errorf("Session %q: expected Expired() to return %t", name, test.expired)
+		}
+		req := httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+		session, err := Start(httptest.NewRecorder(), req, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (session == nil) != test.expired {
+			t.Errorf("Session %q: expected rejection %t, got session %v", name, test.expired, session)
+		}
+	}
+
+	// The start time survives session ID changes.
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := session.Started()
+	if started.IsZero() {
+		t.Fatal("Start time was not set")
+	}
+	if err := session.RegenerateID(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if !session.Started().Equal(started) {
+		t.Errorf("Start time changed from %s to %s", started, session.Started())
+	}
+}
+
 // Session start performs a session ID change.
 func TestSessionIDChange(t *testing.T) {
 	defer reset()
 	SessionIDGracePeriod = 5 * time.Millisecond
-	var deleted, saved int
+	var deleted, saved int64
 	Persistence = ExtendablePersistenceLayer{
 		LoadSessionFunc: func(id string) (*Session, error) {
 			if id != sessionID {
@@ -453,11 +693,11 @@ func TestSessionIDChange(t *testing.T) {
 			}, nil
 		},
 		SaveSessionFunc: func(id string, session *Session) error {
-			saved++
+			atomic.AddInt64(&saved, 1)
 			return nil
 		},
 		DeleteSessionFunc: func(id string) error {
-			deleted++
+			atomic.AddInt64(&deleted, 1)
 			if id != sessionID {
 				return fmt.Errorf("Deleting wrong session ID: %s", id)
 			}
@@ -482,11 +722,10 @@ func TestSessionIDChange(t *testing.T) {
 	if !cookie.MatchString(res.Header().Get("Set-Cookie")) {
 		t.Error("Cookie was not updated")
 	}
-	time.Sleep(10 * time.Millisecond)
-	if deleted != 1 {
+	if !waitFor(func() bool { return atomic.LoadInt64(&deleted) == 1 }) {
 		t.Error("Old session was not deleted")
 	}
-	if saved != 2 {
+	if atomic.LoadInt64(&saved) != 2 {
 		t.Error("New session was not saved")
 	}
 	// Cover the expiry function.
@@ -495,6 +734,61 @@ func TestSessionIDChange(t *testing.T) {
 	}
 }
 
+// Test the session ID expiry jitter.
+func TestSessionIDExpiryJitter(t *testing.T) {
+	defer reset()
+	if sessionIDExpiry(sessionID) != SessionIDExpiry {
+		t.Error("Session ID expiry changed without jitter")
+	}
+	SessionIDExpiryJitter = 10 * time.Minute
+	expiries := make(map[time.Duration]struct{})
+	for _, id := range []string{sessionID, "ABCDEFGHIJKLMNOPQRSTUVWX", "abcdefghijklmnopqrstuvwx"} {
+		expiry := sessionIDExpiry(id)
+		if expiry != sessionIDExpiry(id) {
+			t.Errorf("Session ID expiry for %s is not stable", id)
+		}
+		if expiry > SessionIDExpiry || expiry <= SessionIDExpiry-SessionIDExpiryJitter {
+			t.Errorf("Session ID expiry for %s out of range: %s", id, expiry)
+		}
+		expiries[expiry] = struct{}{}
+	}
+	if len(expiries) < 2 {
+		t.Error("Session ID expiries were not spread")
+	}
+}
+
+// Session start performs a session ID change after a number of requests.
+func TestSessionIDMaxUses(t *testing.T) {
+	defer reset()
+	SessionIDMaxUses = 3
+	res := httptest.NewRecorder()
+	session, err := Start(res, httptest.NewRequest("", "/", nil), true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 2; i <= 4; i++ {
+		id := session.id
+		req := httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: id})
+		res := httptest.NewRecorder()
+		if session, err = Start(res, req, false); err != nil {
+			t.Error(err)
+			return
+		}
+		if session == nil {
+			t.Error("Expected session, received nil")
+			return
+		}
+		if changed := session.id != id; changed != (i == 4) {
+			t.Errorf("Request %d: session ID changed = %t", i, changed)
+		}
+	}
+	if session.uses != 1 {
+		t.Errorf("Session ID uses = %d, expected 1", session.uses)
+	}
+}
+
 // Session start returns referenced session.
 func TestReferencedSession(t *testing.T) {
 	defer reset()
@@ -535,6 +829,90 @@ func TestReferencedSession(t *testing.T) {
 	}
 }
 
+// Reference sessions resolve to the same session object as the new session ID,
+// even across multiple session ID changes.
+func TestReferencedSessionIdentity(t *testing.T) {
+	defer reset()
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("", "/", nil), true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ids := []string{session.id}
+	for i := 0; i < 2; i++ {
+		if err := session.RegenerateID(httptest.NewRecorder()); err != nil {
+			t.Error(err)
+			return
+		}
+		ids = append(ids, session.id)
+	}
+	for _, id := range ids {
+		req := httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: id})
+		res := httptest.NewRecorder()
+		s, err := Start(res, req, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if s != session {
+			t.Errorf("Session ID %s resolved to a different session object", id)
+		}
+		if id != ids[2] && !strings.Contains(res.Header().Get("Set-Cookie"), fmt.Sprintf("%s=%s", SessionCookie, ids[2])) {
+			t.Errorf("Cookie for session ID %s was not redirected to the current session ID", id)
+		}
+	}
+	if err := session.Set("key", "value"); err != nil {
+		t.Error(err)
+		return
+	}
+	req := httptest.NewRequest("", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: ids[0]})
+	s, err := Start(httptest.NewRecorder(), req, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s.Get("key", nil) != "value" {
+		t.Error("Change was not visible via old session ID")
+	}
+}
+
+// The cookie is redirected to the new session ID once or for every request
+// during the grace period.
+func TestReferencedSessionCookie(t *testing.T) {
+	defer reset()
+	for _, once := range []bool{false, true} {
+		RedirectCookieOnce = once
+		session, err := Start(httptest.NewRecorder(), httptest.NewRequest("", "/", nil), true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		oldID := session.id
+		if err := session.RegenerateID(httptest.NewRecorder()); err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("", "/", nil)
+			req.AddCookie(&http.Cookie{Name: SessionCookie, Value: oldID})
+			res := httptest.NewRecorder()
+			if _, err := Start(res, req, false); err != nil {
+				t.Error(err)
+				return
+			}
+			header := res.Header().Get("Set-Cookie")
+			expected := !once || i == 0
+			if expected && !strings.Contains(header, fmt.Sprintf("%s=%s", SessionCookie, session.id)) {
+				t.Errorf("Once = %t, request %d: cookie was not redirected to new session ID (%s)", once, i, header)
+			} else if !expected && header != "" {
+				t.Errorf("Once = %t, request %d: unexpected cookie %s", once, i, header)
+			}
+		}
+	}
+}
+
 // Session start detects that the reference session has expired.
 func TestExpiredReferencedSession(t *testing.T) {
 	defer reset()
@@ -561,12 +939,83 @@ func TestExpiredReferencedSession(t *testing.T) {
 	}
 }
 
+// Reference sessions with a long grace period do not resolve after the grace
+// period, even if their scheduled deletion has not happened.
+func TestLongGracePeriod(t *testing.T) {
+	defer reset()
+	SessionIDExpiry = 24 * time.Hour
+	SessionIDGracePeriod = 10 * time.Hour
+	if err := ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	store := make(map[string]bool)
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			store[id] = true
+			return nil
+		},
+		DeleteSessionFunc: func(id string) error {
+			delete(store, id)
+			return nil
+		},
+	}
+	session := &Session{id: sessionID, created: time.Now(), lastAccess: time.Now(), data: make(map[string]interface{})}
+	if err := sessions.Set(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RegenerateID(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	reference := sessions.cached(sessionID)
+	if reference == nil {
+		t.Fatal("Reference session was not cached")
+	}
+
+	// Within the grace period.
+	reference.Lock()
+	reference.created = time.Now().Add(-9 * time.Hour)
+	reference.Unlock()
+	if reference.Expired() {
+		t.Error("Reference session expired during the grace period")
+	}
+	req := httptest.NewRequest("", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+	resolved, err := Start(httptest.NewRecorder(), req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != session {
+		t.Error("Reference session did not resolve during the grace period")
+	}
+
+	// After the grace period.
+	reference.Lock()
+	reference.created = time.Now().Add(-11 * time.Hour)
+	reference.Unlock()
+	if !reference.Expired() {
+		t.Error("Reference session did not expire after the grace period")
+	}
+	if resolved, err = Start(httptest.NewRecorder(), req, false); err == nil || resolved != nil {
+		t.Error("Reference session resolved after the grace period")
+	}
+	if store[sessionID] || sessions.cached(sessionID) != nil {
+		t.Error("Reference session was not deleted")
+	}
+
+	// Grace periods must be shorter than the session expiry.
+	SessionIDExpiry = 0
+	SessionExpiry = time.Hour
+	if err := ValidateConfig(); err == nil || !strings.Contains(err.Error(), "SessionIDGracePeriod") {
+		t.Errorf("Grace period longer than session expiry was not detected: %v", err)
+	}
+}
+
 // Try requesting lots of session ID changes at once, hoping to get multiple new
 // sessions.
 func TestSessionIDChangeDoS(t *testing.T) {
 	defer reset()
 	SessionIDGracePeriod = 5 * time.Millisecond
-	var deleted, saved int
+	var deleted, saved int64
 	Persistence = ExtendablePersistenceLayer{
 		LoadSessionFunc: func(id string) (*Session, error) {
 			if id != sessionID {
@@ -579,11 +1028,11 @@ func TestSessionIDChangeDoS(t *testing.T) {
 			}, nil
 		},
 		SaveSessionFunc: func(id string, session *Session) error {
-			saved++
+			atomic.AddInt64(&saved, 1)
 			return nil
 		},
 		DeleteSessionFunc: func(id string) error {
-			deleted++
+			atomic.AddInt64(&deleted, 1)
 			if id != sessionID {
 				return fmt.Errorf("Deleting wrong session ID: %s", id)
 			}
@@ -631,11 +1080,10 @@ func TestSessionIDChangeDoS(t *testing.T) {
 			}
 		}
 	}
-	time.Sleep(10 * time.Millisecond)
-	if deleted != 1 {
-		t.Errorf("Old session was not deleted: %d", deleted)
+	if !waitFor(func() bool { return atomic.LoadInt64(&deleted) == 1 }) {
+		t.Errorf("Old session was not deleted: %d", atomic.LoadInt64(&deleted))
 	}
-	if saved != 2 {
+	if atomic.LoadInt64(&saved) != 2 {
 		t.Error("New session was not saved")
 	}
 }
@@ -756,6 +1204,171 @@ func TestSessionInvalidRemoteUserAgent(t *testing.T) {
 	}
 }
 
+// Test user agent changes with normalization.
+func TestSessionNormalizedRemoteUserAgent(t *testing.T) {
+	defer reset()
+	chrome := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.5993.70 Safari/537.36"
+	for userAgent, expected := range map[string]bool{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.5993.88 Safari/537.36":  true,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.6045.105 Safari/537.36": false,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/118.0":                                     false,
+	} {
+		clearCache()
+		req := httptest.NewRequest("", "/", nil)
+		req.Header.Add("User-Agent", chrome)
+		session, err := Start(httptest.NewRecorder(), req, true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req = httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+		req.Header.Add("User-Agent", userAgent)
+		session, err = Start(httptest.NewRecorder(), req, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if (session != nil) != expected {
+			t.Errorf("User agent %s: session returned = %t, expected %t", userAgent, session != nil, expected)
+		}
+	}
+}
+
+// Test that sessions created without user agent normalization survive when
+// normalization is turned on.
+func TestSessionLegacyRemoteUserAgent(t *testing.T) {
+	defer reset()
+	chrome := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.5993.70 Safari/537.36"
+	NormalizeUserAgent = nil
+	req := httptest.NewRequest("", "/", nil)
+	req.Header.Add("User-Agent", chrome)
+	session, err := Start(httptest.NewRecorder(), req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.lastUserAgentHash != FNVUserAgentHash(chrome) {
+		t.Fatal("Session does not hold the hash of the full user agent")
+	}
+
+	// Resume it with normalization.
+	NormalizeUserAgent = normalizeUserAgent
+	req = httptest.NewRequest("", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	req.Header.Add("User-Agent", chrome)
+	resumed, err := Start(httptest.NewRecorder(), req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed != session {
+		t.Fatal("Session with legacy user agent hash was not resumed")
+	}
+	if session.lastUserAgentHash != FNVUserAgentHash(normalizeUserAgent(chrome)) {
+		t.Error("Session does not hold the hash of the normalized user agent")
+	}
+	if len(session.userAgentHistory) != 0 {
+		t.Errorf("Legacy user agent hash was added to the history: %v", session.userAgentHistory)
+	}
+
+	// From now on, minor version changes are accepted.
+	req = httptest.NewRequest("", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	req.Header.Add("User-Agent", strings.Replace(chrome, "5993.70", "5993.88", 1))
+	if resumed, err = Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if resumed != session {
+		t.Error("Session with minor user agent change was not resumed")
+	}
+
+	// A different browser is still rejected, even with a legacy hash.
+	session.lastUserAgentHash = FNVUserAgentHash(chrome)
+	req = httptest.NewRequest("", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	req.Header.Add("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/118.0")
+	if resumed, err = Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if resumed != nil {
+		t.Error("Session with a different user agent was resumed")
+	}
+}
+
+// Test Accept-Language header changes.
+func TestSessionRemoteLanguage(t *testing.T) {
+	defer reset()
+	AcceptChangingLanguage = false
+	for _, test := range []struct {
+		language        string
+		acceptMissing   bool
+		expectedSession bool
+	}{
+		{"en-US, en;q=0.9", true, true},
+		{"de-DE,de;q=0.9", true, false},
+		{"", true, true},
+		{"", false, false},
+	} {
+		AcceptMissingLanguage = test.acceptMissing
+		clearCache()
+		Persistence = ExtendablePersistenceLayer{
+			LoadSessionFunc: func(id string) (*Session, error) {
+				return &Session{
+					created:          time.Now(),
+					lastAccess:       time.Now(),
+					lastLanguageHash: 15154659550163263112,
+				}, nil
+			},
+		}
+		req := httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+		if test.language != "" {
+			req.Header.Add("Accept-Language", test.language)
+		}
+		session, err := Start(httptest.NewRecorder(), req, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if (session != nil) != test.expectedSession {
+			t.Errorf("Language %q: session returned = %t, expected %t", test.language, session != nil, test.expectedSession)
+		}
+	}
+}
+
+// Test TLS fingerprint changes.
+func TestSessionTLSFingerprint(t *testing.T) {
+	defer reset()
+	TLSFingerprint = func(request *http.Request) string {
+		return request.Header.Get("X-Fingerprint")
+	}
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			return &Session{
+				created:        time.Now(),
+				lastAccess:     time.Now(),
+				tlsFingerprint: "abc",
+			}, nil
+		},
+	}
+	for fingerprint, expected := range map[string]bool{"abc": true, "xyz": false} {
+		clearCache()
+		req := httptest.NewRequest("", "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+		req.Header.Add("X-Fingerprint", fingerprint)
+		session, err := Start(httptest.NewRecorder(), req, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if (session != nil) != expected {
+			t.Errorf("Fingerprint %s: session returned = %t, expected %t", fingerprint, session != nil, expected)
+		}
+		if session != nil && session.TLSFingerprint() != fingerprint {
+			t.Errorf("Session has fingerprint %s, expected %s", session.TLSFingerprint(), fingerprint)
+		}
+	}
+}
+
 // Test session data storage.
 func TestSessionData(t *testing.T) {
 	defer reset()
@@ -816,6 +1429,17 @@ func TestSessionData(t *testing.T) {
 		t.Error("key3 value is still stored")
 		return
 	}
+	moved, err := session.Move("key2", "key4")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !moved || session.Get("key2", nil) != nil || session.Get("key4", nil) != "value" {
+		t.Error("key2 was not moved to key4")
+	}
+	if moved, err = session.Move("key2", "key5"); err != nil || moved {
+		t.Error("Non-existing key2 was moved")
+	}
 	val1a := session.GetAndDelete("key1", nil)
 	if val1a == nil {
 		t.Error("key1 value was not found")
@@ -827,3 +1451,495 @@ func TestSessionData(t *testing.T) {
 		return
 	}
 }
+
+// Test swapping session values.
+func TestSessionSwap(t *testing.T) {
+	defer reset()
+	session := &Session{data: make(map[string]interface{})}
+	old, existed, err := session.Swap("key", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existed || old != nil {
+		t.Errorf("Unexpected previous value %v (existed %t)", old, existed)
+	}
+	old, existed, err = session.Swap("key", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !existed || old != 1 || session.Get("key", nil) != 2 {
+		t.Errorf("Unexpected previous value %v (existed %t)", old, existed)
+	}
+}
+
+// Test conditional changes of session values.
+func TestSessionCompareAndSwap(t *testing.T) {
+	defer reset()
+	var saved int
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			saved++
+			return nil
+		},
+	}
+	session := &Session{data: make(map[string]interface{})}
+
+	// Missing keys hold nil.
+	if ok, err := session.CompareAndSwap("version", 0, 1); err != nil || ok {
+		t.Errorf("Swap of missing key succeeded (error %v)", err)
+	}
+	if ok, err := session.CompareAndSwap("version", nil, 1); err != nil || !ok {
+		t.Errorf("Insert failed (error %v)", err)
+	}
+
+	// Only matching values are replaced.
+	if ok, err := session.CompareAndSwap("version", 2, 3); err != nil || ok {
+		t.Errorf("Swap of mismatching value succeeded (error %v)", err)
+	}
+	if ok, err := session.CompareAndSwap("version", 1.0, 3); err != nil || ok {
+		t.Errorf("Swap of value with different type succeeded (error %v)", err)
+	}
+	if ok, err := session.CompareAndSwap("version", 1, 2); err != nil || !ok {
+		t.Errorf("Swap failed (error %v)", err)
+	}
+	if session.Get("version", nil) != 2 {
+		t.Errorf("Unexpected value %v", session.Get("version", nil))
+	}
+	if saved != 2 {
+		t.Errorf("Session was saved %d times, expected 2", saved)
+	}
+
+	// Deep equality.
+	if err := session.Set("list", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := session.CompareAndSwap("list", []string{"a"}, []string{"a", "b"}); err != nil || !ok {
+		t.Errorf("Swap of slice failed (error %v)", err)
+	}
+}
+
+// Test changing multiple session values at once.
+func TestSessionUpdate(t *testing.T) {
+	defer reset()
+	var saved int
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			saved++
+			return nil
+		},
+	}
+	session := &Session{data: map[string]interface{}{"a": 1, "b": 2}}
+	events, unsubscribe := session.Subscribe()
+	defer unsubscribe()
+
+	// Multiple changes, one save.
+	if err := session.Update(func(data map[string]interface{}) error {
+		data["a"] = 10
+		data["c"] = 3
+		delete(data, "b")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if saved != 1 {
+		t.Errorf("Session was saved %d times, expected 1", saved)
+	}
+	if session.Get("a", nil) != 10 || session.Get("c", nil) != 3 || session.Get("b", nil) != nil {
+		t.Errorf("Unexpected session data %v", session.data)
+	}
+	if len(events) != 3 {
+		t.Errorf("Expected 3 events, got %d", len(events))
+	}
+
+	// Errors discard changes.
+	if err := session.Update(func(data map[string]interface{}) error {
+		data["a"] = 20
+		return errors.New("abort")
+	}); err == nil || err.Error() != "abort" {
+		t.Errorf("Expected abort error, got %v", err)
+	}
+	MaxSessionKeys = 2
+	if err := session.Update(func(data map[string]interface{}) error {
+		data["d"] = 4
+		return nil
+	}); err != ErrTooManyKeys {
+		t.Errorf("Expected ErrTooManyKeys, got %v", err)
+	}
+	if saved != 1 || session.Get("a", nil) != 10 || session.Get("d", nil) != nil {
+		t.Errorf("Discarded changes were applied (%d saves, data %v)", saved, session.data)
+	}
+}
+
+// Test recording the instance which last accessed a session.
+func TestSessionInstanceID(t *testing.T) {
+	defer reset()
+	InstanceID = "node-1"
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.LastInstance() != "node-1" {
+		t.Errorf("Unexpected instance %q after creation", session.LastInstance())
+	}
+
+	// Another node accesses the session.
+	InstanceID = "node-2"
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if session, err = Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if session.LastInstance() != "node-2" {
+		t.Errorf("Unexpected instance %q after access", session.LastInstance())
+	}
+
+	// Nothing is recorded without an instance ID.
+	InstanceID = ""
+	if session, err = Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatal(err)
+	}
+	if session.LastInstance() != "node-2" {
+		t.Errorf("Instance %q was overwritten", session.LastInstance())
+	}
+}
+
+// Test the hook for sessions near their idle timeout.
+func TestSessionNearExpiry(t *testing.T) {
+	defer reset()
+	SessionExpiry = time.Hour
+	NearExpiryWindow = time.Minute
+	AcceptRemoteIP = 4
+	var calls int
+	OnSessionNearExpiry = func(session *Session) {
+		calls++
+		if err := session.Set("warned", true); err != nil { // Must not deadlock.
+			t.Error(err)
+		}
+	}
+	session := &Session{id: sessionID, created: time.Now(), lastAccess: time.Now(), lastIP: "192.0.2.1:80", data: make(map[string]interface{})}
+	sessions.Set(session)
+
+	for _, address := range []string{"192.0.2.1:80", "192.0.2.2:80"} { // Fast path, then regular path.
+		calls = 0
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = address
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+
+		// Outside the window.
+		if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+			t.Fatal(err)
+		}
+		if calls != 0 {
+			t.Errorf("%s: Hook called outside the window", address)
+		}
+
+		// Inside the window.
+		session.Lock()
+		session.lastAccess = time.Now().Add(-59 * time.Minute)
+		session.lastIP = "192.0.2.1:80" // A different IP address leads to the regular path.
+		session.Unlock()
+		if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+			t.Fatal(err)
+		}
+		if calls != 1 {
+			t.Errorf("%s: Expected one call, got %d", address, calls)
+		}
+
+		// Not again for the same idle period (e.g. concurrent requests).
+		session.Lock()
+		session.lastAccess = time.Now().Add(-59 * time.Minute)
+		session.lastIP = "192.0.2.1:80" // A different IP address leads to the regular path.
+		session.Unlock()
+		if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+			t.Fatal(err)
+		}
+		if calls != 1 {
+			t.Errorf("%s: Hook called repeatedly", address)
+		}
+		session.Lock()
+		session.nearExpiry = false
+		session.Unlock()
+	}
+}
+
+// Test limiting the number of session keys.
+func TestSessionMaxKeys(t *testing.T) {
+	defer reset()
+	MaxSessionKeys = 2
+	session := &Session{data: make(map[string]interface{})}
+	if err := session.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Set("b", 2); err != nil {
+		t.Fatalf("Reaching the limit failed: %s", err)
+	}
+
+	// Inserting beyond the limit fails.
+	if err := session.Set("c", 3); !errors.Is(err, ErrTooManyKeys) {
+		t.Errorf("Expected ErrTooManyKeys, got %v", err)
+	}
+	if _, _, err := session.Swap("c", 3); !errors.Is(err, ErrTooManyKeys) {
+		t.Errorf("Expected ErrTooManyKeys from Swap(), got %v", err)
+	}
+	if _, ok, _ := session.Lookup("c"); ok {
+		t.Error("Key was added despite the limit")
+	}
+
+	// Overwriting is fine.
+	if err := session.Set("a", 10); err != nil {
+		t.Errorf("Overwriting failed: %s", err)
+	}
+	if old, _, err := session.Swap("b", 20); err != nil || old != 2 {
+		t.Errorf("Swapping failed: %v (previous value %v)", err, old)
+	}
+
+	// Deleting frees a slot.
+	if err := session.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Set("c", 3); err != nil {
+		t.Errorf("Inserting after deletion failed: %s", err)
+	}
+
+	// No limit.
+	MaxSessionKeys = 0
+	if err := session.Set("d", 4); err != nil {
+		t.Errorf("Unlimited insert failed: %s", err)
+	}
+}
+
+// Test grouping sessions by tag.
+func TestSessionTags(t *testing.T) {
+	defer reset()
+	tags := make(map[string]string)
+	var deleted int
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			tags[id] = session.tag
+			return nil
+		},
+		DeleteSessionFunc: func(id string) error {
+			deleted++
+			delete(tags, id)
+			return nil
+		},
+		SessionsByTagFunc: func(tag string) ([]string, error) {
+			var ids []string
+			for id, t := range tags {
+				if t == tag {
+					ids = append(ids, id)
+				}
+			}
+			return ids, nil
+		},
+	}
+	for i := 0; i < 3; i++ {
+		session, err := Start(httptest.NewRecorder(), httptest.NewRequest("", "/", nil), true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		tag := "tenant-a"
+		if i == 2 {
+			tag = "tenant-b"
+		}
+		if err := session.SetTag(tag); err != nil {
+			t.Error(err)
+			return
+		}
+		if session.Tag() != tag {
+			t.Errorf("Session has tag %s, expected %s", session.Tag(), tag)
+		}
+	}
+	count, err := CountByTag("tenant-a")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if count != 2 {
+		t.Errorf("Counted %d sessions, expected 2", count)
+	}
+	if err := DestroySessionsByTag("tenant-a"); err != nil {
+		t.Error(err)
+		return
+	}
+	if deleted != 2 {
+		t.Errorf("Deleted %d sessions, expected 2", deleted)
+	}
+	if len(cachedSessions()) != 1 {
+		t.Errorf("Cache contains %d sessions, expected 1", len(cachedSessions()))
+	}
+}
+
+// Test that the OnDestroyed hook receives tagged sessions which are not cached.
+func TestSessionTagsDestroyUncached(t *testing.T) {
+	defer reset()
+	clearCache()
+	defer clearCache()
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			if id == "missing" {
+				return nil, nil
+			}
+			return &Session{tag: "tenant-a", lastAccess: time.Now()}, nil
+		},
+		SessionsByTagFunc: func(tag string) ([]string, error) {
+			return []string{"stored", "missing"}, nil
+		},
+	}
+	var destroyed []string
+	Events.OnDestroyed = func(session *Session) {
+		destroyed = append(destroyed, session.id)
+	}
+	if err := DestroySessionsByTag("tenant-a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(destroyed) != 1 || destroyed[0] != "stored" {
+		t.Errorf("Unexpected destroyed sessions %v", destroyed)
+	}
+	if len(cachedSessions()) != 0 {
+		t.Errorf("Cache contains %d sessions, expected 0", len(cachedSessions()))
+	}
+}
+
+// Test sessions which end at a fixed time.
+func TestSessionExpiryAt(t *testing.T) {
+	defer reset()
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := session.ExpiresAt(); ok {
+		t.Error("New session has a deadline")
+	}
+	deadline := time.Now().Add(50 * time.Millisecond)
+	if err := session.SetExpiryAt(deadline); err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt, ok := session.ExpiresAt(); !ok || !expiresAt.Equal(deadline) {
+		t.Errorf("Unexpected deadline %s", expiresAt)
+	}
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if started, err := Start(httptest.NewRecorder(), request, false); err != nil || started != session {
+		t.Fatalf("Session was rejected before its deadline: %v", err)
+	}
+	if session.Expired() {
+		t.Error("Session expired before its deadline")
+	}
+
+	// After the deadline.
+	time.Sleep(time.Until(deadline))
+	if !session.Expired() {
+		t.Error("Session did not expire after its deadline")
+	}
+	if started, err := Start(httptest.NewRecorder(), request, false); err != nil || started != nil {
+		t.Errorf("Session was not rejected after its deadline: %v", err)
+	}
+}
+
+// Test reloading a session from the persistence layer.
+func TestSessionReload(t *testing.T) {
+	defer reset()
+	var stored *Session
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			return stored, nil
+		},
+	}
+	session := &Session{id: sessionID, tag: "old", data: map[string]interface{}{"a": 1}}
+	session.SetLocal("local", true)
+	if err := session.Reload(); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+	if session.Tag() != "old" {
+		t.Error("Session was changed although it was not found")
+	}
+
+	// Changed elsewhere.
+	stored = &Session{user: &TestUser{ID: "userid"}, tag: "new", data: map[string]interface{}{"b": 2}}
+	if err := session.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !session.Equal(stored) {
+		t.Error("Reloaded session differs from stored session")
+	}
+	if session.id != sessionID || session.GetLocal("local", nil) != true {
+		t.Error("Session ID or local values were not kept")
+	}
+}
+
+// Test that sessions can be serialized while their data is changed. Run with
+// -race to detect unsynchronized access.
+func TestSessionConcurrentEncode(t *testing.T) {
+	defer reset()
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			if _, err := session.GobEncode(); err != nil {
+				return err
+			}
+			if _, err := session.MarshalJSON(); err != nil {
+				return err
+			}
+			_, err := session.MarshalBinary()
+			return err
+		},
+	}
+	session := &Session{id: sessionID, created: time.Now(), data: make(map[string]interface{})}
+
+	const writers, writes = 4, 100
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for write := 0; write < writes; write++ {
+				if err := session.Set(fmt.Sprintf("%d-%d", writer, write%10), write); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+	if count := len(session.data); count != writers*10 {
+		t.Errorf("Expected %d keys, got %d", writers*10, count)
+	}
+
+	// Snapshots are not affected by later changes.
+	snapshot := session.snapshot()
+	if err := session.Set("new", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snapshot.data["new"]; ok {
+		t.Error("Snapshot shares its data map with the session")
+	}
+}
+
+// Benchmark concurrent starts of a cached session. The "regular" variant
+// changes the remote IP with every request (within the accepted range),
+// forcing Start() to take the path which locks the session ID.
+func BenchmarkStartCached(b *testing.B) {
+	for _, variant := range []string{"fast", "regular"} {
+		b.Run(variant, func(b *testing.B) {
+			defer reset()
+			AcceptRemoteIP = 4
+			sessions.Set(&Session{id: sessionID, created: time.Now(), data: make(map[string]interface{})})
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					req := httptest.NewRequest("", "/", nil)
+					req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+					if variant == "regular" {
+						i++
+						req.RemoteAddr = fmt.Sprintf("192.168.178.%d:80", i%2)
+					}
+					session, err := Start(httptest.NewRecorder(), req, false)
+					if err != nil || session == nil {
+						b.Fatalf("Session not started (error %v)", err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -10,3 +10,28 @@ func init() {
 	initCache()
 	initPasswords()
 }
+
+// Close stops the background goroutines and timers of this package. This is
+// useful in short-lived processes and in tests which check for leaked
+// goroutines. The goroutines are restarted automatically when the package is
+// used again. No sessions may be in use when this function is called.
+// Specifically, Close() stops:
+//
+//   - The goroutines which manage the locks on session IDs (see
+//     BackgroundMutexPurge).
+//   - The goroutine which retries saving sessions (see WriteBehind). Session
+//     changes which are still queued are not saved but remain queued. They are
+//     retried when the next session is queued (see also PendingWrites()).
+//   - The timers which delete reference sessions at the end of their grace
+//     period (see SessionIDGracePeriod). These sessions then expire like any
+//     other session. Call PurgeSessions() first to delete them right away.
+//   - The timers which forget the IDs of destroyed sessions (see
+//     TerminatedSessionExpiry). These IDs are forgotten immediately.
+//
+// The local sessions cache (see MaxSessionCacheSize) is not affected.
+func Close() {
+	sessionIDMutexes.Close()
+	writeBehind.close()
+	cancelReferenceDeletions()
+	forgetTerminated()
+}
@@ -0,0 +1,47 @@
+package sessions
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Statistics contains runtime statistics of this package (see Stats()).
+type Statistics struct {
+	// The number of sessions currently held in the local cache.
+	CachedSessions int
+
+	// Statistics about the locks held on session IDs. These are only collected
+	// while MeasureLockWaits is true.
+	Locks LockStatistics
+}
+
+// LockStatistics contains statistics about the locks which this package holds
+// on session IDs (see MeasureLockWaits). All values except Waiting accumulate
+// since the start of the program.
+type LockStatistics struct {
+	// The number of locks which were acquired.
+	Acquisitions int64
+
+	// The number of acquisitions which had to wait for another lock on the same
+	// session ID to be released.
+	Contended int64
+
+	// The total and the longest time spent waiting for a lock.
+	TotalWait, MaxWait time.Duration
+
+	// The number of goroutines currently trying to acquire a lock.
+	Waiting int
+
+	// The highest number of goroutines which were waiting for a lock on the same
+	// session ID at the same time.
+	MaxWaiters int
+}
+
+// Stats returns a snapshot of this package's runtime statistics. It is cheap
+// to call and may be used to feed a monitoring system.
+func Stats() Statistics {
+	return Statistics{
+		CachedSessions: int(atomic.LoadInt64(&sessions.size)),
+		Locks:          sessionIDMutexes.stats(),
+	}
+}
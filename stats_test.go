@@ -0,0 +1,61 @@
+package sessions
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test the collection of lock statistics.
+func TestStatsLocks(t *testing.T) {
+	defer reset()
+	m := newMutexes()
+	defer m.Close()
+
+	// Nothing is measured by default.
+	m.Lock("key")
+	m.Unlock("key")
+	if stats := m.stats(); stats.Acquisitions != 0 {
+		t.Errorf("Lock was measured despite MeasureLockWaits being false: %+v", stats)
+	}
+
+	// Two goroutines wait for a held lock.
+	MeasureLockWaits = true
+	m.Lock("key")
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Lock("key")
+			m.Unlock("key")
+		}()
+	}
+	if !waitFor(func() bool { return m.stats().Waiting == 2 }) {
+		t.Fatalf("Waiting goroutines not counted: %+v", m.stats())
+	}
+	time.Sleep(5 * time.Millisecond)
+	m.Unlock("key")
+	wg.Wait()
+
+	stats := m.stats()
+	if stats.Acquisitions != 3 || stats.Contended != 2 || stats.Waiting != 0 || stats.MaxWaiters != 2 {
+		t.Errorf("Unexpected lock statistics: %+v", stats)
+	}
+	if stats.MaxWait < 5*time.Millisecond || stats.TotalWait < 10*time.Millisecond {
+		t.Errorf("Wait times too short: %+v", stats)
+	}
+}
+
+// Test the package statistics.
+func TestStats(t *testing.T) {
+	defer reset()
+	for _, id := range []string{"a", "b"} {
+		if err := sessions.Set(&Session{id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := Stats(); stats.CachedSessions != 2 {
+		t.Errorf("Expected 2 cached sessions, got %d", stats.CachedSessions)
+	}
+}
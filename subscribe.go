@@ -0,0 +1,90 @@
+package sessions
+
+import (
+	"sync"
+	"time"
+)
+
+// subscriptionBufferSize is the number of events which are buffered for each
+// subscriber of a session (see Session.Subscribe()).
+const subscriptionBufferSize = 16
+
+// Types of session events (see SessionEvent).
+const (
+	SessionEventSet     = "set"     // A value was stored in the session.
+	SessionEventDelete  = "delete"  // A value was removed from the session.
+	SessionEventDestroy = "destroy" // The session was destroyed.
+	SessionEventLogOut  = "logout"  // The user was logged out of the session.
+)
+
+// SessionEvent describes a change of a session. It is sent to the subscribers
+// of the session (see Session.Subscribe()).
+type SessionEvent struct {
+	// The type of the event, one of the SessionEvent constants.
+	Type string
+
+	// The key of the affected value for "set" and "delete" events. Empty
+	// otherwise.
+	Key string
+
+	// The time of the change.
+	Time time.Time
+}
+
+// Subscribe returns a channel which receives an event whenever this session
+// is changed: when values are stored or removed, when the user is logged out,
+// or when the session is destroyed. This may be used, for example, to notify a
+// WebSocket client immediately when another request changes the same session.
+// The returned function ends the subscription and closes the channel. It must
+// be called when the subscription is not needed anymore.
+//
+// Events are delivered in-process only and only for changes made through this
+// Session object. As long as the session is in the local cache, all requests
+// for the session receive the same object. (Changes made on other machines or
+// to a session which was dropped from the cache and loaded again are not
+// observed.)
+//
+// Each channel buffers a limited number of events. Events are never blocked
+// by slow subscribers. Instead, events which don't fit into the channel's
+// buffer are dropped. Subscribers should therefore read from the channel
+// continuously and re-read any session values they depend on after receiving
+// an event.
+func (s *Session) Subscribe() (<-chan SessionEvent, func()) {
+	events := make(chan SessionEvent, subscriptionBufferSize)
+	s.Lock()
+	s.subscribers = append(s.subscribers, events)
+	s.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			s.Lock()
+			for index, subscriber := range s.subscribers {
+				if subscriber == events {
+					s.subscribers = append(s.subscribers[:index], s.subscribers[index+1:]...)
+					break
+				}
+			}
+			s.Unlock()
+			close(events)
+		})
+	}
+}
+
+// notify sends an event of the given type to all subscribers of this session
+// (see Subscribe()). The session must not be locked when this function is
+// called.
+func (s *Session) notify(eventType, key string) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.subscribers) == 0 {
+		return
+	}
+	event := SessionEvent{Type: eventType, Key: key, Time: time.Now()}
+	for _, subscriber := range s.subscribers {
+		select {
+		case subscriber <- event:
+		default: // The subscriber is too slow. Drop the event.
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test subscribing to session changes.
+func TestSessionSubscribe(t *testing.T) {
+	defer reset()
+	session := &Session{id: sessionID, user: &TestUser{ID: "12345"}, data: make(map[string]interface{})}
+	events, unsubscribe := session.Subscribe()
+
+	// Changes.
+	if err := session.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Set("a", 1); err != nil { // Unchanged, no event.
+		t.Fatal(err)
+	}
+	if err := session.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Delete("a"); err != nil { // Unchanged, no event.
+		t.Fatal(err)
+	}
+	if err := session.LogOut(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: sessionID})
+	if err := session.Destroy(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	expected := []SessionEvent{
+		{Type: SessionEventSet, Key: "a"},
+		{Type: SessionEventDelete, Key: "a"},
+		{Type: SessionEventLogOut},
+		{Type: SessionEventDestroy},
+	}
+	for _, exp := range expected {
+		select {
+		case event := <-events:
+			if event.Type != exp.Type || event.Key != exp.Key || event.Time.IsZero() {
+				t.Errorf("Expected %s event for %q, got %s event for %q", exp.Type, exp.Key, event.Type, event.Key)
+			}
+		default:
+			t.Fatalf("Missing %s event", exp.Type)
+		}
+	}
+
+	// Slow subscribers lose events.
+	for i := 0; i < 2*subscriptionBufferSize; i++ {
+		if err := session.Set("b", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(events) != subscriptionBufferSize {
+		t.Errorf("Expected %d buffered events, got %d", subscriptionBufferSize, len(events))
+	}
+
+	// Unsubscribing closes the channel.
+	unsubscribe()
+	unsubscribe()
+	for range events {
+	}
+	if len(session.subscribers) != 0 {
+		t.Errorf("Subscriber was not removed")
+	}
+	if err := session.Set("c", 1); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,58 @@
+package sessions
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrSessionTerminated is returned by Start() if the browser presents the ID
+// of a session which was recently ended with Session.Destroy() (see
+// TerminatedSessionExpiry).
+var ErrSessionTerminated = errors.New("Session was terminated")
+
+// terminatedSessions holds the timers which forget the IDs of destroyed
+// sessions after TerminatedSessionExpiry, keyed by the session IDs.
+var (
+	terminatedSessions      = make(map[string]*time.Timer)
+	terminatedSessionsMutex sync.Mutex
+)
+
+// markTerminated remembers the given session ID as terminated for the
+// duration of TerminatedSessionExpiry. Nothing happens if that duration is
+// not positive.
+func markTerminated(id string) {
+	if TerminatedSessionExpiry <= 0 {
+		return
+	}
+	terminatedSessionsMutex.Lock()
+	defer terminatedSessionsMutex.Unlock()
+	if timer, ok := terminatedSessions[id]; ok {
+		timer.Stop()
+	}
+	terminatedSessions[id] = time.AfterFunc(TerminatedSessionExpiry, func() {
+		terminatedSessionsMutex.Lock()
+		delete(terminatedSessions, id)
+		terminatedSessionsMutex.Unlock()
+	})
+}
+
+// terminated returns whether the session with the given ID was destroyed
+// within the last TerminatedSessionExpiry.
+func terminated(id string) bool {
+	terminatedSessionsMutex.Lock()
+	defer terminatedSessionsMutex.Unlock()
+	_, ok := terminatedSessions[id]
+	return ok
+}
+
+// forgetTerminated stops the timers which were started by markTerminated() and
+// forgets all terminated session IDs.
+func forgetTerminated() {
+	terminatedSessionsMutex.Lock()
+	defer terminatedSessionsMutex.Unlock()
+	for _, timer := range terminatedSessions {
+		timer.Stop()
+	}
+	terminatedSessions = make(map[string]*time.Timer)
+}
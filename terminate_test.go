@@ -0,0 +1,49 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Requests for recently destroyed sessions are recognized.
+func TestTerminatedSession(t *testing.T) {
+	defer reset()
+	TerminatedSessionExpiry = 20 * time.Millisecond
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session.id})
+	if err := session.Destroy(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another tab sends the old cookie.
+	res := httptest.NewRecorder()
+	if session, err := Start(res, req, true); !errors.Is(err, ErrSessionTerminated) || session != nil {
+		t.Errorf("Expected ErrSessionTerminated, got %v", err)
+	}
+	if !strings.Contains(res.Header().Get("Set-Cookie"), DeletedCookieValue) {
+		t.Error("Cookie was not deleted")
+	}
+
+	// The ID is forgotten after a while.
+	time.Sleep(40 * time.Millisecond)
+	if session, err := Start(httptest.NewRecorder(), req, true); err != nil || session == nil {
+		t.Errorf("No new session after expiry of terminated session ID (error %v)", err)
+	}
+
+	// Disabled by default.
+	TerminatedSessionExpiry = 0
+	if err := session.Destroy(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Start(httptest.NewRecorder(), req, false); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package sessions
+
+import (
+	"reflect"
+	"time"
+)
+
+// GetTyped returns the session value for the given key as a value of type T.
+// It is a type-safe alternative to Session.Get() which saves you the type
+// assertion:
+//
+//	cart := GetTyped(session, "cart", Cart{})
+//
+// If the key does not exist, if the session data could not be loaded, or if
+// the stored value is not of type T, "def" is returned. The only exception are
+// numbers: sessions decoded from JSON hold all numbers as float64 values. A
+// stored number is therefore converted to T if T is a numeric type and if the
+// conversion does not change the number (e.g. 3.0 may be returned as an int
+// but 3.5 may not).
+func GetTyped[T any](s *Session, key string, def T) T {
+	value, ok, err := s.Lookup(key)
+	if err != nil || !ok {
+		return def
+	}
+	if typed, ok := value.(T); ok {
+		return typed
+	}
+	if converted, ok := convertNumber(value, reflect.TypeOf((*T)(nil)).Elem()); ok {
+		return converted.(T)
+	}
+	return def
+}
+
+// SetTyped stores a value of type T in the session under the given key. It
+// is the counterpart to GetTyped() and behaves exactly like Session.Set().
+func SetTyped[T any](s *Session, key string, value T) error {
+	return s.Set(key, value)
+}
+
+// GetString returns the session value for the given key as a string. If the
+// key does not exist or if the value is not a string, "def" is returned. See
+// GetTyped() for values of other types.
+func (s *Session) GetString(key string, def string) string {
+	return GetTyped(s, key, def)
+}
+
+// GetInt returns the session value for the given key as an int. If the key
+// does not exist or if the value is not a number without a fractional part
+// which fits into an int, "def" is returned. See GetTyped() for values of
+// other types.
+func (s *Session) GetInt(key string, def int) int {
+	return GetTyped(s, key, def)
+}
+
+// GetBool returns the session value for the given key as a bool. If the key
+// does not exist or if the value is not a bool, "def" is returned. See
+// GetTyped() for values of other types.
+func (s *Session) GetBool(key string, def bool) bool {
+	return GetTyped(s, key, def)
+}
+
+// GetTime returns the session value for the given key as a time.Time. Since
+// sessions decoded from JSON hold times as strings, strings in RFC 3339 format
+// are converted, too. If the key does not exist or if the value is neither,
+// "def" is returned.
+func (s *Session) GetTime(key string, def time.Time) time.Time {
+	value, ok, err := s.Lookup(key)
+	if err != nil || !ok {
+		return def
+	}
+	switch v := value.(type) {
+	case time.Time:
+		return v
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t
+		}
+	}
+	return def
+}
+
+// convertNumber converts a numeric value to the numeric type "target". It
+// fails if either type is not numeric or if the conversion would change the
+// value, e.g. because of a fractional part or because it is out of range.
+func convertNumber(value interface{}, target reflect.Type) (interface{}, bool) {
+	if value == nil || !numericKind(target.Kind()) {
+		return nil, false
+	}
+	source := reflect.ValueOf(value)
+	if !numericKind(source.Kind()) {
+		return nil, false
+	}
+	converted := source.Convert(target)
+	if converted.Convert(source.Type()).Interface() != source.Interface() {
+		return nil, false
+	}
+	return converted.Interface(), true
+}
+
+// numericKind returns whether the given kind is an integer or a floating-point
+// kind.
+func numericKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package sessions
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Test the typed access to session values.
+func TestTypedValues(t *testing.T) {
+	defer reset()
+	type cart struct {
+		Items []string
+	}
+	session := &Session{data: make(map[string]interface{})}
+	if err := SetTyped(session, "cart", cart{Items: []string{"apple"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTyped(session, "count", 3); err != nil {
+		t.Fatal(err)
+	}
+	if c := GetTyped(session, "cart", cart{}); len(c.Items) != 1 || c.Items[0] != "apple" {
+		t.Errorf("Unexpected cart: %v", c)
+	}
+	if count := GetTyped(session, "count", 0); count != 3 {
+		t.Errorf("Unexpected count: %d", count)
+	}
+
+	// Mismatching and missing values.
+	if name := GetTyped(session, "count", "default"); name != "default" {
+		t.Errorf("Expected default for mismatching type, got %q", name)
+	}
+	if c := GetTyped(session, "missing", cart{Items: []string{"default"}}); len(c.Items) != 1 || c.Items[0] != "default" {
+		t.Errorf("Expected default for missing key, got %v", c)
+	}
+
+	// Numbers from JSON.
+	encoded, err := json.Marshal(map[string]interface{}{
+		"v":  8,
+		"cr": "2017-06-27T00:00:00Z",
+		"la": "2017-06-27T00:00:00Z",
+		"ip": "",
+		"ua": "0",
+		"da": map[string]interface{}{"count": 3, "pi": 3.14159, "negative": -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Session{}
+	if err := json.Unmarshal(encoded, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if count := GetTyped(decoded, "count", 0); count != 3 {
+		t.Errorf("Number from JSON was not converted: %d", count)
+	}
+	if count := GetTyped(decoded, "count", uint8(0)); count != 3 {
+		t.Errorf("Number from JSON was not converted to uint8: %d", count)
+	}
+	if pi := GetTyped(decoded, "pi", 0); pi != 0 {
+		t.Errorf("Fractional number was converted to int: %d", pi)
+	}
+	if pi := GetTyped(decoded, "pi", float32(0)); pi != 0 {
+		t.Errorf("Number was converted to float32 with loss of precision: %f", pi)
+	}
+	if negative := GetTyped(decoded, "negative", uint(0)); negative != 0 {
+		t.Errorf("Negative number was converted to uint: %d", negative)
+	}
+	if value := GetTyped[interface{}](decoded, "count", nil); value != 3.0 {
+		t.Errorf("Unexpected interface value: %v", value)
+	}
+}
+
+// Test the convenience getters.
+func TestTypedGetters(t *testing.T) {
+	defer reset()
+	now := time.Now()
+	session := &Session{data: map[string]interface{}{
+		"name":    "Alice",
+		"count":   3.0,
+		"admin":   true,
+		"seen":    now,
+		"created": "2017-06-27T10:30:00Z",
+	}}
+	if name := session.GetString("name", ""); name != "Alice" {
+		t.Errorf("Unexpected string: %q", name)
+	}
+	if name := session.GetString("count", "default"); name != "default" {
+		t.Errorf("Expected default for mismatching type, got %q", name)
+	}
+	if count := session.GetInt("count", 0); count != 3 {
+		t.Errorf("Unexpected int: %d", count)
+	}
+	if count := session.GetInt("missing", 7); count != 7 {
+		t.Errorf("Expected default for missing key, got %d", count)
+	}
+	if admin := session.GetBool("admin", false); !admin {
+		t.Error("Unexpected bool")
+	}
+	if seen := session.GetTime("seen", time.Time{}); !seen.Equal(now) {
+		t.Errorf("Unexpected time: %s", seen)
+	}
+	if created := session.GetTime("created", time.Time{}); !created.Equal(time.Date(2017, 6, 27, 10, 30, 0, 0, time.UTC)) {
+		t.Errorf("Time string was not parsed: %s", created)
+	}
+	if name := session.GetTime("name", time.Time{}); !name.IsZero() {
+		t.Errorf("Expected default for invalid time, got %s", name)
+	}
+}
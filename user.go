@@ -1,7 +1,59 @@
 package sessions
 
+import "fmt"
+
 // User represents one person who has access to the system.
 type User interface {
 	// GetID returns the user's unique ID.
 	GetID() interface{}
 }
+
+// userID returns the ID of the session's user without loading the user (see
+// LazyUserLoading). The second return value is false if no user is attached
+// to the session. The session must be locked (at least for reading) while this
+// function is called.
+func (s *Session) userID() (interface{}, bool) {
+	if s.pendingUserID != nil {
+		return s.pendingUserID, true
+	}
+	if s.user != nil {
+		return s.user.GetID(), true
+	}
+	return nil, false
+}
+
+// setUser attaches the given user to the session, replacing any user which has
+// not been loaded yet. The user may be nil. The session must be locked while
+// this function is called.
+func (s *Session) setUser(user User) {
+	s.user = user
+	s.pendingUserID = nil
+}
+
+// loadUser loads the user whose loading was deferred (see LazyUserLoading)
+// via Persistence.LoadUser(). Nothing happens if the user has already been
+// loaded or if there is no user.
+func (s *Session) loadUser() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.pendingUserID == nil {
+		return nil
+	}
+	user, err := loadSessionUser(s.pendingUserID)
+	if err != nil {
+		return fmt.Errorf("Failed to load user: %s", err)
+	}
+	s.setUser(user)
+	return nil
+}
+
+// loadSessionUser loads the user with the given ID via Persistence.LoadUser().
+// If that fails and OnLoadUserError is set, the callback decides about the
+// result.
+func loadSessionUser(id interface{}) (User, error) {
+	user, err := Persistence.LoadUser(id)
+	if err != nil && OnLoadUserError != nil {
+		return OnLoadUserError(id, err)
+	}
+	return user, err
+}
@@ -1,9 +1,17 @@
 package sessions
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -98,7 +106,7 @@ func TestUserLogout(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	for id, session := range sessions.sessions {
+	for id, session := range cachedSessions() {
 		if session.user != nil {
 			t.Errorf("User still logged into session %s", id)
 		}
@@ -161,3 +169,575 @@ func TestUserRefresh(t *testing.T) {
 		}
 	}
 }
+
+// Test login with pending authentication.
+func TestUserLoginPending(t *testing.T) {
+	defer reset()
+	req := httptest.NewRequest("", "/", nil)
+	res := httptest.NewRecorder()
+	session, err := Start(res, req, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	user := &TestUser{ID: "userid"}
+	if err := session.LogInPending(user, false, "totp", res); err != nil {
+		t.Error(err)
+		return
+	}
+	if session.User() != User(user) {
+		t.Error("User was not logged in")
+	}
+	if session.EffectiveUser() != nil {
+		t.Error("Effective user should be nil while authentication is pending")
+	}
+	if pending, reason := session.IsAuthPending(); !pending || reason != "totp" {
+		t.Errorf("Unexpected pending state: %t, %s", pending, reason)
+	}
+	if !session.authTime.IsZero() {
+		t.Error("Authentication time was set while authentication is pending")
+	}
+
+	// Serialization must keep the pending state.
+	Persistence = ExtendablePersistenceLayer{
+		LoadUserFunc: func(id interface{}) (User, error) {
+			return user, nil
+		},
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(session); err != nil {
+		t.Error(err)
+		return
+	}
+	var recovered Session
+	if err := gob.NewDecoder(&buffer).Decode(&recovered); err != nil {
+		t.Error(err)
+		return
+	}
+	if pending, reason := recovered.IsAuthPending(); !pending || reason != "totp" {
+		t.Errorf("Unexpected pending state after gob decoding: %t, %s", pending, reason)
+	}
+	j, err := json.Marshal(session)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	recovered = Session{}
+	if err := json.Unmarshal(j, &recovered); err != nil {
+		t.Error(err)
+		return
+	}
+	if pending, reason := recovered.IsAuthPending(); !pending || reason != "totp" {
+		t.Errorf("Unexpected pending state after JSON decoding: %t, %s", pending, reason)
+	}
+
+	// Complete authentication.
+	id := session.id
+	if err := session.CompleteAuth(res); err != nil {
+		t.Error(err)
+		return
+	}
+	if session.EffectiveUser() != User(user) {
+		t.Error("Effective user was not set after completing authentication")
+	}
+	if pending, _ := session.IsAuthPending(); pending {
+		t.Error("Authentication is still pending")
+	}
+	if session.id == id {
+		t.Error("Session ID was not changed")
+	}
+	if time.Since(session.authTime) > time.Minute {
+		t.Errorf("Unexpected authentication time %s", session.authTime)
+	}
+
+	// Logging out clears the authentication time.
+	if err := session.LogOut(); err != nil {
+		t.Fatal(err)
+	}
+	if !session.authTime.IsZero() {
+		t.Error("Authentication time was not cleared")
+	}
+}
+
+// Test changing a user's ID in all sessions.
+func TestUserReassignID(t *testing.T) {
+	defer reset()
+	oldUser := &TestUser{ID: "oldid"}
+	newUser := &TestUser{ID: "newid"}
+	index := make(map[string]interface{})
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			user := oldUser
+			if index[id] == "newid" {
+				user = newUser
+			}
+			return &Session{
+				user:       user,
+				created:    time.Now().Add(-2 * time.Minute),
+				lastAccess: time.Now().Add(-2 * time.Minute),
+			}, nil
+		},
+		SaveSessionFunc: func(id string, session *Session) error {
+			index[id] = session.user.GetID()
+			return nil
+		},
+		UserSessionsFunc: func(userID interface{}) ([]string, error) {
+			if userID != "oldid" {
+				return nil, nil
+			}
+			return []string{"1", "2", "3"}, nil
+		},
+	}
+	if err := ReassignUserID("oldid", "otherid", newUser); err == nil {
+		t.Error("Mismatching user ID was accepted")
+	}
+	if err := ReassignUserID("oldid", "newid", newUser); err != nil {
+		t.Error(err)
+		return
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if index[id] != "newid" {
+			t.Errorf("Session %s was saved with user ID %v", id, index[id])
+		}
+		session, err := sessions.Get(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if session.User() != User(newUser) {
+			t.Errorf("Session %s does not have the new user", id)
+		}
+	}
+}
+
+// sliceIDUser is a user whose ID is not comparable with ==.
+type sliceIDUser struct {
+	id []string
+}
+
+// Return the user ID.
+func (u *sliceIDUser) GetID() interface{} {
+	return u.id
+}
+
+// Test changing a user's ID to one which is not comparable with ==.
+func TestUserReassignSliceID(t *testing.T) {
+	defer reset()
+	clearCache()
+	defer clearCache()
+	oldUser := &sliceIDUser{id: []string{"tenant", "oldid"}}
+	newUser := &sliceIDUser{id: []string{"tenant", "newid"}}
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			return &Session{
+				user:       oldUser,
+				created:    time.Now().Add(-2 * time.Minute),
+				lastAccess: time.Now().Add(-2 * time.Minute),
+			}, nil
+		},
+		UserSessionsFunc: func(userID interface{}) ([]string, error) {
+			return []string{"1"}, nil
+		},
+	}
+	if err := ReassignUserID([]string{"tenant", "oldid"}, []string{"tenant", "otherid"}, newUser); err == nil {
+		t.Error("Mismatching user ID was accepted")
+	}
+	if err := ReassignUserID([]string{"tenant", "oldid"}, []string{"tenant", "newid"}, newUser); err != nil {
+		t.Error(err)
+		return
+	}
+	session, err := sessions.Get("1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if session.User() != User(newUser) {
+		t.Error("Session does not have the new user")
+	}
+}
+
+// Test checking whether a user is logged in anywhere.
+func TestUserIsLoggedIn(t *testing.T) {
+	defer reset()
+	user := &TestUser{ID: "userid"}
+	stored := map[string]*Session{
+		"reference": {user: user, referenceID: "current", lastAccess: time.Now()},
+		"stale":     {user: user, lastAccess: time.Now().Add(-2 * time.Hour)},
+		"current":   {user: user, lastAccess: time.Now()},
+	}
+	ids := []string{"reference", "stale", "current"}
+	SessionExpiry = time.Hour
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			return stored[id], nil
+		},
+		UserSessionsFunc: func(userID interface{}) ([]string, error) {
+			if userID != "userid" {
+				return nil, nil
+			}
+			return ids, nil
+		},
+	}
+	if loggedIn, err := IsUserLoggedIn("userid"); err != nil || !loggedIn {
+		t.Errorf("User not found to be logged in (%v)", err)
+	}
+	if loggedIn, err := IsUserLoggedIn("otheruser"); err != nil || loggedIn {
+		t.Errorf("Other user found to be logged in (%v)", err)
+	}
+	ids = ids[:2]
+	clearCache()
+	if loggedIn, err := IsUserLoggedIn("userid"); err != nil || loggedIn {
+		t.Errorf("User with only inactive sessions found to be logged in (%v)", err)
+	}
+}
+
+// Test checking whether a user with an ID which is not comparable with == is
+// logged in.
+func TestUserIsLoggedInSliceID(t *testing.T) {
+	defer reset()
+	clearCache()
+	defer clearCache()
+	user := &sliceIDUser{id: []string{"tenant", "userid"}}
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			return &Session{user: user, lastAccess: time.Now()}, nil
+		},
+		UserSessionsFunc: func(userID interface{}) ([]string, error) {
+			return []string{"slice"}, nil
+		},
+	}
+	if loggedIn, err := IsUserLoggedIn([]string{"tenant", "userid"}); err != nil || !loggedIn {
+		t.Errorf("User not found to be logged in (%v)", err)
+	}
+	if loggedIn, err := IsUserLoggedIn([]string{"tenant", "otheruser"}); err != nil || loggedIn {
+		t.Errorf("Other user found to be logged in (%v)", err)
+	}
+}
+
+// Test that multi-session operations continue when a single session fails.
+func TestUserMultiSessionErrors(t *testing.T) {
+	defer reset()
+	user := &TestUser{ID: "userid"}
+	saveErr := errors.New("Cannot save session")
+	var saved []string
+	Persistence = ExtendablePersistenceLayer{
+		LoadSessionFunc: func(id string) (*Session, error) {
+			if id == "corrupt" {
+				return nil, errors.New("Corrupt session")
+			}
+			return &Session{user: user, lastAccess: time.Now()}, nil
+		},
+		SaveSessionFunc: func(id string, session *Session) error {
+			if id == "readonly" {
+				return saveErr
+			}
+			saved = append(saved, id)
+			return nil
+		},
+		UserSessionsFunc: func(userID interface{}) ([]string, error) {
+			return []string{"1", "corrupt", "readonly", "2"}, nil
+		},
+	}
+
+	// Log out.
+	err := LogOut(user.ID)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, id := range []string{"corrupt", "readonly"} {
+		if !strings.Contains(err.Error(), MaskSessionID(id)) {
+			t.Errorf("Error does not mention session %s: %s", id, err)
+		}
+	}
+	if !errors.Is(err, saveErr) {
+		t.Error("Error does not wrap the persistence layer's error")
+	}
+	if len(saved) != 2 || saved[0] != "1" || saved[1] != "2" {
+		t.Errorf("Not all sessions were processed: %v", saved)
+	}
+	for _, id := range []string{"1", "2"} {
+		if cachedSessions()[id].user != nil {
+			t.Errorf("User still logged into session %s", id)
+		}
+	}
+
+	// Refresh the user.
+	saved = nil
+	if err := RefreshUser(user); err == nil || len(saved) != 2 {
+		t.Errorf("Unexpected result (error %v, saved %v)", err, saved)
+	}
+}
+
+// Test that data changes during a login land on the new session ID.
+func TestUserLoginConcurrentSet(t *testing.T) {
+	defer reset()
+	var mutex sync.Mutex
+	stored := make(map[string]*Session)
+	Persistence = ExtendablePersistenceLayer{
+		SaveSessionFunc: func(id string, session *Session) error {
+			time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond) // Simulate a data store with varying latency.
+			session.RLock()
+			snapshot := &Session{referenceID: session.referenceID, data: make(map[string]interface{})}
+			for key, value := range session.data {
+				snapshot.data[key] = value
+			}
+			session.RUnlock()
+			mutex.Lock()
+			stored[id] = snapshot
+			mutex.Unlock()
+			return nil
+		},
+	}
+	session, err := Start(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change data while logging in repeatedly.
+	const writers, logins = 8, 20
+	var (
+		started, wg sync.WaitGroup
+		count       int64
+	)
+	stop := make(chan struct{})
+	for writer := 0; writer < writers; writer++ {
+		started.Add(1)
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			started.Done()
+			for write := 0; ; write++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := session.Set(fmt.Sprintf("%d-%d", writer, write), true); err != nil {
+					t.Error(err)
+				}
+				atomic.AddInt64(&count, 1)
+			}
+		}(writer)
+	}
+	started.Wait()
+	replaced := make(map[string]string) // Old ID -> new ID.
+	for login := 0; login < logins; login++ {
+		session.RLock()
+		oldID := session.id
+		session.RUnlock()
+		if err := session.LogIn(&TestUser{ID: "userid"}, false, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+		session.RLock()
+		replaced[oldID] = session.id
+		session.RUnlock()
+	}
+	close(stop)
+	wg.Wait()
+
+	// Check the stored sessions.
+	for oldID, newID := range replaced {
+		if ref := stored[oldID]; ref == nil || ref.referenceID != newID {
+			t.Errorf("Session ID %s was not replaced by a reference session", oldID)
+		}
+	}
+	if saved := stored[session.id]; saved == nil || int64(len(saved.data)) != count {
+		t.Error("Not all changes were saved under the new session ID")
+	}
+}
+
+// Test deferred loading of session users.
+func TestLazyUserLoading(t *testing.T) {
+	defer reset()
+	LazyUserLoading = true
+	user := &TestUser{ID: "userid"}
+	var loads int
+	loadErr := errors.New("User store unavailable")
+	Persistence = ExtendablePersistenceLayer{
+		LoadUserFunc: func(id interface{}) (User, error) {
+			loads++
+			if loads == 1 {
+				return nil, loadErr
+			}
+			if id != user.ID {
+				return nil, fmt.Errorf("Requested wrong user: %v", id)
+			}
+			return user, nil
+		},
+	}
+	original := &Session{user: user, data: make(map[string]interface{})}
+	encoded, err := original.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &Session{}
+	if err := session.GobDecode(encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user ID is available without loading the user.
+	if !session.Equal(original) {
+		t.Error("Decoded session differs from original session")
+	}
+	reencoded, err := session.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, reencoded) {
+		t.Error("Re-encoded session differs from original encoding")
+	}
+	if loads != 0 {
+		t.Fatalf("User was loaded %d times before it was needed", loads)
+	}
+
+	// The user is loaded when needed.
+	if session.User() != nil {
+		t.Error("Expected nil user when loading fails")
+	}
+	if u := session.User(); u != user {
+		t.Errorf("Unexpected user: %v", u)
+	}
+	if u := session.EffectiveUser(); u != user {
+		t.Errorf("Unexpected effective user: %v", u)
+	}
+	if loads != 2 {
+		t.Errorf("User was loaded %d times, expected 2", loads)
+	}
+}
+
+// Test the handling of errors when loading users.
+func TestOnLoadUserError(t *testing.T) {
+	defer reset()
+	var failures int
+	Persistence = ExtendablePersistenceLayer{
+		LoadUserFunc: func(id interface{}) (User, error) {
+			if failures > 0 {
+				failures--
+				return nil, errors.New("User store unavailable")
+			}
+			return &TestUser{ID: id.(string)}, nil
+		},
+	}
+	serialized, err := (&Session{user: &TestUser{ID: "userid"}, data: make(map[string]interface{})}).GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func() (*Session, error) {
+		var session Session
+		return &session, session.GobDecode(serialized)
+	}
+
+	// Errors are propagated by default.
+	failures = 1
+	if _, err := decode(); err == nil {
+		t.Error("User loading error was not propagated")
+	}
+
+	// Treat as logged out.
+	OnLoadUserError = func(id interface{}, err error) (User, error) {
+		return nil, nil
+	}
+	failures = 1
+	session, err := decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.User() != nil {
+		t.Error("Session has a user although it could not be loaded")
+	}
+
+	// Retry.
+	OnLoadUserError = func(id interface{}, err error) (User, error) {
+		return Persistence.LoadUser(id)
+	}
+	failures = 1
+	if session, err = decode(); err != nil {
+		t.Fatal(err)
+	}
+	if user := session.User(); user == nil || user.GetID() != "userid" {
+		t.Error("User was not loaded on retry")
+	}
+}
+
+// Test authentication assurance levels.
+func TestUserAssuranceLevel(t *testing.T) {
+	defer reset()
+	session := &Session{id: sessionID, data: make(map[string]interface{})}
+	if err := session.SetAssuranceLevel(2); err != nil {
+		t.Fatal(err)
+	}
+	if session.RequireAssurance(1) {
+		t.Error("Assurance accepted without a user")
+	}
+
+	// Login resets the level.
+	if err := session.LogInPending(&TestUser{ID: "userid"}, false, "2fa", httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if session.AssuranceLevel() != 0 {
+		t.Errorf("Assurance level %d survived login", session.AssuranceLevel())
+	}
+	if err := session.SetAssuranceLevel(1); err != nil {
+		t.Fatal(err)
+	}
+	if session.RequireAssurance(1) {
+		t.Error("Assurance accepted while authentication is pending")
+	}
+
+	// Step-up.
+	if err := session.CompleteAuth(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if !session.RequireAssurance(1) || session.RequireAssurance(2) {
+		t.Error("Unexpected assurance after password login")
+	}
+	if err := session.SetAssuranceLevel(2); err != nil {
+		t.Fatal(err)
+	}
+	if !session.RequireAssurance(2) || session.RequireAssurance(3) {
+		t.Error("Unexpected assurance after step-up")
+	}
+
+	// Logout resets the level.
+	if err := session.LogOut(); err != nil {
+		t.Fatal(err)
+	}
+	if session.AssuranceLevel() != 0 {
+		t.Errorf("Assurance level %d survived logout", session.AssuranceLevel())
+	}
+}
+
+// Test that logging a user out of all sessions resets the assurance level.
+func TestUserLogOutAllAssuranceLevel(t *testing.T) {
+	defer reset()
+	clearCache()
+	defer clearCache()
+	session := &Session{
+		id:             "assured",
+		user:           &TestUser{ID: "userid"},
+		assuranceLevel: 2,
+		locals:         map[string]interface{}{"key": "value"},
+		created:        time.Now(),
+		lastAccess:     time.Now(),
+	}
+	if err := sessions.Set(session); err != nil {
+		t.Fatal(err)
+	}
+	Persistence = ExtendablePersistenceLayer{
+		UserSessionsFunc: func(userID interface{}) ([]string, error) {
+			return []string{"assured"}, nil
+		},
+	}
+	if err := LogOut("userid"); err != nil {
+		t.Fatal(err)
+	}
+	if session.User() != nil {
+		t.Error("User was not logged out")
+	}
+	if session.AssuranceLevel() != 0 {
+		t.Errorf("Assurance level %d survived logout", session.AssuranceLevel())
+	}
+	if session.GetLocal("key", nil) != nil {
+		t.Error("Local values survived logout")
+	}
+}
@@ -0,0 +1,225 @@
+package sessions
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+// Device types returned in UserAgentInfo.DeviceType.
+const (
+	DeviceUnknown = ""        // The device type could not be determined.
+	DeviceDesktop = "desktop" // A desktop or laptop computer.
+	DeviceMobile  = "mobile"  // A mobile phone.
+	DeviceTablet  = "tablet"  // A tablet computer.
+	DeviceBot     = "bot"     // A crawler, spider, or other automated client.
+)
+
+// UserAgentInfo contains information extracted from a user agent string by
+// ParseUserAgent(). Fields which could not be determined are empty.
+type UserAgentInfo struct {
+	// The name of the browser, e.g. "Chrome", "Firefox", "Safari", "Edge".
+	Browser string
+
+	// The major version of the browser, e.g. "118".
+	BrowserVersion string
+
+	// The name of the operating system, e.g. "Windows", "macOS", "iOS",
+	// "Android", "Linux".
+	OS string
+
+	// The type of device, one of the Device constants.
+	DeviceType string
+
+	// Whether the client is likely a bot (e.g. a search engine crawler).
+	Bot bool
+}
+
+// String returns a short human-readable description of the user agent, e.g.
+// "Chrome on Windows".
+func (i UserAgentInfo) String() string {
+	browser, os := i.Browser, i.OS
+	if browser == "" {
+		browser = "Unknown browser"
+	}
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
+
+// userAgentBrowsers is the list of browser tokens searched for in user agent
+// strings. The order is important as many browsers include the tokens of
+// other browsers in their user agent strings.
+var userAgentBrowsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"Edge/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Opera/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"YaBrowser/", "Yandex Browser"},
+	{"Vivaldi/", "Vivaldi"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"FxiOS/", "Firefox"},
+	{"Firefox/", "Firefox"},
+	{"Version/", "Safari"},
+	{"MSIE ", "Internet Explorer"},
+	{"Trident/", "Internet Explorer"},
+}
+
+// userAgentOperatingSystems is the list of operating system tokens searched
+// for in user agent strings, in this order.
+var userAgentOperatingSystems = []struct{ token, name string }{
+	{"Windows Phone", "Windows Phone"},
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"iPod", "iOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+	{"FreeBSD", "FreeBSD"},
+}
+
+// userAgentBotTokens are lowercase substrings which indicate a bot.
+var userAgentBotTokens = []string{
+	"bot",
+	"crawler",
+	"spider",
+	"slurp",
+	"crawling",
+	"facebookexternalhit",
+	"headlesschrome",
+	"curl/",
+	"wget/",
+	"python-requests",
+	"go-http-client",
+	"java/",
+	"libwww",
+	"httpclient",
+}
+
+// ParseUserAgent extracts the browser, operating system, and device type from
+// a user agent string. It also guesses whether the client is a bot. This may be
+// used, for example, to present a list of a user's sessions ("Chrome on
+// Windows") or to implement anomaly detection rules which tolerate browser
+// updates.
+//
+// This function is heuristic. It uses a small built-in list of well-known
+// tokens and does not attempt to cover every browser or device. User agent
+// strings are also easily forged by clients so the result should not be used
+// for security decisions on its own.
+func ParseUserAgent(ua string) UserAgentInfo {
+	var info UserAgentInfo
+	if ua == "" {
+		return info
+	}
+
+	// Bots.
+	lower := strings.ToLower(ua)
+	for _, token := range userAgentBotTokens {
+		if strings.Contains(lower, token) {
+			info.Bot = true
+			info.DeviceType = DeviceBot
+			break
+		}
+	}
+
+	// Browser.
+	for _, browser := range userAgentBrowsers {
+		index := strings.Index(ua, browser.token)
+		if index < 0 {
+			continue
+		}
+		if browser.name == "Safari" && !strings.Contains(ua, "Safari/") {
+			continue // "Version/" is used by other clients, too.
+		}
+		info.Browser = browser.name
+		if browser.token == "Trident/" {
+			break // Trident versions don't match browser versions.
+		}
+		version := ua[index+len(browser.token):]
+		end := strings.IndexFunc(version, func(r rune) bool {
+			return r < '0' || r > '9'
+		})
+		if end >= 0 {
+			version = version[:end]
+		}
+		info.BrowserVersion = version
+		break
+	}
+
+	// Operating system.
+	for _, os := range userAgentOperatingSystems {
+		if strings.Contains(ua, os.token) {
+			info.OS = os.name
+			break
+		}
+	}
+
+	// Device type.
+	if info.DeviceType == DeviceUnknown {
+		switch {
+		case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") ||
+			info.OS == "Android" && !strings.Contains(ua, "Mobile"):
+			info.DeviceType = DeviceTablet
+		case strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPhone") ||
+			strings.Contains(ua, "iPod") || info.OS == "Windows Phone":
+			info.DeviceType = DeviceMobile
+		case info.OS != "":
+			info.DeviceType = DeviceDesktop
+		}
+	}
+
+	return info
+}
+
+// userAgentVersion matches version numbers with minor version components.
+var userAgentVersion = regexp.MustCompile(`(\d+)(?:[._]\d+)+`)
+
+// normalizeUserAgent is the default implementation of NormalizeUserAgent. It
+// reduces all version numbers in the user agent string to their major version.
+func normalizeUserAgent(userAgent string) string {
+	return userAgentVersion.ReplaceAllString(userAgent, "$1")
+}
+
+// FNVUserAgentHash is the default implementation of HashUserAgent. It returns
+// the 64-bit FNV-1a hash of the user agent string. It is fast but it is not a
+// cryptographic hash.
+func FNVUserAgentHash(userAgent string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(userAgent))
+	return hash.Sum64()
+}
+
+// SHA256UserAgentHash is an implementation of HashUserAgent which returns the
+// first 64 bits of the SHA-256 hash of the user agent string. Unlike
+// FNVUserAgentHash(), it is impractical to find a different user agent string
+// with the same hash.
+func SHA256UserAgentHash(userAgent string) uint64 {
+	hash := sha256.Sum256([]byte(userAgent))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// userAgentHash returns the hash of the given normalized user agent string
+// (see HashUserAgent). It returns 0 for an empty string and never otherwise.
+func userAgentHash(userAgent string) uint64 {
+	if userAgent == "" {
+		return 0
+	}
+	hashUserAgent := HashUserAgent
+	if hashUserAgent == nil {
+		hashUserAgent = FNVUserAgentHash
+	}
+	if hash := hashUserAgent(userAgent); hash != 0 {
+		return hash
+	}
+	return 1 // 0 means "no user agent".
+}
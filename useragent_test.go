@@ -0,0 +1,72 @@
+package sessions
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Test parsing of user agent strings.
+func TestParseUserAgent(t *testing.T) {
+	for ua, expected := range map[string]UserAgentInfo{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36": {
+			Browser: "Chrome", BrowserVersion: "118", OS: "Windows", DeviceType: DeviceDesktop,
+		},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46": {
+			Browser: "Edge", BrowserVersion: "118", OS: "Windows", DeviceType: DeviceDesktop,
+		},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:109.0) Gecko/20100101 Firefox/119.0": {
+			Browser: "Firefox", BrowserVersion: "119", OS: "macOS", DeviceType: DeviceDesktop,
+		},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1": {
+			Browser: "Safari", BrowserVersion: "17", OS: "iOS", DeviceType: DeviceMobile,
+		},
+		"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36": {
+			Browser: "Chrome", BrowserVersion: "118", OS: "Android", DeviceType: DeviceTablet,
+		},
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": {
+			DeviceType: DeviceBot, Bot: true,
+		},
+		"": {},
+	} {
+		info := ParseUserAgent(ua)
+		if info != expected {
+			t.Errorf("User agent %q parsed as %+v, expected %+v", ua, info, expected)
+		}
+	}
+	if s := ParseUserAgent("Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/118.0.0.0 Safari/537.36").String(); s != "Chrome on Windows" {
+		t.Errorf("Unexpected description: %s", s)
+	}
+}
+
+// Test the hash functions for user agent strings.
+func TestUserAgentHash(t *testing.T) {
+	defer reset()
+	const userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/118"
+	if userAgentHash("") != 0 {
+		t.Error("Empty user agent has a hash")
+	}
+	if hash := userAgentHash(userAgent); hash != FNVUserAgentHash(userAgent) || hash == 0 {
+		t.Errorf("Unexpected default hash %d", hash)
+	}
+
+	// SHA-256.
+	HashUserAgent = SHA256UserAgentHash
+	if hash := userAgentHash(userAgent); hash == FNVUserAgentHash(userAgent) || hash != SHA256UserAgentHash(userAgent) {
+		t.Errorf("Unexpected SHA-256 hash %d", hash)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/118.0.5993.70")
+	session, err := Start(httptest.NewRecorder(), req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.lastUserAgentHash != SHA256UserAgentHash(normalizeUserAgent(req.Header.Get("User-Agent"))) {
+		t.Error("Session does not hold the SHA-256 hash of the normalized user agent")
+	}
+
+	// Zero is reserved for missing user agents.
+	HashUserAgent = func(string) uint64 { return 0 }
+	if userAgentHash(userAgent) == 0 {
+		t.Error("Non-empty user agent has a zero hash")
+	}
+}
@@ -0,0 +1,434 @@
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// PasswordError is returned when a new password does not follow
+// PasswordPolicy.
+type PasswordError struct {
+	// The problems found with the password.
+	Problems []sessions.PasswordProblem
+}
+
+// Error implements the error interface.
+func (e *PasswordError) Error() string {
+	return fmt.Sprintf("Password does not follow the password policy (problems %v)", e.Problems)
+}
+
+// LoadUser returns the account with the given ID. It can be used as
+// sessions.ExtendablePersistenceLayer.LoadUserFunc so that accounts are
+// attached to the sessions they were logged into.
+func LoadUser(id interface{}) (sessions.User, error) {
+	if Accounts == nil {
+		return nil, ErrNoStore
+	}
+	accountID, ok := id.(string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid account ID type %T", id)
+	}
+	account, err := Accounts.AccountByID(accountID)
+	if err != nil || account == nil {
+		return nil, err // A nil *Account must not become a non-nil User.
+	}
+	return account, nil
+}
+
+// SignUp creates a new account with the given email address and password. The
+// password must follow PasswordPolicy, otherwise a *PasswordError is returned.
+// If RequireVerification is true, a verification token is sent via SendToken.
+//
+// If the email address is already in use, ErrEmailTaken is returned and a
+// token with PurposeAccountExists is sent to the existing account instead.
+// This way, the account holder learns about the attempt (and may reset their
+// password with the token if it was them) while the caller may respond exactly
+// as for a successful sign-up, not revealing which email addresses have
+// accounts. If the token could not be sent, the returned error wraps both
+// ErrEmailTaken and the cause.
+//
+// The user is not logged in. Call LogIn() to do so, once the email address is
+// verified (if required).
+func SignUp(email, password string) (*Account, error) {
+	if err := checkConfig(); err != nil {
+		return nil, err
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := newPasswordHash(email, password)
+	if err != nil {
+		return nil, err
+	}
+	account := &Account{
+		ID:           sessions.CUID(),
+		Email:        email,
+		PasswordHash: hash,
+		Verified:     !RequireVerification,
+		Created:      time.Now(),
+	}
+	if err := Accounts.CreateAccount(account); err != nil {
+		if errors.Is(err, ErrEmailTaken) {
+			return nil, notifyAccountExists(email)
+		}
+		return nil, fmt.Errorf("Could not create account: %w", err)
+	}
+	if RequireVerification {
+		if err := issueToken(account, PurposeVerifyEmail, VerificationExpiry); err != nil {
+			return account, err
+		}
+	}
+	return account, nil
+}
+
+// notifyAccountExists sends a PurposeAccountExists token to the account with
+// the given email address and returns ErrEmailTaken, joined with any error
+// which occurred while doing so.
+func notifyAccountExists(email string) error {
+	account, err := Accounts.AccountByEmail(email)
+	if err != nil {
+		return errors.Join(ErrEmailTaken, fmt.Errorf("Could not retrieve account: %w", err))
+	}
+	if account == nil {
+		return ErrEmailTaken // Deleted in the meantime.
+	}
+	if err := issueToken(account, PurposeAccountExists, ResetExpiry); err != nil {
+		return errors.Join(ErrEmailTaken, err)
+	}
+	return ErrEmailTaken
+}
+
+// ResendVerification sends a new verification token to the account with the
+// given email address. Nothing happens if there is no such account or if it is
+// already verified. (This way, the function does not reveal which email
+// addresses have accounts.) If the email address is not valid,
+// ErrInvalidEmail is returned.
+func ResendVerification(email string) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	account, err := Accounts.AccountByEmail(email)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve account: %w", err)
+	}
+	if account == nil || account.Verified {
+		return nil
+	}
+	return issueToken(account, PurposeVerifyEmail, VerificationExpiry)
+}
+
+// VerifyEmail marks the email address of the account for which the given token
+// was issued as verified. If the token is unknown, expired, or was issued for
+// a different purpose, ErrInvalidToken is returned.
+func VerifyEmail(token string) (*Account, error) {
+	if err := checkConfig(); err != nil {
+		return nil, err
+	}
+	account, err := redeemToken(token, PurposeVerifyEmail)
+	if err != nil {
+		return nil, err
+	}
+	account.Verified = true
+	if err := Accounts.UpdateAccount(account); err != nil {
+		return nil, fmt.Errorf("Could not update account: %w", err)
+	}
+	return account, nil
+}
+
+// dummyHash is a password hash generated with HashPassword which is verified
+// when no account exists for an email address. This way, LogIn() takes about
+// as long for unknown email addresses as for wrong passwords.
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// verifyDummyPassword verifies the given password against dummyHash and
+// discards the result.
+func verifyDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = HashPassword(sessions.CUID())
+	})
+	VerifyPassword(dummyHash, password)
+}
+
+// LogIn logs the user with the given email address and password into the
+// session of the given request. A session is created if there is none yet.
+// If the credentials are wrong, ErrWrongCredentials is returned, without
+// revealing whether the email address or the password was wrong. (The password
+// is verified against a dummy hash if there is no account for the email
+// address so the response time does not reveal it either.) If
+// RequireVerification is true and the email address has not been verified,
+// ErrNotVerified is returned.
+func LogIn(response http.ResponseWriter, request *http.Request, email, password string) (*Account, error) {
+	if err := checkConfig(); err != nil {
+		return nil, err
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		verifyDummyPassword(password)
+		return nil, ErrWrongCredentials
+	}
+	account, err := Accounts.AccountByEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve account: %w", err)
+	}
+	if account == nil {
+		verifyDummyPassword(password)
+		return nil, ErrWrongCredentials
+	}
+	if !VerifyPassword(account.PasswordHash, password) {
+		return nil, ErrWrongCredentials
+	}
+	if RequireVerification && !account.Verified {
+		return nil, ErrNotVerified
+	}
+	if NeedsRehash != nil && NeedsRehash(account.PasswordHash) {
+		if err := rehashPassword(account, password); err != nil {
+			return nil, err
+		}
+	}
+	session, err := sessions.Start(response, request, true)
+	if err != nil {
+		return nil, fmt.Errorf("Could not start session: %w", err)
+	}
+	if err := session.LogIn(account, ExclusiveLogIn, response); err != nil {
+		return nil, fmt.Errorf("Could not log in: %w", err)
+	}
+	return account, nil
+}
+
+// LogOut logs the user out of the session of the given request. Nothing
+// happens if there is no session or if no user is logged in.
+func LogOut(response http.ResponseWriter, request *http.Request) error {
+	session, err := sessions.Start(response, request, false)
+	if err != nil {
+		return fmt.Errorf("Could not start session: %w", err)
+	}
+	if session == nil {
+		return nil
+	}
+	return session.LogOut()
+}
+
+// RequestPasswordReset sends a password reset token to the account with the
+// given email address via SendToken. Nothing happens if there is no such
+// account. (This way, the function does not reveal which email addresses have
+// accounts.) If the email address is not valid, ErrInvalidEmail is returned.
+func RequestPasswordReset(email string) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	account, err := Accounts.AccountByEmail(email)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve account: %w", err)
+	}
+	if account == nil {
+		return nil
+	}
+	return issueToken(account, PurposeResetPassword, ResetExpiry)
+}
+
+// ResetPassword sets a new password for the account for which the given reset
+// token was issued (see RequestPasswordReset()). Tokens with
+// PurposeAccountExists (see SignUp()) are accepted, too. The password must follow
+// PasswordPolicy, otherwise a *PasswordError is returned and the token remains
+// valid. Because the user proved that they control the email address, the
+// address is marked as verified, too. The user is logged out of all sessions.
+// This requires that sessions.Persistence.UserSessions() be implemented.
+func ResetPassword(token, password string) (*Account, error) {
+	if err := checkConfig(); err != nil {
+		return nil, err
+	}
+	stored, err := Accounts.TakeToken(tokenHash(token))
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve token: %w", err)
+	}
+	account, err := tokenAccount(stored, PurposeResetPassword, PurposeAccountExists)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash, err := newPasswordHash(account.Email, password)
+	if err != nil {
+		if saveErr := Accounts.SaveToken(stored); saveErr != nil {
+			return nil, fmt.Errorf("Could not restore token: %w", saveErr)
+		}
+		return nil, err
+	}
+	account.PasswordHash = passwordHash
+	account.Verified = true
+	if err := Accounts.UpdateAccount(account); err != nil {
+		return nil, fmt.Errorf("Could not update account: %w", err)
+	}
+	if err := sessions.LogOut(account.ID); err != nil {
+		return account, fmt.Errorf("Could not log user out of their sessions: %w", err)
+	}
+	return account, nil
+}
+
+// DeleteAccount deletes the account of the user logged into the session of the
+// given request. The user must confirm the deletion with their password,
+// otherwise ErrWrongCredentials is returned. If no user is logged in,
+// ErrNotLoggedIn is returned. The user is logged out of all sessions and the
+// current session is destroyed.
+func DeleteAccount(response http.ResponseWriter, request *http.Request, password string) error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	session, err := sessions.Start(response, request, false)
+	if err != nil {
+		return fmt.Errorf("Could not start session: %w", err)
+	}
+	if session == nil {
+		return ErrNotLoggedIn
+	}
+	account, ok := session.User().(*Account)
+	if !ok || account == nil {
+		return ErrNotLoggedIn
+	}
+	if !VerifyPassword(account.PasswordHash, password) {
+		return ErrWrongCredentials
+	}
+	if err := Accounts.DeleteAccount(account.ID); err != nil {
+		return fmt.Errorf("Could not delete account: %w", err)
+	}
+	if err := sessions.LogOut(account.ID); err != nil {
+		return fmt.Errorf("Could not log user out of their sessions: %w", err)
+	}
+	return session.Destroy(response, request)
+}
+
+// checkConfig returns an error if the package variables required by all
+// functions are not set.
+func checkConfig() error {
+	if Accounts == nil {
+		return ErrNoStore
+	}
+	if HashPassword == nil || VerifyPassword == nil {
+		return ErrNoPasswordHashing
+	}
+	return nil
+}
+
+// normalizeEmail checks the syntax of the given email address and returns it
+// without a display name or surrounding whitespace.
+func normalizeEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || address.Name != "" {
+		return "", ErrInvalidEmail
+	}
+	return address.Address, nil
+}
+
+// newPasswordHash checks the given password against PasswordPolicy and returns
+// its hash.
+func newPasswordHash(email, password string) (string, error) {
+	if problems := PasswordPolicy.Check(password, []string{email}); len(problems) > 0 {
+		return "", &PasswordError{Problems: problems}
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return "", fmt.Errorf("Could not hash password: %w", err)
+	}
+	return hash, nil
+}
+
+// rehashPassword replaces the password hash of the given account with a new
+// hash of the given (verified) password.
+func rehashPassword(account *Account, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("Could not hash password: %w", err)
+	}
+	account.PasswordHash = hash
+	if err := Accounts.UpdateAccount(account); err != nil {
+		return fmt.Errorf("Could not update account: %w", err)
+	}
+	return nil
+}
+
+// issueToken generates a one-time token for the given account, stores its hash,
+// and sends it via SendToken.
+func issueToken(account *Account, purpose Purpose, expiry time.Duration) error {
+	if SendToken == nil {
+		return errors.New("SendToken is not set")
+	}
+	token, err := sessions.RandomID(32)
+	if err != nil {
+		return fmt.Errorf("Could not generate token: %w", err)
+	}
+	if err := Accounts.SaveToken(&Token{
+		Hash:      tokenHash(token),
+		Purpose:   purpose,
+		AccountID: account.ID,
+		Expires:   time.Now().Add(expiry),
+	}); err != nil {
+		return fmt.Errorf("Could not save token: %w", err)
+	}
+	if err := SendToken(account, purpose, token); err != nil {
+		return fmt.Errorf("Could not send token: %w", err)
+	}
+	return nil
+}
+
+// redeemToken removes the given token from the store and returns the account
+// it was issued for. The token must have the given purpose and it must not
+// have expired.
+func redeemToken(token string, purpose Purpose) (*Account, error) {
+	stored, err := Accounts.TakeToken(tokenHash(token))
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve token: %w", err)
+	}
+	return tokenAccount(stored, purpose)
+}
+
+// tokenAccount checks the given stored token (which may be nil) and returns
+// the account it was issued for. The token must have one of the given
+// purposes.
+func tokenAccount(token *Token, purposes ...Purpose) (*Account, error) {
+	if token == nil || !time.Now().Before(token.Expires) {
+		return nil, ErrInvalidToken
+	}
+	var valid bool
+	for _, purpose := range purposes {
+		if token.Purpose == purpose {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrInvalidToken
+	}
+	account, err := Accounts.AccountByID(token.AccountID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve account: %w", err)
+	}
+	if account == nil {
+		return nil, ErrInvalidToken
+	}
+	return account, nil
+}
+
+// tokenHash returns the hex-encoded SHA-256 hash of the given token.
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,65 @@
+package users
+
+import (
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// The configuration of this package. It should be set before the functions of
+// this package are used and it should not be changed afterwards.
+var (
+	// Accounts is the store which holds the user accounts and their one-time
+	// tokens. It must be set before any of the functions of this package are
+	// used.
+	Accounts Store
+
+	// SendToken is called when a one-time token was issued for an account,
+	// i.e. after signing up (if RequireVerification is true), when someone
+	// tries to sign up with an email address which already has an account, and
+	// when a password reset was requested. It is typically implemented by sending an
+	// email to the account's address containing a link with the token. The
+	// token must be passed to VerifyEmail() or ResetPassword(), respectively.
+	// If nil, tokens cannot be delivered and these functions fail.
+	SendToken func(account *Account, purpose Purpose, token string) error
+
+	// HashPassword returns a hash of the given password which is stored with
+	// the account. It must use a slow, salted password hashing function such
+	// as Argon2id, scrypt, or bcrypt. Must be set together with VerifyPassword
+	// and NeedsRehash. The default uses Argon2id (see sessions.HashPassword()).
+	HashPassword func(password string) (string, error) = sessions.HashPassword
+
+	// VerifyPassword returns whether the given password matches the hash
+	// generated by HashPassword.
+	VerifyPassword func(hash, password string) bool = sessions.VerifyPassword
+
+	// NeedsRehash, if set, is called after a user has logged in successfully. If
+	// it returns true, the account's password hash is replaced with a new hash
+	// from HashPassword, e.g. to upgrade it to stronger hashing parameters. The
+	// default (see sessions.PasswordNeedsRehash()) only recognizes hashes from
+	// sessions.HashPassword() and reports all others. If you replace
+	// HashPassword, you must replace this function, too, or set it to nil.
+	// Otherwise, the password is rehashed and saved with every login.
+	NeedsRehash func(hash string) bool = sessions.PasswordNeedsRehash
+
+	// PasswordPolicy is applied to new passwords when signing up and when
+	// resetting passwords.
+	PasswordPolicy = sessions.DefaultPasswordPolicy()
+
+	// RequireVerification determines whether users must verify their email
+	// address before they can log in. If true, a token with the purpose
+	// PurposeVerifyEmail is sent after signing up.
+	RequireVerification = true
+
+	// VerificationExpiry is the time after which email verification tokens
+	// expire.
+	VerificationExpiry = 48 * time.Hour
+
+	// ResetExpiry is the time after which password reset tokens expire. It
+	// should be short because these tokens grant access to the account.
+	ResetExpiry = time.Hour
+
+	// ExclusiveLogIn determines whether a user who logs in is logged out of all
+	// other sessions first (see sessions.Session.LogIn()).
+	ExclusiveLogIn = false
+)
@@ -0,0 +1,141 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// The names of the form fields read by the HTTP handlers.
+const (
+	FieldEmail    = "email"
+	FieldPassword = "password"
+	FieldToken    = "token"
+)
+
+// OnHandlerError, if set, is called by the HTTP handlers when an unexpected
+// error occurs, i.e. any error other than the errors caused by invalid user
+// input. These errors are reported to the client as "Internal server error"
+// only, so this is the place to log them.
+var OnHandlerError func(request *http.Request, err error)
+
+// SignUpHandler creates a new account (see SignUp()) from the form fields
+// "email" and "password". If the email address already has an account, the
+// response is the same as for a successful sign-up so it does not reveal which
+// email addresses have accounts. (The account holder is notified instead.)
+// For the same reason, the new account's ID is not returned.
+func SignUpHandler(response http.ResponseWriter, request *http.Request) {
+	if !requirePost(response, request) {
+		return
+	}
+	_, err := SignUp(request.FormValue(FieldEmail), request.FormValue(FieldPassword))
+	if errors.Is(err, ErrEmailTaken) {
+		if err != ErrEmailTaken && OnHandlerError != nil {
+			OnHandlerError(request, err) // The account holder could not be notified.
+		}
+		err = nil
+	}
+	respond(response, request, http.StatusCreated, nil, err)
+}
+
+// VerifyEmailHandler verifies an email address (see VerifyEmail()) with the
+// token in the form field "token". It also accepts GET requests so the token
+// may be part of a link in an email. Because verification tokens do not grant
+// access to an account, this is harmless.
+func VerifyEmailHandler(response http.ResponseWriter, request *http.Request) {
+	account, err := VerifyEmail(request.FormValue(FieldToken))
+	respond(response, request, http.StatusOK, account, err)
+}
+
+// LogInHandler logs a user in (see LogIn()) with the form fields "email" and
+// "password".
+func LogInHandler(response http.ResponseWriter, request *http.Request) {
+	if !requirePost(response, request) {
+		return
+	}
+	account, err := LogIn(response, request, request.FormValue(FieldEmail), request.FormValue(FieldPassword))
+	respond(response, request, http.StatusOK, account, err)
+}
+
+// LogOutHandler logs the current user out (see LogOut()).
+func LogOutHandler(response http.ResponseWriter, request *http.Request) {
+	if !requirePost(response, request) {
+		return
+	}
+	respond(response, request, http.StatusOK, nil, LogOut(response, request))
+}
+
+// RequestPasswordResetHandler sends a password reset token (see
+// RequestPasswordReset()) to the email address in the form field "email". The
+// response does not reveal whether an account with this address exists.
+func RequestPasswordResetHandler(response http.ResponseWriter, request *http.Request) {
+	if !requirePost(response, request) {
+		return
+	}
+	respond(response, request, http.StatusAccepted, nil, RequestPasswordReset(request.FormValue(FieldEmail)))
+}
+
+// ResetPasswordHandler sets a new password (see ResetPassword()) from the form
+// fields "token" and "password".
+func ResetPasswordHandler(response http.ResponseWriter, request *http.Request) {
+	if !requirePost(response, request) {
+		return
+	}
+	account, err := ResetPassword(request.FormValue(FieldToken), request.FormValue(FieldPassword))
+	respond(response, request, http.StatusOK, account, err)
+}
+
+// DeleteAccountHandler deletes the account of the current user (see
+// DeleteAccount()). The user's password must be provided in the form field
+// "password".
+func DeleteAccountHandler(response http.ResponseWriter, request *http.Request) {
+	if !requirePost(response, request) {
+		return
+	}
+	respond(response, request, http.StatusOK, nil, DeleteAccount(response, request, request.FormValue(FieldPassword)))
+}
+
+// requirePost responds with "405 Method Not Allowed" and returns false if the
+// request is not a POST request.
+func requirePost(response http.ResponseWriter, request *http.Request) bool {
+	if request.Method == http.MethodPost {
+		return true
+	}
+	response.Header().Set("Allow", http.MethodPost)
+	http.Error(response, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+// respond writes the result of a handler as JSON. On success, the account's ID
+// and email address (if there is an account) are returned with the given
+// status code. Errors are mapped to appropriate status codes.
+func respond(response http.ResponseWriter, request *http.Request, status int, account *Account, err error) {
+	body := make(map[string]interface{})
+	if err != nil {
+		var passwordErr *PasswordError
+		switch {
+		case errors.As(err, &passwordErr):
+			status = http.StatusUnprocessableEntity
+			body["problems"] = passwordErr.Problems
+		case errors.Is(err, ErrInvalidEmail), errors.Is(err, ErrInvalidToken):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrWrongCredentials), errors.Is(err, ErrNotLoggedIn):
+			status = http.StatusUnauthorized
+		case errors.Is(err, ErrNotVerified):
+			status = http.StatusForbidden
+		default:
+			if OnHandlerError != nil {
+				OnHandlerError(request, err)
+			}
+			err = errors.New(http.StatusText(http.StatusInternalServerError))
+			status = http.StatusInternalServerError
+		}
+		body["error"] = err.Error()
+	} else if account != nil {
+		body["id"] = account.ID
+		body["email"] = account.Email
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(body)
+}
@@ -0,0 +1,73 @@
+package users
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postForm sends a form to the given handler and returns the response.
+func postForm(handler http.HandlerFunc, values url.Values) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := httptest.NewRecorder()
+	handler(response, request)
+	return response
+}
+
+// Test the HTTP handlers.
+func TestHandlers(t *testing.T) {
+	defer setup()()
+
+	// Only POST requests.
+	response := httptest.NewRecorder()
+	SignUpHandler(response, httptest.NewRequest("GET", "/", nil))
+	if response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", response.Code)
+	}
+
+	// Sign up.
+	credentials := url.Values{FieldEmail: {"dave@example.com"}, FieldPassword: {"correct horse battery"}}
+	if response = postForm(SignUpHandler, credentials); response.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", response.Code, response.Body)
+	}
+	created := response.Body.String()
+	if response = postForm(SignUpHandler, credentials); response.Code != http.StatusCreated || response.Body.String() != created {
+		t.Errorf("Expected the same response for a taken email address, got %d: %s (first sign-up: %s)", response.Code, response.Body, created)
+	}
+	if sentTokens[PurposeAccountExists] == "" {
+		t.Error("Account holder was not notified")
+	}
+	weak := url.Values{FieldEmail: {"erin@example.com"}, FieldPassword: {"password"}}
+	if response = postForm(SignUpHandler, weak); response.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Body.String(), "problems") {
+		t.Errorf("Expected status 422 with problems, got %d: %s", response.Code, response.Body)
+	}
+
+	// Log in before and after verification.
+	if response = postForm(LogInHandler, credentials); response.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", response.Code)
+	}
+	response = httptest.NewRecorder()
+	VerifyEmailHandler(response, httptest.NewRequest("GET", "/?token="+url.QueryEscape(sentTokens[PurposeVerifyEmail]), nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", response.Code, response.Body)
+	}
+	if response = postForm(LogInHandler, credentials); response.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", response.Code, response.Body)
+	}
+
+	// Password reset.
+	if response = postForm(RequestPasswordResetHandler, url.Values{FieldEmail: {"nobody@example.com"}}); response.Code != http.StatusAccepted {
+		t.Errorf("Expected status 202, got %d", response.Code)
+	}
+	if response = postForm(ResetPasswordHandler, url.Values{FieldToken: {"wrong"}, FieldPassword: {"new secret passphrase"}}); response.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", response.Code)
+	}
+
+	// Deletion without a session.
+	if response = postForm(DeleteAccountHandler, url.Values{FieldPassword: {"correct horse battery"}}); response.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", response.Code)
+	}
+}
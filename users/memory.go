@@ -0,0 +1,122 @@
+package users
+
+import (
+	"strings"
+	"sync"
+)
+
+// MemoryStore is a Store which keeps accounts and tokens in memory. All data
+// is lost when the process ends, so it is only suitable for tests and
+// prototypes. The zero value is not usable. Use NewMemoryStore() instead.
+type MemoryStore struct {
+	sync.Mutex
+	accounts map[string]*Account // Keyed by account ID.
+	emails   map[string]string   // Lower-case email addresses to account IDs.
+	tokens   map[string]*Token   // Keyed by token hash.
+}
+
+// NewMemoryStore returns a new, empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts: make(map[string]*Account),
+		emails:   make(map[string]string),
+		tokens:   make(map[string]*Token),
+	}
+}
+
+// CreateAccount inserts a new account.
+func (m *MemoryStore) CreateAccount(account *Account) error {
+	m.Lock()
+	defer m.Unlock()
+	email := strings.ToLower(account.Email)
+	if _, ok := m.emails[email]; ok {
+		return ErrEmailTaken
+	}
+	a := *account
+	m.accounts[account.ID] = &a
+	m.emails[email] = account.ID
+	return nil
+}
+
+// AccountByID returns a copy of the account with the given ID.
+func (m *MemoryStore) AccountByID(id string) (*Account, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.account(id), nil
+}
+
+// AccountByEmail returns a copy of the account with the given email address.
+func (m *MemoryStore) AccountByEmail(email string) (*Account, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.account(m.emails[strings.ToLower(email)]), nil
+}
+
+// account returns a copy of the account with the given ID or nil if it doesn't
+// exist. The store must be locked.
+func (m *MemoryStore) account(id string) *Account {
+	account, ok := m.accounts[id]
+	if !ok {
+		return nil
+	}
+	a := *account
+	return &a
+}
+
+// UpdateAccount replaces an existing account.
+func (m *MemoryStore) UpdateAccount(account *Account) error {
+	m.Lock()
+	defer m.Unlock()
+	previous, ok := m.accounts[account.ID]
+	if !ok {
+		return nil
+	}
+	email := strings.ToLower(account.Email)
+	if id, ok := m.emails[email]; ok && id != account.ID {
+		return ErrEmailTaken
+	}
+	delete(m.emails, strings.ToLower(previous.Email))
+	a := *account
+	m.accounts[account.ID] = &a
+	m.emails[email] = account.ID
+	return nil
+}
+
+// DeleteAccount deletes an account and its tokens.
+func (m *MemoryStore) DeleteAccount(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	account, ok := m.accounts[id]
+	if !ok {
+		return nil
+	}
+	delete(m.emails, strings.ToLower(account.Email))
+	delete(m.accounts, id)
+	for hash, token := range m.tokens {
+		if token.AccountID == id {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// SaveToken stores a one-time token.
+func (m *MemoryStore) SaveToken(token *Token) error {
+	m.Lock()
+	defer m.Unlock()
+	t := *token
+	m.tokens[token.Hash] = &t
+	return nil
+}
+
+// TakeToken returns and removes the token with the given hash.
+func (m *MemoryStore) TakeToken(hash string) (*Token, error) {
+	m.Lock()
+	defer m.Unlock()
+	token, ok := m.tokens[hash]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.tokens, hash)
+	return token, nil
+}
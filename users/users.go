@@ -0,0 +1,140 @@
+/*
+Package users implements the account functions which most websites need on top
+of sessions: signing up, verifying email addresses, logging in and out,
+resetting forgotten passwords, and deleting accounts. It is built on the
+"sessions" package, i.e. users are logged into and out of sessions with
+Session.LogIn() and Session.LogOut().
+
+Like the sessions package, this package is database-agnostic. Accounts and
+one-time tokens are kept in a Store which you implement for your database
+(MemoryStore may be used for tests and prototypes). Emails are not sent by this
+package either. Instead, SendToken is called with a token which you include in
+a link, e.g. to a page which calls VerifyEmail() or ResetPassword().
+
+Before using this package, set the following package variables:
+
+	users.Accounts = myStore
+	users.SendToken = func(account *users.Account, purpose users.Purpose, token string) error {
+		// Send an email to account.Email containing the token.
+	}
+
+Passwords are hashed with Argon2id by default (see sessions.HashPassword()).
+Hashes which were generated with outdated parameters are upgraded when users
+log in.
+
+The accounts must also be made available to the sessions package so it can
+attach them to sessions loaded from the persistence layer:
+
+	sessions.Persistence = sessions.ExtendablePersistenceLayer{
+		LoadUserFunc: users.LoadUser,
+		// ...
+	}
+
+You may then call the functions of this package from your own handlers or use
+the ready-made HTTP handlers (e.g. SignUpHandler()) which read their input
+from form fields and respond with JSON. The handlers do not protect against
+cross-site request forgery. Wrap them with sessions.CSRFMiddleware().
+*/
+package users
+
+import (
+	"errors"
+	"time"
+)
+
+// Errors returned by this package.
+var (
+	ErrNoStore           = errors.New("No account store configured")
+	ErrNoPasswordHashing = errors.New("No password hashing functions configured")
+	ErrInvalidEmail      = errors.New("Invalid email address")
+	ErrEmailTaken        = errors.New("Email address is already in use")
+	ErrWrongCredentials  = errors.New("Wrong email address or password")
+	ErrNotVerified       = errors.New("Email address has not been verified")
+	ErrInvalidToken      = errors.New("Invalid or expired token")
+	ErrNotLoggedIn       = errors.New("Not logged in")
+)
+
+// Purpose describes what a one-time token is used for.
+type Purpose string
+
+// Purposes of one-time tokens.
+const (
+	PurposeVerifyEmail   Purpose = "verify" // The token confirms that the user controls their email address.
+	PurposeResetPassword Purpose = "reset"  // The token allows the user to choose a new password.
+	PurposeAccountExists Purpose = "exists" // Someone tried to sign up with the user's email address. The token may be used like a reset token.
+)
+
+// Account is a user account. It implements the sessions.User interface so it
+// can be attached to sessions.
+type Account struct {
+	// The account's unique ID.
+	ID string
+
+	// The user's email address. It is used to log in and it is unique among
+	// all accounts.
+	Email string
+
+	// The hash of the user's password, as returned by HashPassword.
+	PasswordHash string
+
+	// Whether the user has verified their email address.
+	Verified bool
+
+	// The time the account was created.
+	Created time.Time
+}
+
+// GetID returns the account's ID. It implements the sessions.User interface.
+func (a *Account) GetID() interface{} {
+	return a.ID
+}
+
+// Token is a one-time token which is sent to a user, e.g. to verify their email
+// address. Only the hash of the token is stored so that the contents of the
+// store cannot be used to take over accounts.
+type Token struct {
+	// The SHA-256 hash of the token (hex-encoded).
+	Hash string
+
+	// What the token may be used for.
+	Purpose Purpose
+
+	// The ID of the account the token was issued for.
+	AccountID string
+
+	// The time after which the token is no longer valid.
+	Expires time.Time
+}
+
+// Store provides the methods which read/write accounts and tokens from/to the
+// permanent data store. Implementations must be safe for concurrent use.
+type Store interface {
+	// CreateAccount inserts a new account. If another account has the same
+	// email address (case-insensitive), ErrEmailTaken must be returned.
+	CreateAccount(account *Account) error
+
+	// AccountByID returns the account with the given ID. If no such account
+	// exists, that's not an error. A nil account should be returned in that
+	// case.
+	AccountByID(id string) (*Account, error)
+
+	// AccountByEmail returns the account with the given email address
+	// (case-insensitive). If no such account exists, a nil account should be
+	// returned.
+	AccountByEmail(email string) (*Account, error)
+
+	// UpdateAccount replaces an existing account.
+	UpdateAccount(account *Account) error
+
+	// DeleteAccount deletes the account with the given ID as well as all of its
+	// tokens. It is not an error if the account does not exist.
+	DeleteAccount(id string) error
+
+	// SaveToken stores a one-time token.
+	SaveToken(token *Token) error
+
+	// TakeToken returns the token with the given hash and removes it from the
+	// store, so it cannot be used again. If no such token exists, a nil token
+	// should be returned.
+	TakeToken(hash string) (*Token, error)
+}
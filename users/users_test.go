@@ -0,0 +1,256 @@
+package users
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rivo/sessions"
+)
+
+// sentTokens records the tokens sent via SendToken, keyed by purpose.
+var sentTokens map[Purpose]string
+
+// setup configures the package for tests. The returned function restores the
+// defaults.
+func setup() func() {
+	Accounts = NewMemoryStore()
+	sentTokens = make(map[Purpose]string)
+	SendToken = func(account *Account, purpose Purpose, token string) error {
+		sentTokens[purpose] = token
+		return nil
+	}
+	HashPassword = func(password string) (string, error) {
+		return "hashed:" + password, nil
+	}
+	VerifyPassword = func(hash, password string) bool {
+		return hash == "hashed:"+password
+	}
+	NeedsRehash = nil
+	sessions.Persistence = sessions.ExtendablePersistenceLayer{LoadUserFunc: LoadUser}
+	return func() {
+		Accounts, SendToken = nil, nil
+		HashPassword, VerifyPassword, NeedsRehash = sessions.HashPassword, sessions.VerifyPassword, sessions.PasswordNeedsRehash
+		PasswordPolicy = sessions.DefaultPasswordPolicy()
+		RequireVerification = true
+		sessions.Persistence = sessions.ExtendablePersistenceLayer{}
+	}
+}
+
+// sessionRequest returns a request which carries the session cookie set in
+// the given response, if any.
+func sessionRequest(method string, response *httptest.ResponseRecorder) *http.Request {
+	request := httptest.NewRequest(method, "/", nil)
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == sessions.SessionCookie {
+			request.AddCookie(cookie)
+		}
+	}
+	return request
+}
+
+// Test the life cycle of an account.
+func TestAccountLifeCycle(t *testing.T) {
+	defer setup()()
+	var _ sessions.User = (*Account)(nil)
+
+	// Sign up.
+	if _, err := SignUp("not an address", "correct horse battery"); err != ErrInvalidEmail {
+		t.Errorf("Expected ErrInvalidEmail, got %v", err)
+	}
+	var passwordErr *PasswordError
+	if _, err := SignUp("alice@example.com", "short"); !errors.As(err, &passwordErr) {
+		t.Errorf("Expected password error, got %v", err)
+	}
+	account, err := SignUp(" alice@example.com ", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Email != "alice@example.com" || account.Verified || account.PasswordHash != "hashed:correct horse battery" {
+		t.Errorf("Unexpected account %+v", account)
+	}
+	if _, err := SignUp("ALICE@example.com", "correct horse battery"); err != ErrEmailTaken {
+		t.Errorf("Expected ErrEmailTaken, got %v", err)
+	}
+	if sentTokens[PurposeAccountExists] == "" {
+		t.Error("Account holder was not notified of the sign-up attempt")
+	}
+
+	// Log in before verification.
+	if _, err := LogIn(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), "alice@example.com", "correct horse battery"); err != ErrNotVerified {
+		t.Errorf("Expected ErrNotVerified, got %v", err)
+	}
+
+	// Verify.
+	if _, err := VerifyEmail("wrong"); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+	if account, err = VerifyEmail(sentTokens[PurposeVerifyEmail]); err != nil {
+		t.Fatal(err)
+	}
+	if !account.Verified {
+		t.Error("Account was not verified")
+	}
+	if _, err := VerifyEmail(sentTokens[PurposeVerifyEmail]); err != ErrInvalidToken {
+		t.Errorf("Token was accepted twice (error %v)", err)
+	}
+
+	// Log in.
+	if _, err := LogIn(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), "alice@example.com", "wrong password"); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials, got %v", err)
+	}
+	response := httptest.NewRecorder()
+	if _, err := LogIn(response, httptest.NewRequest("POST", "/", nil), "alice@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	session, err := sessions.Start(httptest.NewRecorder(), sessionRequest("GET", response), false)
+	if err != nil || session == nil {
+		t.Fatalf("Session not found (error %v)", err)
+	}
+	if user, ok := session.User().(*Account); !ok || user.ID != account.ID {
+		t.Errorf("Unexpected session user %v", session.User())
+	}
+
+	// Log out.
+	if err := LogOut(httptest.NewRecorder(), sessionRequest("POST", response)); err != nil {
+		t.Fatal(err)
+	}
+	if session.User() != nil {
+		t.Error("User was not logged out")
+	}
+
+	// Reset the password.
+	if err := RequestPasswordReset("nobody@example.com"); err != nil || sentTokens[PurposeResetPassword] != "" {
+		t.Errorf("Reset for unknown address was sent (error %v)", err)
+	}
+	if err := RequestPasswordReset("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	token := sentTokens[PurposeResetPassword]
+	if _, err := ResetPassword(token, "short"); !errors.As(err, &passwordErr) {
+		t.Errorf("Expected password error, got %v", err)
+	}
+	if _, err := ResetPassword(token, "new secret passphrase"); err != nil {
+		t.Fatalf("Token was not restored after a weak password: %v", err)
+	}
+	if _, err := ResetPassword(token, "another secret passphrase"); err != ErrInvalidToken {
+		t.Errorf("Token was accepted twice (error %v)", err)
+	}
+	if _, err := ResetPassword(sentTokens[PurposeAccountExists], "new secret passphrase"); err != nil {
+		t.Errorf("Sign-up notification token was not accepted for a reset: %v", err)
+	}
+
+	// Delete the account.
+	response = httptest.NewRecorder()
+	if _, err := LogIn(response, httptest.NewRequest("POST", "/", nil), "alice@example.com", "new secret passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteAccount(httptest.NewRecorder(), sessionRequest("POST", response), "correct horse battery"); err != ErrWrongCredentials {
+		t.Errorf("Expected ErrWrongCredentials, got %v", err)
+	}
+	deleteResponse := httptest.NewRecorder()
+	if err := DeleteAccount(deleteResponse, sessionRequest("POST", response), "new secret passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	if account, _ := Accounts.AccountByID(account.ID); account != nil {
+		t.Error("Account was not deleted")
+	}
+	if cookie := deleteResponse.Header().Get("Set-Cookie"); !strings.Contains(cookie, sessions.SessionCookie+"=") {
+		t.Errorf("Session cookie was not deleted: %q", cookie)
+	}
+}
+
+// Test that unknown email addresses are handled like wrong passwords and that
+// email addresses are normalized when looking up accounts.
+func TestLogInUnknownEmail(t *testing.T) {
+	defer setup()()
+	RequireVerification = false
+	if _, err := SignUp("alice@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	var verified int
+	verify := VerifyPassword
+	VerifyPassword = func(hash, password string) bool {
+		verified++
+		return verify(hash, password)
+	}
+
+	// Unknown and invalid addresses still verify a password.
+	for _, email := range []string{"nobody@example.com", "not an address"} {
+		verified = 0
+		if _, err := LogIn(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), email, "correct horse battery"); err != ErrWrongCredentials {
+			t.Errorf("%s: expected ErrWrongCredentials, got %v", email, err)
+		}
+		if verified != 1 {
+			t.Errorf("%s: password was verified %d times, expected 1", email, verified)
+		}
+	}
+
+	// Addresses are normalized like in SignUp().
+	if _, err := LogIn(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), "<alice@example.com>", "correct horse battery"); err != nil {
+		t.Errorf("Normalized address was not accepted: %v", err)
+	}
+	if err := RequestPasswordReset(" <alice@example.com> "); err != nil || sentTokens[PurposeResetPassword] == "" {
+		t.Errorf("Reset for normalized address was not sent (error %v)", err)
+	}
+	if err := RequestPasswordReset("not an address"); err != ErrInvalidEmail {
+		t.Errorf("Expected ErrInvalidEmail, got %v", err)
+	}
+	if err := ResendVerification("not an address"); err != ErrInvalidEmail {
+		t.Errorf("Expected ErrInvalidEmail, got %v", err)
+	}
+}
+
+// Test expired tokens and missing configuration.
+func TestTokensAndConfig(t *testing.T) {
+	restore := setup()
+	defer restore()
+	RequireVerification = false
+	account, err := SignUp("bob@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !account.Verified || sentTokens[PurposeVerifyEmail] != "" {
+		t.Error("Verification was required")
+	}
+
+	// Tokens must be used for their purpose and before they expire.
+	ResetExpiry = -time.Second
+	defer func() { ResetExpiry = time.Hour }()
+	if err := RequestPasswordReset("bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResetPassword(sentTokens[PurposeResetPassword], "new secret passphrase"); err != ErrInvalidToken {
+		t.Errorf("Expired token was accepted (error %v)", err)
+	}
+
+	restore()
+	if _, err := SignUp("carol@example.com", "correct horse battery"); err != ErrNoStore {
+		t.Errorf("Expected ErrNoStore, got %v", err)
+	}
+}
+
+// Test upgrading password hashes when users log in.
+func TestRehash(t *testing.T) {
+	defer setup()()
+	RequireVerification = false
+	NeedsRehash = func(hash string) bool {
+		return strings.HasPrefix(hash, "hashed:")
+	}
+	account, err := SignUp("frank@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	HashPassword = func(password string) (string, error) {
+		return "rehashed:" + password, nil
+	}
+	if _, err := LogIn(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), "frank@example.com", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if account, _ = Accounts.AccountByID(account.ID); account.PasswordHash != "rehashed:correct horse battery" {
+		t.Errorf("Hash was not upgraded: %q", account.PasswordHash)
+	}
+}
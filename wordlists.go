@@ -0,0 +1,99 @@
+package sessions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Word lists registered at runtime, keyed by their names. Each list is a set
+// of words. Access is synchronized with wordListsMutex.
+var (
+	dictionaryLists  = make(map[string]map[string]struct{}) // Dictionary words, in lower case (see AddPasswordDictionary()).
+	compromisedLists = make(map[string]map[string]struct{}) // Compromised passwords (see AddCompromisedPasswords()).
+)
+
+// AddPasswordDictionary registers a dictionary which is used in addition to
+// the built-in English dictionary by ReasonablePassword() and
+// PasswordPolicy.Check() (if CheckDictionary is true). Passwords found in any
+// dictionary result in PasswordFoundInDictionary. This allows you to reject
+// words of other languages or words specific to your domain. The reader must
+// provide one UTF-8 encoded word per line. Empty lines are ignored. Unlike the
+// built-in dictionary, words are compared case-insensitively.
+//
+// The name identifies the dictionary. Adding a dictionary under an existing
+// name replaces it. Use RemovePasswordList() to remove it again. Set
+// UseBuiltInPasswordLists to false to use your own dictionaries only.
+//
+// This function is safe for concurrent use, also with password checks.
+func AddPasswordDictionary(name string, words io.Reader) error {
+	list, err := readWordList(words, strings.ToLower)
+	if err != nil {
+		return fmt.Errorf("Could not read dictionary %s: %s", name, err)
+	}
+	wordListsMutex.Lock()
+	defer wordListsMutex.Unlock()
+	dictionaryLists[name] = list
+	return nil
+}
+
+// AddCompromisedPasswords registers a list of compromised passwords which is
+// used in addition to the built-in list by ReasonablePassword() and
+// PasswordPolicy.Check() (if CheckBreached is true). Passwords found in any of
+// these lists result in PasswordWasCompromised. The reader must provide one
+// password per line. Empty lines are ignored. Passwords are compared exactly.
+//
+// Names work the same as for AddPasswordDictionary(). A name may be used for
+// both a dictionary and a list of compromised passwords.
+//
+// This function is safe for concurrent use, also with password checks.
+func AddCompromisedPasswords(name string, passwords io.Reader) error {
+	list, err := readWordList(passwords, nil)
+	if err != nil {
+		return fmt.Errorf("Could not read compromised passwords %s: %s", name, err)
+	}
+	wordListsMutex.Lock()
+	defer wordListsMutex.Unlock()
+	compromisedLists[name] = list
+	return nil
+}
+
+// RemovePasswordList removes the dictionary and the list of compromised
+// passwords registered under the given name (see AddPasswordDictionary() and
+// AddCompromisedPasswords()). Nothing happens if there is no such list.
+func RemovePasswordList(name string) {
+	wordListsMutex.Lock()
+	defer wordListsMutex.Unlock()
+	delete(dictionaryLists, name)
+	delete(compromisedLists, name)
+}
+
+// readWordList reads one word per line from the given reader. Words are
+// transformed with the given function, if not nil.
+func readWordList(reader io.Reader, transform func(string) string) (map[string]struct{}, error) {
+	list := make(map[string]struct{})
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		word := strings.TrimRight(scanner.Text(), "\r")
+		if word == "" {
+			continue
+		}
+		if transform != nil {
+			word = transform(word)
+		}
+		list[word] = struct{}{}
+	}
+	return list, scanner.Err()
+}
+
+// inWordLists returns whether the given word is contained in any of the given
+// lists. The caller must hold at least a read lock on wordListsMutex.
+func inWordLists(lists map[string]map[string]struct{}, word string) bool {
+	for _, list := range lists {
+		if _, ok := list[word]; ok {
+			return true
+		}
+	}
+	return false
+}
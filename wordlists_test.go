@@ -0,0 +1,49 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test registering custom word lists.
+func TestPasswordWordLists(t *testing.T) {
+	defer reset()
+	defer RemovePasswordList("de")
+
+	if err := AddPasswordDictionary("de", strings.NewReader("Donaudampfschifffahrt\r\n\nStreichholzschachtel\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddCompromisedPasswords("de", strings.NewReader("Passwort123!\n")); err != nil {
+		t.Fatal(err)
+	}
+	for password, expected := range map[string]int{
+		"donaudampfschifffahrt": PasswordFoundInDictionary,
+		"STREICHHOLZSCHACHTEL":  PasswordFoundInDictionary,
+		"Passwort123!":          PasswordWasCompromised,
+		"passwort123!":          PasswordOK,
+		"aardvarks":             PasswordFoundInDictionary,
+		"football":              PasswordWasCompromised,
+	} {
+		if result := ReasonablePassword(password, nil); result != expected {
+			t.Errorf("Password %s resulted in %d, expected %d", password, result, expected)
+		}
+	}
+
+	// Without the built-in lists.
+	UseBuiltInPasswordLists = false
+	for password, expected := range map[string]int{
+		"aardvarks":             PasswordOK,
+		"football":              PasswordOK,
+		"donaudampfschifffahrt": PasswordFoundInDictionary,
+	} {
+		if result := ReasonablePassword(password, nil); result != expected {
+			t.Errorf("Password %s resulted in %d, expected %d without built-in lists", password, result, expected)
+		}
+	}
+
+	// Removal.
+	RemovePasswordList("de")
+	if result := ReasonablePassword("donaudampfschifffahrt", nil); result != PasswordOK {
+		t.Errorf("Removed dictionary was still used: %d", result)
+	}
+}
@@ -0,0 +1,207 @@
+package sessions
+
+import (
+	"sync"
+	"time"
+)
+
+// The initial and the maximum delay between two attempts to save the sessions
+// in the write-behind queue.
+const (
+	writeBehindMinBackoff = 100 * time.Millisecond
+	writeBehindMaxBackoff = time.Minute
+)
+
+// writeBehindQueue holds sessions which could not be saved to the persistence
+// layer and which are retried in the background (see WriteBehind).
+type writeBehindQueue struct {
+	sync.Mutex
+	sessions map[string]*Session
+	done     chan struct{} // Closed to stop the retry goroutine, nil if it is not running.
+}
+
+// writeBehind is the global write-behind queue.
+var writeBehind = &writeBehindQueue{sessions: make(map[string]*Session)}
+
+// saveSession saves a session via the persistence layer. If this fails and
+// WriteBehind is enabled, the session is queued for a later retry and nil is
+// returned. The original error is returned if the queue is full.
+//
+// If the session's data was not loaded yet (see LazyDataLoading), it is loaded
+// first so it is not overwritten.
+func saveSession(id string, session *Session) error {
+	if err := session.loadData(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := Persistence.SaveSession(id, session)
+	observeDuration(MetricPersistenceSave, start)
+	if err == nil {
+		writeBehind.supersede(id, session)
+		return nil
+	}
+	if !WriteBehind {
+		return err
+	}
+	if !writeBehind.add(id, session) {
+		return err
+	}
+	logWarn("Could not save session, queued for retry", "session", MaskSessionID(id), "error", err)
+	return nil
+}
+
+// add queues a session for a retry. It returns false if the queue is full.
+func (q *writeBehindQueue) add(id string, session *Session) bool {
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.sessions[id]; !ok && len(q.sessions) >= WriteBehindQueueSize {
+		return false
+	}
+	q.sessions[id] = session
+	if q.done == nil {
+		q.done = make(chan struct{})
+		go q.retry(q.done)
+	}
+	return true
+}
+
+// close stops the retry goroutine. The queued sessions remain in the queue.
+// The goroutine is restarted when the next session is queued.
+func (q *writeBehindQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	if q.done != nil {
+		close(q.done)
+		q.done = nil
+	}
+}
+
+// remove removes a session from the queue, e.g. because it was deleted.
+func (q *writeBehindQueue) remove(id string) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.sessions, id)
+}
+
+// supersede removes a queued session which was stored under the given ID but
+// which is not the given session, which has just been saved under that ID.
+// This happens when a session's ID is replaced (see Session.RegenerateID()):
+// the session may be queued under its old ID, which now belongs to the
+// reference session. Saving the queued session would overwrite the reference
+// session.
+func (q *writeBehindQueue) supersede(id string, session *Session) {
+	q.Lock()
+	defer q.Unlock()
+	if queued, ok := q.sessions[id]; ok && queued != session {
+		delete(q.sessions, id)
+	}
+}
+
+// pending returns whether the session with the given ID is waiting to be
+// saved.
+func (q *writeBehindQueue) pending(id string) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, ok := q.sessions[id]
+	return ok
+}
+
+// retry attempts to save all queued sessions, with an exponentially increasing
+// delay between attempts, until the queue is empty or the given channel is
+// closed.
+func (q *writeBehindQueue) retry(done chan struct{}) {
+	backoff := writeBehindMinBackoff
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		// Get the queued sessions.
+		q.Lock()
+		pending := make(map[string]*Session, len(q.sessions))
+		for id, session := range q.sessions {
+			pending[id] = session
+		}
+		q.Unlock()
+
+		// Save them. A session whose ID is being replaced holds its saveMutex
+		// (see Session.RegenerateID()). Afterwards, it may not be queued under
+		// this ID anymore.
+		failed := false
+		for id, session := range pending {
+			session.saveMutex.Lock()
+			q.Lock()
+			queued := q.sessions[id] == session
+			q.Unlock()
+			if !queued {
+				session.saveMutex.Unlock()
+				continue
+			}
+			err := Persistence.SaveSession(id, session)
+			session.saveMutex.Unlock()
+			if err != nil {
+				logError("Could not save queued session", "session", MaskSessionID(id), "error", err, "retry", backoff)
+				failed = true
+				break
+			}
+			q.Lock()
+			if q.sessions[id] == session {
+				delete(q.sessions, id)
+			}
+			q.Unlock()
+		}
+
+		// Are we done?
+		q.Lock()
+		select {
+		case <-done:
+			q.Unlock()
+			return // Closed while saving.
+		default:
+		}
+		if len(q.sessions) == 0 {
+			q.done = nil
+			q.Unlock()
+			return
+		}
+		q.Unlock()
+
+		// Increase the delay if the persistence layer is still unavailable.
+		if failed {
+			backoff *= 2
+			if backoff > writeBehindMaxBackoff {
+				backoff = writeBehindMaxBackoff
+			}
+		} else {
+			backoff = writeBehindMinBackoff
+		}
+		timer.Reset(backoff)
+	}
+}
+
+// save saves this session under its current ID (see saveSession()). Use this
+// function instead of saveSession() when the session was changed outside of
+// the sessions cache, e.g. by Set(). It waits for a concurrent session ID change
+// (see RegenerateID()) to complete so the session is not saved under an ID
+// which has already been replaced.
+func (s *Session) save() error {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	s.RLock()
+	id := s.id
+	s.RUnlock()
+	return saveSession(id, s)
+}
+
+// PendingWrites returns the number of sessions which could not be saved to the
+// persistence layer yet and which are waiting to be retried (see
+// WriteBehind).
+func PendingWrites() int {
+	writeBehind.Lock()
+	defer writeBehind.Unlock()
+	return len(writeBehind.sessions)
+}